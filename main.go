@@ -2,16 +2,21 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/pprof"
-	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"path"
 	"runtime/debug"
 	"strings"
+	"syscall"
 
 	"github.com/mikispag/dns-over-tls-forwarder/proxy"
 	log "github.com/sirupsen/logrus"
@@ -19,13 +24,59 @@ import (
 
 var (
 	upstreamServers = flag.String("s", "one.one.one.one:853@1.1.1.1,dns.google:853@8.8.8.8", "comma-separated list of upstream servers")
+	upstreamsPath   = flag.String("sfile", "", "path of a file listing upstream servers one per line, used instead of -s. The file is read again on SIGHUP")
 	logPath         = flag.String("l", "", "log file path")
 	isLogVerbose    = flag.Bool("v", false, "verbose mode")
 	evictMetrics    = flag.Bool("em", false, "collect metrics on evictions")
-	addr            = flag.String("a", ":53", "the `address:port` to listen on. In order to listen on the loopback interface only, use `127.0.0.1:53`. To listen on any interface, use `:53`")
+	lruOnly         = flag.Bool("lru", false, "use a plain LRU cache instead of the hybrid LRU/MFA one")
+	addr            = flag.String("a", ":53", "comma-separated list of the `address:port` to listen on. In order to listen on the loopback interface only, use `127.0.0.1:53`. To listen on any interface, use `:53`")
+	allowedClients  = flag.String("allow", "", "comma-separated list of CIDRs of the clients allowed to query the server. If empty (default) all clients are allowed.")
+	dohAddr         = flag.String("doh", "", "the `address:port` to serve DNS over HTTPS queries on at /dns-query, over plain HTTP to be put behind a reverse proxy terminating TLS. If empty (default) DNS over HTTPS is not served.")
+	dohProxies      = flag.String("dohproxies", "", "comma-separated list of CIDRs of the reverse proxies in front of -doh that are trusted to report the address of their clients in the Forwarded or X-Forwarded-For header. If empty (default) the proxies are seen as the clients.")
+	dotAddr         = flag.String("dot", "", "comma-separated list of the `address:port` to serve DNS over TLS queries on, usually on port 853, with the -cert and -key certificate. If empty (default) DNS over TLS is not served.")
+	certPath        = flag.String("cert", "", "path of the PEM certificate chain to serve DNS over TLS with")
+	keyPath         = flag.String("key", "", "path of the PEM private key of the -cert certificate")
+	dnssec          = flag.Bool("dnssec", false, "validate DNSSEC signatures instead of trusting the upstream servers")
+	deniedClients   = flag.String("deny", "", "comma-separated list of CIDRs of the clients not allowed to query the server, takes precedence over -allow")
+	blocklistPath   = flag.String("blocklist", "", "path of a file listing names to block, one per line or in hosts file format")
+	sortlist        = flag.String("sortlist", "", "comma-separated list of CIDRs to sort the addresses of answers by: addresses in earlier networks are served first")
+	sinkhole        = flag.Bool("sinkhole", false, "answer queries for names in the -blocklist with 0.0.0.0 and :: instead of NXDOMAIN")
+	hostsPath       = flag.String("hosts", "", "path of a hosts file whose names and addresses are answered locally, with synthesized PTR records")
+	hostsTTL        = flag.Uint("hoststtl", 300, "the TTL of the records read from the -hosts file")
+	cacheFile       = flag.String("cachefile", "", "path of a file to save the cache to on shutdown and load it from on startup")
+	clientCertPath  = flag.String("clientcert", "", "path of the PEM client certificate chain to authenticate to the upstreams that require it, with the -clientkey key")
+	clientKeyPath   = flag.String("clientkey", "", "path of the PEM private key of the -clientcert certificate")
+	caPath          = flag.String("ca", "", "path of a PEM file with the CA certificates to verify upstreams with instead of the system ones")
+	qmin            = flag.Bool("qmin", false, "ask the upstream servers whether the ancestors of names exist before forwarding queries for them, and answer NXDOMAIN without sending the full name if they do not (QNAME minimization)")
+	queryLogPath    = flag.String("querylog", "", "path of a file to log every query to as JSON lines")
+	redisAddr       = flag.String("redis", "", "the `address:port` of a Redis server to store the answers in instead of the built-in cache, to share them across servers. If empty (default) the built-in cache is used.")
+	statsd          = flag.String("statsd", "", "the `address:port` of a StatsD server to push metrics to. If empty (default) metrics will not be pushed.")
+	adminAddr       = flag.String("admin", "", "the `address:port` to serve the admin endpoint on, where POST /admin/flush flushes the cache, or only the answers for a name with ?name=example.com. Requests must carry the -admintoken in an \"Authorization: Bearer\" header. If empty (default) the admin endpoint is not served.")
+	adminTokenPath  = flag.String("admintoken", "", "path of a file holding the token required by the -admin endpoint")
+	udpWorkers      = flag.Int("udpworkers", 1, "the number of UDP sockets bound to every -a address with SO_REUSEPORT, so that the kernel spreads the queries across them on machines with many cores")
 	ppr             = flag.Int("pprof", 0, "The port to use for pprof debugging. If set to 0 (default) pprof will not be started.")
 )
 
+// routes holds the -route flags, which can be repeated.
+var routes routeFlags
+
+func init() {
+	flag.Var(&routes, "route", "a `domain=upstream[,upstream]` pair: the names in domain are resolved only with its upstream servers instead of the -s ones. It can be repeated, the longest matching domain is used")
+}
+
+// routeFlags is a repeatable flag of domains and their comma-separated upstream servers.
+type routeFlags []string
+
+func (r *routeFlags) String() string { return strings.Join(*r, " ") }
+
+func (r *routeFlags) Set(v string) error {
+	if i := strings.IndexByte(v, '='); i <= 0 || i == len(v)-1 {
+		return fmt.Errorf("want domain=upstream[,upstream], got %q", v)
+	}
+	*r = append(*r, v)
+	return nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -55,21 +106,200 @@ func main() {
 	}
 
 	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	go func() {
 		<-sigs
 		cancel()
 	}()
+	upstreams := strings.Split(*upstreamServers, ",")
+	if *upstreamsPath != "" {
+		var err error
+		if upstreams, err = readUpstreams(*upstreamsPath); err != nil {
+			log.Fatalf("Unable to read upstream servers: %v", err)
+		}
+	}
+	opts := []proxy.Option{
+		proxy.WithEvictMetrics(*evictMetrics),
+		proxy.WithLRUOnlyCache(*lruOnly),
+		proxy.WithUpstreams(upstreams...),
+		proxy.WithStatsD(*statsd, "dot", 0),
+		proxy.WithCacheFile(*cacheFile),
+		proxy.WithUDPWorkers(*udpWorkers),
+	}
+	for _, r := range routes {
+		i := strings.IndexByte(r, '=')
+		opts = append(opts, proxy.WithDomainUpstreams(r[:i], strings.Split(r[i+1:], ",")...))
+	}
+	if *redisAddr != "" {
+		opts = append(opts, proxy.WithCache(proxy.NewRedisCache(*redisAddr, "dot:")))
+	}
+	if *allowedClients != "" {
+		opts = append(opts, proxy.WithAllowedClients(parseCIDRs(*allowedClients)...))
+	}
+	if *deniedClients != "" {
+		opts = append(opts, proxy.WithDeniedClients(parseCIDRs(*deniedClients)...))
+	}
+	if *dohProxies != "" {
+		opts = append(opts, proxy.WithDoHTrustedProxies(parseCIDRs(*dohProxies)...))
+	}
+	if *sortlist != "" {
+		opts = append(opts, proxy.WithSortlist(parseCIDRs(*sortlist)...))
+	}
+	var queryLog *proxy.JSONQueryLogger
+	if *queryLogPath != "" {
+		qf, err := os.OpenFile(*queryLogPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0640)
+		if err != nil {
+			log.Fatalf("Unable to open query log file for writing: %v", err)
+		}
+		queryLog = proxy.NewJSONQueryLogger(qf)
+		opts = append(opts, proxy.WithQueryLogger(queryLog))
+	}
+	if *dotAddr != "" {
+		cert, err := tls.LoadX509KeyPair(*certPath, *keyPath)
+		if err != nil {
+			log.Fatalf("Unable to load the DNS over TLS certificate: %v", err)
+		}
+		opts = append(opts, proxy.WithDoTServer(&tls.Config{Certificates: []tls.Certificate{cert}}, strings.Split(*dotAddr, ",")...))
+	}
+	if *sinkhole {
+		opts = append(opts, proxy.WithSinkhole(net.IPv4zero, net.IPv6zero))
+	}
+	if *dnssec {
+		opts = append(opts, proxy.WithDNSSECValidation())
+	}
+	if *qmin {
+		opts = append(opts, proxy.WithQNAMEMinimization())
+	}
+	if *hostsPath != "" {
+		f, err := os.Open(*hostsPath)
+		if err != nil {
+			log.Fatalf("Unable to open hosts file: %v", err)
+		}
+		rrs, err := proxy.ParseHosts(f, uint32(*hostsTTL))
+		f.Close()
+		if err != nil {
+			log.Fatalf("Unable to load hosts file: %v", err)
+		}
+		opts = append(opts, proxy.WithLocalZone("", rrs...))
+	}
+	if *clientCertPath != "" || *clientKeyPath != "" {
+		opts = append(opts, proxy.WithClientCertificate(*clientCertPath, *clientKeyPath))
+	}
+	if *caPath != "" {
+		pem, err := ioutil.ReadFile(*caPath)
+		if err != nil {
+			log.Fatalf("Unable to read CA certificates: %v", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			log.Fatalf("No CA certificates found in %s", *caPath)
+		}
+		opts = append(opts, proxy.WithRootCAs(roots))
+	}
 	// Run the server with a default cache size and the specified upstream servers.
-	server := proxy.NewServer(0, *evictMetrics, strings.Split(*upstreamServers, ",")...)
+	server, err := proxy.NewServerE(opts...)
+	if err != nil {
+		log.Fatalf("Unable to create the server: %v", err)
+	}
+	if *upstreamsPath != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				upstreams, err := readUpstreams(*upstreamsPath)
+				if err == nil {
+					err = server.SetUpstreams(upstreams)
+				}
+				if err != nil {
+					log.Errorf("Unable to reload upstream servers, keeping the current ones: %v", err)
+				}
+			}
+		}()
+	}
+
+	if *blocklistPath != "" {
+		f, err := os.Open(*blocklistPath)
+		if err != nil {
+			log.Fatalf("Unable to open blocklist: %v", err)
+		}
+		err = server.ReloadBlocklist(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("Unable to load blocklist: %v", err)
+		}
+	}
 
 	if *ppr != 0 {
 		mux := http.NewServeMux()
-		mux.Handle("/debug/pprof/", http.HandlerFunc(pprof.Index))
-		mux.Handle("/debug/server/", server.DebugHandler())
+		server.RegisterDebugHandlers(mux)
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 		go func() { log.Error(http.ListenAndServe(fmt.Sprintf("localhost:%d", *ppr), mux)) }()
 	}
 
-	log.Fatal(server.Run(ctx, *addr))
+	if *adminAddr != "" {
+		token, err := ioutil.ReadFile(*adminTokenPath)
+		if err != nil {
+			log.Fatalf("Unable to read the admin token: %v", err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/admin/flush", server.FlushCacheHandler(strings.TrimSpace(string(token))))
+		go func() { log.Error(http.ListenAndServe(*adminAddr, mux)) }()
+	}
+
+	if *dohAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/dns-query", server.DoHHandler())
+		go func() { log.Error(http.ListenAndServe(*dohAddr, mux)) }()
+	}
+
+	err = server.RunMulti(ctx, strings.Split(*addr, ","))
+	if queryLog != nil {
+		// The server is done answering queries, write the ones still pending to the query log.
+		if err := queryLog.Close(); err != nil {
+			log.Errorf("Unable to write query log: %v", err)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readUpstreams reads the upstream servers listed one per line in the file at path.
+// Empty lines and lines starting with # are ignored.
+func readUpstreams(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var upstreams []string
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		upstreams = append(upstreams, l)
+	}
+	if len(upstreams) == 0 {
+		return nil, fmt.Errorf("no upstream servers in %s", path)
+	}
+	return upstreams, nil
+}
+
+// parseCIDRs parses a comma-separated list of CIDRs and exits on failure.
+func parseCIDRs(list string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, c := range strings.Split(list, ",") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(c))
+		if err != nil {
+			log.Fatalf("Invalid CIDR %q: %v", c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
 }
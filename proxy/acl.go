@@ -0,0 +1,43 @@
+package proxy
+
+import "net"
+
+// WithAllowedClients makes the server only answer clients whose IP is in one of the given networks.
+// Other clients get REFUSED. By default all clients are allowed.
+func WithAllowedClients(nets ...*net.IPNet) Option {
+	return func(o *options) { o.acl.allow = append(o.acl.allow, nets...) }
+}
+
+// WithDeniedClients makes the server refuse clients whose IP is in one of the given networks.
+// Denied networks take precedence over allowed ones, see WithAllowedClients.
+func WithDeniedClients(nets ...*net.IPNet) Option {
+	return func(o *options) { o.acl.deny = append(o.acl.deny, nets...) }
+}
+
+// acl decides which clients can query the server.
+type acl struct {
+	allow, deny []*net.IPNet
+}
+
+// permits reports whether the client with the given IP can query the server.
+func (a acl) permits(ip net.IP) bool {
+	if len(a.allow) == 0 && len(a.deny) == 0 {
+		return true
+	}
+	if ip == nil {
+		return false
+	}
+	if len(a.allow) > 0 && !contains(a.allow, ip) {
+		return false
+	}
+	return !contains(a.deny, ip)
+}
+
+func contains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func mustParseCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			t.Fatalf("Cannot parse %q: %v", c, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func TestACL(t *testing.T) {
+	tests := []struct {
+		name        string
+		allow, deny []string
+		ip          string
+		want        bool
+	}{
+		{name: "no lists", ip: "192.0.2.1", want: true},
+		{name: "allowed", allow: []string{"192.168.0.0/16", "fd00::/8"}, ip: "192.168.1.1", want: true},
+		{name: "allowed v6", allow: []string{"192.168.0.0/16", "fd00::/8"}, ip: "fd12::1", want: true},
+		{name: "not allowed", allow: []string{"192.168.0.0/16"}, ip: "10.0.0.1"},
+		{name: "denied", deny: []string{"10.0.0.0/8"}, ip: "10.0.0.1"},
+		{name: "not denied", deny: []string{"10.0.0.0/8"}, ip: "192.168.1.1", want: true},
+		{name: "denied wins", allow: []string{"10.0.0.0/8"}, deny: []string{"10.1.0.0/16"}, ip: "10.1.2.3"},
+		{name: "allowed and not denied", allow: []string{"10.0.0.0/8"}, deny: []string{"10.1.0.0/16"}, ip: "10.2.2.3", want: true},
+		{name: "unparsable", deny: []string{"10.0.0.0/8"}, ip: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := acl{allow: mustParseCIDRs(t, tt.allow...), deny: mustParseCIDRs(t, tt.deny...)}
+			if got := a.permits(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("permits(%q): got %t want %t", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACLRefused(t *testing.T) {
+	s := NewServerWithOptions(WithCacheSize(-1), WithChaos(1, 0), WithAllowedClients(mustParseCIDRs(t, "127.0.0.0/8")...))
+	var q dns.Msg
+	q.SetQuestion(testQuestion, dns.TypeA)
+	for _, tt := range []struct {
+		ip   net.IP
+		want int
+	}{
+		{net.IPv4(127, 0, 0, 1), dns.RcodeServerFailure},
+		{net.IPv4(192, 0, 2, 1), dns.RcodeRefused},
+	} {
+		w := &fakeResponseWriter{remote: &net.UDPAddr{IP: tt.ip, Port: 42}}
+		s.ServeDNS(w, &q)
+		if len(w.msgs) != 1 || w.msgs[0].Rcode != tt.want {
+			t.Errorf("%v: got %v want %s", tt.ip, w.msgs, dns.RcodeToString[tt.want])
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// blocklist is an immutable set of blocked names. A name is blocked if it or any of its parents is in the set.
+// A nil *blocklist blocks nothing.
+type blocklist struct {
+	names map[string]struct{}
+	// digest is a hash of the sorted names, see Server.configHash.
+	digest [sha256.Size]byte
+}
+
+// parseBlocklist reads a blocklist from r, see ReloadBlocklist for the format.
+func parseBlocklist(r io.Reader) (*blocklist, error) {
+	bl := &blocklist{names: make(map[string]struct{})}
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		l := sc.Text()
+		if i := strings.IndexByte(l, '#'); i >= 0 {
+			l = l[:i]
+		}
+		names := strings.Fields(l)
+		if len(names) > 1 && net.ParseIP(names[0]) != nil {
+			// Hosts file format, the address is irrelevant.
+			names = names[1:]
+		}
+		for _, n := range names {
+			if _, ok := dns.IsDomainName(n); !ok {
+				return nil, fmt.Errorf("line %d: invalid name %q", line, n)
+			}
+			bl.names[strings.ToLower(dns.Fqdn(n))] = struct{}{}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(bl.names))
+	for n := range bl.names {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	bl.digest = sha256.Sum256([]byte(strings.Join(names, " ")))
+	return bl, nil
+}
+
+// blocks reports whether name, which must be fully qualified, is blocked.
+// It does not allocate if name is lowercase.
+func (bl *blocklist) blocks(name string) bool {
+	if bl == nil || len(bl.names) == 0 {
+		return false
+	}
+	name = strings.ToLower(name)
+	for {
+		if _, ok := bl.names[name]; ok {
+			return true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return false
+		}
+		name = name[i+1:]
+	}
+}
+
+// ReloadBlocklist replaces the blocklist with the one read from r. Queries for blocked names and
+// their subdomains get NXDOMAIN, or the sinkhole addresses if WithSinkhole is used.
+// Every line of r holds names, optionally preceded by an address as in hosts file format.
+// Everything after a # is a comment.
+// Queries are served with the previous blocklist until the new one is ready, and if r cannot be
+// parsed the previous blocklist is kept.
+func (s *Server) ReloadBlocklist(r io.Reader) error {
+	bl, err := parseBlocklist(r)
+	if err != nil {
+		return err
+	}
+	s.blocklist.Store(bl)
+	log.Infof("Loaded blocklist with %d names", len(bl.names))
+	return nil
+}
+
+// blocked reports whether the name queried by q is blocked.
+func (s *Server) blocked(q *dns.Msg) bool {
+	bl, _ := s.blocklist.Load().(*blocklist)
+	return bl.blocks(q.Question[0].Name)
+}
+
+// blockedAnswer returns the response to a query for a blocked name, see WithSinkhole.
+func (s *Server) blockedAnswer(q *dns.Msg) *dns.Msg {
+	v4, v6 := s.opts.sinkholeV4, s.opts.sinkholeV6
+	if v4 == nil && v6 == nil {
+		m := new(dns.Msg)
+		m.SetRcode(q, dns.RcodeNameError)
+		m.Ns = []dns.RR{soa(dns.Fqdn(q.Question[0].Name))}
+		return m
+	}
+	qs := q.Question[0]
+	hdr := dns.RR_Header{Name: qs.Name, Rrtype: qs.Qtype, Class: dns.ClassINET, Ttl: localTTL}
+	var rr dns.RR
+	switch {
+	case qs.Qtype == dns.TypeA && v4 != nil:
+		rr = &dns.A{Hdr: hdr, A: v4}
+	case qs.Qtype == dns.TypeAAAA && v6 != nil:
+		rr = &dns.AAAA{Hdr: hdr, AAAA: v6}
+	default:
+		return noData(q)
+	}
+	m := new(dns.Msg)
+	m.SetReply(q)
+	m.Answer = []dns.RR{rr}
+	return m
+}
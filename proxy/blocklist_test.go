@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const testBlocklist = `
+# Trackers
+ads.miki.
+0.0.0.0 tracker.miki  Metrics.Miki # hosts file format
+:: beacon.miki
+pixel.miki telemetry.miki
+`
+
+func TestBlocklist(t *testing.T) {
+	bl, err := parseBlocklist(strings.NewReader(testBlocklist))
+	if err != nil {
+		t.Fatalf("Cannot parse blocklist: %v", err)
+	}
+	for _, tt := range []struct {
+		name string
+		want bool
+	}{
+		{"ads.miki.", true},
+		{"ADS.miki.", true},
+		{"cdn.ads.miki.", true},
+		{"tracker.miki.", true},
+		{"metrics.miki.", true},
+		{"beacon.miki.", true},
+		{"pixel.miki.", true},
+		{"telemetry.miki.", true},
+		{"miki.", false},
+		{"raccoon.miki.", false},
+		{"bads.miki.", false},
+		{"ads.miki.raccoon.", false},
+	} {
+		if got := bl.blocks(tt.name); got != tt.want {
+			t.Errorf("blocks(%q): got %t want %t", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := parseBlocklist(strings.NewReader("0.0.0.0 bad..name\n")); err == nil {
+		t.Errorf("parsing invalid name: got nil error")
+	}
+	var nilbl *blocklist
+	if nilbl.blocks("ads.miki.") {
+		t.Errorf("nil blocklist blocks names")
+	}
+}
+
+func TestBlocklistAllocs(t *testing.T) {
+	bl, err := parseBlocklist(strings.NewReader(testBlocklist))
+	if err != nil {
+		t.Fatalf("Cannot parse blocklist: %v", err)
+	}
+	s := NewServerWithOptions()
+	s.blocklist.Store(bl)
+	q := new(dns.Msg).SetQuestion("www.raccoon.miki.", dns.TypeA)
+	if n := testing.AllocsPerRun(100, func() { s.blocked(q) }); n != 0 {
+		t.Errorf("blocklist check allocations: got %v want 0", n)
+	}
+}
+
+func TestReloadBlocklist(t *testing.T) {
+	ts, cleanup := setupTestServer(t, 0, nil)
+	defer cleanup()
+	s := ts.s
+
+	query := func(name string) int {
+		w := &fakeResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 42}}
+		s.ServeDNS(w, new(dns.Msg).SetQuestion(name, dns.TypeMX))
+		if len(w.msgs) != 1 {
+			t.Errorf("%s: got %d responses want 1", name, len(w.msgs))
+			return -1
+		}
+		return w.msgs[0].Rcode
+	}
+	if got := query("ads." + testQuestion); got != dns.RcodeSuccess {
+		t.Errorf("before load: got %s want NOERROR", dns.RcodeToString[got])
+	}
+	if err := s.ReloadBlocklist(strings.NewReader(testQuestion)); err != nil {
+		t.Fatalf("Cannot load blocklist: %v", err)
+	}
+	if got := query("ads." + testQuestion); got != dns.RcodeNameError {
+		t.Errorf("after load: got %s want NXDOMAIN", dns.RcodeToString[got])
+	}
+	if err := s.ReloadBlocklist(strings.NewReader("bad..name")); err == nil {
+		t.Errorf("reloading invalid blocklist: got nil error")
+	}
+	if got := query("ads." + testQuestion); got != dns.RcodeNameError {
+		t.Errorf("after failed reload: got %s want NXDOMAIN", dns.RcodeToString[got])
+	}
+
+	// Reload while queries are being served: every query must see either list.
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if got := query("ads." + testQuestion); got != dns.RcodeNameError {
+					t.Errorf("during reload: got %s want NXDOMAIN", dns.RcodeToString[got])
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 20; i++ {
+		var b strings.Builder
+		fmt.Fprintf(&b, "%s\n", testQuestion)
+		for j := 0; j < 1000; j++ {
+			fmt.Fprintf(&b, "0.0.0.0 %d.%d.miki\n", i, j)
+		}
+		if err := s.ReloadBlocklist(strings.NewReader(b.String())); err != nil {
+			t.Fatalf("Cannot reload blocklist: %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestSinkhole(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []Option
+		qtype     uint16
+		wantRcode int
+		wantAns   string
+	}{
+		{name: "nxdomain", qtype: dns.TypeA, wantRcode: dns.RcodeNameError},
+		{name: "a", opts: []Option{WithSinkhole(net.IPv4zero, net.IPv6zero)}, qtype: dns.TypeA, wantAns: "0.0.0.0"},
+		{name: "aaaa", opts: []Option{WithSinkhole(net.IPv4zero, net.IPv6zero)}, qtype: dns.TypeAAAA, wantAns: "::"},
+		{name: "other type", opts: []Option{WithSinkhole(net.IPv4zero, net.IPv6zero)}, qtype: dns.TypeMX},
+		{name: "no v6 address", opts: []Option{WithSinkhole(net.IPv4zero, nil)}, qtype: dns.TypeAAAA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, cleanup := setupTestServer(t, 0, nil, tt.opts...)
+			defer cleanup()
+			s := ts.s
+			if err := s.ReloadBlocklist(strings.NewReader(testQuestion)); err != nil {
+				t.Fatalf("Cannot load blocklist: %v", err)
+			}
+			w := &fakeResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 42}}
+			s.ServeDNS(w, new(dns.Msg).SetQuestion("ads."+testQuestion, tt.qtype))
+			if len(w.msgs) != 1 {
+				t.Fatalf("got %d responses want 1", len(w.msgs))
+			}
+			m := w.msgs[0]
+			if m.Rcode != tt.wantRcode {
+				t.Errorf("rcode: got %s want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			switch {
+			case tt.wantAns == "" && len(m.Answer) != 0:
+				t.Errorf("answers: got %v want none", m.Answer)
+			case tt.wantAns != "" && (len(m.Answer) != 1 || !strings.HasSuffix(m.Answer[0].String(), "\t"+tt.wantAns)):
+				t.Errorf("answers: got %v want %s", m.Answer, tt.wantAns)
+			}
+			if got := s.Stats().Blocked; got != 1 {
+				t.Errorf("blocked: got %d want 1", got)
+			}
+		})
+	}
+}
+
+func BenchmarkBlocklist(b *testing.B) {
+	var sb strings.Builder
+	for i := 0; i < 100000; i++ {
+		fmt.Fprintf(&sb, "0.0.0.0 %d.ads.miki\n", i)
+	}
+	bl, err := parseBlocklist(strings.NewReader(sb.String()))
+	if err != nil {
+		b.Fatalf("Cannot parse blocklist: %v", err)
+	}
+	s := NewServerWithOptions()
+	s.blocklist.Store(bl)
+	q := new(dns.Msg).SetQuestion("www.cdn.raccoon.miki.", dns.TypeA)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		s.blocked(q)
+	}
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// WithCircuitBreaker opens the circuit breaker of an upstream after failures consecutive failed
+// exchanges: the upstream is not asked to resolve questions for cooldown, unless the breakers of all
+// upstreams are open. Once cooldown has elapsed the breaker is half-open and the next exchange probes
+// the upstream, closing the breaker if it succeeds or opening it again if it fails.
+// Unlike health checks, breakers react to the failures of the questions asked by clients.
+// A failures <= 0 disables circuit breakers, which is the default.
+func WithCircuitBreaker(failures int, cooldown time.Duration) Option {
+	return func(o *options) {
+		o.breakerFailures = failures
+		o.breakerCooldown = cooldown
+	}
+}
+
+// breakerState is the state of a circuit breaker.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker is the circuit breaker of an upstream, see WithCircuitBreaker. A nil *breaker is always closed.
+type breaker struct {
+	addr      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	// openUntil is when an open breaker becomes half-open.
+	openUntil time.Time
+	// probing is set while the exchange probing a half-open breaker is in progress.
+	probing bool
+}
+
+func newBreaker(addr string, threshold int, cooldown time.Duration) *breaker {
+	if threshold <= 0 {
+		return nil
+	}
+	return &breaker{addr: addr, threshold: threshold, cooldown: cooldown}
+}
+
+// stateAt returns the state of b at now. The caller must hold b.mu.
+func (b *breaker) stateAt(now time.Time) breakerState {
+	if b.state == breakerOpen && !now.Before(b.openUntil) {
+		return breakerHalfOpen
+	}
+	return b.state
+}
+
+// status returns the state of b at now, or an empty string if b is nil.
+func (b *breaker) status(now time.Time) string {
+	if b == nil {
+		return ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stateAt(now).String()
+}
+
+// skip reports whether the upstream of b should not be asked at now: its breaker is open, or half-open
+// and already being probed.
+func (b *breaker) skip(now time.Time) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.stateAt(now) {
+	case breakerOpen:
+		return true
+	case breakerHalfOpen:
+		return b.probing
+	}
+	return false
+}
+
+// begin is called when an exchange starts at now and reports whether it probes a half-open breaker.
+func (b *breaker) begin(now time.Time) (probe bool) {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.stateAt(now) != breakerHalfOpen || b.probing {
+		return false
+	}
+	b.state = breakerHalfOpen
+	b.probing = true
+	return true
+}
+
+// done records the outcome of an exchange that ended at now. Exchanges abandoned by the caller are
+// neither failures nor successes, they only end the probe if they were one.
+func (b *breaker) done(now time.Time, probe, abandoned bool, err error) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if probe {
+		b.probing = false
+	}
+	if abandoned {
+		return
+	}
+	if err == nil {
+		if b.state != breakerClosed {
+			log.Infof("Circuit breaker of upstream %s is closed again", b.addr)
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		log.Warnf("Circuit breaker of upstream %s is open for %v after %d consecutive failures: %v", b.addr, b.cooldown, b.failures, err)
+		b.state = breakerOpen
+		b.openUntil = now.Add(b.cooldown)
+	}
+}
+
+// closedTiers returns all without the upstreams whose breakers are open, omitting the tiers left empty.
+// If the breakers of all upstreams are open all tiers are returned, as failing is not better than trying.
+func (s *Server) closedTiers(all [][]*upstream) [][]*upstream {
+	if s.opts.breakerFailures <= 0 {
+		return all
+	}
+	now := s.now()
+	var tiers [][]*upstream
+	for _, tier := range all {
+		var ups []*upstream
+		for _, u := range tier {
+			if !u.breaker.skip(now) {
+				ups = append(ups, u)
+			}
+		}
+		if len(ups) > 0 {
+			tiers = append(tiers, ups)
+		}
+	}
+	if len(tiers) == 0 {
+		return all
+	}
+	return tiers
+}
@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var (
+		down       int32 = 1
+		badQueries int32
+	)
+	good := &fakeTransport{}
+	bad := funcTransport(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(&badQueries, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			return nil, errors.New("down")
+		}
+		return good.Exchange(ctx, q)
+	})
+	const cooldown = time.Minute
+	s := NewServerWithOptions(
+		WithCacheSize(-1),
+		WithUpstreams("fake://bad", "fake://good"),
+		WithUpstreamTransport("fake", func(spec string) (UpstreamTransport, error) {
+			if spec == "fake://bad" {
+				return bad, nil
+			}
+			return good, nil
+		}),
+		WithSelectionStrategy(SelectRoundRobin),
+		WithCircuitBreaker(2, cooldown),
+	)
+	now := s.now()
+	// The steps run in order and share the state of the breaker.
+	tests := []struct {
+		name        string
+		advance     time.Duration
+		up          bool
+		wantQueries int32
+		wantState   string
+	}{
+		{name: "first failure", wantQueries: 1, wantState: "closed"},
+		{name: "threshold", wantQueries: 2, wantState: "open"},
+		{name: "open", wantQueries: 2, wantState: "open"},
+		{name: "still open", advance: cooldown / 2, wantQueries: 2, wantState: "open"},
+		{name: "failed probe", advance: cooldown / 2, wantQueries: 3, wantState: "open"},
+		{name: "open again", advance: cooldown / 2, wantQueries: 3, wantState: "open"},
+		{name: "successful probe", advance: cooldown / 2, up: true, wantQueries: 4, wantState: "closed"},
+		{name: "closed", up: true, wantQueries: 5, wantState: "closed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.advance)
+			s.mu.Lock()
+			s.currentTime = now
+			s.mu.Unlock()
+			if tt.up {
+				atomic.StoreInt32(&down, 0)
+			}
+			// Round robin puts the bad upstream first for one of the two questions.
+			for i := 0; i < 2; i++ {
+				q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+				if m, _ := s.forwardMessageAndGetResponse(context.Background(), q); m == nil {
+					t.Fatal("got no response")
+				}
+			}
+			if got := atomic.LoadInt32(&badQueries); got != tt.wantQueries {
+				t.Errorf("queries to the bad upstream: got %d want %d", got, tt.wantQueries)
+			}
+			if got := s.upstreamStats()[0].Breaker; got != tt.wantState {
+				t.Errorf("breaker: got %q want %q", got, tt.wantState)
+			}
+		})
+	}
+	if got := s.upstreamStats()[1].Breaker; got != "closed" {
+		t.Errorf("breaker of the good upstream: got %q want %q", got, "closed")
+	}
+}
+
+func TestClosedTiers(t *testing.T) {
+	now := time.Now()
+	open := &upstream{addr: "open", breaker: &breaker{threshold: 1, state: breakerOpen, openUntil: now.Add(time.Minute)}}
+	probing := &upstream{addr: "probing", breaker: &breaker{threshold: 1, state: breakerHalfOpen, probing: true}}
+	halfOpen := &upstream{addr: "half-open", breaker: &breaker{threshold: 1, state: breakerOpen, openUntil: now}}
+	closed := &upstream{addr: "closed", breaker: &breaker{threshold: 1}}
+	tests := []struct {
+		name string
+		all  [][]*upstream
+		want [][]*upstream
+	}{
+		{name: "closed", all: [][]*upstream{{closed}}, want: [][]*upstream{{closed}}},
+		{name: "open skipped", all: [][]*upstream{{open, closed}}, want: [][]*upstream{{closed}}},
+		{name: "probing skipped", all: [][]*upstream{{probing, halfOpen}}, want: [][]*upstream{{halfOpen}}},
+		{name: "empty tier", all: [][]*upstream{{open}, {closed}}, want: [][]*upstream{{closed}}},
+		{name: "all open", all: [][]*upstream{{open}, {probing}}, want: [][]*upstream{{open}, {probing}}},
+	}
+	s := NewServerWithOptions(WithCacheSize(-1), WithCircuitBreaker(1, time.Minute))
+	s.currentTime = now
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := s.closedTiers(tt.all)
+			if len(got) != len(tt.want) {
+				t.Fatalf("tiers: got %d want %d", len(got), len(tt.want))
+			}
+			for i := range got {
+				if len(got[i]) != len(tt.want[i]) {
+					t.Fatalf("tier %d: got %d upstreams want %d", i, len(got[i]), len(tt.want[i]))
+				}
+				for j := range got[i] {
+					if got[i][j] != tt.want[i][j] {
+						t.Errorf("tier %d upstream %d: got %s want %s", i, j, got[i][j].addr, tt.want[i][j].addr)
+					}
+				}
+			}
+		})
+	}
+}
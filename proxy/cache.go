@@ -1,6 +1,9 @@
 package proxy
 
 import (
+	"fmt"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -8,25 +11,158 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const maxTTL = time.Duration(24) * time.Hour
+// defaultMaxTTL is the longest cached answers are fresh for unless set with WithCacheTTLBounds.
+const defaultMaxTTL = time.Duration(24) * time.Hour
 
+// Cache stores the answers of a Server, see WithCache. Implementations must be safe for concurrent use.
+type Cache interface {
+	// Get returns the answer cached for the query q and whether it is fresh. Expired answers that can
+	// still be served are returned with ok set to false: the server serves them and resolves q again.
+	// The returned answer is modified by the server, it must not be shared with the cache.
+	Get(q *dns.Msg) (m *dns.Msg, ok bool)
+	// Put stores m as the answer to q. Implementations decide whether to store it and for how long,
+	// and must not retain m, which is modified by the server.
+	Put(q, m *dns.Msg)
+	// Len returns the amount of stored answers, Cap the maximum amount the cache can hold.
+	Len() int
+	Cap() int
+	Metrics() CacheMetrics
+}
+
+// CacheMetrics counts the hits and misses of a Cache.
+type CacheMetrics = specialized.CacheMetrics
+
+// cache is the built-in Cache.
 type cache struct {
 	// TODO(empijei): This is too much indirection, it doesn't make sense to just have a pointer to the
 	// actual cache in a pointer to this struct.
-	c *specialized.Cache
+	c *specialized.ShardedCache
+	// ttl decides when entries expire.
+	ttl TTLStrategy
+	// minTTL and maxTTL bound the TTL of every cached record when computing expirations.
+	minTTL, maxTTL time.Duration
+	// originalTTL makes hits carry the TTLs records were cached with instead of the remaining ones.
+	originalTTL bool
+	// maxStale is how long after expiration entries can still be served, 0 means forever.
+	maxStale time.Duration
+	// staleServed and staleExpired count the expired entries that were served and the ones that were
+	// too old to be served, accessed atomically.
+	staleServed, staleExpired uint64
+	// negative enables caching of NXDOMAIN and NODATA responses as described in RFC 2308.
+	negative bool
+	// servfailTTL is how long SERVFAIL responses are cached for, they are not cached if it is <= 0.
+	servfailTTL time.Duration
+	// clock is used to get the current time, if nil time.Now is used.
+	clock func() time.Time
 }
 
 type cacheValue struct {
-	m   dns.Msg
-	exp time.Time
+	// msg is the answer in wire format, packed with compression as it takes much less memory than a
+	// dns.Msg and spares the garbage collector the pointers of its records.
+	msg []byte
+	// question and rcode are the ones of msg, kept to avoid unpacking it.
+	question dns.Question
+	rcode    int
+	// stored is when the value was put in the cache.
+	stored time.Time
+	exp    time.Time
+	// exps holds the expiration of every answer record if they expire independently.
+	exps []time.Time
+	// ecs and do are the EDNS0 Client Subnet option and the DO bit of the query the answer was stored
+	// for, so that it is refreshed with the same query.
+	ecs *dns.EDNS0_SUBNET
+	do  bool
+}
+
+// TTLStrategy decides how the expiration of a cached answer is computed from the TTLs of its records.
+type TTLStrategy struct {
+	kind   ttlKind
+	rrtype uint16
+}
+
+type ttlKind int
+
+const (
+	ttlMin ttlKind = iota
+	ttlMax
+	ttlType
+	ttlSplit
+)
+
+var (
+	// TTLMin makes answers expire together with their shortest lived record. This is the default.
+	TTLMin = TTLStrategy{kind: ttlMin}
+	// TTLMax makes answers expire together with their longest lived record.
+	TTLMax = TTLStrategy{kind: ttlMax}
+	// TTLSplit makes answer records expire independently: expired records are dropped from served
+	// answers and the answer expires together with its longest lived record.
+	// Note that this might break CNAME chains until the answer is refreshed.
+	TTLSplit = TTLStrategy{kind: ttlSplit}
+)
+
+// TTLOfType makes answers expire together with their shortest lived record of type rrtype,
+// for example to ignore short TTLs on CNAMEs leading to long lived addresses.
+// Answers without records of type rrtype behave as with TTLMin.
+func TTLOfType(rrtype uint16) TTLStrategy { return TTLStrategy{kind: ttlType, rrtype: rrtype} }
+
+// clampTTL returns ttl bounded to [minTTL, maxTTL]. maxTTL wins if the bounds overlap.
+func clampTTL(ttl, minTTL, maxTTL time.Duration) time.Duration {
+	if ttl < minTTL {
+		ttl = minTTL
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+	return ttl
 }
 
-func newCache(size int, evictMetrics bool) (*cache, error) {
-	c, err := specialized.NewCache(size, evictMetrics)
+// expiration returns when an answer with the given records and received at now should expire.
+// The TTL of each record is clamped to [minTTL, maxTTL] first.
+func (st TTLStrategy) expiration(now time.Time, rrs []dns.RR, minTTL, maxTTL time.Duration) time.Time {
+	var (
+		min, max = maxTTL, time.Duration(0)
+		typed    = maxTTL
+		hasTyped bool
+	)
+	for _, a := range rrs {
+		ttl := clampTTL(time.Duration(a.Header().Ttl)*time.Second, minTTL, maxTTL)
+		if ttl < min {
+			min = ttl
+		}
+		if ttl > max {
+			max = ttl
+		}
+		if a.Header().Rrtype == st.rrtype && ttl < typed {
+			typed, hasTyped = ttl, true
+		}
+	}
+	d := min
+	switch {
+	case st.kind == ttlMax || st.kind == ttlSplit:
+		d = max
+	case st.kind == ttlType && hasTyped:
+		d = typed
+	}
+	return now.Add(d)
+}
+
+func newCache(size, shards int, evictMetrics, lruOnly bool) (*cache, error) {
+	newc := specialized.NewCache
+	if lruOnly {
+		newc = specialized.NewLRUCache
+	}
+	c, err := specialized.NewShardedCache(size, shards, evictMetrics, newc)
 	if err != nil {
 		return nil, err
 	}
-	return &cache{c: c}, nil
+	return &cache{c: c, maxTTL: defaultMaxTTL}, nil
+}
+
+func (c *cache) now() time.Time {
+	if c.clock != nil {
+		return c.clock().UTC()
+	}
+	return time.Now().UTC()
 }
 
 func (c *cache) get(mk *dns.Msg) (*dns.Msg, bool) {
@@ -41,53 +177,307 @@ func (c *cache) get(mk *dns.Msg) (*dns.Msg, bool) {
 		return nil, false
 	}
 	v := r.(cacheValue)
-	mv := v.m.Copy()
-	// Rewrite the answer ID to match the question ID.
+	now := c.now()
+	stale := v.exp.Before(now)
+	if stale {
+		if v.rcode == dns.RcodeServerFailure {
+			// Cached SERVFAIL responses only spare upstreams for a moment, they are worse than asking again.
+			log.Debugf("[CACHE] MISS due to expired SERVFAIL for %v", k)
+			return nil, false
+		}
+		if c.maxStale > 0 && now.Sub(v.exp) > c.maxStale {
+			log.Debugf("[CACHE] MISS due to TTL expired for more than %v for %v", c.maxStale, k)
+			atomic.AddUint64(&c.staleExpired, 1)
+			return nil, false
+		}
+	}
+	mv, err := v.unpack()
+	if err != nil {
+		log.Warnf("[CACHE] MISS due to corrupted entry for %v: %v", k, err)
+		return nil, false
+	}
+	// Rewrite the answer ID and question to match the ones of the query, which might be spelled differently.
 	mv.Id = mk.Id
+	mv.Question = append([]dns.Question(nil), mk.Question...)
 	// If the TTL has expired, speculatively return the cache entry anyway with a short TTL, and refresh it.
-	if v.exp.Before(time.Now().UTC()) {
+	if stale {
 		log.Debugf("[CACHE] MISS + REFRESH due to expired TTL for %v", k)
+		atomic.AddUint64(&c.staleServed, 1)
 		// Set a very short TTL
-		for _, a := range mv.Answer {
-			a.Header().Ttl = 60
-		}
+		setTTL(mv, 60)
 		return mv, false
 	}
 	log.Debugf("[CACHE] HIT %v", k)
-	// Rewrite TTL
-	for _, a := range mv.Answer {
-		a.Header().Ttl = uint32(time.Since(v.exp).Seconds() * -1)
+	if !c.originalTTL {
+		// Rewrite TTL
+		setTTL(mv, uint32(v.exp.Sub(now).Seconds()))
+	}
+	if v.exps != nil {
+		// Records expire independently, only serve the ones that are still valid.
+		ans := mv.Answer[:0]
+		for i, a := range mv.Answer {
+			if v.exps[i].After(now) {
+				if !c.originalTTL {
+					a.Header().Ttl = uint32(v.exps[i].Sub(now).Seconds())
+				}
+				ans = append(ans, a)
+			}
+		}
+		mv.Answer = ans
 	}
 	return mv, true
 }
 
+// Get implements Cache.
+func (c *cache) Get(q *dns.Msg) (*dns.Msg, bool) { return c.get(q) }
+
+// Put implements Cache.
+func (c *cache) Put(q, m *dns.Msg) { c.put(q, m) }
+
+// Len implements Cache.
+func (c *cache) Len() int {
+	if c == nil {
+		return 0
+	}
+	return c.c.Len()
+}
+
+// Cap implements Cache.
+func (c *cache) Cap() int {
+	if c == nil {
+		return 0
+	}
+	return c.c.Cap()
+}
+
+// Metrics implements Cache.
+func (c *cache) Metrics() CacheMetrics {
+	if c == nil {
+		return CacheMetrics{}
+	}
+	return c.c.Metrics()
+}
+
+// setTTL sets the TTL of all records in m but the OPT pseudo-record.
+func setTTL(m *dns.Msg, ttl uint32) {
+	for _, rrs := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			rr.Header().Ttl = ttl
+		}
+	}
+}
+
 func (c *cache) put(k *dns.Msg, v *dns.Msg) {
 	if c == nil {
 		return
 	}
 
-	now := time.Now().UTC()
-	minExpirationTime := now.Add(maxTTL)
-	// Do not cache negative results.
-	if len(v.Answer) == 0 {
-		log.Debugf("[CACHE] Did not cache empty answer %v", key(k))
+	if v.Truncated {
+		// Transports retry truncated responses over a stream, one that is still truncated is incomplete
+		// and must not be served as a complete answer until it expires.
+		log.Warnf("[CACHE] Did not cache truncated answer %v", key(k))
 		return
 	}
-	for _, a := range v.Answer {
-		exp := now.Add(time.Duration(a.Header().Ttl) * time.Second)
-		if exp.Before(minExpirationTime) {
-			minExpirationTime = exp
+	if v.Rcode == dns.RcodeServerFailure {
+		// See putServfail.
+		log.Debugf("[CACHE] Did not cache SERVFAIL %v", key(k))
+		return
+	}
+	now := c.now()
+	cv := cacheValue{stored: now}
+	if len(v.Answer) == 0 {
+		exp, ok := negativeExpiration(now, v, c.minTTL, c.maxTTL)
+		if !c.negative || !ok {
+			log.Debugf("[CACHE] Did not cache empty answer %v", key(k))
+			return
 		}
+		cv.exp = exp
+	} else {
+		cv.exp = c.ttl.expiration(now, v.Answer, c.minTTL, c.maxTTL)
 	}
-	cm := v.Copy()
-	// Always set the TC bit to off.
-	cm.Truncated = false
-	// Always compress on the wire.
+	if c.ttl.kind == ttlSplit && len(v.Answer) > 0 {
+		cv.exps = make([]time.Time, len(v.Answer))
+		for i, a := range v.Answer {
+			cv.exps[i] = TTLMin.expiration(now, []dns.RR{a}, c.minTTL, c.maxTTL)
+		}
+	}
+	c.store(k, v, cv)
+}
+
+// putServfail caches v, a SERVFAIL response to k, for servfailTTL if it is positive. Unlike put it does
+// not replace an answer already cached for k, even one too stale to be served, as a later answer is
+// better than a SERVFAIL.
+func (c *cache) putServfail(k *dns.Msg, v *dns.Msg) {
+	if c == nil || c.servfailTTL <= 0 {
+		return
+	}
+	now := c.now()
+	cv := cacheValue{stored: now, exp: now.Add(c.servfailTTL)}
+	if err := cv.set(k, v); err != nil {
+		log.Warnf("[CACHE] Did not cache %v: %v", key(k), err)
+		return
+	}
+	if !c.c.PutIfAbsent(key(k), cv) {
+		log.Debugf("[CACHE] Did not cache SERVFAIL %v over a stored answer", key(k))
+	}
+}
+
+// store puts v in cv and stores it for k.
+func (c *cache) store(k *dns.Msg, v *dns.Msg, cv cacheValue) {
+	if err := cv.set(k, v); err != nil {
+		log.Warnf("[CACHE] Did not cache %v: %v", key(k), err)
+		return
+	}
+	c.c.Put(key(k), cv)
+}
+
+// set sets the message of cv to v, the answer to k.
+func (v *cacheValue) set(k, m *dns.Msg) error {
+	if err := v.pack(m); err != nil {
+		return err
+	}
+	v.ecs = clientSubnet(k)
+	if opt := k.IsEdns0(); opt != nil {
+		v.do = opt.Do()
+	}
+	return nil
+}
+
+// pack sets the message of v to m.
+func (v *cacheValue) pack(m *dns.Msg) error {
+	// Compression is decided on egress depending on the transport, m must not be affected.
+	cm := *m
 	cm.Compress = true
+	buf, err := cm.Pack()
+	if err != nil {
+		return err
+	}
+	v.msg = buf
+	v.question, v.rcode = dns.Question{}, m.Rcode
+	if len(m.Question) > 0 {
+		v.question = m.Question[0]
+	}
+	return nil
+}
 
-	c.c.Put(key(k), cacheValue{m: *cm, exp: minExpirationTime})
+// query returns a new query for the answer of v, with the EDNS0 Client Subnet option and the DO bit
+// of the query it was stored for. It returns nil if the question of the answer is unknown.
+func (v cacheValue) query() *dns.Msg {
+	if v.question.Name == "" {
+		return nil
+	}
+	q := new(dns.Msg)
+	q.Id = dns.Id()
+	q.RecursionDesired = true
+	q.Question = []dns.Question{v.question}
+	if v.ecs != nil || v.do {
+		q.SetEdns0(ednsUDPSize, v.do)
+	}
+	if v.ecs != nil {
+		opt := q.IsEdns0()
+		opt.Option = append(opt.Option, v.ecs)
+	}
+	return q
+}
+
+// unpack returns a new message unpacked from v.
+func (v cacheValue) unpack() (*dns.Msg, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(v.msg); err != nil {
+		return nil, err
+	}
+	return m, nil
 }
 
+// negativeExpiration returns when a negative response received at now should expire, which is
+// the minimum of the TTL and the MINIMUM field of the SOA record in its authority section as
+// specified by RFC 2308, clamped to [minTTL, maxTTL]. Responses that are not NXDOMAIN or NODATA,
+// or that have no SOA, cannot be cached.
+func negativeExpiration(now time.Time, m *dns.Msg, minTTL, maxTTL time.Duration) (time.Time, bool) {
+	if m.Rcode != dns.RcodeNameError && m.Rcode != dns.RcodeSuccess {
+		return time.Time{}, false
+	}
+	for _, rr := range m.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		return now.Add(clampTTL(time.Duration(ttl)*time.Second, minTTL, maxTTL)), true
+	}
+	return time.Time{}, false
+}
+
+// flush removes all entries and returns how many were removed.
+func (c *cache) flush() int {
+	if c == nil {
+		return 0
+	}
+	return c.c.Flush()
+}
+
+// delete removes the entries for name, for all types, classes and client subnets, and returns how many
+// were removed.
+func (c *cache) delete(name string) int {
+	if c == nil {
+		return 0
+	}
+	// Keys start with the question, whose first field is the name as spelled by key.
+	q := dns.Question{Name: strings.ToLower(dns.Fqdn(name))}
+	qs := q.String()
+	prefix := qs[:strings.IndexByte(qs, '\t')+1]
+	return c.c.DeleteFunc(func(k string) bool { return strings.HasPrefix(k, prefix) })
+}
+
+// expiring returns the queries for the n most accessed entries that expire before the given time.
+func (c *cache) expiring(n int, before time.Time) []*dns.Msg {
+	if c == nil {
+		return nil
+	}
+	var qs []*dns.Msg
+	for _, e := range c.c.MostAccessed(n) {
+		v := e.Value.(cacheValue)
+		if q := v.query(); v.exp.Before(before) && q != nil {
+			qs = append(qs, q)
+		}
+	}
+	return qs
+}
+
+// prefetchable returns the queries for the entries among the n most accessed ones that were accessed at least
+// minAccesses times and have less than fraction of their lifetime left at now.
+func (c *cache) prefetchable(n int, minAccesses uint, fraction float64, now time.Time) []*dns.Msg {
+	if c == nil {
+		return nil
+	}
+	var qs []*dns.Msg
+	for _, e := range c.c.MostAccessed(n) {
+		if e.Accesses < minAccesses {
+			// Entries are sorted by accesses, the remaining ones are colder.
+			break
+		}
+		v := e.Value.(cacheValue)
+		left, lifetime := v.exp.Sub(now), v.exp.Sub(v.stored)
+		if q := v.query(); left > 0 && float64(left) < fraction*float64(lifetime) && q != nil {
+			qs = append(qs, q)
+		}
+	}
+	return qs
+}
+
+// key returns the cache key for k. Names are compared case-insensitively and in their fully qualified form.
+// Queries with an EDNS0 Client Subnet option have different keys for every subnet.
 func key(k *dns.Msg) string {
-	return k.Question[0].String()
+	q := k.Question[0]
+	q.Name = strings.ToLower(dns.Fqdn(q.Name))
+	if ecs := clientSubnet(k); ecs != nil {
+		return fmt.Sprintf("%s %s/%d", q.String(), ecs.Address, ecs.SourceNetmask)
+	}
+	return q.String()
 }
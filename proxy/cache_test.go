@@ -0,0 +1,494 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestCache returns a cache with a clock that can be moved forward by calling the returned function.
+func newTestCache(t *testing.T, st TTLStrategy) (c *cache, advance func(time.Duration)) {
+	t.Helper()
+	c, err := newCache(100, 1, false, false)
+	if err != nil {
+		t.Fatalf("Cannot construct cache: %v", err)
+	}
+	now := time.Date(2019, 10, 18, 0, 0, 0, 0, time.UTC)
+	c.clock = func() time.Time { return now }
+	c.ttl = st
+	return c, func(d time.Duration) { now = now.Add(d) }
+}
+
+// testAnswer returns a question for name and an answer with the given records.
+func testAnswer(t *testing.T, name string, rrs ...string) (q, m *dns.Msg) {
+	t.Helper()
+	q = new(dns.Msg).SetQuestion(name, dns.TypeA)
+	m = new(dns.Msg).SetReply(q)
+	for _, r := range rrs {
+		rr, err := dns.NewRR(r)
+		if err != nil {
+			t.Fatalf("Cannot parse %q: %v", r, err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	return q, m
+}
+
+func TestTTLStrategy(t *testing.T) {
+	rrs := []string{
+		"www.miki. 10 IN CNAME raccoon.miki.",
+		"raccoon.miki. 300 IN A 42.42.42.42",
+		"raccoon.miki. 200 IN A 43.43.43.43",
+	}
+	tests := []struct {
+		name string
+		st   TTLStrategy
+		// wantFresh is how long the answer should be fresh.
+		wantFresh time.Duration
+		// wantTTLs are the TTLs of the served records after 100 seconds.
+		wantTTLs []uint32
+	}{
+		{name: "min", st: TTLMin, wantFresh: 10 * time.Second},
+		{name: "max", st: TTLMax, wantFresh: 300 * time.Second, wantTTLs: []uint32{200, 200, 200}},
+		{name: "type", st: TTLOfType(dns.TypeA), wantFresh: 200 * time.Second, wantTTLs: []uint32{100, 100, 100}},
+		{name: "type not found", st: TTLOfType(dns.TypeAAAA), wantFresh: 10 * time.Second},
+		{name: "split", st: TTLSplit, wantFresh: 300 * time.Second, wantTTLs: []uint32{200, 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, advance := newTestCache(t, tt.st)
+			q, m := testAnswer(t, "www.miki.", rrs...)
+			c.put(q, m)
+
+			advance(100 * time.Second)
+			got, fresh := c.get(q)
+			if wantFresh := tt.wantFresh > 100*time.Second; fresh != wantFresh {
+				t.Fatalf("fresh after 100s: got %v want %v", fresh, wantFresh)
+			}
+			if fresh {
+				if len(got.Answer) != len(tt.wantTTLs) {
+					t.Fatalf("answers after 100s: got %v want %d records", got.Answer, len(tt.wantTTLs))
+				}
+				for i, a := range got.Answer {
+					if a.Header().Ttl != tt.wantTTLs[i] {
+						t.Errorf("TTL of record %d after 100s: got %d want %d", i, a.Header().Ttl, tt.wantTTLs[i])
+					}
+				}
+			}
+
+			advance(tt.wantFresh - 100*time.Second - time.Second)
+			if _, fresh := c.get(q); !fresh {
+				t.Errorf("answer expired before %v", tt.wantFresh)
+			}
+			advance(2 * time.Second)
+			if _, fresh := c.get(q); fresh {
+				t.Errorf("answer still fresh after %v", tt.wantFresh)
+			}
+		})
+	}
+}
+
+func TestTTLBounds(t *testing.T) {
+	rrs := []string{
+		"www.miki. 10 IN CNAME raccoon.miki.",
+		"raccoon.miki. 300 IN A 42.42.42.42",
+	}
+	tests := []struct {
+		name           string
+		st             TTLStrategy
+		minTTL, maxTTL time.Duration
+		// wantFresh is how long the answer should be fresh.
+		wantFresh time.Duration
+	}{
+		{name: "within bounds", st: TTLMin, minTTL: 5 * time.Second, maxTTL: time.Hour, wantFresh: 10 * time.Second},
+		{name: "floor", st: TTLMin, minTTL: 60 * time.Second, maxTTL: time.Hour, wantFresh: 60 * time.Second},
+		{name: "ceiling", st: TTLMax, maxTTL: 120 * time.Second, wantFresh: 120 * time.Second},
+		{name: "overlapping bounds", st: TTLMin, minTTL: time.Hour, maxTTL: 30 * time.Second, wantFresh: 30 * time.Second},
+		{name: "split floor", st: TTLSplit, minTTL: 400 * time.Second, maxTTL: time.Hour, wantFresh: 400 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, advance := newTestCache(t, tt.st)
+			c.minTTL, c.maxTTL = tt.minTTL, tt.maxTTL
+			q, m := testAnswer(t, "www.miki.", rrs...)
+			c.put(q, m)
+
+			got, fresh := c.get(q)
+			if !fresh {
+				t.Fatalf("fresh after put: got false want true")
+			}
+			for _, a := range got.Answer {
+				if ttl := time.Duration(a.Header().Ttl) * time.Second; ttl != clampTTL(ttl, tt.minTTL, tt.maxTTL) {
+					t.Errorf("served TTL of %v: got %v want it clamped", a, ttl)
+				}
+			}
+			advance(tt.wantFresh - time.Second)
+			if _, fresh := c.get(q); !fresh {
+				t.Errorf("answer expired before %v", tt.wantFresh)
+			}
+			advance(2 * time.Second)
+			if _, fresh := c.get(q); fresh {
+				t.Errorf("answer still fresh after %v", tt.wantFresh)
+			}
+		})
+	}
+}
+
+func TestCacheKeyNormalization(t *testing.T) {
+	c, _ := newTestCache(t, TTLMin)
+	q, m := testAnswer(t, "example.com.", "example.com. 300 IN A 42.42.42.42")
+	c.put(q, m)
+	for _, name := range []string{"example.com.", "EXAMPLE.com", "eXaMpLe.CoM."} {
+		q := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		got, ok := c.get(q)
+		if !ok {
+			t.Errorf("get(%q): got miss want hit", name)
+			continue
+		}
+		if got.Question[0].Name != name {
+			t.Errorf("get(%q): got question %q want it to match the query", name, got.Question[0].Name)
+		}
+	}
+	for _, q := range []*dns.Msg{
+		new(dns.Msg).SetQuestion("example.co.", dns.TypeA),
+		new(dns.Msg).SetQuestion("www.example.com.", dns.TypeA),
+		new(dns.Msg).SetQuestion("example.com.", dns.TypeAAAA),
+	} {
+		if got, ok := c.get(q); ok || got != nil {
+			t.Errorf("get(%v): got %v want miss", q.Question[0], got)
+		}
+	}
+}
+
+func TestTruncatedNotCached(t *testing.T) {
+	c, _ := newTestCache(t, TTLMin)
+	q, m := testAnswer(t, "raccoon.miki.", "raccoon.miki. 300 IN A 42.42.42.42")
+	m.Truncated = true
+	c.put(q, m)
+	if got, ok := c.get(q); ok || got != nil {
+		t.Errorf("get after putting a truncated answer: got %v want miss", got)
+	}
+}
+
+func TestCacheDelete(t *testing.T) {
+	c, _ := newTestCache(t, TTLMin)
+	put := func(name string, qtype uint16, ecs string) *dns.Msg {
+		q := new(dns.Msg).SetQuestion(name, qtype)
+		if ecs != "" {
+			q.SetEdns0(dns.DefaultMsgSize, false)
+			q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_SUBNET{
+				Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(ecs).To4(),
+			})
+		}
+		rr, err := dns.NewRR(name + " 300 IN A 42.42.42.42")
+		if err != nil {
+			t.Fatalf("Cannot parse record: %v", err)
+		}
+		m := new(dns.Msg).SetReply(q)
+		m.Answer = []dns.RR{rr}
+		c.put(q, m)
+		return q
+	}
+	deleted := []*dns.Msg{
+		put("example.com.", dns.TypeA, ""),
+		put("example.com.", dns.TypeAAAA, ""),
+		put("Example.COM.", dns.TypeMX, ""),
+		put("example.com.", dns.TypeA, "192.0.2.0"),
+	}
+	kept := []*dns.Msg{
+		put("www.example.com.", dns.TypeA, ""),
+		put("example.co.", dns.TypeA, ""),
+		put("example.com.example.", dns.TypeA, ""),
+	}
+	if got, want := c.delete("EXAMPLE.com"), len(deleted); got != want {
+		t.Errorf("delete: got %d want %d", got, want)
+	}
+	for _, q := range deleted {
+		if got, ok := c.get(q); ok || got != nil {
+			t.Errorf("get(%v) after delete: got %v want miss", q.Question[0], got)
+		}
+	}
+	for _, q := range kept {
+		if _, ok := c.get(q); !ok {
+			t.Errorf("get(%v) after delete: got miss want hit", q.Question[0])
+		}
+	}
+	var nilc *cache
+	if got := nilc.delete("example.com."); got != 0 {
+		t.Errorf("nil cache delete: got %d want 0", got)
+	}
+}
+
+func TestOriginalTTL(t *testing.T) {
+	for name, st := range map[string]TTLStrategy{"min": TTLMin, "split": TTLSplit} {
+		for _, original := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s original %t", name, original), func(t *testing.T) {
+				c, advance := newTestCache(t, st)
+				c.originalTTL = original
+				q, m := testAnswer(t, "raccoon.miki.", "raccoon.miki. 300 IN A 42.42.42.42", "raccoon.miki. 200 IN A 43.43.43.43")
+				c.put(q, m)
+				advance(100 * time.Second)
+				got, fresh := c.get(q)
+				if !fresh {
+					t.Fatalf("fresh after 100s: got false want true")
+				}
+				want := []uint32{200, 100}
+				if original {
+					want = []uint32{300, 200}
+				}
+				if st == TTLMin && !original {
+					want = []uint32{100, 100}
+				}
+				if len(got.Answer) != len(want) {
+					t.Fatalf("answers: got %v want %d records", got.Answer, len(want))
+				}
+				for i, a := range got.Answer {
+					if a.Header().Ttl != want[i] {
+						t.Errorf("TTL of record %d: got %d want %d", i, a.Header().Ttl, want[i])
+					}
+				}
+				// Expiration is not affected.
+				advance(201 * time.Second)
+				if _, fresh := c.get(q); fresh {
+					t.Errorf("answer still fresh after 301s")
+				}
+			})
+		}
+	}
+}
+
+func TestTTLAllSections(t *testing.T) {
+	c, advance := newTestCache(t, TTLMin)
+	q, m := testAnswer(t, "raccoon.miki.", "raccoon.miki. 300 IN A 42.42.42.42")
+	ns, _ := dns.NewRR("miki. 3600 IN NS ns.miki.")
+	glue, _ := dns.NewRR("ns.miki. 3600 IN A 43.43.43.43")
+	m.Ns = []dns.RR{ns}
+	m.Extra = []dns.RR{glue}
+	m.SetEdns0(4096, true)
+	c.put(q, m)
+
+	check := func(got *dns.Msg, want uint32) {
+		t.Helper()
+		for _, rr := range append(append(got.Answer, got.Ns...), got.Extra...) {
+			if opt, ok := rr.(*dns.OPT); ok {
+				if !opt.Do() {
+					t.Errorf("OPT record was modified: %v", opt)
+				}
+				continue
+			}
+			if ttl := rr.Header().Ttl; ttl != want {
+				t.Errorf("TTL of %v: got %d want %d", rr, ttl, want)
+			}
+		}
+		if len(got.Ns) != 1 || len(got.Extra) != 2 {
+			t.Errorf("sections: got %d authority and %d additional records want 1 and 2", len(got.Ns), len(got.Extra))
+		}
+	}
+	var elapsed uint32
+	for _, step := range []uint32{10, 90, 100} {
+		advance(time.Duration(step) * time.Second)
+		elapsed += step
+		got, fresh := c.get(q)
+		if !fresh {
+			t.Fatalf("fresh after %ds: got false want true", elapsed)
+		}
+		check(got, 300-elapsed)
+	}
+	advance(101 * time.Second)
+	got, fresh := c.get(q)
+	if fresh {
+		t.Fatalf("fresh after expiration: got true want false")
+	}
+	check(got, 60)
+}
+
+func TestNegativeCaching(t *testing.T) {
+	soa := func(ttl, minttl int) string {
+		return fmt.Sprintf("miki. %d IN SOA ns.miki. hostmaster.miki. 1 7200 3600 1209600 %d", ttl, minttl)
+	}
+	tests := []struct {
+		name     string
+		disabled bool
+		rcode    int
+		ns       []string
+		// wantFresh is how long the answer should be fresh, 0 if it should not be cached.
+		wantFresh time.Duration
+	}{
+		{name: "nxdomain", rcode: dns.RcodeNameError, ns: []string{soa(3600, 300)}, wantFresh: 300 * time.Second},
+		{name: "nodata", rcode: dns.RcodeSuccess, ns: []string{soa(3600, 300)}, wantFresh: 300 * time.Second},
+		{name: "soa ttl", rcode: dns.RcodeNameError, ns: []string{soa(60, 300)}, wantFresh: 60 * time.Second},
+		{name: "capped", rcode: dns.RcodeNameError, ns: []string{soa(1<<30, 1<<30)}, wantFresh: defaultMaxTTL},
+		{name: "no soa", rcode: dns.RcodeNameError, ns: []string{"miki. 3600 IN NS ns.miki."}},
+		{name: "servfail", rcode: dns.RcodeServerFailure, ns: []string{soa(3600, 300)}},
+		{name: "disabled", disabled: true, rcode: dns.RcodeNameError, ns: []string{soa(3600, 300)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, advance := newTestCache(t, TTLMin)
+			c.negative = !tt.disabled
+			q, m := testAnswer(t, "raccoon.miki.")
+			m.Rcode = tt.rcode
+			for _, r := range tt.ns {
+				rr, err := dns.NewRR(r)
+				if err != nil {
+					t.Fatalf("Cannot parse %q: %v", r, err)
+				}
+				m.Ns = append(m.Ns, rr)
+			}
+			c.put(q, m)
+			if tt.wantFresh == 0 {
+				if c.c.Len() != 0 {
+					t.Errorf("response was cached")
+				}
+				return
+			}
+			advance(tt.wantFresh / 2)
+			got, fresh := c.get(q)
+			if !fresh {
+				t.Fatalf("fresh after %v: got false want true", tt.wantFresh/2)
+			}
+			if got.Rcode != tt.rcode {
+				t.Errorf("rcode: got %s want %s", dns.RcodeToString[got.Rcode], dns.RcodeToString[tt.rcode])
+			}
+			if want := uint32((tt.wantFresh - tt.wantFresh/2).Seconds()); len(got.Ns) != 1 || got.Ns[0].Header().Ttl != want {
+				t.Errorf("authority: got %v want SOA with TTL %d", got.Ns, want)
+			}
+			advance(tt.wantFresh/2 + time.Second)
+			if _, fresh := c.get(q); fresh {
+				t.Errorf("answer still fresh after %v", tt.wantFresh+time.Second)
+			}
+		})
+	}
+}
+
+func TestMaxStale(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxStale time.Duration
+		after    time.Duration
+		wantMsg  bool
+	}{
+		{name: "unbounded", after: 24 * time.Hour, wantMsg: true},
+		{name: "within window", maxStale: time.Hour, after: 100*time.Second + 30*time.Minute, wantMsg: true},
+		{name: "beyond window", maxStale: time.Hour, after: 100*time.Second + 2*time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, advance := newTestCache(t, TTLMin)
+			c.maxStale = tt.maxStale
+			q, m := testAnswer(t, "raccoon.miki.", "raccoon.miki. 100 IN A 42.42.42.42")
+			c.put(q, m)
+			advance(tt.after)
+			got, fresh := c.get(q)
+			if fresh {
+				t.Fatalf("fresh after %v: got true want false", tt.after)
+			}
+			if (got != nil) != tt.wantMsg {
+				t.Errorf("stale answer: got %v want %t", got, tt.wantMsg)
+			}
+			var wantServed, wantExpired uint64 = 1, 0
+			if !tt.wantMsg {
+				wantServed, wantExpired = 0, 1
+			}
+			if c.staleServed != wantServed || c.staleExpired != wantExpired {
+				t.Errorf("metrics: got %d served and %d expired want %d and %d", c.staleServed, c.staleExpired, wantServed, wantExpired)
+			}
+		})
+	}
+}
+
+func TestPutServfail(t *testing.T) {
+	c, advance := newTestCache(t, TTLMin)
+	c.maxStale = time.Hour
+	c.servfailTTL = time.Minute
+	q, m := testAnswer(t, "raccoon.miki.", "raccoon.miki. 100 IN A 42.42.42.42")
+	servfail := new(dns.Msg).SetRcode(q, dns.RcodeServerFailure)
+
+	// An answer too stale to be served is not replaced.
+	c.put(q, m)
+	advance(2 * time.Hour)
+	if got, _ := c.get(q); got != nil {
+		t.Fatalf("stale answer: got %v want nil", got)
+	}
+	c.putServfail(q, servfail)
+	v, ok := c.c.Get(key(q))
+	if !ok || v.(cacheValue).rcode != dns.RcodeSuccess {
+		t.Errorf("after putServfail over stale answer: got %v, %t want the stored answer", v, ok)
+	}
+
+	// A missing answer is replaced.
+	other, _ := testAnswer(t, "other.miki.")
+	c.putServfail(other, new(dns.Msg).SetRcode(other, dns.RcodeServerFailure))
+	if got, fresh := c.get(other); !fresh || got.Rcode != dns.RcodeServerFailure {
+		t.Errorf("after putServfail: got %v, %t want fresh SERVFAIL", got, fresh)
+	}
+}
+
+func TestCacheStoresWireFormat(t *testing.T) {
+	c, _ := newTestCache(t, TTLMin)
+	q, m := testAnswer(t, "www.miki.",
+		"www.miki. 300 IN CNAME raccoon.miki.",
+		"raccoon.miki. 300 IN A 42.42.42.42",
+		"raccoon.miki. 300 IN A 43.43.43.43",
+	)
+	c.put(q, m)
+	// Changes to the stored message or to a served one must not reach the cache.
+	m.Answer[1].(*dns.A).A = net.IPv4(1, 2, 3, 4)
+	got, ok := c.get(q)
+	if !ok {
+		t.Fatalf("get: got a miss want a hit")
+	}
+	got.Answer[2].(*dns.A).A = net.IPv4(1, 2, 3, 4)
+	got, _ = c.get(q)
+	for i, want := range []string{"42.42.42.42", "43.43.43.43"} {
+		if a := got.Answer[i+1].(*dns.A).A.String(); a != want {
+			t.Errorf("address %d: got %s want %s", i, a, want)
+		}
+	}
+	v, _ := c.c.Get(key(q))
+	if cv := v.(cacheValue); cv.question != q.Question[0] || cv.rcode != dns.RcodeSuccess {
+		t.Errorf("cached question and rcode: got %v and %d want %v and %d", cv.question, cv.rcode, q.Question[0], dns.RcodeSuccess)
+	}
+	if got, uncompressed := len(v.(cacheValue).msg), m.Len(); got >= uncompressed {
+		t.Errorf("cached message size: got %d bytes want less than %d, the uncompressed size", got, uncompressed)
+	}
+}
+
+func BenchmarkCache(b *testing.B) {
+	q := new(dns.Msg).SetQuestion("www.miki.", dns.TypeA)
+	m := new(dns.Msg).SetReply(q)
+	for _, r := range []string{
+		"www.miki. 300 IN CNAME raccoon.miki.",
+		"raccoon.miki. 300 IN A 42.42.42.42",
+		"raccoon.miki. 300 IN A 43.43.43.43",
+		"raccoon.miki. 300 IN A 44.44.44.44",
+	} {
+		rr, err := dns.NewRR(r)
+		if err != nil {
+			b.Fatalf("Cannot parse %q: %v", r, err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	c, err := newCache(100, 1, false, false)
+	if err != nil {
+		b.Fatalf("Cannot construct cache: %v", err)
+	}
+	b.Run("get", func(b *testing.B) {
+		c.put(q, m)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, ok := c.get(q); !ok {
+				b.Fatal("Unexpected miss")
+			}
+		}
+	})
+	b.Run("put", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			c.put(q, m)
+		}
+	})
+}
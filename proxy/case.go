@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"errors"
+
+	"github.com/miekg/dns"
+)
+
+// caseSuffix enables the randomization of the case of query names sent to an upstream, also known as
+// DNS 0x20 encoding, when appended to its spec, e.g. "dns.google:853@8.8.8.8#0x20".
+// Off-path attackers have to guess the case of every letter of the name on top of the query ID to spoof
+// a response. It is opt-in as some servers do not preserve the case of names in responses.
+const caseSuffix = "#0x20"
+
+// errCaseMismatch is returned when the response of an upstream does not preserve the randomized case of
+// the query name.
+var errCaseMismatch = errors.New("upstream response question does not match the case of the query")
+
+// randomCase returns name with the case of each letter flipped at random.
+func randomCase(name string) string {
+	b := []byte(name)
+	bits := make([]byte, (len(b)+7)/8)
+	if _, err := rand.Read(bits); err != nil {
+		return name
+	}
+	for i, c := range b {
+		if bits[i/8]&(1<<uint(i%8)) == 0 {
+			continue
+		}
+		switch {
+		case 'a' <= c && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case 'A' <= c && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b)
+}
+
+// withRandomCase returns a copy of q with the case of the query name randomized.
+func withRandomCase(q *dns.Msg) *dns.Msg {
+	rq := q.Copy()
+	rq.Question[0].Name = randomCase(rq.Question[0].Name)
+	return rq
+}
+
+// restoreCase checks that resp, the response to the randomized query rq, preserved its case and
+// replaces the randomized name with the original one, so that clients and the cache never see it.
+func restoreCase(rq, resp *dns.Msg, name string) error {
+	if len(resp.Question) == 0 || resp.Question[0].Name != rq.Question[0].Name {
+		return errCaseMismatch
+	}
+	resp.Question[0].Name = name
+	for _, sec := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range sec {
+			if h := rr.Header(); h.Name == rq.Question[0].Name {
+				h.Name = name
+			}
+		}
+	}
+	return nil
+}
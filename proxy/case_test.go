@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCaseRandomization(t *testing.T) {
+	const name = "abcdefghijklmnopqrstuvwxyz.abcdefghijklmnopqrstuvwxyz.miki."
+	tests := []struct {
+		name      string
+		spec      string
+		lowercase bool
+		wantErr   bool
+	}{
+		{name: "disabled", spec: "fake://echo"},
+		{name: "enabled", spec: "fake://echo#0x20"},
+		{name: "case not preserved", spec: "fake://echo#0x20", lowercase: true, wantErr: true},
+		{name: "disabled case not preserved", spec: "fake://echo", lowercase: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent string
+			s := NewServerWithOptions(
+				WithCacheSize(-1),
+				WithUpstreams(tt.spec),
+				WithUpstreamTransport("fake", func(spec string) (UpstreamTransport, error) {
+					if spec != "fake://echo" {
+						t.Errorf("transport spec: got %q want fake://echo", spec)
+					}
+					return funcTransport(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+						sent = q.Question[0].Name
+						m := new(dns.Msg).SetReply(q)
+						if tt.lowercase {
+							m.Question[0].Name = strings.ToLower(m.Question[0].Name)
+						}
+						rr, err := dns.NewRR(m.Question[0].Name + " 300 IN A 42.42.42.42")
+						if err != nil {
+							return nil, err
+						}
+						m.Answer = []dns.RR{rr}
+						return m, nil
+					}), nil
+				}),
+			)
+			if len(s.upstreams) != 1 {
+				t.Fatalf("upstreams: got %d want 1", len(s.upstreams))
+			}
+			m, err := s.exchangeMessages(context.Background(), s.upstreams[0], new(dns.Msg).SetQuestion(name, dns.TypeA))
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("exchange: got %v want error %v", err, tt.wantErr)
+			}
+			if randomized := sent != name; randomized != s.upstreams[0].randomCase {
+				t.Errorf("sent name: got %q, randomized %v want %v", sent, randomized, s.upstreams[0].randomCase)
+			}
+			if !strings.EqualFold(sent, name) {
+				t.Errorf("sent name: got %q want a case variant of %q", sent, name)
+			}
+			if err != nil {
+				return
+			}
+			if got := m.Question[0].Name; got != name {
+				t.Errorf("question: got %q want %q", got, name)
+			}
+			if got := m.Answer[0].Header().Name; !tt.lowercase && got != name {
+				t.Errorf("answer owner: got %q want %q", got, name)
+			}
+		})
+	}
+}
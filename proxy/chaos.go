@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+var errChaos = errors.New("chaos: injected upstream failure")
+
+// WithChaos injects faults into every upstream exchange: each exchange is delayed by extraLatency
+// and then fails with probability failureRate, without reaching the upstream.
+//
+// This is a testing feature meant to validate timeouts, retries and stale answers under adverse
+// conditions. Never use it in production.
+func WithChaos(failureRate float64, extraLatency time.Duration) Option {
+	return func(o *options) {
+		o.chaosFailureRate = failureRate
+		o.chaosLatency = extraLatency
+	}
+}
+
+func (o *options) chaosEnabled() bool { return o.chaosFailureRate > 0 || o.chaosLatency > 0 }
+
+// exchange exchanges q with u, injecting faults if chaos is enabled.
+func (s *Server) exchange(ctx context.Context, u *upstream, q *dns.Msg) (*dns.Msg, error) {
+	if !s.opts.chaosEnabled() {
+		return s.exchangeMessages(ctx, u, q)
+	}
+	if d := s.opts.chaosLatency; d > 0 {
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+	}
+	if rand.Float64() < s.opts.chaosFailureRate {
+		log.Debugf("[CHAOS] Failing exchange for %q", q.Question[0].Name)
+		return nil, errChaos
+	}
+	return s.exchangeMessages(ctx, u, q)
+}
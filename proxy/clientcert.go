@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// clientCertPrefix introduces, in a DNS over TLS upstream spec, the path of a PEM file holding both the
+// client certificate chain and the private key presented to that upstream, e.g.
+// "dns.corp:853@10.0.0.53#cert=/etc/dot/client.pem". It takes precedence over WithClientCertificate.
+const clientCertPrefix = "#cert="
+
+// WithClientCertificate makes the server authenticate to the upstreams that request it, e.g. private DNS
+// over TLS or DNS over HTTPS endpoints, with the certificate chain and private key in the given PEM files.
+// The server cannot be constructed if they cannot be loaded. Use the clientCertPrefix suffix to set the
+// certificate of a single upstream instead.
+func WithClientCertificate(certFile, keyFile string) Option {
+	return func(o *options) { o.clientCertFile, o.clientKeyFile = certFile, keyFile }
+}
+
+// loadClientCert loads the certificate set with WithClientCertificate, if any.
+func loadClientCert(certFile, keyFile string) (*tls.Certificate, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	c, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load the client certificate: %w", err)
+	}
+	return &c, nil
+}
+
+// cutClientCert splits the clientCertPrefix suffix off spec and loads the certificate it points to.
+func cutClientCert(spec string) (rest string, cert *tls.Certificate, err error) {
+	rest, path, ok := cutSpecValue(spec, clientCertPrefix)
+	if !ok {
+		return spec, nil, nil
+	}
+	// The certificate and the key are read from the same file, tls.X509KeyPair skips the blocks of the other kind.
+	cert, err = loadClientCert(path, path)
+	if err != nil {
+		return "", nil, err
+	}
+	return rest, cert, nil
+}
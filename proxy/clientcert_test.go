@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// writeCertPEM writes the chain of cert to certFile and its key to keyFile, which can be the same file.
+func writeCertPEM(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("Cannot marshal key: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if certFile == keyFile {
+		certPEM, keyPEM = append(certPEM, keyPEM...), nil
+	}
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("Cannot write certificate: %v", err)
+	}
+	if keyPEM != nil {
+		if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			t.Fatalf("Cannot write key: %v", err)
+		}
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clientcert")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	var (
+		certFile = filepath.Join(dir, "client.crt")
+		keyFile  = filepath.Join(dir, "client.key")
+		bothFile = filepath.Join(dir, "client.pem")
+		missing  = filepath.Join(dir, "missing.pem")
+	)
+	client := newTestCert(t, time.Now().Add(time.Hour))
+	writeCertPEM(t, client, certFile, keyFile)
+	writeCertPEM(t, client, bothFile, bothFile)
+
+	serverCert := newTestCert(t, time.Now().Add(time.Hour))
+	addr, cleanup := startTLSUpstream(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	defer cleanup()
+	sum := sha256.Sum256(serverCert.Leaf.RawSubjectPublicKeyInfo)
+	pin := pinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name string
+		// spec is appended to the address of the upstream.
+		spec        string
+		opts        []Option
+		wantNewErr  bool
+		wantExchErr bool
+	}{
+		{name: "no certificate", wantExchErr: true},
+		{name: "global", opts: []Option{WithClientCertificate(certFile, keyFile)}},
+		{name: "per upstream", spec: clientCertPrefix + bothFile},
+		{name: "per upstream with pin", spec: clientCertPrefix + bothFile + pin},
+		{name: "missing global", opts: []Option{WithClientCertificate(missing, missing)}, wantNewErr: true},
+		{name: "missing per upstream", spec: clientCertPrefix + missing, wantNewErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewServerE(append([]Option{WithUpstreams(addr + tt.spec)}, tt.opts...)...)
+			if (err != nil) != tt.wantNewErr {
+				t.Fatalf("NewServerE: got %v want error %t", err, tt.wantNewErr)
+			}
+			if tt.wantNewErr {
+				return
+			}
+			s.dial = trustingDialer(serverCert)
+			defer s.upstreams[0].t.Close()
+			q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+			if _, err := s.exchangeMessages(context.Background(), s.upstreams[0], q); (err != nil) != tt.wantExchErr {
+				t.Errorf("exchange: got %v want error %t", err, tt.wantExchErr)
+			}
+		})
+	}
+}
@@ -1,26 +1,97 @@
 package proxy
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"math/rand"
+	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// certExpiryWarning is how long before expiration an upstream certificate is reported as about to expire.
+const certExpiryWarning = 7 * 24 * time.Hour
+
+// dialBackoffMin and dialBackoffMax bound the exponential backoff applied after failed dials.
+const (
+	dialBackoffMin = 100 * time.Millisecond
+	dialBackoffMax = 30 * time.Second
 )
 
 type connector func() (*dns.Conn, error)
 
+// pool is the built-in DNS over TLS UpstreamTransport. It keeps a set of connections to the upstream
+// open for reuse.
 type pool struct {
-	c connector
+	addr string
+	c    connector
+	// retry, if set, is used instead of c to retry truncated responses.
+	retry connector
+	// tcRetries counts the truncated responses that were retried, accessed atomically.
+	tcRetries uint64
+	// dials counts the connector calls, resumptions the TLS sessions resumed by them, reuses the connections
+	// taken from buf and inUse the connections exchanging messages, all accessed atomically. See PoolStats.
+	dials, resumptions, reuses uint64
+	inUse                      int64
+
+	// idleTimeout, if > 0, is how long a connection can sit in buf before it is closed instead of reused.
+	idleTimeout time.Duration
+	// maxLifetime, if > 0, is how long after it was first put in buf a connection is closed instead of
+	// being put back. born holds when the connections were first put in buf.
+	maxLifetime time.Duration
+	bornMu      sync.Mutex
+	born        map[*dns.Conn]time.Time
 
 	mu     sync.RWMutex
 	closed bool
-	buf    chan *dns.Conn
+	buf    chan idleConn
+
+	tlsMu sync.Mutex
+	tls   *TLSInfo
+
+	// backoffMu guards dialFailures, the count of consecutive failed dials, and retryAt, before which no
+	// dial is attempted.
+	backoffMu    sync.Mutex
+	dialFailures uint
+	retryAt      time.Time
+
+	// depth is the maximum amount of queries in flight on the pipelined connection,
+	// 0 disables pipelining.
+	depth int
+	plMu  sync.Mutex
+	pl    *pipeline
+}
+
+// TLSInfo describes the TLS session negotiated with an upstream.
+type TLSInfo struct {
+	Version     string
+	CipherSuite string
+	ALPN        string
+	// Fingerprint is the hex encoded SHA-256 of the leaf certificate.
+	Fingerprint string
+	NotAfter    time.Time
+}
+
+// idleConn is a connection waiting in the pool to be reused.
+type idleConn struct {
+	c *dns.Conn
+	// since is when the connection was put back in the pool.
+	since time.Time
 }
 
-func newPool(size int, c connector) *pool {
+func newPool(addr string, size int, c connector) *pool {
 	return &pool{
-		buf: make(chan *dns.Conn, size),
-		c:   c,
+		addr: addr,
+		buf:  make(chan idleConn, size),
+		c:    c,
 	}
 }
 
@@ -28,15 +99,180 @@ func (p *pool) get() (*dns.Conn, error) {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 	if p.closed {
-		return nil, errors.New("pool is shut down")
+		return nil, errPoolShutDown
 	}
 
-	select {
-	case c := <-p.buf:
-		return c, nil
-	default:
-		return p.c()
+	for {
+		select {
+		case ic := <-p.buf:
+			if p.idleTimeout > 0 && time.Since(ic.since) > p.idleTimeout {
+				// Upstreams close idle connections on their side, the first write on this one would likely fail.
+				log.Debugf("Closing connection to %s idle for more than %v", p.addr, p.idleTimeout)
+				p.discard(ic.c)
+				continue
+			}
+			atomic.AddUint64(&p.reuses, 1)
+			return ic.c, nil
+		default:
+			return p.dial()
+		}
+	}
+}
+
+// dial creates a new connection to the upstream, bypassing the pooled ones.
+// After a failed dial it fails fast until the backoff elapses, so that queries do not all wait for the
+// dial timeout of an unreachable upstream and can be forwarded to other ones.
+func (p *pool) dial() (*dns.Conn, error) {
+	p.backoffMu.Lock()
+	backoff := time.Now().Before(p.retryAt)
+	p.backoffMu.Unlock()
+	if backoff {
+		return nil, errDialBackoff
+	}
+	atomic.AddUint64(&p.dials, 1)
+	c, err := p.c()
+	p.dialed(err)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.Conn.(*tls.Conn); ok {
+		cs := tc.ConnectionState()
+		if cs.DidResume {
+			atomic.AddUint64(&p.resumptions, 1)
+		}
+		p.recordTLS(cs)
+	}
+	return c, nil
+}
+
+// dialed updates the backoff with the result of a dial. The backoff doubles with every consecutive
+// failure, with jitter so that pools do not retry in lockstep, and is reset by a successful dial.
+func (p *pool) dialed(err error) {
+	p.backoffMu.Lock()
+	defer p.backoffMu.Unlock()
+	if err == nil {
+		p.dialFailures, p.retryAt = 0, time.Time{}
+		return
+	}
+	d := dialBackoffMax
+	if p.dialFailures < 16 {
+		if b := dialBackoffMin << p.dialFailures; b < d {
+			d = b
+		}
+	}
+	p.dialFailures++
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	p.retryAt = time.Now().Add(d)
+	log.Debugf("Dialing %s failed %d times in a row, backing off for %v", p.addr, p.dialFailures, d)
+}
+
+func (p *pool) recordTLS(cs tls.ConnectionState) {
+	ti := &TLSInfo{
+		Version:     tlsVersionName(cs.Version),
+		CipherSuite: cipherSuiteName(cs.CipherSuite),
+		ALPN:        cs.NegotiatedProtocol,
+	}
+	if len(cs.PeerCertificates) > 0 {
+		leaf := cs.PeerCertificates[0]
+		sum := sha256.Sum256(leaf.Raw)
+		ti.Fingerprint = hex.EncodeToString(sum[:])
+		ti.NotAfter = leaf.NotAfter
+	}
+
+	p.tlsMu.Lock()
+	changed := p.tls == nil || *p.tls != *ti
+	p.tls = ti
+	p.tlsMu.Unlock()
+	if !changed {
+		return
+	}
+	log.Debugf("TLS session with %s: %s, %s, ALPN %q, certificate %s expiring on %v",
+		p.addr, ti.Version, ti.CipherSuite, ti.ALPN, ti.Fingerprint, ti.NotAfter)
+	if !ti.NotAfter.IsZero() && time.Until(ti.NotAfter) < certExpiryWarning {
+		log.Warnf("Certificate %s of upstream %s expires on %v", ti.Fingerprint, p.addr, ti.NotAfter)
+	}
+}
+
+// PoolStats describes how the connections to an upstream are used, to tune WithConnectionsPerUpstream.
+type PoolStats struct {
+	// Idle is the amount of connections waiting to be reused, InUse the amount of connections exchanging
+	// messages. Pipelined connections are not counted.
+	Idle, InUse int
+	// Dials counts the attempts to establish a new connection, Reuses the exchanges that used an idle one.
+	Dials, Reuses uint64
+	// Resumptions counts the new connections that resumed a previous TLS session.
+	Resumptions uint64
+}
+
+func (p *pool) stats() *PoolStats {
+	return &PoolStats{
+		Idle:   len(p.buf),
+		InUse:  int(atomic.LoadInt64(&p.inUse)),
+		Dials:  atomic.LoadUint64(&p.dials),
+		Reuses: atomic.LoadUint64(&p.reuses),
+
+		Resumptions: atomic.LoadUint64(&p.resumptions),
+	}
+}
+
+// tlsInfo returns the details of the last TLS session established with the upstream, if any.
+func (p *pool) tlsInfo() *TLSInfo {
+	p.tlsMu.Lock()
+	defer p.tlsMu.Unlock()
+	return p.tls
+}
+
+func tlsVersionName(v uint16) string {
+	switch v {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return "unknown"
+}
+
+// cipherSuiteNames maps the cipher suites supported by crypto/tls to their standard names.
+// It replaces tls.CipherSuiteName, which is not available before Go 1.14.
+var cipherSuiteNames = map[uint16]string{
+	tls.TLS_RSA_WITH_RC4_128_SHA:                "TLS_RSA_WITH_RC4_128_SHA",
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA:           "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA:            "TLS_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA:            "TLS_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256:         "TLS_RSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256:         "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384:         "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA:        "TLS_ECDHE_ECDSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA:    "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA:          "TLS_ECDHE_RSA_WITH_RC4_128_SHA",
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA:     "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA:      "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:   "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:   "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305:    "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305:  "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	tls.TLS_AES_128_GCM_SHA256:                  "TLS_AES_128_GCM_SHA256",
+	tls.TLS_AES_256_GCM_SHA384:                  "TLS_AES_256_GCM_SHA384",
+	tls.TLS_CHACHA20_POLY1305_SHA256:            "TLS_CHACHA20_POLY1305_SHA256",
+}
+
+// cipherSuiteName returns the standard name of the cipher suite id, or its hexadecimal value if it is
+// unknown.
+func cipherSuiteName(id uint16) string {
+	if name, ok := cipherSuiteNames[id]; ok {
+		return name
 	}
+	return fmt.Sprintf("0x%04X", id)
 }
 
 func (p *pool) put(c *dns.Conn) {
@@ -45,21 +281,206 @@ func (p *pool) put(c *dns.Conn) {
 	if p.closed {
 		return
 	}
+	if p.expired(c) {
+		log.Debugf("Closing connection to %s older than %v", p.addr, p.maxLifetime)
+		p.discard(c)
+		return
+	}
 
 	select {
-	case p.buf <- c:
+	case p.buf <- idleConn{c: c, since: time.Now()}:
 	default:
-		c.Close()
+		p.discard(c)
+	}
+}
+
+// expired tells whether c has reached the maximum lifetime, and starts tracking its age otherwise.
+func (p *pool) expired(c *dns.Conn) bool {
+	if p.maxLifetime <= 0 {
+		return false
+	}
+	now := time.Now()
+	p.bornMu.Lock()
+	defer p.bornMu.Unlock()
+	born, ok := p.born[c]
+	if !ok {
+		if p.born == nil {
+			p.born = make(map[*dns.Conn]time.Time)
+		}
+		p.born[c] = now
+		return false
+	}
+	return now.Sub(born) >= p.maxLifetime
+}
+
+// discard closes c and stops tracking its age.
+func (p *pool) discard(c *dns.Conn) {
+	if p.maxLifetime > 0 {
+		p.bornMu.Lock()
+		delete(p.born, c)
+		p.bornMu.Unlock()
 	}
+	c.Close()
 }
 
-func (p *pool) shutdown() {
+// Close implements UpstreamTransport.
+func (p *pool) Close() {
+	p.plMu.Lock()
+	if p.pl != nil {
+		p.pl.fail(errPoolShutDown)
+	}
+	p.plMu.Unlock()
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 	p.closed = true
 
 	close(p.buf)
-	for c := range p.buf {
-		c.Close()
+	for ic := range p.buf {
+		p.discard(ic.c)
+	}
+}
+
+var (
+	errPoolShutDown = errors.New("pool is shut down")
+	errNilResponse  = errors.New("nil response from upstream")
+	errTruncated    = errors.New("truncated response from upstream")
+	errDialBackoff  = errors.New("upstream unreachable, backing off")
+)
+
+// Exchange implements UpstreamTransport. It either returns a valid response, which might have
+// no answers, or an error.
+func (p *pool) Exchange(ctx context.Context, q *dns.Msg) (resp *dns.Msg, err error) {
+	if p.depth > 0 {
+		resp, err = p.exchangePipelined(ctx, q)
+	} else {
+		resp, err = p.exchangeOnce(ctx, p.get, q)
+	}
+	if err == nil && resp.Truncated {
+		resp, err = p.retryTruncated(ctx, q)
+	}
+	return resp, err
+}
+
+// exchangePipelined sends q over the pipelined connection, dialing a new one if needed.
+func (p *pool) exchangePipelined(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	p.plMu.Lock()
+	if p.pl == nil || p.pl.broken() {
+		p.mu.RLock()
+		closed := p.closed
+		p.mu.RUnlock()
+		if closed {
+			p.plMu.Unlock()
+			return nil, errPoolShutDown
+		}
+		c, err := p.dial()
+		if err != nil {
+			p.plMu.Unlock()
+			return nil, err
+		}
+		p.pl = newPipeline(c, p.depth)
+	}
+	pl := p.pl
+	p.plMu.Unlock()
+	return pl.exchange(ctx, q)
+}
+
+// retryTruncated is called when the upstream could not fit the answer in its response.
+// This should not happen over TLS, but misbehaving servers or UDP hops in front of them might do it
+// anyway: ask once more over a brand new TCP connection and never hand out a partial answer.
+func (p *pool) retryTruncated(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	log.Debugf("Truncated response for %q, retrying over a new connection", q.Question[0].Name)
+	atomic.AddUint64(&p.tcRetries, 1)
+	dial := p.dial
+	if p.retry != nil {
+		dial = p.retry
+	}
+	resp, err := p.exchangeOnce(ctx, dial, q)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated {
+		log.Debugf("Response for %q is still truncated after retry", q.Question[0].Name)
+		return nil, errTruncated
+	}
+	return resp, nil
+}
+
+// exchangeOnce sends q over a connection obtained with get and reads the response.
+// On success the connection is returned to the pool for reuse.
+func (p *pool) exchangeOnce(ctx context.Context, get connector, q *dns.Msg) (resp *dns.Msg, err error) {
+	c, err := get()
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&p.inUse, 1)
+	defer atomic.AddInt64(&p.inUse, -1)
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(connectionTimeout)
+	}
+	_ = c.SetDeadline(deadline)
+	defer func() {
+		if err != nil {
+			p.discard(c)
+			return
+		}
+		p.put(c)
+	}()
+	if err := writeMsg(c, q); err != nil {
+		log.Debugf("Send question message failed: %v", err)
+		return nil, err
+	}
+	resp, err = c.ReadMsg()
+	if err != nil {
+		log.Debugf("Error while reading message: %v", err)
+		return nil, err
+	}
+	if resp == nil {
+		log.Debug("Response message returned nil. Please check your query or DNS configuration")
+		return nil, errNilResponse
+	}
+	if resp.Id != q.Id {
+		// A late response to a previous query, the connection is out of sync and is not reused.
+		return nil, errIDMismatch
+	}
+	return resp, err
+}
+
+// wireBufs holds the buffers queries are packed into by writeMsg. Buffers for responses are not pooled,
+// as unpacked messages can keep references to them.
+var wireBufs = sync.Pool{New: func() interface{} {
+	buf := make([]byte, 0, 2+dns.MinMsgSize)
+	return &buf
+}}
+
+// writeMsg writes m to c as c.WriteMsg does, packing it in a pooled buffer to spare the allocations.
+func writeMsg(c *dns.Conn, m *dns.Msg) error {
+	if m.IsTsig() != nil {
+		return c.WriteMsg(m)
+	}
+	bp := wireBufs.Get().(*[]byte)
+	defer wireBufs.Put(bp)
+	// Streams need the length of the message before it, leave room for it.
+	buf := (*bp)[:cap(*bp)]
+	p, err := m.PackBuffer(buf[2:])
+	if err != nil {
+		return err
+	}
+	if len(p) > dns.MaxMsgSize {
+		return errors.New("message too large")
+	}
+	if &p[0] != &buf[2] {
+		// PackBuffer needed a larger buffer, keep one for the next messages.
+		buf = append(make([]byte, 2, 2+len(p)), p...)
+		*bp = buf[:0]
+	}
+	buf = buf[:2+len(p)]
+	if _, ok := c.Conn.(net.PacketConn); ok {
+		_, err = c.Conn.Write(buf[2:])
+		return err
 	}
+	buf[0], buf[1] = byte(len(p)>>8), byte(len(p))
+	_, err = c.Conn.Write(buf)
+	return err
 }
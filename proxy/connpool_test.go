@@ -0,0 +1,630 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// newTestCert creates a self-signed certificate valid for 127.0.0.1 until notAfter.
+func newTestCert(tb testing.TB, notAfter time.Time) tls.Certificate {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatalf("Cannot generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "gopher.empijei"},
+		DNSNames:              []string{"gopher.empijei"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		tb.Fatalf("Cannot create certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatalf("Cannot parse certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// startTLSUpstream starts a DNS-over-TLS server on a random local port that answers every question
+// with an A record and returns its address.
+func startTLSUpstream(tb testing.TB, cfg *tls.Config) (addr string, cleanup func()) {
+	tb.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		tb.Fatalf("Cannot listen: %v", err)
+	}
+	srv := &dns.Server{
+		Listener: l,
+		Handler: fakeServer(func(w dns.ResponseWriter, q *dns.Msg) {
+			m := new(dns.Msg).SetReply(q)
+			rr, _ := dns.NewRR(q.Question[0].Name + " 2311 IN A 42.42.42.42")
+			m.Answer = []dns.RR{rr}
+			_ = w.WriteMsg(m)
+		}),
+	}
+	go func() { _ = srv.ActivateAndServe() }()
+	return l.Addr().String(), func() { _ = srv.Shutdown() }
+}
+
+// trustingDialer returns a dialer that trusts the given certificate on top of the configuration built by
+// the connector.
+func trustingDialer(cert tls.Certificate) func(addr string, cfg *tls.Config) (net.Conn, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	return func(addr string, cfg *tls.Config) (net.Conn, error) {
+		cfg = cfg.Clone()
+		cfg.RootCAs = roots
+		return tls.Dial("tcp", addr, cfg)
+	}
+}
+
+func TestPoolTLSInfo(t *testing.T) {
+	notAfter := time.Now().Add(72 * time.Hour).Truncate(time.Second).UTC()
+	cert := newTestCert(t, notAfter)
+	addr, cleanup := startTLSUpstream(t, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+	})
+	defer cleanup()
+
+	s := NewServerWithOptions(WithUpstreams(addr))
+	s.dial = trustingDialer(cert)
+	p := s.upstreams[0].t.(*pool)
+	if got := p.tlsInfo(); got != nil {
+		t.Errorf("TLS info before dialing: got %+v want nil", got)
+	}
+	var q dns.Msg
+	q.SetQuestion(testQuestion, dns.TypeA)
+	if _, err := s.exchangeMessages(context.Background(), s.upstreams[0], &q); err != nil {
+		t.Fatalf("Cannot exchange messages: %v", err)
+	}
+
+	got := p.tlsInfo()
+	if got == nil {
+		t.Fatalf("TLS info after dialing: got nil")
+	}
+	sum := sha256.Sum256(cert.Leaf.Raw)
+	want := TLSInfo{
+		Version:     "TLS 1.3",
+		CipherSuite: got.CipherSuite,
+		Fingerprint: hex.EncodeToString(sum[:]),
+		NotAfter:    notAfter,
+	}
+	if got.CipherSuite == "" {
+		t.Errorf("cipher suite: got empty string")
+	}
+	if !got.NotAfter.Equal(want.NotAfter) {
+		t.Errorf("NotAfter: got %v want %v", got.NotAfter, want.NotAfter)
+	}
+	got.NotAfter = want.NotAfter
+	if *got != want {
+		t.Errorf("TLS info: got %+v want %+v", *got, want)
+	}
+	if us := s.upstreamStats(); len(us) != 1 || us[0].Address != addr || us[0].TLS == nil {
+		t.Errorf("upstream stats: got %+v", us)
+	}
+}
+
+func TestTLSSessionResumption(t *testing.T) {
+	cert := newTestCert(t, time.Now().Add(time.Hour))
+	for _, v := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		t.Run(tlsVersionName(v), func(t *testing.T) {
+			addr, cleanup := startTLSUpstream(t, &tls.Config{
+				Certificates: []tls.Certificate{cert},
+				MinVersion:   v,
+				MaxVersion:   v,
+			})
+			defer cleanup()
+			s := NewServerWithOptions(WithUpstreams(addr))
+			s.dial = trustingDialer(cert)
+			defer s.upstreams[0].t.Close()
+			p := s.upstreams[0].t.(*pool)
+			var q dns.Msg
+			q.SetQuestion(testQuestion, dns.TypeA)
+			// TLS 1.3 session tickets are received after the handshake, together with the response.
+			if _, err := s.exchangeMessages(context.Background(), s.upstreams[0], &q); err != nil {
+				t.Fatalf("Cannot exchange messages: %v", err)
+			}
+			c, err := p.dial()
+			if err != nil {
+				t.Fatalf("Cannot dial again: %v", err)
+			}
+			defer c.Close()
+			if !c.Conn.(*tls.Conn).ConnectionState().DidResume {
+				t.Errorf("second connection did not resume the TLS session")
+			}
+			if got := p.stats().Resumptions; got != 1 {
+				t.Errorf("resumptions: got %d want 1", got)
+			}
+		})
+	}
+}
+
+func TestTLSOptions(t *testing.T) {
+	cert := newTestCert(t, time.Now().Add(time.Hour))
+	addr, cleanup := startTLSUpstream(t, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305},
+	})
+	defer cleanup()
+
+	tests := []struct {
+		name       string
+		opts       []Option
+		wantErr    bool
+		wantCipher string
+	}{
+		{name: "default", wantCipher: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		{name: "TLS 1.3 only", opts: []Option{WithTLSVersions(tls.VersionTLS13, 0)}, wantErr: true},
+		{
+			name:       "restricted ciphers",
+			opts:       []Option{WithTLSCipherSuites(tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305)},
+			wantCipher: "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+		},
+		{name: "no common cipher", opts: []Option{WithTLSCipherSuites(tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384)}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServerWithOptions(append([]Option{WithUpstreams(addr)}, tt.opts...)...)
+			s.dial = trustingDialer(cert)
+			defer s.upstreams[0].t.Close()
+			var q dns.Msg
+			q.SetQuestion(testQuestion, dns.TypeA)
+			_, err := s.exchangeMessages(context.Background(), s.upstreams[0], &q)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("exchange error: got %v want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := s.upstreams[0].t.(*pool).tlsInfo().CipherSuite; got != tt.wantCipher {
+				t.Errorf("cipher suite: got %s want %s", got, tt.wantCipher)
+			}
+		})
+	}
+}
+
+func TestRootCAs(t *testing.T) {
+	cert := newTestCert(t, time.Now().Add(time.Hour))
+	addr, cleanup := startTLSUpstream(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer cleanup()
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+
+	tests := []struct {
+		name    string
+		opts    []Option
+		wantErr bool
+	}{
+		{name: "system roots", wantErr: true},
+		{name: "custom roots", opts: []Option{WithRootCAs(roots)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServerWithOptions(append([]Option{WithUpstreams(addr)}, tt.opts...)...)
+			defer s.upstreams[0].t.Close()
+			var q dns.Msg
+			q.SetQuestion(testQuestion, dns.TypeA)
+			if _, err := s.exchangeMessages(context.Background(), s.upstreams[0], &q); (err != nil) != tt.wantErr {
+				t.Errorf("exchange error: got %v want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConnectionsPerUpstream(t *testing.T) {
+	for _, tt := range []struct{ n, want int }{{0, connectionsPerUpstream}, {-1, connectionsPerUpstream}, {1, 1}, {32, 32}} {
+		s := NewServerWithOptions(WithUpstreams("dns.google:853@8.8.8.8", "udp://8.8.8.8:53"), WithConnectionsPerUpstream(tt.n))
+		for _, u := range s.upstreams {
+			if got := cap(u.t.(*pool).buf); got != tt.want {
+				t.Errorf("%d connections, %s: got pool size %d want %d", tt.n, u.addr, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		idleTimeout time.Duration
+		wantReused  bool
+		wantDials   int32
+	}{
+		{name: "disabled", wantReused: true, wantDials: 1},
+		{name: "fresh", idleTimeout: time.Minute, wantReused: true, wantDials: 1},
+		{name: "idle", idleTimeout: 10 * time.Millisecond, wantDials: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dials int32
+			p := newPool("gopher.empijei:853", connectionsPerUpstream, func() (*dns.Conn, error) {
+				atomic.AddInt32(&dials, 1)
+				l, _ := net.Pipe()
+				return &dns.Conn{Conn: l}, nil
+			})
+			p.idleTimeout = tt.idleTimeout
+			defer p.Close()
+			c, err := p.get()
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			p.put(c)
+			time.Sleep(30 * time.Millisecond)
+			got, err := p.get()
+			if err != nil {
+				t.Fatalf("get after idle: %v", err)
+			}
+			if reused := got == c; reused != tt.wantReused {
+				t.Errorf("connection reused: got %t want %t", reused, tt.wantReused)
+			}
+			if got := atomic.LoadInt32(&dials); got != tt.wantDials {
+				t.Errorf("dials: got %d want %d", got, tt.wantDials)
+			}
+		})
+	}
+}
+
+func TestMaxConnectionLifetime(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxLifetime time.Duration
+		wantReused  bool
+		wantDials   int32
+	}{
+		{name: "disabled", wantReused: true, wantDials: 1},
+		{name: "young", maxLifetime: time.Minute, wantReused: true, wantDials: 1},
+		{name: "old", maxLifetime: 10 * time.Millisecond, wantDials: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dials int32
+			p := newPool("gopher.empijei:853", connectionsPerUpstream, func() (*dns.Conn, error) {
+				atomic.AddInt32(&dials, 1)
+				l, _ := net.Pipe()
+				return &dns.Conn{Conn: l}, nil
+			})
+			p.maxLifetime = tt.maxLifetime
+			defer p.Close()
+			c, err := p.get()
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			p.put(c)
+			// The connection is in use while it gets old.
+			if got, err := p.get(); err != nil || got != c {
+				t.Fatalf("second get: got %p, %v want the pooled connection %p", got, err, c)
+			}
+			time.Sleep(30 * time.Millisecond)
+			p.put(c)
+			got, err := p.get()
+			if err != nil {
+				t.Fatalf("get after lifetime: %v", err)
+			}
+			if reused := got == c; reused != tt.wantReused {
+				t.Errorf("connection reused: got %t want %t", reused, tt.wantReused)
+			}
+			if got := atomic.LoadInt32(&dials); got != tt.wantDials {
+				t.Errorf("dials: got %d want %d", got, tt.wantDials)
+			}
+			if got := len(p.born); !tt.wantReused && got != 0 {
+				t.Errorf("tracked connections: got %d want 0", got)
+			}
+		})
+	}
+}
+
+func TestDialBackoff(t *testing.T) {
+	var (
+		dials int32
+		down  = true
+	)
+	p := newPool("gopher.empijei:853", connectionsPerUpstream, func() (*dns.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		if down {
+			return nil, errors.New("down")
+		}
+		l, _ := net.Pipe()
+		return &dns.Conn{Conn: l}, nil
+	})
+	defer p.Close()
+	// elapse makes the backoff elapse and checks it was within the given bounds.
+	elapse := func(min, max time.Duration) {
+		t.Helper()
+		if d := time.Until(p.retryAt); d < min-time.Millisecond || d > max {
+			t.Errorf("backoff: got %v want between %v and %v", d, min, max)
+		}
+		p.retryAt = time.Now()
+	}
+
+	for i, want := range []time.Duration{dialBackoffMin, 2 * dialBackoffMin, 4 * dialBackoffMin} {
+		if _, err := p.get(); err == nil || err == errDialBackoff {
+			t.Fatalf("dial %d: got %v want the connector error", i, err)
+		}
+		if _, err := p.get(); err != errDialBackoff {
+			t.Fatalf("dial %d during backoff: got %v want %v", i, err, errDialBackoff)
+		}
+		elapse(want/2, want)
+	}
+	if got := atomic.LoadInt32(&dials); got != 3 {
+		t.Errorf("dials: got %d want 3", got)
+	}
+
+	down = false
+	if _, err := p.get(); err != nil {
+		t.Fatalf("dial after recovery: %v", err)
+	}
+	if p.dialFailures != 0 || !p.retryAt.IsZero() {
+		t.Errorf("backoff after recovery: got %d failures, retry at %v want it reset", p.dialFailures, p.retryAt)
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	const (
+		depth   = 4
+		queries = 3 * depth
+	)
+	var dials int32
+	l, r := net.Pipe()
+	p := newPool("gopher.empijei:853", connectionsPerUpstream, func() (*dns.Conn, error) {
+		if atomic.AddInt32(&dials, 1) > 1 {
+			return nil, errors.New("dialed more than once")
+		}
+		return &dns.Conn{Conn: l}, nil
+	})
+	p.depth = depth
+	defer p.Close()
+
+	// The upstream waits for depth queries to be in flight and answers them in reverse order.
+	go func() {
+		uc := &dns.Conn{Conn: r}
+		for served := 0; served < queries; served += depth {
+			var qs []*dns.Msg
+			for len(qs) < depth {
+				q, err := uc.ReadMsg()
+				if err != nil {
+					t.Errorf("Cannot read query: %v", err)
+					return
+				}
+				qs = append(qs, q)
+			}
+			for i := len(qs) - 1; i >= 0; i-- {
+				m := new(dns.Msg).SetReply(qs[i])
+				rr, _ := dns.NewRR(qs[i].Question[0].Name + " 2311 IN A 42.42.42.42")
+				m.Answer = []dns.RR{rr}
+				if err := uc.WriteMsg(m); err != nil {
+					t.Errorf("Cannot write response: %v", err)
+					return
+				}
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("%d.%s", i, testQuestion)
+			q := new(dns.Msg).SetQuestion(name, dns.TypeA)
+			// All queries share the same ID, the pipeline must tell them apart anyway.
+			q.Id = 42
+			m, err := p.Exchange(ctx, q)
+			if err != nil {
+				t.Errorf("%s: cannot exchange: %v", name, err)
+				return
+			}
+			if m.Id != q.Id {
+				t.Errorf("%s: ID: got %d want %d", name, m.Id, q.Id)
+			}
+			if len(m.Answer) != 1 || m.Answer[0].Header().Name != name {
+				t.Errorf("%s: got answer %v", name, m.Answer)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if got := atomic.LoadInt32(&dials); got != 1 {
+		t.Errorf("dials: got %d want 1", got)
+	}
+}
+
+func TestPipeliningBrokenConnection(t *testing.T) {
+	var dials int32
+	p := newPool("gopher.empijei:853", connectionsPerUpstream, func() (*dns.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		l, r := net.Pipe()
+		go func() {
+			uc := &dns.Conn{Conn: r}
+			q, err := uc.ReadMsg()
+			if err != nil {
+				return
+			}
+			// Answer the first query and hang up.
+			_ = uc.WriteMsg(new(dns.Msg).SetReply(q))
+			uc.Close()
+		}()
+		return &dns.Conn{Conn: l}, nil
+	})
+	p.depth = 2
+	defer p.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+	for i := 0; i < 3; i++ {
+		if _, err := p.Exchange(ctx, q); err != nil {
+			t.Fatalf("exchange %d: %v", i, err)
+		}
+		// Let the read loop notice the connection was closed.
+		<-p.pl.done
+	}
+	if got := atomic.LoadInt32(&dials); got != 3 {
+		t.Errorf("dials: got %d want 3", got)
+	}
+}
+
+func TestPipeliningAbandonedQuery(t *testing.T) {
+	var dials int32
+	l, r := net.Pipe()
+	p := newPool("gopher.empijei:853", connectionsPerUpstream, func() (*dns.Conn, error) {
+		if atomic.AddInt32(&dials, 1) > 1 {
+			return nil, errors.New("dialed more than once")
+		}
+		return &dns.Conn{Conn: l}, nil
+	})
+	p.depth = 2
+	defer p.Close()
+
+	answer := func(q *dns.Msg) *dns.Msg {
+		m := new(dns.Msg).SetReply(q)
+		rr, _ := dns.NewRR(q.Question[0].Name + " 2311 IN A 42.42.42.42")
+		m.Answer = []dns.RR{rr}
+		return m
+	}
+	// The upstream holds the response to the first query back until the second one is answered.
+	go func() {
+		uc := &dns.Conn{Conn: r}
+		slow, err := uc.ReadMsg()
+		if err != nil {
+			t.Errorf("Cannot read query: %v", err)
+			return
+		}
+		for i := 0; i < 2; i++ {
+			q, err := uc.ReadMsg()
+			if err != nil {
+				t.Errorf("Cannot read query: %v", err)
+				return
+			}
+			if i == 1 {
+				// The late response to the abandoned query must not be taken for this one.
+				late := answer(slow)
+				late.Id = q.Id
+				_ = uc.WriteMsg(late)
+			}
+			_ = uc.WriteMsg(answer(q))
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.Exchange(ctx, new(dns.Msg).SetQuestion("slow."+testQuestion, dns.TypeA)); err != context.DeadlineExceeded {
+		t.Fatalf("abandoned exchange: got %v want %v", err, context.DeadlineExceeded)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		name := fmt.Sprintf("%d.%s", i, testQuestion)
+		m, err := p.Exchange(ctx, new(dns.Msg).SetQuestion(name, dns.TypeA))
+		if err != nil {
+			t.Fatalf("%s: cannot exchange: %v", name, err)
+		}
+		if len(m.Answer) != 1 || m.Answer[0].Header().Name != name {
+			t.Errorf("%s: got answer %v", name, m.Answer)
+		}
+	}
+	if got := atomic.LoadInt32(&dials); got != 1 {
+		t.Errorf("dials: got %d want 1", got)
+	}
+}
+
+// recordingConn is a net.Conn that records what is written to it as a stream, recordingPacketConn as
+// packets.
+type recordingConn struct {
+	net.Conn
+	w bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+func (c *recordingConn) Bytes() []byte               { return c.w.Bytes() }
+
+type recordingPacketConn struct {
+	recordingConn
+	net.PacketConn
+}
+
+func TestWriteMsg(t *testing.T) {
+	small := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+	large := new(dns.Msg).SetQuestion(testQuestion, dns.TypeTXT)
+	for i := 0; i < 8; i++ {
+		rr, err := dns.NewRR(fmt.Sprintf("%s 300 IN TXT %q", testQuestion, strings.Repeat("a", 250)))
+		if err != nil {
+			t.Fatalf("Cannot parse test record: %v", err)
+		}
+		large.Answer = append(large.Answer, rr)
+	}
+	compressed := large.Copy()
+	compressed.Compress = true
+	for _, packet := range []bool{false, true} {
+		// Messages larger than the pooled buffers make them grow, the following ones reuse them.
+		for i, m := range []*dns.Msg{small, large, compressed, small} {
+			var got, want interface {
+				net.Conn
+				Bytes() []byte
+			}
+			if packet {
+				got, want = new(recordingPacketConn), new(recordingPacketConn)
+			} else {
+				got, want = new(recordingConn), new(recordingConn)
+			}
+			if err := writeMsg(&dns.Conn{Conn: got}, m); err != nil {
+				t.Fatalf("packet %t, message %d: writeMsg: %v", packet, i, err)
+			}
+			if err := (&dns.Conn{Conn: want}).WriteMsg(m); err != nil {
+				t.Fatalf("packet %t, message %d: WriteMsg: %v", packet, i, err)
+			}
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Errorf("packet %t, message %d: got %x want %x", packet, i, got.Bytes(), want.Bytes())
+			}
+		}
+	}
+}
+
+func benchmarkWriteMsg(b *testing.B, write func(*dns.Conn, *dns.Msg) error) {
+	c := &dns.Conn{Conn: new(recordingConn)}
+	q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+	q.SetEdns0(dns.DefaultMsgSize, false)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.Conn.(*recordingConn).w.Reset()
+		if err := write(c, q); err != nil {
+			b.Fatalf("Cannot write: %v", err)
+		}
+	}
+}
+
+func BenchmarkWriteMsg(b *testing.B) { benchmarkWriteMsg(b, writeMsg) }
+
+func BenchmarkWriteMsgUnpooled(b *testing.B) {
+	benchmarkWriteMsg(b, func(c *dns.Conn, m *dns.Msg) error { return c.WriteMsg(m) })
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// cookieSuffix enables EDNS0 cookies (RFC 7873) with an upstream when appended to its spec,
+// e.g. "dns.google:853@8.8.8.8#cookie". Queries carry a client cookie and the last server cookie
+// received from the upstream, and responses that do not echo the client cookie are rejected.
+const cookieSuffix = "#cookie"
+
+var (
+	errCookieMismatch = errors.New("upstream response cookie does not match the query")
+	errBadCookie      = errors.New("upstream rejected the server cookie")
+)
+
+// cookieJar holds the cookies exchanged with an upstream. Cookies are hex encoded as in dns.EDNS0_COOKIE.
+type cookieJar struct {
+	client string
+
+	mu     sync.Mutex
+	server string
+}
+
+func newCookieJar() *cookieJar {
+	b := make([]byte, 8)
+	// A client cookie that cannot be guessed is nice to have, not a requirement: RFC 7873 accepts fixed
+	// ones for clients that do not care about privacy.
+	_, _ = rand.Read(b)
+	return &cookieJar{client: hex.EncodeToString(b)}
+}
+
+func (j *cookieJar) serverCookie() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.server
+}
+
+func (j *cookieJar) setServerCookie(c string) {
+	j.mu.Lock()
+	j.server = c
+	j.mu.Unlock()
+}
+
+// withCookie returns a copy of q with the cookies of j, replacing the ones sent by the client, if any.
+func (j *cookieJar) withCookie(q *dns.Msg) *dns.Msg {
+	cq := q.Copy()
+	if cq.IsEdns0() == nil {
+		cq.SetEdns0(dns.DefaultMsgSize, false)
+	}
+	removeEdns0Option(cq, dns.EDNS0COOKIE)
+	opt := cq.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: j.client + j.serverCookie()})
+	return cq
+}
+
+// check verifies that resp echoes the client cookie and stores the server cookie it carries.
+// Responses without cookies are accepted until the upstream sends one, as it might not support them.
+// A BADCOOKIE response is an error, the query should be retried with the new server cookie.
+func (j *cookieJar) check(resp *dns.Msg) error {
+	var c *dns.EDNS0_COOKIE
+	if opt := resp.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if oc, ok := o.(*dns.EDNS0_COOKIE); ok {
+				c = oc
+				break
+			}
+		}
+	}
+	if c == nil {
+		if j.serverCookie() != "" || resp.Rcode == dns.RcodeBadCookie {
+			return errCookieMismatch
+		}
+		return nil
+	}
+	const clientLen = 16
+	if len(c.Cookie) < clientLen || !strings.EqualFold(c.Cookie[:clientLen], j.client) {
+		return errCookieMismatch
+	}
+	// Server cookies are 8 to 32 bytes long.
+	server := strings.ToLower(c.Cookie[clientLen:])
+	if l := len(server); l < 16 || l > 64 {
+		return errCookieMismatch
+	}
+	j.setServerCookie(server)
+	if resp.Rcode == dns.RcodeBadCookie {
+		return errBadCookie
+	}
+	return nil
+}
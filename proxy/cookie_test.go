@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCookies(t *testing.T) {
+	const serverCookie = "0102030405060708"
+	var (
+		sent  string
+		reply func(m *dns.Msg, client string)
+	)
+	s := NewServerWithOptions(
+		WithCacheSize(-1),
+		WithUpstreams("fake://cookies#cookie"),
+		WithUpstreamTransport("fake", func(spec string) (UpstreamTransport, error) {
+			return funcTransport(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+				sent = ""
+				if opt := q.IsEdns0(); opt != nil {
+					for _, o := range opt.Option {
+						if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+							sent = c.Cookie
+						}
+					}
+				}
+				m := new(dns.Msg).SetReply(q)
+				m.SetEdns0(dns.DefaultMsgSize, false)
+				if len(sent) >= 16 {
+					reply(m, sent[:16])
+				}
+				return m, nil
+			}), nil
+		}),
+	)
+	u := s.upstreams[0]
+	addCookie := func(m *dns.Msg, cookie string) {
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: cookie})
+	}
+	echo := func(server string) func(m *dns.Msg, client string) {
+		return func(m *dns.Msg, client string) { addCookie(m, client+server) }
+	}
+	noCookie := func(*dns.Msg, string) {}
+	// The cases run in order and share the cookies stored for the upstream.
+	tests := []struct {
+		name      string
+		reply     func(m *dns.Msg, client string)
+		wantSent  string
+		wantErr   error
+		wantStore string
+	}{
+		{
+			name:     "no server support",
+			reply:    noCookie,
+			wantSent: u.cookies.client,
+		},
+		{
+			name:      "server cookie",
+			reply:     echo(serverCookie),
+			wantSent:  u.cookies.client,
+			wantStore: serverCookie,
+		},
+		{
+			name:      "server cookie echoed",
+			reply:     echo(serverCookie),
+			wantSent:  u.cookies.client + serverCookie,
+			wantStore: serverCookie,
+		},
+		{
+			name:      "wrong client cookie",
+			reply:     func(m *dns.Msg, _ string) { addCookie(m, "ffffffffffffffff"+serverCookie) },
+			wantSent:  u.cookies.client + serverCookie,
+			wantErr:   errCookieMismatch,
+			wantStore: serverCookie,
+		},
+		{
+			name:      "missing cookie",
+			reply:     noCookie,
+			wantSent:  u.cookies.client + serverCookie,
+			wantErr:   errCookieMismatch,
+			wantStore: serverCookie,
+		},
+		{
+			name: "bad cookie",
+			reply: func(m *dns.Msg, client string) {
+				addCookie(m, client+"1112131415161718")
+				m.Rcode = dns.RcodeBadCookie
+			},
+			wantSent:  u.cookies.client + serverCookie,
+			wantErr:   errBadCookie,
+			wantStore: "1112131415161718",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reply = tt.reply
+			m, err := s.exchangeMessages(context.Background(), u, new(dns.Msg).SetQuestion(testQuestion, dns.TypeA))
+			if err != tt.wantErr {
+				t.Fatalf("exchange: got %v want %v", err, tt.wantErr)
+			}
+			if sent != tt.wantSent {
+				t.Errorf("sent cookie: got %q want %q", sent, tt.wantSent)
+			}
+			if got := u.cookies.serverCookie(); got != tt.wantStore {
+				t.Errorf("stored server cookie: got %q want %q", got, tt.wantStore)
+			}
+			if m != nil && m.IsEdns0() != nil {
+				t.Errorf("response: got %v want no OPT record for a query without one", m.IsEdns0())
+			}
+		})
+	}
+}
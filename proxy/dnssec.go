@@ -0,0 +1,802 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rootAnchor is the DS record of the root zone KSK-2017, the default DNSSEC trust anchor.
+const rootAnchor = ". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+
+const (
+	// maxValidationCacheTTL caps how long validated keys and delegations are remembered.
+	maxValidationCacheTTL = time.Hour
+	// maxValidationCacheLen bounds the amount of zones and delegations remembered by the validator.
+	maxValidationCacheLen = 4096
+)
+
+var (
+	// errBogus is returned for responses that fail DNSSEC validation.
+	errBogus = errors.New("bogus DNSSEC data")
+	// errIndeterminate is returned for signatures that could not be checked because the records
+	// needed to do so could not be looked up. Responses they cover are served without the AD bit.
+	errIndeterminate = errors.New("indeterminate DNSSEC data")
+)
+
+// WithDNSSECValidation makes the server validate DNSSEC signatures instead of trusting the upstreams.
+// Upstream queries are sent with the DO and CD bits set, answers are verified against the chain of trust
+// starting at the given trust anchors, or the root KSK if none are given, before being cached.
+// Validated answers get the AD bit set, answers that fail validation are replaced with SERVFAIL and
+// answers from zones that are provably unsigned are served without the AD bit. Answers synthesized from
+// a wildcard are only considered validated if the response proves that no closer match exists,
+// otherwise they are served without the AD bit. So are answers whose zone could not be established
+// because a delegation lookup failed.
+//
+// Known limitations: names are compared in canonical order ignoring escaped characters.
+func WithDNSSECValidation(anchors ...*dns.DS) Option {
+	return func(o *options) {
+		o.dnssec = true
+		o.trustAnchors = anchors
+	}
+}
+
+// validator verifies DNSSEC signatures. Keys and delegations it looks up are remembered.
+type validator struct {
+	anchors []*dns.DS
+	lookup  func(name string, qtype uint16) (*dns.Msg, error)
+	now     func() time.Time
+
+	mu sync.Mutex
+	// keys holds the validated DNSKEYs of zones.
+	keys map[string]zoneKeys
+	// cuts holds what is known about the delegation to names.
+	cuts map[string]cutEntry
+}
+
+type zoneKeys struct {
+	keys []*dns.DNSKEY
+	exp  time.Time
+}
+
+// cutStatus describes what the DS lookup for a name proved about it.
+type cutStatus int
+
+const (
+	// cutSecure means the name is not an insecure delegation and is not known to be a signed one either:
+	// it is most likely not a delegation at all.
+	cutSecure cutStatus = iota
+	// cutSigned means the name is a delegation to a signed zone.
+	cutSigned
+	// cutInsecure means the name is a delegation to an unsigned zone.
+	cutInsecure
+	// cutUnknown means nothing could be proved about the name.
+	cutUnknown
+)
+
+type cutEntry struct {
+	st  cutStatus
+	exp time.Time
+}
+
+func newValidator(anchors []*dns.DS, lookup func(name string, qtype uint16) (*dns.Msg, error), now func() time.Time) *validator {
+	if len(anchors) == 0 {
+		rr, err := dns.NewRR(rootAnchor)
+		if err != nil {
+			panic(err)
+		}
+		anchors = []*dns.DS{rr.(*dns.DS)}
+	}
+	return &validator{
+		anchors: anchors,
+		lookup:  lookup,
+		now:     now,
+		keys:    make(map[string]zoneKeys),
+		cuts:    make(map[string]cutEntry),
+	}
+}
+
+// withDNSSECOK returns a copy of q asking for DNSSEC records without upstream validation.
+func withDNSSECOK(q *dns.Msg) *dns.Msg {
+	c := q.Copy()
+	c.CheckingDisabled = true
+	if opt := c.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		c.SetEdns0(ednsUDPSize, true)
+	}
+	return c
+}
+
+// dnssecLookup asks the upstreams for the records the validator needs.
+func (s *Server) dnssecLookup(name string, qtype uint16) (*dns.Msg, error) {
+	q := new(dns.Msg).SetQuestion(name, qtype)
+	m, _ := s.forwardMessageAndGetResponse(s.context(), withDNSSECOK(q))
+	if m == nil {
+		return nil, fmt.Errorf("no response for %s %s", name, dns.TypeToString[qtype])
+	}
+	return m, nil
+}
+
+// stripDNSSEC removes from m the DNSSEC records and the AD bit that the client did not ask for,
+// as required by RFC 3225 and RFC 6840.
+func stripDNSSEC(q, m *dns.Msg) {
+	if opt := q.IsEdns0(); opt != nil && opt.Do() {
+		return
+	}
+	if !q.AuthenticatedData {
+		m.AuthenticatedData = false
+	}
+	qtype := q.Question[0].Qtype
+	for _, sec := range []*[]dns.RR{&m.Answer, &m.Ns} {
+		// m might share its records with the cache, so they are copied rather than filtered in place.
+		var rrs []dns.RR
+		for _, rr := range *sec {
+			switch t := rr.Header().Rrtype; t {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3:
+				if t != qtype {
+					continue
+				}
+			}
+			rrs = append(rrs, rr)
+		}
+		*sec = rrs
+	}
+}
+
+// validate verifies the response m to q. It reports whether m is secure, or returns an error wrapping
+// errBogus if m should not be trusted.
+func (v *validator) validate(q, m *dns.Msg) (secure bool, err error) {
+	qname, qtype := q.Question[0].Name, q.Question[0].Qtype
+	if m.Rcode != dns.RcodeSuccess && m.Rcode != dns.RcodeNameError {
+		return false, nil
+	}
+	if qtype == dns.TypeRRSIG || qtype == dns.TypeANY {
+		// These answers are not RRsets that can be verified.
+		return false, nil
+	}
+	v.learnCuts(m)
+	secure = true
+	name := qname
+	answered := false
+	// expanded holds the owners of the records synthesized from wildcards and the signatures that
+	// verified them.
+	var expanded []*dns.RRSIG
+	for _, set := range rrsets(m.Answer) {
+		h := set.rrs[0].Header()
+		sig, err := v.verify(set)
+		if err != nil {
+			if !errors.Is(err, errIndeterminate) && !v.insecure(h.Name) {
+				return false, err
+			}
+			secure = false
+		} else if int(sig.Labels) < ownerLabels(h.Name) {
+			expanded = append(expanded, sig)
+		}
+		if cname, ok := set.rrs[0].(*dns.CNAME); ok && equalNames(h.Name, name) {
+			name = cname.Target
+		}
+		if equalNames(h.Name, name) && h.Rrtype == qtype {
+			answered = true
+		}
+	}
+	if answered {
+		if secure && len(expanded) > 0 && !v.provesExpansions(m.Ns, expanded) {
+			// The wildcard might hide a closer match, the answer is not considered validated.
+			secure = false
+		}
+		return secure, nil
+	}
+
+	// This is a negative answer for name, the authority section must prove it.
+	var (
+		nsecs []dns.RR
+		ok    = true
+	)
+	for _, set := range rrsets(m.Ns) {
+		if set.rrs[0].Header().Rrtype == dns.TypeNS && len(set.sigs) == 0 {
+			// Delegations are not signed.
+			continue
+		}
+		if _, err = v.verify(set); err != nil {
+			ok = false
+			break
+		}
+		switch set.rrs[0].(type) {
+		case *dns.NSEC, *dns.NSEC3:
+			nsecs = append(nsecs, set.rrs...)
+		}
+	}
+	if ok && m.Rcode == dns.RcodeNameError && !provesNXDomain(nsecs, name) {
+		ok, err = false, fmt.Errorf("%w: no proof that %s does not exist", errBogus, name)
+	}
+	if ok && m.Rcode == dns.RcodeSuccess && !provesNoData(nsecs, name, qtype) {
+		ok, err = false, fmt.Errorf("%w: no proof that %s has no %s records", errBogus, name, dns.TypeToString[qtype])
+	}
+	if ok {
+		return secure, nil
+	}
+	if errors.Is(err, errIndeterminate) || v.insecure(name) {
+		return false, nil
+	}
+	return false, err
+}
+
+// verify checks that one of the signatures of set was made by a validated key of the zone set belongs
+// to, and returns it. If a valid signature could not be checked to be made by the apex of the zone the
+// returned error wraps errIndeterminate.
+func (v *validator) verify(set *rrset) (*dns.RRSIG, error) {
+	h := set.rrs[0].Header()
+	err := fmt.Errorf("%w: no valid signature for %s %s", errBogus, h.Name, dns.TypeToString[h.Rrtype])
+	var indeterminate error
+	for _, sig := range set.sigs {
+		if !dns.IsSubDomain(sig.SignerName, h.Name) || !sig.ValidityPeriod(v.now()) {
+			continue
+		}
+		if int(sig.Labels) > ownerLabels(h.Name) {
+			// RFC 4035 5.3.1: the signature cannot cover more labels than the owner has.
+			continue
+		}
+		if h.Rrtype == dns.TypeDS && equalNames(sig.SignerName, h.Name) {
+			// DS records are signed by the parent zone.
+			continue
+		}
+		keys, kerr := v.zoneKeys(sig.SignerName)
+		if kerr != nil {
+			err = kerr
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() != sig.KeyTag || sig.Verify(k, set.rrs) != nil {
+				continue
+			}
+			if aerr := v.signedByApex(sig.SignerName, h.Name, h.Rrtype); aerr != nil {
+				if errors.Is(aerr, errIndeterminate) {
+					indeterminate = aerr
+				} else {
+					err = aerr
+				}
+				break
+			}
+			return sig, nil
+		}
+	}
+	if indeterminate != nil {
+		return nil, indeterminate
+	}
+	return nil, err
+}
+
+// signedByApex checks that signer is the apex of the zone that holds the records of type rrtype owned by
+// name, which is below signer: there is no delegation between them. It returns an error wrapping
+// errBogus if there is one, or errIndeterminate if that could not be established.
+func (v *validator) signedByApex(signer, name string, rrtype uint16) error {
+	labels := dns.SplitDomainName(strings.ToLower(name))
+	n := len(labels) - dns.CountLabel(signer)
+	notApex := fmt.Errorf("%w: %s %s is signed by %s, which is not the apex of its zone", errBogus, name, dns.TypeToString[rrtype], signer)
+	if rrtype == dns.TypeNSEC3 {
+		// RFC 5155 7.1: NSEC3 records are owned by the hash of a name directly below the apex.
+		if n != 1 {
+			return notApex
+		}
+		return nil
+	}
+	first := 0
+	if rrtype == dns.TypeDS || rrtype == dns.TypeNSEC {
+		// The DS and NSEC records owned by a delegation belong to the parent zone.
+		first = 1
+	}
+	// Names closer to the signer are checked first, so that nothing is looked up below a delegation.
+	for i := n - 1; i >= first; i-- {
+		if labels[i] == "*" {
+			continue
+		}
+		cut := dns.Fqdn(strings.Join(labels[i:], "."))
+		switch v.cut(cut) {
+		case cutSecure:
+		case cutUnknown:
+			return fmt.Errorf("%w: unable to tell whether %s is a delegation", errIndeterminate, cut)
+		default:
+			return notApex
+		}
+	}
+	return nil
+}
+
+// learnCuts remembers what the verified DS, NSEC and NSEC3 records of m prove about the delegations to
+// the ancestors of the names in m, which spares looking them up to verify the records of m.
+func (v *validator) learnCuts(m *dns.Msg) {
+	rrs := append(m.Answer[:len(m.Answer):len(m.Answer)], m.Ns...)
+	var sets []*rrset
+	for _, set := range rrsets(rrs) {
+		switch set.rrs[0].Header().Rrtype {
+		case dns.TypeDS, dns.TypeNSEC, dns.TypeNSEC3:
+			sets = append(sets, set)
+		}
+	}
+	if len(sets) == 0 {
+		return
+	}
+	names := make(map[string]bool)
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeNSEC3 {
+			// The owners of NSEC3 records are hashes, not names.
+			continue
+		}
+		labels := dns.SplitDomainName(strings.ToLower(rr.Header().Name))
+		for i := range labels {
+			names[dns.Fqdn(strings.Join(labels[i:], "."))] = true
+		}
+	}
+	// Sets closer to the root are verified first, so that what they prove is known when verifying the
+	// ones below them.
+	sort.SliceStable(sets, func(i, j int) bool {
+		return dns.CountLabel(sets[i].rrs[0].Header().Name) < dns.CountLabel(sets[j].rrs[0].Header().Name)
+	})
+	for _, set := range sets {
+		sig, err := v.verify(set)
+		if err != nil {
+			continue
+		}
+		for name := range names {
+			if st, ok := cutProof(set.rrs, sig.SignerName, name); ok {
+				v.setCut(name, st, set.ttl())
+				delete(names, name)
+			}
+		}
+	}
+}
+
+// cutProof returns what rrs, records of the zone of signer, prove about the delegation to name, and
+// whether they prove anything.
+func cutProof(rrs []dns.RR, signer, name string) (cutStatus, bool) {
+	if equalNames(signer, name) || !dns.IsSubDomain(signer, name) {
+		// Only the parent zone knows about the delegation.
+		return cutUnknown, false
+	}
+	// delegation returns what the type bitmap of a record owned by name proves.
+	delegation := func(bitmap []uint16) (cutStatus, bool) {
+		switch {
+		case hasType(bitmap, dns.TypeSOA):
+			return cutUnknown, false
+		case !hasType(bitmap, dns.TypeNS):
+			return cutSecure, true
+		case hasType(bitmap, dns.TypeDS):
+			return cutSigned, true
+		}
+		return cutInsecure, true
+	}
+	for _, rr := range rrs {
+		switch rr := rr.(type) {
+		case *dns.DS:
+			if equalNames(rr.Hdr.Name, name) {
+				return cutSigned, true
+			}
+		case *dns.NSEC:
+			if equalNames(rr.Hdr.Name, name) {
+				return delegation(rr.TypeBitMap)
+			}
+			if nsecCovers(rr, name) {
+				// Names that do not exist are not delegations.
+				return cutSecure, true
+			}
+		case *dns.NSEC3:
+			if rr.Match(name) {
+				return delegation(rr.TypeBitMap)
+			}
+			if rr.Flags&1 == 0 && rr.Cover(name) {
+				// Names that do not exist are not delegations, unless they are in an opt-out span.
+				return cutSecure, true
+			}
+		}
+	}
+	return cutUnknown, false
+}
+
+// provesExpansions reports whether the authority section ns proves that no closer match exists for
+// the records synthesized from wildcards and verified by sigs, as required by RFC 4035 5.3.4 and
+// RFC 5155 8.8.
+func (v *validator) provesExpansions(ns []dns.RR, sigs []*dns.RRSIG) bool {
+	var denials []dns.RR
+	for _, set := range rrsets(ns) {
+		switch set.rrs[0].(type) {
+		case *dns.NSEC, *dns.NSEC3:
+		default:
+			continue
+		}
+		if _, err := v.verify(set); err == nil {
+			denials = append(denials, set.rrs...)
+		}
+	}
+	for _, sig := range sigs {
+		name := sig.Hdr.Name
+		labels := dns.SplitDomainName(name)
+		nextCloser := dns.Fqdn(strings.Join(labels[len(labels)-int(sig.Labels)-1:], "."))
+		proved := false
+		for _, rr := range denials {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				proved = proved || nsecCovers(rr, name)
+			case *dns.NSEC3:
+				proved = proved || rr.Cover(nextCloser)
+			}
+		}
+		if !proved {
+			return false
+		}
+	}
+	return true
+}
+
+// ownerLabels returns the amount of labels of name as counted by the Labels field of RRSIG records,
+// which does not count the leftmost label of wildcards.
+func ownerLabels(name string) int {
+	n := dns.CountLabel(name)
+	if strings.HasPrefix(name, "*.") {
+		n--
+	}
+	return n
+}
+
+// zoneKeys returns the validated DNSKEYs of zone.
+func (v *validator) zoneKeys(zone string) ([]*dns.DNSKEY, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	v.mu.Lock()
+	zk, ok := v.keys[zone]
+	v.mu.Unlock()
+	if ok && zk.exp.After(v.now()) {
+		return zk.keys, nil
+	}
+
+	var dss []*dns.DS
+	for _, a := range v.anchors {
+		if equalNames(a.Hdr.Name, zone) {
+			dss = append(dss, a)
+		}
+	}
+	if dss == nil {
+		if v.anchor(zone) == "" {
+			return nil, fmt.Errorf("%w: no trust anchor for %s", errBogus, zone)
+		}
+		m, err := v.lookup(zone, dns.TypeDS)
+		if err != nil {
+			return nil, err
+		}
+		set := findRRset(m.Answer, zone, dns.TypeDS)
+		if set == nil {
+			return nil, fmt.Errorf("%w: no DS for %s", errBogus, zone)
+		}
+		if _, err := v.verify(set); err != nil {
+			return nil, err
+		}
+		v.setCut(zone, cutSigned, set.ttl())
+		for _, rr := range set.rrs {
+			dss = append(dss, rr.(*dns.DS))
+		}
+	}
+
+	m, err := v.lookup(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	set := findRRset(m.Answer, zone, dns.TypeDNSKEY)
+	if set == nil {
+		return nil, fmt.Errorf("%w: no DNSKEY for %s", errBogus, zone)
+	}
+	var keys []*dns.DNSKEY
+	for _, rr := range set.rrs {
+		if k := rr.(*dns.DNSKEY); k.Flags&dns.ZONE != 0 {
+			keys = append(keys, k)
+		}
+	}
+	for _, sig := range set.sigs {
+		if !sig.ValidityPeriod(v.now()) {
+			continue
+		}
+		for _, k := range keys {
+			if k.KeyTag() == sig.KeyTag && matchesDS(k, dss) && sig.Verify(k, set.rrs) == nil {
+				v.mu.Lock()
+				if len(v.keys) >= maxValidationCacheLen {
+					v.keys = make(map[string]zoneKeys)
+				}
+				v.keys[zone] = zoneKeys{keys: keys, exp: v.now().Add(set.ttl())}
+				v.mu.Unlock()
+				return keys, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%w: no DNSKEY of %s matches its DS", errBogus, zone)
+}
+
+// insecure reports whether name is provably not signed: it is either outside of the trust anchors or
+// below a delegation to an unsigned zone.
+func (v *validator) insecure(name string) bool {
+	name = strings.ToLower(dns.Fqdn(name))
+	anchor := v.anchor(name)
+	if anchor == "" {
+		return true
+	}
+	labels := dns.SplitDomainName(name)
+	for i := len(labels) - dns.CountLabel(anchor) - 1; i >= 0; i-- {
+		switch v.cut(dns.Fqdn(strings.Join(labels[i:], "."))) {
+		case cutInsecure:
+			return true
+		case cutUnknown:
+			return false
+		}
+	}
+	return false
+}
+
+// anchor returns the closest trust anchor name is below of, or the empty string.
+func (v *validator) anchor(name string) string {
+	var closest string
+	for _, a := range v.anchors {
+		if dns.IsSubDomain(a.Hdr.Name, name) && (closest == "" || dns.CountLabel(a.Hdr.Name) > dns.CountLabel(closest)) {
+			closest = a.Hdr.Name
+		}
+	}
+	return closest
+}
+
+// cut returns what the DS records of name prove about it.
+func (v *validator) cut(name string) cutStatus {
+	v.mu.Lock()
+	ce, ok := v.cuts[name]
+	v.mu.Unlock()
+	if ok && ce.exp.After(v.now()) {
+		return ce.st
+	}
+	m, err := v.lookup(name, dns.TypeDS)
+	if err != nil {
+		return cutUnknown
+	}
+	st, ttl := v.cutStatus(m, name)
+	v.setCut(name, st, ttl)
+	return st
+}
+
+// setCut remembers for ttl what is known about the delegation to name.
+func (v *validator) setCut(name string, st cutStatus, ttl time.Duration) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.cuts) >= maxValidationCacheLen {
+		v.cuts = make(map[string]cutEntry)
+	}
+	v.cuts[name] = cutEntry{st: st, exp: v.now().Add(ttl)}
+}
+
+// cutStatus returns what the response m to a DS query for name proves, and for how long.
+func (v *validator) cutStatus(m *dns.Msg, name string) (cutStatus, time.Duration) {
+	if set := findRRset(m.Answer, name, dns.TypeDS); set != nil {
+		if _, err := v.verify(set); err != nil {
+			return cutUnknown, set.ttl()
+		}
+		return cutSigned, set.ttl()
+	}
+	for _, set := range rrsets(m.Ns) {
+		switch set.rrs[0].(type) {
+		case *dns.NSEC, *dns.NSEC3:
+		default:
+			continue
+		}
+		if _, err := v.verify(set); err != nil {
+			continue
+		}
+		for _, rr := range set.rrs {
+			switch rr := rr.(type) {
+			case *dns.NSEC:
+				if equalNames(rr.Hdr.Name, name) && insecureDelegation(rr.TypeBitMap) {
+					return cutInsecure, set.ttl()
+				}
+			case *dns.NSEC3:
+				if rr.Match(name) && insecureDelegation(rr.TypeBitMap) {
+					return cutInsecure, set.ttl()
+				}
+				// RFC 5155 6: opt-out spans might contain insecure delegations. Names are looked up
+				// starting from the trust anchor, so name is the next closer name to its parent.
+				if rr.Flags&1 == 1 && rr.Cover(name) {
+					return cutInsecure, set.ttl()
+				}
+			}
+		}
+	}
+	// Either name is not a delegation or the response proves nothing, which makes the names below it
+	// bogus if they are unsigned.
+	return cutSecure, maxValidationCacheTTL / 4
+}
+
+func insecureDelegation(bitmap []uint16) bool {
+	return hasType(bitmap, dns.TypeNS) && !hasType(bitmap, dns.TypeDS) && !hasType(bitmap, dns.TypeSOA)
+}
+
+// provesNoData reports whether nsecs prove that name exists but has no records of type qtype.
+func provesNoData(nsecs []dns.RR, name string, qtype uint16) bool {
+	for _, rr := range nsecs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if equalNames(rr.Hdr.Name, name) && !hasType(rr.TypeBitMap, qtype) && !hasType(rr.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+		case *dns.NSEC3:
+			if rr.Match(name) && !hasType(rr.TypeBitMap, qtype) && !hasType(rr.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// provesNXDomain reports whether nsecs prove that neither name nor a wildcard matching it exist.
+func provesNXDomain(nsecs []dns.RR, name string) bool {
+	var (
+		nsec3s []*dns.NSEC3
+		ce     string
+	)
+	for _, rr := range nsecs {
+		switch rr := rr.(type) {
+		case *dns.NSEC:
+			if nsecCovers(rr, name) {
+				// The closest encloser is the longest ancestor of name that is known to exist.
+				n := dns.CompareDomainName(name, rr.Hdr.Name)
+				if m := dns.CompareDomainName(name, rr.NextDomain); m > n {
+					n = m
+				}
+				labels := dns.SplitDomainName(name)
+				ce = dns.Fqdn(strings.Join(labels[len(labels)-n:], "."))
+			}
+		case *dns.NSEC3:
+			nsec3s = append(nsec3s, rr)
+		}
+	}
+	if ce != "" {
+		for _, rr := range nsecs {
+			if nsec, ok := rr.(*dns.NSEC); ok && nsecCovers(nsec, "*."+ce) {
+				return true
+			}
+		}
+		return false
+	}
+	// RFC 5155 8.4: closest encloser proof.
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		ce := dns.Fqdn(strings.Join(labels[i:], "."))
+		if !anyNSEC3(nsec3s, func(rr *dns.NSEC3) bool { return rr.Match(ce) }) {
+			continue
+		}
+		nextCloser := dns.Fqdn(strings.Join(labels[i-1:], "."))
+		return anyNSEC3(nsec3s, func(rr *dns.NSEC3) bool { return rr.Cover(nextCloser) }) &&
+			anyNSEC3(nsec3s, func(rr *dns.NSEC3) bool { return rr.Cover("*." + ce) })
+	}
+	return false
+}
+
+func anyNSEC3(rrs []*dns.NSEC3, f func(*dns.NSEC3) bool) bool {
+	for _, rr := range rrs {
+		if f(rr) {
+			return true
+		}
+	}
+	return false
+}
+
+// nsecCovers reports whether name falls strictly between the owner and the next name of rr.
+func nsecCovers(rr *dns.NSEC, name string) bool {
+	owner, next := rr.Hdr.Name, rr.NextDomain
+	if canonicalCompare(owner, next) < 0 {
+		return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+	}
+	// The last NSEC of the zone points back to the apex.
+	return canonicalCompare(owner, name) < 0 && dns.IsSubDomain(next, name)
+}
+
+// canonicalCompare compares names in the canonical order defined by RFC 4034 6.1.
+func canonicalCompare(a, b string) int {
+	la, lb := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i, j := len(la)-1, len(lb)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if c := strings.Compare(la[i], lb[j]); c != 0 {
+			return c
+		}
+	}
+	switch {
+	case len(la) < len(lb):
+		return -1
+	case len(la) > len(lb):
+		return 1
+	}
+	return 0
+}
+
+func hasType(bitmap []uint16, t uint16) bool {
+	for _, b := range bitmap {
+		if b == t {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesDS(k *dns.DNSKEY, dss []*dns.DS) bool {
+	for _, ds := range dss {
+		if ds.KeyTag != k.KeyTag() || ds.Algorithm != k.Algorithm {
+			continue
+		}
+		if d := k.ToDS(ds.DigestType); d != nil && strings.EqualFold(d.Digest, ds.Digest) {
+			return true
+		}
+	}
+	return false
+}
+
+func equalNames(a, b string) bool {
+	return strings.EqualFold(dns.Fqdn(a), dns.Fqdn(b))
+}
+
+// rrset is a set of records with the same name, type and class, and the signatures covering them.
+type rrset struct {
+	rrs  []dns.RR
+	sigs []*dns.RRSIG
+}
+
+// ttl returns the time the validation of the set can be remembered for.
+func (s *rrset) ttl() time.Duration {
+	ttl := maxValidationCacheTTL
+	for _, rr := range s.rrs {
+		if d := time.Duration(rr.Header().Ttl) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	return ttl
+}
+
+// rrsets groups rrs in sets, in order of appearance.
+func rrsets(rrs []dns.RR) []*rrset {
+	type setKey struct {
+		name          string
+		rrtype, class uint16
+	}
+	var (
+		sets  []*rrset
+		index = make(map[setKey]*rrset)
+		sigs  []*dns.RRSIG
+	)
+	for _, rr := range rrs {
+		h := rr.Header()
+		switch rr := rr.(type) {
+		case *dns.RRSIG:
+			sigs = append(sigs, rr)
+			continue
+		case *dns.OPT:
+			continue
+		}
+		k := setKey{strings.ToLower(h.Name), h.Rrtype, h.Class}
+		set, ok := index[k]
+		if !ok {
+			set = &rrset{}
+			index[k] = set
+			sets = append(sets, set)
+		}
+		set.rrs = append(set.rrs, rr)
+	}
+	for _, sig := range sigs {
+		if set, ok := index[setKey{strings.ToLower(sig.Hdr.Name), sig.TypeCovered, sig.Hdr.Class}]; ok {
+			set.sigs = append(set.sigs, sig)
+		}
+	}
+	return sets
+}
+
+// findRRset returns the set of records of type rrtype owned by name in rrs, if any.
+func findRRset(rrs []dns.RR, name string, rrtype uint16) *rrset {
+	for _, set := range rrsets(rrs) {
+		if h := set.rrs[0].Header(); h.Rrtype == rrtype && equalNames(h.Name, name) {
+			return set
+		}
+	}
+	return nil
+}
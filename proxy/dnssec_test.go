@@ -0,0 +1,310 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testZone signs records with a key for its apex.
+type testZone struct {
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, apex string) *testZone {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: apex, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     dns.ZONE | dns.SEP,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("Cannot generate key: %v", err)
+	}
+	return &testZone{key: key, priv: priv.(crypto.Signer)}
+}
+
+// sign returns the records parsed from rrs followed by their signature.
+func (z *testZone) sign(t *testing.T, rrs ...string) []dns.RR {
+	t.Helper()
+	var set []dns.RR
+	for _, r := range rrs {
+		rr, err := dns.NewRR(r)
+		if err != nil {
+			t.Fatalf("Cannot parse %q: %v", r, err)
+		}
+		set = append(set, rr)
+	}
+	return append(set, z.signature(t, set))
+}
+
+func (z *testZone) signature(t *testing.T, set []dns.RR) *dns.RRSIG {
+	t.Helper()
+	h := set[0].Header()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: h.Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: h.Ttl},
+		Inception:  uint32(time.Now().Add(-time.Hour).Unix()),
+		Expiration: uint32(time.Now().Add(time.Hour).Unix()),
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.key.Hdr.Name,
+		Algorithm:  z.key.Algorithm,
+	}
+	if err := sig.Sign(z.priv, set); err != nil {
+		t.Fatalf("Cannot sign %v: %v", set, err)
+	}
+	return sig
+}
+
+func (z *testZone) dnskey(t *testing.T) []dns.RR {
+	return []dns.RR{z.key, z.signature(t, []dns.RR{z.key})}
+}
+
+func TestDNSSECValidation(t *testing.T) {
+	miki := newTestZone(t, "miki.")
+	sub := newTestZone(t, "sub.miki.")
+	ds := sub.key.ToDS(dns.SHA256)
+	ds.Hdr.Ttl = 3600
+	soa := "miki. 300 IN SOA ns.miki. hostmaster.miki. 1 7200 3600 1209600 300"
+
+	type response struct {
+		rcode  int
+		answer []dns.RR
+		ns     []dns.RR
+	}
+	forged := miki.sign(t, "forged.miki. 300 IN A 42.42.42.42")
+	forged[0].(*dns.A).A = net.IPv4(43, 43, 43, 43)
+	// expand returns the records synthesized for name from the signed wildcard records rrs.
+	expand := func(name string, rrs []dns.RR) []dns.RR {
+		for _, rr := range rrs {
+			rr.Header().Name = name
+		}
+		return rrs
+	}
+	zone := map[string]response{
+		"miki. DNSKEY":     {answer: miki.dnskey(t)},
+		"sub.miki. DS":     {answer: []dns.RR{ds, miki.signature(t, []dns.RR{ds})}},
+		"sub.miki. DNSKEY": {answer: sub.dnskey(t)},
+		"raccoon.miki. A":  {answer: miki.sign(t, "raccoon.miki. 300 IN A 42.42.42.42")},
+		"www.miki. A": {answer: append(
+			miki.sign(t, "www.miki. 300 IN CNAME raccoon.miki."),
+			miki.sign(t, "raccoon.miki. 300 IN A 42.42.42.42")...)},
+		"forged.miki. A":   {answer: forged},
+		"unsigned.miki. A": {answer: []dns.RR{mustRR(t, "unsigned.miki. 300 IN A 42.42.42.42")}},
+		"host.sub.miki. A": {answer: sub.sign(t, "host.sub.miki. 300 IN A 42.42.42.42")},
+		"insecure.miki. DS": {ns: append(
+			miki.sign(t, soa),
+			miki.sign(t, "insecure.miki. 300 IN NSEC raccoon.miki. NS RRSIG NSEC")...)},
+		"host.insecure.miki. A": {answer: []dns.RR{mustRR(t, "host.insecure.miki. 300 IN A 42.42.42.42")}},
+		"raccoon.miki. MX": {ns: append(
+			miki.sign(t, soa),
+			miki.sign(t, "raccoon.miki. 300 IN NSEC sub.miki. A RRSIG NSEC")...)},
+		"nx.miki. A": {rcode: dns.RcodeNameError, ns: append(append(
+			miki.sign(t, soa),
+			miki.sign(t, "miki. 300 IN NSEC forged.miki. NS SOA RRSIG NSEC DNSKEY")...),
+			miki.sign(t, "insecure.miki. 300 IN NSEC raccoon.miki. NS RRSIG NSEC")...)},
+		"noproof.miki. A":      {rcode: dns.RcodeNameError, ns: miki.sign(t, soa)},
+		"ancestor.sub.miki. A": {answer: miki.sign(t, "ancestor.sub.miki. 300 IN A 42.42.42.42")},
+		"a.wild.miki. A": {
+			answer: expand("a.wild.miki.", miki.sign(t, "*.wild.miki. 300 IN A 42.42.42.42")),
+			ns:     miki.sign(t, "*.wild.miki. 300 IN NSEC b.wild.miki. A RRSIG NSEC"),
+		},
+		"c.wild.miki. A": {answer: expand("c.wild.miki.", miki.sign(t, "*.wild.miki. 300 IN A 42.42.42.42"))},
+		"x.y.miki. A": {
+			answer: miki.sign(t, "x.y.miki. 300 IN A 42.42.42.42"),
+			ns: append(
+				miki.sign(t, "y.miki. 300 IN NSEC x.y.miki. RRSIG NSEC"),
+				miki.sign(t, "x.y.miki. 300 IN NSEC z.miki. A RRSIG NSEC")...),
+		},
+		"host.flaky.miki. A": {answer: miki.sign(t, "host.flaky.miki. 300 IN A 42.42.42.42")},
+	}
+	// failing are the lookups the upstream fails.
+	failing := map[string]bool{"flaky.miki. DS": true}
+
+	var lookups []string
+	upstream := funcTransport(func(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+		k := q.Question[0].Name + " " + dns.TypeToString[q.Question[0].Qtype]
+		lookups = append(lookups, k)
+		if failing[k] {
+			return nil, fmt.Errorf("lookup of %s failed", k)
+		}
+		m := new(dns.Msg).SetReply(q)
+		if opt := q.IsEdns0(); opt == nil || !opt.Do() || !q.CheckingDisabled {
+			return nil, fmt.Errorf("query %v without DO and CD bits", q.Question[0])
+		}
+		r := zone[k]
+		m.Rcode, m.Answer, m.Ns = r.rcode, r.answer, r.ns
+		return m, nil
+	})
+	anchor := miki.key.ToDS(dns.SHA256)
+	s := NewServerWithOptions(
+		WithCacheSize(-1),
+		WithUpstreams("fake://"),
+		WithUpstreamTransport("fake", func(string) (UpstreamTransport, error) { return upstream, nil }),
+		WithDNSSECValidation(anchor),
+	)
+
+	tests := []struct {
+		qname     string
+		qtype     uint16
+		wantRcode int
+		wantAD    bool
+	}{
+		{qname: "raccoon.miki.", qtype: dns.TypeA, wantAD: true},
+		{qname: "www.miki.", qtype: dns.TypeA, wantAD: true},
+		{qname: "forged.miki.", qtype: dns.TypeA, wantRcode: dns.RcodeServerFailure},
+		{qname: "unsigned.miki.", qtype: dns.TypeA, wantRcode: dns.RcodeServerFailure},
+		{qname: "host.sub.miki.", qtype: dns.TypeA, wantAD: true},
+		{qname: "host.insecure.miki.", qtype: dns.TypeA},
+		{qname: "raccoon.miki.", qtype: dns.TypeMX, wantAD: true},
+		{qname: "nx.miki.", qtype: dns.TypeA, wantRcode: dns.RcodeNameError, wantAD: true},
+		{qname: "noproof.miki.", qtype: dns.TypeA, wantRcode: dns.RcodeServerFailure},
+		// sub.miki. is a signed delegation, so its records cannot be signed by miki.
+		{qname: "ancestor.sub.miki.", qtype: dns.TypeA, wantRcode: dns.RcodeServerFailure},
+		{qname: "a.wild.miki.", qtype: dns.TypeA, wantAD: true},
+		// Without a proof that c.wild.miki. does not exist the wildcard expansion is not validated.
+		{qname: "c.wild.miki.", qtype: dns.TypeA},
+		// The NSEC records in the response prove that there are no delegations to look up.
+		{qname: "x.y.miki.", qtype: dns.TypeA, wantAD: true},
+		// Whether flaky.miki. is a delegation is unknown, the answer is not validated but not bogus either.
+		{qname: "host.flaky.miki.", qtype: dns.TypeA},
+	}
+	for _, tt := range tests {
+		for _, do := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s %s do=%t", tt.qname, dns.TypeToString[tt.qtype], do), func(t *testing.T) {
+				var q dns.Msg
+				q.SetQuestion(tt.qname, tt.qtype)
+				if do {
+					q.SetEdns0(1232, true)
+				}
+				w := &fakeResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 42}}
+				s.ServeDNS(w, &q)
+				if len(w.msgs) != 1 {
+					t.Fatalf("responses: got %d want 1", len(w.msgs))
+				}
+				m := w.msgs[0]
+				if m.Rcode != tt.wantRcode {
+					t.Fatalf("rcode: got %s want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.wantRcode])
+				}
+				if want := tt.wantAD && do; m.AuthenticatedData != want {
+					t.Errorf("AD: got %t want %t", m.AuthenticatedData, want)
+				}
+				var sigs int
+				for _, rr := range append(m.Answer, m.Ns...) {
+					if rr.Header().Rrtype == dns.TypeRRSIG {
+						sigs++
+					}
+				}
+				if (sigs > 0 && !do) || (sigs == 0 && do && tt.wantAD) {
+					t.Errorf("signatures: got %d with DO %t", sigs, do)
+				}
+			})
+		}
+	}
+	// Keys and delegations are remembered.
+	for _, l := range []string{"miki. DNSKEY", "sub.miki. DS", "insecure.miki. DS"} {
+		var n int
+		for _, got := range lookups {
+			if got == l {
+				n++
+			}
+		}
+		if n != 1 {
+			t.Errorf("lookups of %s: got %d want 1", l, n)
+		}
+	}
+	for _, got := range lookups {
+		if got == "y.miki. DS" || got == "x.y.miki. DS" {
+			t.Errorf("looked up %s, which the response proved", got)
+		}
+	}
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatalf("Cannot parse %q: %v", s, err)
+	}
+	return rr
+}
+
+func TestNSEC3Proofs(t *testing.T) {
+	const (
+		apex = "miki."
+		salt = "AABB"
+		iter = 1
+	)
+	hash := func(name string) string { return dns.HashName(name, dns.SHA1, iter, salt) }
+	// nsec3 returns a record for the hash of owner covering the hashes up to next, exclusive.
+	nsec3 := func(ownerHash, nextHash string, flags uint8, types ...uint16) *dns.NSEC3 {
+		return &dns.NSEC3{
+			Hdr:        dns.RR_Header{Name: strings.ToLower(ownerHash) + "." + apex, Rrtype: dns.TypeNSEC3, Class: dns.ClassINET, Ttl: 300},
+			Hash:       dns.SHA1,
+			Flags:      flags,
+			Iterations: iter,
+			SaltLength: uint8(len(salt) / 2),
+			Salt:       salt,
+			HashLength: 20,
+			NextDomain: nextHash,
+			TypeBitMap: types,
+		}
+	}
+	// around returns a record covering h, assuming no other hash is that close.
+	around := func(h string, flags uint8) *dns.NSEC3 {
+		lo, hi := []byte(h), []byte(h)
+		lo[len(lo)-1]--
+		hi[len(hi)-1]++
+		return nsec3(string(lo), string(hi), flags)
+	}
+
+	match := nsec3(hash(apex), hash(apex), 0, dns.TypeNS, dns.TypeSOA)
+	if got := provesNoData([]dns.RR{match}, apex, dns.TypeA); !got {
+		t.Errorf("NODATA with matching NSEC3: got false want true")
+	}
+	if got := provesNoData([]dns.RR{match}, apex, dns.TypeSOA); got {
+		t.Errorf("NODATA for existing type: got true want false")
+	}
+
+	nx := []dns.RR{
+		nsec3(hash(apex), hash(apex)+"0", 0, dns.TypeSOA),
+		around(hash("nx."+apex), 0),
+		around(hash("*."+apex), 0),
+	}
+	if got := provesNXDomain(nx, "nx."+apex); !got {
+		t.Errorf("NXDOMAIN with closest encloser proof: got false want true")
+	}
+	if got := provesNXDomain(nx[:2], "nx."+apex); got {
+		t.Errorf("NXDOMAIN without wildcard proof: got true want false")
+	}
+
+	for _, tt := range []struct {
+		name   string
+		rr     *dns.NSEC3
+		want   cutStatus
+		wantOK bool
+	}{
+		{name: "insecure delegation", rr: nsec3(hash("child."+apex), hash("child."+apex), 0, dns.TypeNS), want: cutInsecure, wantOK: true},
+		{name: "signed delegation", rr: nsec3(hash("child."+apex), hash("child."+apex), 0, dns.TypeNS, dns.TypeDS), want: cutSigned, wantOK: true},
+		{name: "not a delegation", rr: nsec3(hash("child."+apex), hash("child."+apex), 0, dns.TypeA), want: cutSecure, wantOK: true},
+		{name: "missing name", rr: around(hash("child."+apex), 0), want: cutSecure, wantOK: true},
+		{name: "opt-out span", rr: around(hash("child."+apex), 1), want: cutUnknown},
+	} {
+		if st, ok := cutProof([]dns.RR{tt.rr}, apex, "child."+apex); st != tt.want || ok != tt.wantOK {
+			t.Errorf("cut proof for %s: got %d, %t want %d, %t", tt.name, st, ok, tt.want, tt.wantOK)
+		}
+	}
+
+	v := newValidator(nil, nil, time.Now)
+	if st, _ := v.cutStatus(&dns.Msg{}, "child."+apex); st != cutSecure {
+		t.Errorf("cut without proof: got %d want %d", st, cutSecure)
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/miekg/dns"
+)
+
+// dohScheme is the scheme of the built-in DNS over HTTPS transport.
+const dohScheme = "https"
+
+const dohMediaType = "application/dns-message"
+
+// doh is the built-in DNS over HTTPS (RFC 8484) UpstreamTransport.
+// Connections are kept open for reuse by the HTTP client, and HTTP/2 is used if the server supports it.
+type doh struct {
+	url string
+	t   *http.Transport
+	c   *http.Client
+}
+
+func (s *Server) newDoH(spec string) (*doh, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, errors.New("missing host")
+	}
+	servername := u.Hostname()
+	t := &http.Transport{
+		DialTLS: func(network, addr string) (net.Conn, error) {
+			cfg := s.tlsConfig(servername)
+			cfg.NextProtos = []string{"h2", "http/1.1"}
+			return s.dial(addr, cfg)
+		},
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: s.opts.poolSize,
+	}
+	return &doh{url: spec, t: t, c: &http.Client{Transport: t, Timeout: s.opts.upstreamTimeout}}, nil
+}
+
+// Exchange implements UpstreamTransport.
+func (d *doh) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 recommends an ID of 0 to make responses cacheable by HTTP caches.
+	pq := *q
+	pq.Id = 0
+	buf, err := pq.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	req.Header.Set("Accept", dohMediaType)
+	resp, err := d.c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %q", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != dohMediaType {
+		return nil, fmt.Errorf("unexpected content type %q", ct)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	m := new(dns.Msg)
+	if err := m.Unpack(body); err != nil {
+		return nil, err
+	}
+	m.Id = q.Id
+	return m, nil
+}
+
+// Close implements UpstreamTransport.
+func (d *doh) Close() {
+	d.t.CloseIdleConnections()
+}
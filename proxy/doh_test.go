@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDoH(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		conns int
+	)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if r.ProtoMajor != 2 {
+			t.Errorf("protocol: got %s want HTTP/2", r.Proto)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		q := new(dns.Msg)
+		if err := q.Unpack(body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if q.Id != 0 {
+			t.Errorf("query ID: got %d want 0", q.Id)
+		}
+		m := new(dns.Msg).SetReply(q)
+		rr, _ := dns.NewRR(q.Question[0].Name + " 2311 IN A 42.42.42.42")
+		m.Answer = []dns.RR{rr}
+		buf, _ := m.Pack()
+		w.Header().Set("Content-Type", dohMediaType)
+		_, _ = w.Write(buf)
+	}))
+	srv.EnableHTTP2 = true
+	srv.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	dial := func(o *options) {
+		o.dial = func(addr string, cfg *tls.Config) (net.Conn, error) {
+			cfg = cfg.Clone()
+			cfg.RootCAs = roots
+			// The test certificate is only valid for example.com and 127.0.0.1.
+			cfg.ServerName = "example.com"
+			return tls.Dial("tcp", addr, cfg)
+		}
+	}
+	s := NewServerWithOptions(WithUpstreams(srv.URL+"/dns-query", "dns.google:853@8.8.8.8"), dial)
+	if len(s.upstreams) != 2 {
+		t.Fatalf("upstreams: got %d want 2", len(s.upstreams))
+	}
+	if _, ok := s.upstreams[0].t.(*doh); !ok {
+		t.Errorf("DoH upstream transport: got %T", s.upstreams[0].t)
+	}
+	if _, ok := s.upstreams[1].t.(*pool); !ok {
+		t.Errorf("DoT upstream transport: got %T", s.upstreams[1].t)
+	}
+	defer s.upstreams[0].t.Close()
+
+	for i := 0; i < 3; i++ {
+		q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+		m, err := s.exchange(context.Background(), s.upstreams[0], q)
+		if err != nil {
+			t.Fatalf("Cannot exchange messages: %v", err)
+		}
+		if m.Id != q.Id {
+			t.Errorf("response ID: got %d want %d", m.Id, q.Id)
+		}
+		if len(m.Answer) != 1 {
+			t.Errorf("answer: got %v want one record", m.Answer)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if conns != 1 {
+		t.Errorf("connections: got %d want 1", conns)
+	}
+
+	s = NewServerWithOptions(WithUpstreams("https://"))
+	if got := len(s.FailedUpstreams()); got != 1 {
+		t.Errorf("invalid DoH URL: got %d failed upstreams want 1", got)
+	}
+}
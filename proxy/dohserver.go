@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// DoHHandler returns an http.Handler that answers DNS over HTTPS (RFC 8484) queries, sent either with GET
+// and the base64url encoded message in the dns parameter or with POST and the message as body.
+// Queries are answered as the ones received by Run, including access control and rate limiting by client IP.
+// The handler does not terminate TLS, it is meant to be served with http.ListenAndServeTLS or behind a
+// reverse proxy, at the path chosen by the caller, usually /dns-query. The clients of queries relayed by
+// reverse proxies are only known if the proxies are trusted, see WithDoHTrustedProxies.
+func (s *Server) DoHHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf []byte
+		switch r.Method {
+		case http.MethodGet:
+			var err error
+			if buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns")); err != nil || len(buf) == 0 {
+				http.Error(w, "Missing or invalid dns parameter", http.StatusBadRequest)
+				return
+			}
+		case http.MethodPost:
+			if ct := r.Header.Get("Content-Type"); ct != dohMediaType {
+				http.Error(w, fmt.Sprintf("Unsupported content type %q", ct), http.StatusUnsupportedMediaType)
+				return
+			}
+			var err error
+			if buf, err = ioutil.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize)); err != nil {
+				http.Error(w, "Unable to read the query", http.StatusBadRequest)
+				return
+			}
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		q := new(dns.Msg)
+		if err := q.Unpack(buf); err != nil || len(q.Question) == 0 {
+			http.Error(w, "Invalid DNS message", http.StatusBadRequest)
+			return
+		}
+
+		dw := &dohResponseWriter{remote: s.dohClientAddr(r)}
+		s.ServeDNS(dw, q)
+		if dw.m == nil {
+			http.Error(w, "No response", http.StatusInternalServerError)
+			return
+		}
+		resp, err := dw.m.Pack()
+		if err != nil {
+			log.Debugf("Unable to pack DoH response for %q: %v", q.Question[0].Name, err)
+			http.Error(w, "Unable to pack the response", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		if ttl, ok := minTTL(dw.m); ok {
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+		} else {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		_, _ = w.Write(resp)
+	})
+}
+
+// dohClientAddr returns the address of the client that sent r. Queries received over HTTP are treated as
+// received over TCP. If r was sent by a trusted proxy, the client is the closest address in the
+// Forwarded header, or in the X-Forwarded-For one if there is none, that is not a trusted proxy.
+func (s *Server) dohClientAddr(r *http.Request) net.Addr {
+	addr := parseForwardedNode(r.RemoteAddr)
+	if addr == nil {
+		return &net.TCPAddr{}
+	}
+	if !contains(s.opts.dohTrustedProxies, addr.IP) {
+		return addr
+	}
+	hops := forwardedFor(r.Header)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseForwardedNode(hops[i])
+		if hop == nil {
+			// The proxy does not know the address of its client, e.g. it is obfuscated.
+			break
+		}
+		addr = hop
+		if !contains(s.opts.dohTrustedProxies, addr.IP) {
+			break
+		}
+	}
+	return addr
+}
+
+// forwardedFor returns the addresses of the clients and proxies r went through, from the first client to
+// the last proxy, as reported in the for parameters of the Forwarded header (RFC 7239) or in the
+// X-Forwarded-For header.
+func forwardedFor(h http.Header) []string {
+	var hops []string
+	for _, v := range h["Forwarded"] {
+		for _, elem := range strings.Split(v, ",") {
+			node := "unknown"
+			for _, pair := range strings.Split(elem, ";") {
+				if kv := strings.SplitN(strings.TrimSpace(pair), "=", 2); len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					node = kv[1]
+				}
+			}
+			hops = append(hops, node)
+		}
+	}
+	if hops != nil {
+		return hops
+	}
+	for _, v := range h["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	return hops
+}
+
+// parseForwardedNode parses an IP address, optionally quoted, with an optional port and with IPv6
+// addresses optionally between square brackets. It returns nil for anything else, e.g. the unknown and
+// obfuscated identifiers of RFC 7239.
+func parseForwardedNode(node string) *net.TCPAddr {
+	node = strings.Trim(strings.TrimSpace(node), `"`)
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")); ip != nil {
+		return &net.TCPAddr{IP: ip}
+	}
+	host, port, err := net.SplitHostPort(node)
+	if err != nil {
+		return nil
+	}
+	ip := net.ParseIP(host)
+	p, err := strconv.Atoi(port)
+	if ip == nil || err != nil {
+		return nil
+	}
+	return &net.TCPAddr{IP: ip, Port: p}
+}
+
+// minTTL returns the smallest TTL of the records in m, which is how long HTTP caches can keep it.
+// It reports false if m has no records.
+func minTTL(m *dns.Msg) (uint32, bool) {
+	ttl := uint32(math.MaxUint32)
+	for _, sec := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range sec {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if t := rr.Header().Ttl; t < ttl {
+				ttl = t
+			}
+		}
+	}
+	return ttl, ttl != math.MaxUint32
+}
+
+// dohResponseWriter is the dns.ResponseWriter used to answer DoH queries, it keeps the response so that
+// it can be written in the HTTP response.
+type dohResponseWriter struct {
+	remote net.Addr
+	m      *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.m = m
+	return nil
+}
+
+func (w *dohResponseWriter) Write(buf []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(buf); err != nil {
+		return 0, err
+	}
+	w.m = m
+	return len(buf), nil
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDoHHandler(t *testing.T) {
+	upstream := funcTransport(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+		if q.Question[0].Name == "fail.miki." {
+			return nil, errors.New("failing upstream")
+		}
+		return (&fakeTransport{}).Exchange(ctx, q)
+	})
+	s := NewServerWithOptions(
+		WithCacheSize(-1),
+		WithUpstreams("fake://"),
+		WithUpstreamTransport("fake", func(string) (UpstreamTransport, error) { return upstream, nil }),
+	)
+	srv := httptest.NewServer(s.DoHHandler())
+	defer srv.Close()
+
+	pack := func(name string) []byte {
+		q := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		q.Id = 0
+		buf, err := q.Pack()
+		if err != nil {
+			t.Fatalf("Cannot pack query: %v", err)
+		}
+		return buf
+	}
+	get := func(param string) *http.Request {
+		r, _ := http.NewRequest(http.MethodGet, srv.URL+"/dns-query?dns="+param, nil)
+		return r
+	}
+	post := func(body []byte, ct string) *http.Request {
+		r, _ := http.NewRequest(http.MethodPost, srv.URL+"/dns-query", bytes.NewReader(body))
+		r.Header.Set("Content-Type", ct)
+		return r
+	}
+	tests := []struct {
+		name             string
+		req              *http.Request
+		wantStatus       int
+		wantRcode        int
+		wantCacheControl string
+	}{
+		{
+			name:             "GET",
+			req:              get(base64.RawURLEncoding.EncodeToString(pack(testQuestion))),
+			wantStatus:       http.StatusOK,
+			wantCacheControl: "max-age=300",
+		},
+		{
+			name:             "POST",
+			req:              post(pack(testQuestion), dohMediaType),
+			wantStatus:       http.StatusOK,
+			wantCacheControl: "max-age=300",
+		},
+		{
+			name:             "SERVFAIL",
+			req:              post(pack("fail.miki."), dohMediaType),
+			wantStatus:       http.StatusOK,
+			wantRcode:        dns.RcodeServerFailure,
+			wantCacheControl: "no-store",
+		},
+		{name: "missing parameter", req: get(""), wantStatus: http.StatusBadRequest},
+		{name: "padded parameter", req: get(base64.URLEncoding.EncodeToString(pack(testQuestion)) + "="), wantStatus: http.StatusBadRequest},
+		{name: "invalid message", req: post([]byte("raccoon"), dohMediaType), wantStatus: http.StatusBadRequest},
+		{name: "content type", req: post(pack(testQuestion), "text/plain"), wantStatus: http.StatusUnsupportedMediaType},
+		{name: "method", req: func() *http.Request { r, _ := http.NewRequest(http.MethodPut, srv.URL, nil); return r }(), wantStatus: http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := http.DefaultClient.Do(tt.req)
+			if err != nil {
+				t.Fatalf("Cannot send request: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status: got %d want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != dohMediaType {
+				t.Errorf("content type: got %q want %q", ct, dohMediaType)
+			}
+			if cc := resp.Header.Get("Cache-Control"); cc != tt.wantCacheControl {
+				t.Errorf("cache control: got %q want %q", cc, tt.wantCacheControl)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Cannot read response: %v", err)
+			}
+			m := new(dns.Msg)
+			if err := m.Unpack(body); err != nil {
+				t.Fatalf("Cannot unpack response: %v", err)
+			}
+			if m.Id != 0 || m.Rcode != tt.wantRcode {
+				t.Errorf("response: got ID %d and rcode %s want 0 and %s", m.Id, dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+		})
+	}
+}
+
+func TestDoHClientAddr(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	s := NewServerWithOptions(WithDoHTrustedProxies(trusted))
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string][]string
+		want    string
+	}{
+		{name: "direct", remote: "192.0.2.1:1234", want: "192.0.2.1:1234"},
+		{
+			name:    "untrusted proxy",
+			remote:  "192.0.2.1:1234",
+			headers: map[string][]string{"X-Forwarded-For": {"198.51.100.1"}},
+			want:    "192.0.2.1:1234",
+		},
+		{
+			name:    "X-Forwarded-For",
+			remote:  "10.0.0.1:1234",
+			headers: map[string][]string{"X-Forwarded-For": {"203.0.113.1, 198.51.100.1, 10.0.0.2"}},
+			want:    "198.51.100.1:0",
+		},
+		{
+			name:    "Forwarded",
+			remote:  "10.0.0.1:1234",
+			headers: map[string][]string{"Forwarded": {`for="[2001:db8::1]:4711";proto=https`, "for=10.0.0.2"}},
+			want:    "[2001:db8::1]:4711",
+		},
+		{
+			name:    "Forwarded takes precedence",
+			remote:  "10.0.0.1:1234",
+			headers: map[string][]string{"Forwarded": {"for=192.0.2.2"}, "X-Forwarded-For": {"198.51.100.1"}},
+			want:    "192.0.2.2:0",
+		},
+		{
+			name:    "obfuscated",
+			remote:  "10.0.0.1:1234",
+			headers: map[string][]string{"Forwarded": {"for=_hidden, for=10.0.0.2"}},
+			want:    "10.0.0.2:0",
+		},
+		{
+			name:   "only proxies",
+			remote: "10.0.0.1:1234",
+			want:   "10.0.0.1:1234",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header[k] = v
+			}
+			if got := s.dohClientAddr(r).String(); got != tt.want {
+				t.Errorf("client: got %s want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// WithClientSubnet makes the server add an EDNS0 Client Subnet option (RFC 7871) to forwarded queries,
+// so that upstreams can tailor answers to the location of clients. The subnet is derived from the
+// address of the client, truncated to v4Prefix or v6Prefix bits. A prefix of 0 disables the option
+// for the address family. Queries that already carry the option are forwarded as they are.
+// Answers are cached separately for every subnet.
+func WithClientSubnet(v4Prefix, v6Prefix int) Option {
+	return func(o *options) {
+		o.ecsV4Prefix = v4Prefix
+		o.ecsV6Prefix = v6Prefix
+	}
+}
+
+// clientSubnet returns the EDNS0 Client Subnet option of m, if any.
+func clientSubnet(m *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return ecs
+		}
+	}
+	return nil
+}
+
+// withClientSubnet returns a copy of q with the EDNS0 Client Subnet option for ip, or q itself if the option
+// should not be added.
+func (s *Server) withClientSubnet(q *dns.Msg, ip net.IP) *dns.Msg {
+	if ip == nil || clientSubnet(q) != nil {
+		return q
+	}
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := ip.To4(); ip4 != nil {
+		ecs.Family = 1
+		ecs.SourceNetmask = uint8(clamp(s.opts.ecsV4Prefix, 32))
+		ecs.Address = ip4.Mask(net.CIDRMask(int(ecs.SourceNetmask), 32))
+	} else {
+		ecs.Family = 2
+		ecs.SourceNetmask = uint8(clamp(s.opts.ecsV6Prefix, 128))
+		ecs.Address = ip.Mask(net.CIDRMask(int(ecs.SourceNetmask), 128))
+	}
+	if ecs.SourceNetmask == 0 {
+		return q
+	}
+	fq := q.Copy()
+	opt := fq.IsEdns0()
+	if opt == nil {
+		fq.SetEdns0(ednsUDPSize, false)
+		opt = fq.IsEdns0()
+	}
+	opt.Option = append(opt.Option, ecs)
+	return fq
+}
+
+// removeClientSubnet removes the EDNS0 Client Subnet option from m.
+func removeClientSubnet(m *dns.Msg) {
+	removeEdns0Option(m, dns.EDNS0SUBNET)
+}
+
+func clamp(v, max int) int {
+	switch {
+	case v < 0:
+		return 0
+	case v > max:
+		return max
+	}
+	return v
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientSubnet(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		subnets []string
+	)
+	ts, cleanup := setupTestServerWithHandler(t, 0, func(w dns.ResponseWriter, q *dns.Msg) {
+		ecs := clientSubnet(q)
+		mu.Lock()
+		if ecs == nil {
+			subnets = append(subnets, "")
+		} else {
+			bits := 32
+			if ecs.Family == 2 {
+				bits = 128
+			}
+			subnets = append(subnets, (&net.IPNet{IP: ecs.Address, Mask: net.CIDRMask(int(ecs.SourceNetmask), bits)}).String())
+		}
+		mu.Unlock()
+		m := new(dns.Msg).SetReply(q)
+		rr, _ := dns.NewRR("raccoon.miki. 2311 IN MX 10 42.42.42.42")
+		m.Answer = []dns.RR{rr}
+		if ecs != nil {
+			// Echo the option back as required by RFC 7871.
+			m.SetEdns0(4096, false)
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, ecs)
+		}
+		_ = w.WriteMsg(m)
+	}, WithClientSubnet(24, 56))
+	defer cleanup()
+
+	query := func(ip string, edns bool) *dns.Msg {
+		t.Helper()
+		q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeMX)
+		if edns {
+			q.SetEdns0(4096, false)
+		}
+		w := &fakeResponseWriter{remote: &net.UDPAddr{IP: net.ParseIP(ip), Port: 42}}
+		ts.s.ServeDNS(w, q)
+		if len(w.msgs) != 1 || len(w.msgs[0].Answer) != 1 {
+			t.Fatalf("%s: got %v want one answer", ip, w.msgs)
+		}
+		return w.msgs[0]
+	}
+	for _, c := range []struct {
+		ip   string
+		edns bool
+	}{
+		{"10.0.0.1", false},
+		{"10.0.0.2", true}, // Same subnet, from cache.
+		{"10.0.1.1", false},
+		{"2001:db8:1:2::1", true},
+		{"2001:db8:1:3::1", false}, // Same /56, from cache.
+	} {
+		m := query(c.ip, c.edns)
+		if opt := m.IsEdns0(); (opt != nil) != c.edns {
+			t.Errorf("%s: got OPT %v want OPT %t", c.ip, opt, c.edns)
+		}
+		if ecs := clientSubnet(m); ecs != nil {
+			t.Errorf("%s: got client subnet %v in the response to a query without it", c.ip, ecs)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"10.0.0.0/24", "10.0.1.0/24", "2001:db8:1::/56"}
+	if len(subnets) != len(want) {
+		t.Fatalf("upstream subnets: got %q want %q", subnets, want)
+	}
+	for i := range want {
+		if subnets[i] != want[i] {
+			t.Errorf("upstream subnet %d: got %q want %q", i, subnets[i], want[i])
+		}
+	}
+}
+
+func TestClientSubnetKey(t *testing.T) {
+	s := NewServerWithOptions(WithClientSubnet(24, 0))
+	q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+	for _, tt := range []struct {
+		a, b string
+		same bool
+	}{
+		{"192.0.2.1", "192.0.2.200", true},
+		{"192.0.2.1", "192.0.3.1", false},
+		// IPv6 is disabled, so all IPv6 clients share the key of queries without subnet.
+		{"2001:db8::1", "2001:db8:ffff::1", true},
+	} {
+		ka, kb := key(s.withClientSubnet(q, net.ParseIP(tt.a))), key(s.withClientSubnet(q, net.ParseIP(tt.b)))
+		if (ka == kb) != tt.same {
+			t.Errorf("keys for %s and %s: got %q and %q, want same %t", tt.a, tt.b, ka, kb, tt.same)
+		}
+	}
+	if q.IsEdns0() != nil {
+		t.Errorf("withClientSubnet modified the query")
+	}
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxHealthBackoff caps how long the health checker waits between probes of an unhealthy upstream.
+const maxHealthBackoff = 5 * time.Minute
+
+// WithHealthCheck makes the server ask every upstream for the root NS records every interval.
+// Upstreams failing failures consecutive checks are marked unhealthy and are not asked to resolve
+// questions until they answer a check again, unless all upstreams are unhealthy. Unhealthy upstreams
+// are checked with an exponential backoff, up to maxHealthBackoff.
+// An interval <= 0 disables health checks, a failures <= 0 is treated as 1.
+func WithHealthCheck(interval time.Duration, failures int) Option {
+	return func(o *options) {
+		o.healthInterval = interval
+		o.healthFailures = failures
+	}
+}
+
+// healthy reports whether u is passing its health checks.
+func (u *upstream) healthy() bool {
+	return atomic.LoadInt32(&u.unhealthy) == 0
+}
+
+func (s *Server) healthChecker(ctx context.Context) {
+	t := time.NewTicker(s.opts.healthInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.checkHealth(ctx, now)
+		}
+	}
+}
+
+// checkHealth checks the upstreams that are due at now, concurrently, and waits for the checks to complete.
+func (s *Server) checkHealth(ctx context.Context, now time.Time) {
+	var wg sync.WaitGroup
+	for _, u := range s.allUpstreams() {
+		if now.Before(u.nextCheck) {
+			continue
+		}
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			s.checkUpstream(ctx, u, now)
+		}(u)
+	}
+	wg.Wait()
+}
+
+// checkUpstream sends a health check to u and updates its health state.
+// The scheduling fields of u are only accessed by the health checker.
+func (s *Server) checkUpstream(ctx context.Context, u *upstream, now time.Time) {
+	q := new(dns.Msg).SetQuestion(".", dns.TypeNS)
+	_, err := s.exchange(ctx, u, q)
+	if ctx.Err() != nil {
+		return
+	}
+	if err == nil {
+		atomic.StoreUint32(&u.checkFailures, 0)
+		u.backoff = 0
+		if atomic.CompareAndSwapInt32(&u.unhealthy, 1, 0) {
+			log.Infof("Upstream %s is healthy again", u.addr)
+		}
+		return
+	}
+	failures := atomic.AddUint32(&u.checkFailures, 1)
+	log.Debugf("Health check of upstream %s failed: %v", u.addr, err)
+	threshold := s.opts.healthFailures
+	if threshold <= 0 {
+		threshold = 1
+	}
+	if int(failures) < threshold {
+		return
+	}
+	if atomic.CompareAndSwapInt32(&u.unhealthy, 0, 1) {
+		log.Warnf("Upstream %s is unhealthy after %d failed health checks: %v", u.addr, failures, err)
+	}
+	switch {
+	case u.backoff == 0:
+		u.backoff = s.opts.healthInterval
+	case u.backoff < maxHealthBackoff:
+		u.backoff *= 2
+	}
+	if u.backoff > maxHealthBackoff {
+		u.backoff = maxHealthBackoff
+	}
+	u.nextCheck = now.Add(u.backoff)
+}
+
+// healthyTiers returns the tiers of ups without the unhealthy upstreams, omitting the tiers left empty.
+// If all ups are unhealthy all tiers are returned, as failing is not better than trying.
+func (s *Server) healthyTiers(ups []*upstream, all [][]*upstream) [][]*upstream {
+	if s.opts.healthInterval <= 0 {
+		return all
+	}
+	healthy := true
+	for _, u := range ups {
+		if !u.healthy() {
+			healthy = false
+			break
+		}
+	}
+	if healthy {
+		return all
+	}
+	var tiers [][]*upstream
+	for _, tier := range all {
+		var ups []*upstream
+		for _, u := range tier {
+			if u.healthy() {
+				ups = append(ups, u)
+			}
+		}
+		if len(ups) > 0 {
+			tiers = append(tiers, ups)
+		}
+	}
+	if len(tiers) == 0 {
+		return all
+	}
+	return tiers
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestHealthCheck(t *testing.T) {
+	var (
+		down      int32 = 1
+		badChecks int32
+	)
+	good := &fakeTransport{}
+	bad := funcTransport(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+		if q.Question[0].Name == "." {
+			atomic.AddInt32(&badChecks, 1)
+		}
+		if atomic.LoadInt32(&down) == 1 {
+			return nil, errors.New("down")
+		}
+		return good.Exchange(ctx, q)
+	})
+	const interval = time.Second
+	s := NewServerWithOptions(
+		WithCacheSize(-1),
+		WithUpstreams("fake://bad", "fake://good"),
+		WithUpstreamTransport("fake", func(spec string) (UpstreamTransport, error) {
+			if spec == "fake://bad" {
+				return bad, nil
+			}
+			return good, nil
+		}),
+		WithSelectionStrategy(SelectRoundRobin),
+		WithHealthCheck(interval, 2),
+	)
+	badU := s.upstreams[0]
+	ctx := context.Background()
+	now := time.Now()
+	check := func(wantChecks int32, wantHealthy bool) {
+		t.Helper()
+		s.checkHealth(ctx, now)
+		if got := atomic.LoadInt32(&badChecks); got != wantChecks {
+			t.Errorf("checks: got %d want %d", got, wantChecks)
+		}
+		if got := s.upstreamStats()[0].Healthy; got != wantHealthy {
+			t.Errorf("healthy: got %t want %t", got, wantHealthy)
+		}
+	}
+
+	check(1, true)
+	now = now.Add(interval)
+	check(2, false)
+	// Unhealthy upstreams are not asked.
+	for i := 0; i < 4; i++ {
+		q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+		if _, u := s.forwardMessageAndGetResponse(ctx, q); u != s.upstreams[1] {
+			t.Fatalf("upstream: got %v want %v", u, s.upstreams[1])
+		}
+	}
+	// Checks back off.
+	now = now.Add(interval / 2)
+	check(2, false)
+	now = now.Add(interval / 2)
+	check(3, false)
+	if got, want := badU.nextCheck, now.Add(2*interval); !got.Equal(want) {
+		t.Errorf("next check: got %v want %v", got, want)
+	}
+	now = now.Add(interval)
+	check(3, false)
+	// Recovery is noticed at the next check.
+	atomic.StoreInt32(&down, 0)
+	now = now.Add(interval)
+	check(4, true)
+	if got := s.upstreamStats()[0].HealthCheckFailures; got != 0 {
+		t.Errorf("failures: got %d want 0", got)
+	}
+}
+
+func TestAllUnhealthy(t *testing.T) {
+	s := NewServerWithOptions(
+		WithCacheSize(-1),
+		WithUpstreams("fake://one", "fake://two"),
+		WithUpstreamTransport("fake", func(string) (UpstreamTransport, error) { return &fakeTransport{}, nil }),
+		WithHealthCheck(time.Second, 1),
+	)
+	for _, u := range s.upstreams {
+		u.unhealthy = 1
+	}
+	q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+	if m, _ := s.forwardMessageAndGetResponse(context.Background(), q); m == nil {
+		t.Errorf("answer: got nil want the upstreams to be asked anyway")
+	}
+}
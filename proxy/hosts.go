@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ParseHosts reads records from r in hosts file format, to be served with WithLocalZone.
+// Every line of r holds an address followed by one or more names, everything after a # is a comment.
+// Every name gets an A or AAAA record for the address, and the address gets a PTR record for the first
+// name of the first line it appears on. All records have the given TTL.
+// Addresses with a zone, e.g. "fe80::1%lo0", are ignored as they are meaningless to clients.
+func ParseHosts(r io.Reader, ttl uint32) ([]dns.RR, error) {
+	var (
+		rrs  []dns.RR
+		ptrs = make(map[string]bool)
+	)
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		l := sc.Text()
+		if i := strings.IndexByte(l, '#'); i >= 0 {
+			l = l[:i]
+		}
+		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.IndexByte(fields[0], '%') >= 0 {
+			continue
+		}
+		if len(fields) == 1 {
+			return nil, fmt.Errorf("line %d: missing names for %q", line, fields[0])
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, fmt.Errorf("line %d: invalid address %q", line, fields[0])
+		}
+		for _, n := range fields[1:] {
+			if _, ok := dns.IsDomainName(n); !ok {
+				return nil, fmt.Errorf("line %d: invalid name %q", line, n)
+			}
+			hdr := dns.RR_Header{Name: dns.Fqdn(n), Class: dns.ClassINET, Ttl: ttl}
+			if ip4 := ip.To4(); ip4 != nil {
+				hdr.Rrtype = dns.TypeA
+				rrs = append(rrs, &dns.A{Hdr: hdr, A: ip4})
+			} else {
+				hdr.Rrtype = dns.TypeAAAA
+				rrs = append(rrs, &dns.AAAA{Hdr: hdr, AAAA: ip})
+			}
+		}
+		// ReverseAddr cannot fail on a parsed address.
+		rev, _ := dns.ReverseAddr(ip.String())
+		if ptrs[rev] {
+			continue
+		}
+		ptrs[rev] = true
+		rrs = append(rrs, &dns.PTR{
+			Hdr: dns.RR_Header{Name: rev, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+			Ptr: dns.Fqdn(fields[1]),
+		})
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return rrs, nil
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		hosts   string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "ipv4",
+			hosts: "192.168.1.10 nas nas.home.lan # the NAS\n",
+			want: []string{
+				"nas.\t120\tIN\tA\t192.168.1.10",
+				"nas.home.lan.\t120\tIN\tA\t192.168.1.10",
+				"10.1.168.192.in-addr.arpa.\t120\tIN\tPTR\tnas.",
+			},
+		},
+		{
+			name:  "ipv6",
+			hosts: "2001:db8::10 nas.home.lan",
+			want: []string{
+				"nas.home.lan.\t120\tIN\tAAAA\t2001:db8::10",
+				"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.\t120\tIN\tPTR\tnas.home.lan.",
+			},
+		},
+		{
+			name:  "repeated address",
+			hosts: "192.168.1.10 nas\n192.168.1.10 files",
+			want: []string{
+				"nas.\t120\tIN\tA\t192.168.1.10",
+				"10.1.168.192.in-addr.arpa.\t120\tIN\tPTR\tnas.",
+				"files.\t120\tIN\tA\t192.168.1.10",
+			},
+		},
+		{
+			name:  "comments, blanks and zones",
+			hosts: "# local names\n\n   \nfe80::1%lo0 localhost\n",
+		},
+		{name: "missing names", hosts: "192.168.1.10\n", wantErr: true},
+		{name: "invalid address", hosts: "192.168.1 nas\n", wantErr: true},
+		{name: "invalid name", hosts: "192.168.1.10 nas..lan\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rrs, err := ParseHosts(strings.NewReader(tt.hosts), 120)
+			if gotErr := err != nil; gotErr != tt.wantErr {
+				t.Fatalf("error: got %v want error %v", err, tt.wantErr)
+			}
+			if len(rrs) != len(tt.want) {
+				t.Fatalf("records: got %v want %v", rrs, tt.want)
+			}
+			for i, rr := range rrs {
+				if got := rr.String(); got != tt.want[i] {
+					t.Errorf("record %d: got %q want %q", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestHostsLocalZone(t *testing.T) {
+	rrs, err := ParseHosts(strings.NewReader("192.168.1.10 nas.home.lan\n"), 120)
+	if err != nil {
+		t.Fatalf("Cannot parse hosts: %v", err)
+	}
+	ts, cleanup := setupTestServer(t, 0, nil, WithLocalZone("", rrs...))
+	defer cleanup()
+	var c dns.Client
+	for _, tt := range []struct {
+		qname string
+		qtype uint16
+		want  string
+	}{
+		{"nas.home.lan.", dns.TypeA, "192.168.1.10"},
+		{"10.1.168.192.in-addr.arpa.", dns.TypePTR, "nas.home.lan."},
+	} {
+		var m dns.Msg
+		m.SetQuestion(tt.qname, tt.qtype)
+		r, _, err := c.Exchange(&m, ts.laddr)
+		if err != nil {
+			t.Fatalf("%s: cannot contact server: %v", tt.qname, err)
+		}
+		if len(r.Answer) != 1 || !r.Authoritative {
+			t.Fatalf("%s: got %v want an authoritative answer", tt.qname, r)
+		}
+		if got := r.Answer[0]; got.Header().Ttl != 120 || !strings.HasSuffix(got.String(), tt.want) {
+			t.Errorf("%s: got %v want %s with TTL 120", tt.qname, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// identity holds the TXT records served in the CHAOS class, see WithIdentity.
+type identity struct {
+	version, hostname string
+}
+
+// WithIdentity sets the version and hostname served to CHAOS class TXT queries for version.bind and
+// version.server, and for hostname.bind and id.server (RFC 4892). These are used by monitoring tools
+// to tell servers apart. An empty string disables the corresponding names, which are then refused.
+// By default the build version and the hostname of the machine are served.
+func WithIdentity(version, hostname string) Option {
+	return func(o *options) { o.identity = &identity{version: version, hostname: hostname} }
+}
+
+func defaultIdentity() *identity {
+	h, _ := os.Hostname()
+	return &identity{version: "dns-over-tls-forwarder " + buildVersion(), hostname: h}
+}
+
+// chaosAnswer returns the response to q, which must be in the CHAOS class. Such queries are never
+// forwarded as upstreams would describe themselves rather than this server.
+func (id *identity) chaosAnswer(q *dns.Msg) *dns.Msg {
+	qs := q.Question[0]
+	var txt string
+	switch strings.ToLower(qs.Name) {
+	case "version.bind.", "version.server.":
+		txt = id.version
+	case "hostname.bind.", "id.server.":
+		txt = id.hostname
+	}
+	m := new(dns.Msg)
+	if txt == "" {
+		return m.SetRcode(q, dns.RcodeRefused)
+	}
+	m.SetReply(q)
+	m.Authoritative = true
+	if qs.Qtype == dns.TypeTXT || qs.Qtype == dns.TypeANY {
+		m.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: qs.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS},
+			Txt: []string{txt},
+		}}
+	}
+	return m
+}
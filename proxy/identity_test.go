@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestIdentity(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []Option
+		qname     string
+		wantRcode int
+		wantTXT   string
+	}{
+		{name: "default version", qname: "version.bind.", wantTXT: "dns-over-tls-forwarder "},
+		{name: "version", opts: []Option{WithIdentity("v1", "gopher")}, qname: "VERSION.bind.", wantTXT: "v1"},
+		{name: "version.server", opts: []Option{WithIdentity("v1", "gopher")}, qname: "version.server.", wantTXT: "v1"},
+		{name: "hostname", opts: []Option{WithIdentity("v1", "gopher")}, qname: "hostname.bind.", wantTXT: "gopher"},
+		{name: "id.server", opts: []Option{WithIdentity("v1", "gopher")}, qname: "id.server.", wantTXT: "gopher"},
+		{name: "disabled version", opts: []Option{WithIdentity("", "gopher")}, qname: "version.bind.", wantRcode: dns.RcodeRefused},
+		{name: "unknown name", qname: "authors.bind.", wantRcode: dns.RcodeRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstream int32
+			ts, cleanup := setupTestServer(t, 0, func(string) string {
+				atomic.AddInt32(&upstream, 1)
+				return "42.42.42.42"
+			}, tt.opts...)
+			defer cleanup()
+			q := new(dns.Msg).SetQuestion(tt.qname, dns.TypeTXT)
+			q.Question[0].Qclass = dns.ClassCHAOS
+			w := &fakeResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 42}}
+			ts.s.ServeDNS(w, q)
+			if len(w.msgs) != 1 {
+				t.Fatalf("got %d responses want 1", len(w.msgs))
+			}
+			m := w.msgs[0]
+			if m.Rcode != tt.wantRcode {
+				t.Errorf("rcode: got %s want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			if tt.wantTXT != "" {
+				var got string
+				if len(m.Answer) == 1 {
+					if txt, ok := m.Answer[0].(*dns.TXT); ok && txt.Hdr.Class == dns.ClassCHAOS {
+						got = strings.Join(txt.Txt, "")
+					}
+				}
+				if !strings.HasPrefix(got, tt.wantTXT) {
+					t.Errorf("answer: got %v want a CHAOS TXT starting with %q", m.Answer, tt.wantTXT)
+				}
+			}
+			if got := atomic.LoadInt32(&upstream); got != 0 {
+				t.Errorf("upstream queries: got %d want 0", got)
+			}
+		})
+	}
+}
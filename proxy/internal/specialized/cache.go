@@ -3,6 +3,7 @@ package specialized
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 )
 
@@ -25,6 +26,8 @@ type Cache struct {
 	capacity int
 	// m is used to collect metrics to better tune cache
 	m metrics
+	// lruOnly disables the MFA store, see NewLRUCache
+	lruOnly bool
 }
 
 // compute max size at compile time since it depends on the target architecture
@@ -54,6 +57,24 @@ func NewCache(size int, evictMetrics bool) (*Cache, error) {
 	return &c, nil
 }
 
+// NewLRUCache constructs a new Cache that behaves as a plain Least-Recently-Used cache.
+// All items are kept in the LRU store and there is no promotion to or demotion from MFA,
+// so the least recently accessed item is always the one to be evicted.
+//
+// This makes hit rates easy to reason about, but loses the protection that MFA
+// gives frequently accessed items against bursts of one-off lookups.
+// Parameters have the same meaning as for NewCache.
+func NewLRUCache(size int, evictMetrics bool) (*Cache, error) {
+	c, err := NewCache(size, evictMetrics)
+	if c == nil || err != nil {
+		return c, err
+	}
+	c.lru = newStore(size, byTime)
+	c.mfa = newStore(0, byAccesses)
+	c.lruOnly = true
+	return c, nil
+}
+
 // Metrics copies current metrics values and returns the snapshot.
 // If the cache has size<=0 zero metrics will be returned.
 func (c *Cache) Metrics() CacheMetrics {
@@ -88,6 +109,15 @@ func (c *Cache) Get(k string) (v Value, ok bool) {
 	defer c.mu.Unlock()
 	now := c.now()
 
+	if c.lruOnly {
+		if v, ok := c.lru.get(now, k); ok {
+			c.m.hitLRU()
+			return v, true
+		}
+		c.m.missLRU()
+		c.m.miss(k)
+		return nil, false
+	}
 	if v, ok := c.mfa.get(now, k); ok {
 		// Hit on MFA
 		c.m.hitMFA()
@@ -112,8 +142,30 @@ func (c *Cache) Put(k string, v Value) {
 	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	now := c.now()
+	c.put(c.now(), k, v)
+}
+
+// PutIfAbsent stores an item in the cache unless its key is already stored, and reports whether it
+// was stored. Checking for the key does not count as an access.
+// Its amortized worst-case complexity is ~O(log(c.Len())).
+func (c *Cache) PutIfAbsent(k string, v Value) (stored bool) {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.mfa.m[k]; ok {
+		return false
+	}
+	if _, ok := c.lru.m[k]; ok {
+		return false
+	}
+	c.put(c.now(), k, v)
+	return true
+}
 
+// put stores an item in the cache, c.mu must be held.
+func (c *Cache) put(now uint, k string, v Value) {
 	if c.mfa.update(now, k, v) {
 		// Item was in MFA and was updated
 		return
@@ -128,6 +180,11 @@ func (c *Cache) Put(k string, v Value) {
 		// LRU had room to accommodate the new entry
 		return
 	}
+	if c.lruOnly {
+		// No MFA to promote to, the least recently used item is gone.
+		c.m.evict(lruovf.key)
+		return
+	}
 	// LRU popped out an item because of our push.
 	// Let's promote to MFA if there is room.
 	if c.mfa.Len() < c.mfa.cap() {
@@ -164,6 +221,77 @@ func (c *Cache) Put(k string, v Value) {
 	c.m.evict(lruovf.key)
 }
 
+// Flush removes all items from the cache and returns how many were removed.
+// Removed items are not counted as evictions in the metrics.
+func (c *Cache) Flush() int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.lru.Len() + c.mfa.Len()
+	c.lru = newStore(c.lru.cap(), byTime)
+	c.mfa = newStore(c.mfa.cap(), byAccesses)
+	return n
+}
+
+// DeleteFunc removes the items whose key satisfies match and returns how many were removed.
+// Removed items are not counted as evictions in the metrics.
+// Its complexity is O(c.Len()*log(c.Len())).
+func (c *Cache) DeleteFunc(match func(key string) bool) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, s := range []*store{c.lru, c.mfa} {
+		var keys []string
+		for k := range s.m {
+			if match(k) {
+				keys = append(keys, k)
+			}
+		}
+		for _, k := range keys {
+			if s.remove(k) {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+// Entry is a snapshot of an item stored in the cache.
+type Entry struct {
+	Key      string
+	Value    Value
+	Accesses uint
+}
+
+// MostAccessed returns up to n entries with the highest access count, most accessed first.
+// Calling it does not count as an access to the returned entries.
+// Its complexity is O(c.Len()*log(c.Len())).
+func (c *Cache) MostAccessed(n int) []Entry {
+	if c == nil || n <= 0 {
+		return nil
+	}
+	c.mu.Lock()
+	items := make([]item, 0, c.lru.Len()+c.mfa.Len())
+	items = append(items, c.mfa.pq...)
+	items = append(items, c.lru.pq...)
+	c.mu.Unlock()
+
+	sort.Slice(items, func(i, j int) bool { return items[i].a > items[j].a })
+	if len(items) > n {
+		items = items[:n]
+	}
+	es := make([]Entry, len(items))
+	for i, it := range items {
+		es[i] = Entry{Key: it.key, Value: it.v, Accesses: it.a}
+	}
+	return es
+}
+
 // Len returns the amount of items currently stored in the cache.
 func (c *Cache) Len() int {
 	if c == nil {
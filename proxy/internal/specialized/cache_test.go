@@ -2,6 +2,7 @@ package specialized
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -337,3 +338,138 @@ func BenchmarkMix(b *testing.B) {
 		}
 	}
 }
+
+func TestMostAccessed(t *testing.T) {
+	c, err := NewCache(8, false)
+	if err != nil {
+		t.Fatalf("Cannot construct cache: %v", err)
+	}
+	for i, k := range []string{"foo1", "foo2", "foo3", "foo4", "foo5"} {
+		c.Put(k, i)
+		for j := 0; j < i; j++ {
+			c.Get(k)
+		}
+	}
+	got := c.MostAccessed(3)
+	want := []string{"foo5", "foo4", "foo3"}
+	if len(got) != len(want) {
+		t.Fatalf("MostAccessed(3): got %d entries want %d", len(got), len(want))
+	}
+	for i, e := range got {
+		if e.Key != want[i] {
+			t.Errorf("MostAccessed(3)[%d]: got %q want %q", i, e.Key, want[i])
+		}
+	}
+	if m := c.Metrics(); m.Tot() != 10 {
+		t.Errorf("MostAccessed should not count as access: got %d accesses want 10", m.Tot())
+	}
+	if got := c.MostAccessed(10); len(got) != 5 {
+		t.Errorf("MostAccessed(10): got %d entries want 5", len(got))
+	}
+	var nilc *Cache
+	if got := nilc.MostAccessed(1); got != nil {
+		t.Errorf("nil cache MostAccessed(1): got %v want nil", got)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	c, err := NewCache(4, false)
+	if err != nil {
+		t.Fatalf("Cannot construct cache: %v", err)
+	}
+	for _, k := range []string{"foo1", "foo2", "foo3", "foo4"} {
+		c.Put(k, k)
+		c.Get(k)
+	}
+	if got, want := c.Flush(), 4; got != want {
+		t.Errorf("Flush: got %d want %d", got, want)
+	}
+	if got := c.Len(); got != 0 {
+		t.Errorf("len after Flush: got %d want 0", got)
+	}
+	if got, want := c.Cap(), 4; got != want {
+		t.Errorf("cap after Flush: got %d want %d", got, want)
+	}
+	if v, ok := c.Get("foo1"); ok {
+		t.Errorf("get(%q) after Flush: got %v want miss", "foo1", v)
+	}
+	c.Put("foo1", "bar1")
+	if v, ok := c.Get("foo1"); !ok || v != "bar1" {
+		t.Errorf("get(%q) after Flush and Put: got %v, %v want %q, true", "foo1", v, ok, "bar1")
+	}
+	var nilc *Cache
+	if got := nilc.Flush(); got != 0 {
+		t.Errorf("nil cache Flush: got %d want 0", got)
+	}
+}
+
+func TestDeleteFunc(t *testing.T) {
+	c, err := NewCache(6, false)
+	if err != nil {
+		t.Fatalf("Cannot construct cache: %v", err)
+	}
+	// Access some items more to have them in both stores.
+	for i, k := range []string{"foo1", "bar1", "foo2", "bar2", "foo3", "bar3"} {
+		c.Put(k, k)
+		for j := 0; j < i; j++ {
+			c.Get(k)
+		}
+	}
+	if got, want := c.DeleteFunc(func(k string) bool { return strings.HasPrefix(k, "foo") }), 3; got != want {
+		t.Errorf("DeleteFunc: got %d want %d", got, want)
+	}
+	if got, want := c.Len(), 3; got != want {
+		t.Errorf("len after DeleteFunc: got %d want %d", got, want)
+	}
+	for _, k := range []string{"foo1", "foo2", "foo3"} {
+		if v, ok := c.Get(k); ok {
+			t.Errorf("get(%q): got %v want miss", k, v)
+		}
+	}
+	for _, k := range []string{"bar1", "bar2", "bar3"} {
+		if v, ok := c.Get(k); !ok || v != k {
+			t.Errorf("get(%q): got %v, %v want %q, true", k, v, ok, k)
+		}
+	}
+	var nilc *Cache
+	if got := nilc.DeleteFunc(func(string) bool { return true }); got != 0 {
+		t.Errorf("nil cache DeleteFunc: got %d want 0", got)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c, err := NewLRUCache(3, true)
+	if err != nil {
+		t.Fatalf("Cannot construct cache: %v", err)
+	}
+	// Access "foo1" a lot: in a hybrid cache this would keep it around.
+	c.Put("foo1", "bar1")
+	for i := 0; i < 10; i++ {
+		c.Get("foo1")
+	}
+	c.Put("foo2", "bar2")
+	c.Put("foo3", "bar3")
+	c.Get("foo2")
+	// Evicts "foo1", the least recently used.
+	c.Put("foo4", "bar4")
+	// Evicts "foo3".
+	c.Put("foo5", "bar5")
+
+	for _, k := range []string{"foo1", "foo3"} {
+		if v, ok := c.Get(k); ok {
+			t.Errorf("get(%q): got %v want miss", k, v)
+		}
+	}
+	for _, k := range []string{"foo2", "foo4", "foo5"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("get(%q): got miss want hit", k)
+		}
+	}
+	if got, want := c.Cap(), 3; got != want {
+		t.Errorf("cap: got %d want %d", got, want)
+	}
+	want := CacheMetrics{HitLRU: 14, MissLRU: 2, Miss: 2, RecentlyEvictedMiss: 2}
+	if got := c.Metrics(); got != want {
+		t.Errorf("metrics: got \n%+v\nwant\n%+v", got, want)
+	}
+}
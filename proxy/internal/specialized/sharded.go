@@ -0,0 +1,160 @@
+package specialized
+
+import "sort"
+
+// MinShardSize is the minimum amount of items a shard of a ShardedCache holds: caches too small to be
+// split in the requested amount of shards get fewer shards.
+const MinShardSize = 1024
+
+// ShardedCache is a Cache split in shards with their own lock, so that accesses to different keys
+// rarely contend. Keys are assigned to shards by their hash and every shard holds an equal part of
+// the capacity, so items are evicted from a full shard even if other shards have room.
+// All its methods are safe to call concurrently.
+type ShardedCache struct {
+	shards []*Cache
+}
+
+// NewShardedCache constructs a new ShardedCache holding size items in up to shards shards, see
+// MinShardSize. Each shard is constructed with newc, NewCache or NewLRUCache, and evictMetrics.
+// As for NewCache, if size <= 0 a nil cache, which stores nothing, is returned.
+func NewShardedCache(size, shards int, evictMetrics bool, newc func(size int, evictMetrics bool) (*Cache, error)) (*ShardedCache, error) {
+	if size <= 0 {
+		return nil, nil
+	}
+	if max := size / MinShardSize; shards > max {
+		shards = max
+	}
+	if shards < 1 {
+		shards = 1
+	}
+	sc := ShardedCache{shards: make([]*Cache, shards)}
+	for i := range sc.shards {
+		// Spread the remainder over the first shards.
+		n := size / shards
+		if i < size%shards {
+			n++
+		}
+		c, err := newc(n, evictMetrics)
+		if err != nil {
+			return nil, err
+		}
+		sc.shards[i] = c
+	}
+	return &sc, nil
+}
+
+// shard returns the shard holding k.
+func (c *ShardedCache) shard(k string) *Cache {
+	if len(c.shards) == 1 {
+		return c.shards[0]
+	}
+	// FNV-1a, computed inline to avoid allocations.
+	h := uint32(2166136261)
+	for i := 0; i < len(k); i++ {
+		h ^= uint32(k[i])
+		h *= 16777619
+	}
+	return c.shards[h%uint32(len(c.shards))]
+}
+
+// Shards returns the amount of shards of the cache.
+func (c *ShardedCache) Shards() int {
+	if c == nil {
+		return 0
+	}
+	return len(c.shards)
+}
+
+// Get retrieves an item from the cache, see Cache.Get.
+func (c *ShardedCache) Get(k string) (v Value, ok bool) {
+	if c == nil {
+		return nil, false
+	}
+	return c.shard(k).Get(k)
+}
+
+// Put stores an item in the cache, see Cache.Put.
+func (c *ShardedCache) Put(k string, v Value) {
+	if c == nil {
+		return
+	}
+	c.shard(k).Put(k, v)
+}
+
+// PutIfAbsent stores an item in the cache unless its key is already stored, see Cache.PutIfAbsent.
+func (c *ShardedCache) PutIfAbsent(k string, v Value) (stored bool) {
+	if c == nil {
+		return false
+	}
+	return c.shard(k).PutIfAbsent(k, v)
+}
+
+// Metrics returns the sum of the metrics of all shards.
+func (c *ShardedCache) Metrics() CacheMetrics {
+	var m CacheMetrics
+	if c == nil {
+		return m
+	}
+	for _, s := range c.shards {
+		sm := s.Metrics()
+		m.HitMFA += sm.HitMFA
+		m.MissMFA += sm.MissMFA
+		m.HitLRU += sm.HitLRU
+		m.MissLRU += sm.MissLRU
+		m.Miss += sm.Miss
+		m.RecentlyEvictedMiss += sm.RecentlyEvictedMiss
+	}
+	return m
+}
+
+// Flush removes all items from the cache, see Cache.Flush.
+func (c *ShardedCache) Flush() int {
+	return c.sum((*Cache).Flush)
+}
+
+// DeleteFunc removes the items whose key satisfies match, see Cache.DeleteFunc.
+func (c *ShardedCache) DeleteFunc(match func(key string) bool) int {
+	return c.sum(func(s *Cache) int { return s.DeleteFunc(match) })
+}
+
+// MostAccessed returns up to n entries with the highest access count across all shards, see
+// Cache.MostAccessed.
+func (c *ShardedCache) MostAccessed(n int) []Entry {
+	if c == nil || n <= 0 {
+		return nil
+	}
+	if len(c.shards) == 1 {
+		return c.shards[0].MostAccessed(n)
+	}
+	var es []Entry
+	for _, s := range c.shards {
+		es = append(es, s.MostAccessed(n)...)
+	}
+	sort.SliceStable(es, func(i, j int) bool { return es[i].Accesses > es[j].Accesses })
+	if len(es) > n {
+		es = es[:n]
+	}
+	return es
+}
+
+// Len returns the amount of items currently stored in the cache.
+func (c *ShardedCache) Len() int {
+	return c.sum((*Cache).Len)
+}
+
+// Cap returns the maximum amount of items the cache can hold.
+func (c *ShardedCache) Cap() int {
+	return c.sum((*Cache).Cap)
+}
+
+// sum returns the sum of f over all shards.
+func (c *ShardedCache) sum(f func(*Cache) int) int {
+	if c == nil {
+		return 0
+	}
+	n := 0
+	for _, s := range c.shards {
+		n += f(s)
+	}
+	return n
+}
@@ -0,0 +1,139 @@
+package specialized
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestShardedCache(t *testing.T) {
+	tests := []struct {
+		size, shards int
+		wantShards   int
+	}{
+		{size: 16 * MinShardSize, shards: 16, wantShards: 16},
+		{size: 16*MinShardSize + 3, shards: 16, wantShards: 16},
+		{size: 4*MinShardSize + 1, shards: 16, wantShards: 4},
+		{size: 100, shards: 16, wantShards: 1},
+		{size: 16 * MinShardSize, shards: 0, wantShards: 1},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.size)+"/"+strconv.Itoa(tt.shards), func(t *testing.T) {
+			c, err := NewShardedCache(tt.size, tt.shards, false, NewCache)
+			if err != nil {
+				t.Fatalf("Cannot construct cache: %v", err)
+			}
+			if got := c.Shards(); got != tt.wantShards {
+				t.Errorf("shards: got %d want %d", got, tt.wantShards)
+			}
+			if got := c.Cap(); got != tt.size {
+				t.Errorf("cap: got %d want %d", got, tt.size)
+			}
+		})
+	}
+}
+
+func TestShardedCacheOperations(t *testing.T) {
+	c, err := NewShardedCache(4*MinShardSize, 4, false, NewCache)
+	if err != nil {
+		t.Fatalf("Cannot construct cache: %v", err)
+	}
+	const n = 100
+	for i := 0; i < n; i++ {
+		c.Put("key"+strconv.Itoa(i), i)
+	}
+	used := 0
+	for _, s := range c.shards {
+		if s.Len() > 0 {
+			used++
+		}
+	}
+	if used != len(c.shards) {
+		t.Errorf("shards used: got %d want %d", used, len(c.shards))
+	}
+	if got := c.Len(); got != n {
+		t.Errorf("len: got %d want %d", got, n)
+	}
+	for i := 0; i < n; i++ {
+		k := "key" + strconv.Itoa(i)
+		if v, ok := c.Get(k); !ok || v != i {
+			t.Errorf("get %q: got %v, %v want %d, true", k, v, ok, i)
+		}
+	}
+	// The keys of the last ten items are accessed once more.
+	for i := n - 10; i < n; i++ {
+		c.Get("key" + strconv.Itoa(i))
+	}
+	c.Get("missing")
+	if got, want := c.Metrics(), (CacheMetrics{HitLRU: n + 10, MissMFA: n + 11, MissLRU: 1, Miss: 1}); got != want {
+		t.Errorf("metrics: got %+v want %+v", got, want)
+	}
+	es := c.MostAccessed(10)
+	if len(es) != 10 {
+		t.Fatalf("most accessed: got %d entries want 10", len(es))
+	}
+	for _, e := range es {
+		if i, _ := strconv.Atoi(strings.TrimPrefix(e.Key, "key")); i < n-10 {
+			t.Errorf("most accessed: got %q want one of the last ten keys", e.Key)
+		}
+	}
+	if got := c.DeleteFunc(func(k string) bool { return strings.HasPrefix(k, "key1") }); got != 11 {
+		t.Errorf("delete: got %d want 11", got)
+	}
+	if got := c.Flush(); got != n-11 {
+		t.Errorf("flush: got %d want %d", got, n-11)
+	}
+	if got := c.Len(); got != 0 {
+		t.Errorf("len after flush: got %d want 0", got)
+	}
+}
+
+func TestNilShardedCache(t *testing.T) {
+	c, err := NewShardedCache(0, 16, false, NewCache)
+	if c != nil || err != nil {
+		t.Fatalf("NewShardedCache(0): got %v, %v want nil, nil", c, err)
+	}
+	c.Put("k", 1)
+	if _, ok := c.Get("k"); ok || c.Len() != 0 || c.Cap() != 0 || c.MostAccessed(1) != nil {
+		t.Errorf("nil cache stored an item")
+	}
+}
+
+// benchmarkParallel runs a mix of hits, updates and misses on c from parallel goroutines.
+func benchmarkParallel(b *testing.B, c interface {
+	Get(string) (Value, bool)
+	Put(string, Value)
+}) {
+	var items [4096]string
+	for i := range items {
+		items[i] = strconv.Itoa(i)
+		c.Put(items[i], i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			k := items[i%len(items)]
+			c.Get(k)
+			if i%8 == 0 {
+				c.Put(k, i)
+			}
+		}
+	})
+}
+
+func BenchmarkParallelCache(b *testing.B) {
+	c, err := NewCache(65536, false)
+	if err != nil {
+		b.Fatalf("Cannot construct cache: %v", err)
+	}
+	benchmarkParallel(b, c)
+}
+
+func BenchmarkParallelShardedCache(b *testing.B) {
+	c, err := NewShardedCache(65536, 16, false, NewCache)
+	if err != nil {
+		b.Fatalf("Cannot construct cache: %v", err)
+	}
+	benchmarkParallel(b, c)
+}
@@ -86,6 +86,16 @@ func (c *store) update(now uint, key string, v Value) (updated bool) {
 	return true
 }
 
+// remove removes the item with the given key, if any.
+func (c *store) remove(key string) (removed bool) {
+	i, ok := c.m[key]
+	if !ok {
+		return false
+	}
+	heap.Remove(c, i)
+	return true
+}
+
 func (c *store) peek() item { return c.pq[0] }
 
 // updateUnchecked updates the item as specified without checking if the item is there or checking
@@ -130,6 +140,27 @@ func (c *store) reset(start uint) uint {
 
 func (c *store) cap() int { return cap(c.pq) }
 
+// resize changes the capacity of the store to newCap.
+// If the store holds more than newCap items the ones with the lowest priority are evicted
+// and returned, lowest first.
+// Growing takes O(c.Len()): items keep their position in the heap, so neither the heap nor
+// the lookup map need to be rebuilt.
+func (c *store) resize(newCap int) (evicted []item) {
+	if newCap < 0 {
+		newCap = 0
+	}
+	for len(c.pq) > newCap {
+		evicted = append(evicted, heap.Pop(c).(item))
+	}
+	if newCap == cap(c.pq) {
+		return evicted
+	}
+	pq := make([]item, len(c.pq), newCap)
+	copy(pq, c.pq)
+	c.pq = pq
+	return evicted
+}
+
 func (c *store) less(a, b item) bool {
 	// LRU
 	if c.cmp == byTime {
@@ -1,6 +1,7 @@
 package specialized
 
 import (
+	"container/heap"
 	"fmt"
 	"strconv"
 	"testing"
@@ -270,3 +271,73 @@ func TestReset(t *testing.T) {
 		}
 	}
 }
+
+// checkHeap verifies the heap and lookup map invariants of s.
+func checkHeap(t *testing.T, s *store) {
+	t.Helper()
+	if len(s.m) != len(s.pq) {
+		t.Fatalf("corruption: map len: %d pq len %d", len(s.m), len(s.pq))
+	}
+	for i, it := range s.pq {
+		if s.m[it.key] != i || it.index != i {
+			t.Errorf("item %q at %d: map index %d item index %d", it.key, i, s.m[it.key], it.index)
+		}
+		if i > 0 && s.Less(i, (i-1)/2) {
+			t.Errorf("item %q at %d is less than its parent", it.key, i)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	for _, by := range []cmpBy{byTime, byAccesses} {
+		t.Run(fmt.Sprintf("by accesses %v", by), func(t *testing.T) {
+			s := newStore(8, by)
+			for k := 0; k < 8; k++ {
+				s.put(uint(k), strconv.Itoa(k), k, uint(k%3+1))
+			}
+
+			// Grow
+			if ev := s.resize(16); len(ev) != 0 {
+				t.Errorf("grow evicted: %+v", ev)
+			}
+			if got := s.cap(); got != 16 {
+				t.Errorf("cap after grow: got %d want 16", got)
+			}
+			checkHeap(t, s)
+			for k := 0; k < 8; k++ {
+				if v, ok := s.get(uint(8+k), strconv.Itoa(k)); !ok || v.(int) != k {
+					t.Errorf("get(%d) after grow: got %v,%v want %d", k, v, ok, k)
+				}
+			}
+			for k := 8; k < 16; k++ {
+				if ev := s.put(uint(16+k), strconv.Itoa(k), k, 1); ev.v != nil {
+					t.Errorf("put(%d) after grow evicted %+v", k, ev)
+				}
+			}
+			checkHeap(t, s)
+
+			// Shrink
+			want := make([]item, 0, 12)
+			c := newStore(16, by)
+			for _, it := range s.pq {
+				c.put(it.t, it.key, it.v, it.a)
+			}
+			for i := 0; i < 12; i++ {
+				want = append(want, heap.Pop(c).(item))
+			}
+			ev := s.resize(4)
+			if len(ev) != len(want) {
+				t.Fatalf("shrink evicted %d items want %d", len(ev), len(want))
+			}
+			for i := range ev {
+				if ev[i].key != want[i].key {
+					t.Errorf("shrink evicted[%d]: got %q want %q", i, ev[i].key, want[i].key)
+				}
+			}
+			if got := s.cap(); got != 4 {
+				t.Errorf("cap after shrink: got %d want 4", got)
+			}
+			checkHeap(t, s)
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// IntrospectionOption is the EDNS0 local option code that asks the server to describe itself.
+// Queries carrying it get their normal answer plus an option with the same code in the OPT record,
+// containing a JSON encoded IntrospectionInfo.
+//
+// With dig: dig +ednsopt=65301 @server example.com
+const IntrospectionOption = 65301
+
+// IntrospectionInfo is the content of the IntrospectionOption sent back to clients.
+type IntrospectionInfo struct {
+	Version    string
+	Uptime     string
+	CacheLen   int
+	CacheCap   int
+	ConfigHash string
+}
+
+// WithIntrospection makes the server reply to queries carrying the IntrospectionOption with details about
+// its version, uptime, cache and configuration. This is useful to manage a fleet of forwarders with
+// plain DNS tools, but leaks information to any client that can query the server.
+func WithIntrospection(enabled bool) Option {
+	return func(o *options) { o.introspection = enabled }
+}
+
+func buildVersion() string {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		return bi.Main.Version
+	}
+	return "unknown"
+}
+
+// configHash returns a digest of the configuration that affects how queries are answered: the options,
+// the current upstreams and the blocklist. Options that only affect logging and monitoring are left out.
+// Maps are formatted with their keys sorted, so the digest does not depend on their iteration order.
+func (s *Server) configHash() string {
+	o := &s.opts
+	h := sha256.New()
+	fmt.Fprintf(h, "cache %T %d %t %t %d %v %t %v %v %v %t %v\n",
+		o.cache, o.cacheSize, o.evictMetrics, o.lruOnly, o.cacheShards, o.ttlStrategy, o.originalTTL,
+		o.maxStale, o.minTTL, o.maxTTL, o.negativeCache, o.servfailTTL)
+	fmt.Fprintf(h, "answers %d %d %v %t %t %d %t %t %v %t %d %d\n",
+		o.maxAnswerSize, o.sizePolicy, o.firstQuestionOnly, o.noStreamCompression, o.noIPv6, o.maxCNAMEChain,
+		o.rotateAddresses, o.sortByClient, o.sortlist, o.introspection, o.ecsV4Prefix, o.ecsV6Prefix)
+	fmt.Fprintf(h, "refresh %d %v %d %v %d\n",
+		o.refreshTopK, o.refreshLead, o.prefetchTopK, o.prefetchFraction, o.prefetchMinAccesses)
+	fmt.Fprintf(h, "forward %d %v %d %v %v %v %d %t %t %d %v %d %v %d %v %d %v\n",
+		o.selection, o.upstreamTimeout, o.forwardRetries, o.retryDelay, o.servfailWait, o.domainUpstreams,
+		o.pipelineDepth, o.plainFallback, o.upstreamDO, o.upstreamUDPSize, o.paddingBlock, o.healthFailures,
+		o.healthInterval, o.breakerFailures, o.breakerCooldown, o.stickySize, o.stickyTTL)
+	fmt.Fprintf(h, "tls %d %d %v %t %q %q\n",
+		o.tlsMinVersion, o.tlsMaxVersion, o.tlsCipherSuites, o.rootCAs != nil, o.clientCertFile, o.clientKeyFile)
+	fmt.Fprintf(h, "dnssec %t %v %t\n", o.dnssec, o.trustAnchors, o.qnameMinimization)
+	fmt.Fprintf(h, "clients %v %v %v %d %v\n", o.acl.allow, o.acl.deny, o.dohTrustedProxies, o.clientLimit, o.clientWait)
+	fmt.Fprintf(h, "local %v %v %v %v\n", o.identity, o.localZones, o.sinkholeV4, o.sinkholeV6)
+	fmt.Fprintf(h, "chaos %v %v\n", o.chaosFailureRate, o.chaosLatency)
+	ups, _ := s.upstreamSet()
+	for _, u := range ups {
+		fmt.Fprintf(h, "upstream %s\n", u.addr)
+	}
+	if bl, _ := s.blocklist.Load().(*blocklist); bl != nil {
+		fmt.Fprintf(h, "blocklist %x\n", bl.digest)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// wantsIntrospection tells whether q asks for introspection and it is enabled.
+func (s *Server) wantsIntrospection(q *dns.Msg) bool {
+	if !s.opts.introspection {
+		return false
+	}
+	opt := q.IsEdns0()
+	if opt == nil {
+		return false
+	}
+	for _, o := range opt.Option {
+		if o.Option() == IntrospectionOption {
+			return true
+		}
+	}
+	return false
+}
+
+// addIntrospection attaches the introspection info to the OPT record of m, creating one if needed.
+func (s *Server) addIntrospection(q, m *dns.Msg) {
+	buf, err := json.Marshal(IntrospectionInfo{
+		Version:    buildVersion(),
+		Uptime:     s.uptime().String(),
+		CacheLen:   s.answers.Len(),
+		CacheCap:   s.answers.Cap(),
+		ConfigHash: s.configHash(),
+	})
+	if err != nil {
+		log.Warnf("Unable to encode introspection info: %v", err)
+		return
+	}
+	opt := m.IsEdns0()
+	if opt == nil {
+		m.SetEdns0(q.IsEdns0().UDPSize(), false)
+		opt = m.IsEdns0()
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: IntrospectionOption, Data: buf})
+}
@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// clientLimiter caps the amount of in-flight queries per client.
+// Clients are only tracked while they have queries in flight, so its memory usage is bounded by the
+// amount of concurrent queries the server is handling.
+// A nil *clientLimiter imposes no limits.
+type clientLimiter struct {
+	limit int
+	wait  time.Duration
+
+	mu      sync.Mutex
+	clients map[string]*clientSlots
+}
+
+type clientSlots struct {
+	sem   chan struct{}
+	users int
+}
+
+func newClientLimiter(limit int, wait time.Duration) *clientLimiter {
+	if limit <= 0 {
+		return nil
+	}
+	return &clientLimiter{
+		limit:   limit,
+		wait:    wait,
+		clients: make(map[string]*clientSlots),
+	}
+}
+
+// acquire reserves an in-flight slot for client, waiting at most l.wait for one to free up.
+// It reports whether the slot was obtained, in which case release must be called once the query is
+// served.
+func (l *clientLimiter) acquire(client string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	cs, ok := l.clients[client]
+	if !ok {
+		cs = &clientSlots{sem: make(chan struct{}, l.limit)}
+		l.clients[client] = cs
+	}
+	cs.users++
+	l.mu.Unlock()
+
+	select {
+	case cs.sem <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait > 0 {
+		t := time.NewTimer(l.wait)
+		defer t.Stop()
+		select {
+		case cs.sem <- struct{}{}:
+			return true
+		case <-t.C:
+		}
+	}
+	l.forget(client, cs)
+	return false
+}
+
+// release frees a slot obtained with acquire.
+func (l *clientLimiter) release(client string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	cs := l.clients[client]
+	l.mu.Unlock()
+	<-cs.sem
+	l.forget(client, cs)
+}
+
+func (l *clientLimiter) forget(client string, cs *clientSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cs.users--
+	if cs.users == 0 {
+		delete(l.clients, client)
+	}
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// localTTL is the TTL of synthesized negative answers for local zones.
+const localTTL = 60
+
+// localZone is a tree of locally served records, indexed by label from the root.
+// Name matching is case-insensitive.
+//
+// Names that have records are always answered locally: with the records of the requested type,
+// with their CNAME, or with NODATA.
+// Names under an authoritative apex are also answered locally when they have no records:
+// empty non-terminals (names that only exist because they have children) get NODATA and
+// non-existent names get NXDOMAIN.
+// All other names are not local and should be forwarded.
+// A nil *localZone has no names.
+type localZone struct {
+	root *zoneNode
+}
+
+type zoneNode struct {
+	children map[string]*zoneNode
+	rrs      []dns.RR
+	// apex is set if this node is the apex of an authoritative zone.
+	apex bool
+}
+
+func newLocalZone() *localZone {
+	return &localZone{root: &zoneNode{}}
+}
+
+// labels returns the lowercase labels of name, from the root down.
+func labels(name string) []string {
+	ls := dns.SplitDomainName(strings.ToLower(dns.Fqdn(name)))
+	for i, j := 0, len(ls)-1; i < j; i, j = i+1, j-1 {
+		ls[i], ls[j] = ls[j], ls[i]
+	}
+	return ls
+}
+
+// node returns the node for name, creating it and all its parents if create is true.
+func (z *localZone) node(name string, create bool) *zoneNode {
+	n := z.root
+	for _, l := range labels(name) {
+		c, ok := n.children[l]
+		if !ok {
+			if !create {
+				return nil
+			}
+			if n.children == nil {
+				n.children = make(map[string]*zoneNode)
+			}
+			c = &zoneNode{}
+			n.children[l] = c
+		}
+		n = c
+	}
+	return n
+}
+
+// addZone makes z authoritative for apex and all names below it.
+func (z *localZone) addZone(apex string) {
+	z.node(apex, true).apex = true
+}
+
+// add adds rr to the records served by z.
+func (z *localZone) add(rr dns.RR) {
+	n := z.node(rr.Header().Name, true)
+	n.rrs = append(n.rrs, rr)
+}
+
+// answer builds the response to q if q is for a local name.
+func (z *localZone) answer(q *dns.Msg) (*dns.Msg, bool) {
+	if z == nil {
+		return nil, false
+	}
+	qq := q.Question[0]
+	var (
+		n    = z.root
+		apex string
+		ls   = labels(qq.Name)
+	)
+	for i, l := range ls {
+		if n.apex {
+			apex = dns.Fqdn(strings.Join(reverse(ls[:i]), "."))
+		}
+		if n = n.children[l]; n == nil {
+			break
+		}
+	}
+	if n != nil && n.apex {
+		apex = dns.Fqdn(strings.Join(reverse(ls), "."))
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(q)
+	m.Authoritative = true
+	switch {
+	case n != nil && len(n.rrs) > 0:
+		m.Answer = matching(n.rrs, qq)
+	case n != nil && apex != "":
+		// Empty non-terminal: the name exists but has no records.
+	case apex != "":
+		m.Rcode = dns.RcodeNameError
+	default:
+		return nil, false
+	}
+	if len(m.Answer) == 0 && apex != "" {
+		m.Ns = []dns.RR{soa(apex)}
+	}
+	return m, true
+}
+
+// matching returns copies of the records in rrs that answer q, owned by the name as spelled in q.
+func matching(rrs []dns.RR, q dns.Question) []dns.RR {
+	var ans []dns.RR
+	for _, rr := range rrs {
+		h := rr.Header()
+		if h.Class != q.Qclass && q.Qclass != dns.ClassANY {
+			continue
+		}
+		if h.Rrtype != q.Qtype && h.Rrtype != dns.TypeCNAME && q.Qtype != dns.TypeANY {
+			continue
+		}
+		c := dns.Copy(rr)
+		c.Header().Name = q.Name
+		ans = append(ans, c)
+	}
+	return ans
+}
+
+// noData returns a synthesized NODATA response to q.
+func noData(q *dns.Msg) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(q)
+	m.Ns = []dns.RR{soa(dns.Fqdn(q.Question[0].Name))}
+	return m
+}
+
+func soa(apex string) dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: apex, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: localTTL},
+		Ns:      "localhost.",
+		Mbox:    "hostmaster." + apex,
+		Serial:  1,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  localTTL,
+	}
+}
+
+func reverse(ls []string) []string {
+	r := make([]string, len(ls))
+	for i, l := range ls {
+		r[len(ls)-1-i] = l
+	}
+	return r
+}
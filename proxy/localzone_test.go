@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestLocalZone(t *testing.T) {
+	z := newLocalZone()
+	z.addZone("Home.Lan.")
+	for _, r := range []string{
+		"nas.home.lan. 300 IN A 192.168.1.10",
+		"www.nas.home.lan. 300 IN CNAME nas.home.lan.",
+		"printer.office.home.lan. 300 IN A 192.168.1.20",
+		"router.example. 300 IN A 192.168.1.1",
+	} {
+		rr, err := dns.NewRR(r)
+		if err != nil {
+			t.Fatalf("Cannot parse %q: %v", r, err)
+		}
+		z.add(rr)
+	}
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		wantLocal bool
+		wantRcode int
+		wantAns   []string
+		wantSOA   bool
+	}{
+		{name: "record", qname: "nas.home.lan.", qtype: dns.TypeA, wantLocal: true, wantAns: []string{"192.168.1.10"}},
+		{name: "mixed case", qname: "NaS.HoMe.LaN.", qtype: dns.TypeA, wantLocal: true, wantAns: []string{"192.168.1.10"}},
+		{name: "cname", qname: "www.nas.home.lan.", qtype: dns.TypeA, wantLocal: true, wantAns: []string{"nas.home.lan."}},
+		{name: "nodata", qname: "nas.home.lan.", qtype: dns.TypeAAAA, wantLocal: true, wantSOA: true},
+		{name: "empty non-terminal", qname: "office.home.lan.", qtype: dns.TypeA, wantLocal: true, wantSOA: true},
+		{name: "empty non-terminal mixed case", qname: "OFFICE.home.lan.", qtype: dns.TypeA, wantLocal: true, wantSOA: true},
+		{name: "apex", qname: "home.lan.", qtype: dns.TypeA, wantLocal: true, wantSOA: true},
+		{name: "nxdomain", qname: "tv.home.lan.", qtype: dns.TypeA, wantLocal: true, wantRcode: dns.RcodeNameError, wantSOA: true},
+		{name: "nxdomain below record", qname: "foo.printer.office.home.lan.", qtype: dns.TypeA, wantLocal: true, wantRcode: dns.RcodeNameError, wantSOA: true},
+		{name: "static record", qname: "ROUTER.example.", qtype: dns.TypeA, wantLocal: true, wantAns: []string{"192.168.1.1"}},
+		{name: "static nodata", qname: "router.example.", qtype: dns.TypeMX, wantLocal: true},
+		{name: "not authoritative parent", qname: "example.", qtype: dns.TypeA},
+		{name: "not authoritative sibling", qname: "other.example.", qtype: dns.TypeA},
+		{name: "not local", qname: "raccoon.miki.", qtype: dns.TypeA},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var q dns.Msg
+			q.SetQuestion(tt.qname, tt.qtype)
+			m, ok := z.answer(&q)
+			if ok != tt.wantLocal {
+				t.Fatalf("local: got %v want %v", ok, tt.wantLocal)
+			}
+			if !ok {
+				return
+			}
+			if m.Rcode != tt.wantRcode {
+				t.Errorf("rcode: got %s want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			if len(m.Answer) != len(tt.wantAns) {
+				t.Fatalf("answers: got %v want %v", m.Answer, tt.wantAns)
+			}
+			for i, a := range m.Answer {
+				if a.Header().Name != tt.qname {
+					t.Errorf("answer %d owner: got %q want %q", i, a.Header().Name, tt.qname)
+				}
+				if got := a.String(); !strings.HasSuffix(got, tt.wantAns[i]) {
+					t.Errorf("answer %d: got %q want it to end with %q", i, got, tt.wantAns[i])
+				}
+			}
+			if gotSOA := len(m.Ns) == 1 && m.Ns[0].Header().Rrtype == dns.TypeSOA; gotSOA != tt.wantSOA {
+				t.Errorf("SOA in authority: got %v want %v", m.Ns, tt.wantSOA)
+			}
+		})
+	}
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"context"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// AnswerFunc returns the answer to the query q sent by client. A nil answer makes the server reply SERVFAIL.
+type AnswerFunc func(client net.Addr, q *dns.Msg) *dns.Msg
+
+// MiddlewareFunc wraps the AnswerFunc the server uses to answer queries. Middlewares can inspect or
+// rewrite queries before calling next, reject them by returning their own answer without calling next,
+// and inspect or rewrite the answers returned by next.
+// Answers returned by next are never shared with the cache, so they can be modified in place.
+type MiddlewareFunc func(next AnswerFunc) AnswerFunc
+
+// Use registers middlewares to run on every query, after client access control and rate limiting.
+// The first middleware registered is the outermost one.
+// Use is not safe for concurrent use with the server, it must be called before Run.
+func (s *Server) Use(mw ...MiddlewareFunc) {
+	s.middlewares = append(s.middlewares, mw...)
+}
+
+// answer runs the middlewares around getAnswer. Answers produced by middlewares without calling
+// getAnswer are reported as bypassing the cache.
+func (s *Server) answer(ctx context.Context, client net.Addr, q *dns.Msg) (m *dns.Msg, cs CacheStatus, u *upstream) {
+	cs = CacheBypass
+	var h AnswerFunc = func(client net.Addr, q *dns.Msg) *dns.Msg {
+		var m *dns.Msg
+		m, cs, u = s.getAnswer(ctx, q)
+		s.sortAddresses(client, q, m)
+		return m
+	}
+	for i := len(s.middlewares) - 1; i >= 0; i-- {
+		h = s.middlewares[i](h)
+	}
+	return h(client, q), cs, u
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestMiddleware(t *testing.T) {
+	var (
+		calls   []string
+		clients []net.Addr
+	)
+	trace := func(name string) MiddlewareFunc {
+		return func(next AnswerFunc) AnswerFunc {
+			return func(client net.Addr, q *dns.Msg) *dns.Msg {
+				calls = append(calls, name)
+				clients = append(clients, client)
+				return next(client, q)
+			}
+		}
+	}
+	reject := func(next AnswerFunc) AnswerFunc {
+		return func(client net.Addr, q *dns.Msg) *dns.Msg {
+			if strings.HasPrefix(q.Question[0].Name, "ads.") {
+				return new(dns.Msg).SetRcode(q, dns.RcodeRefused)
+			}
+			return next(client, q)
+		}
+	}
+	rewrite := func(next AnswerFunc) AnswerFunc {
+		return func(client net.Addr, q *dns.Msg) *dns.Msg {
+			q.Question[0].Name = strings.Replace(q.Question[0].Name, "alias.", "", 1)
+			if strings.HasPrefix(q.Question[0].Name, "multi.") {
+				q.Question = append(q.Question, q.Question[0])
+			}
+			m := next(client, q)
+			if m != nil {
+				for _, a := range m.Answer {
+					a.Header().Ttl = 42
+				}
+			}
+			return m
+		}
+	}
+	s := NewServerWithOptions(
+		WithCacheSize(-1),
+		WithUpstreams("fake://one"),
+		WithUpstreamTransport("fake", func(upstream string) (UpstreamTransport, error) {
+			return &fakeTransport{upstream: upstream}, nil
+		}),
+	)
+	s.Use(trace("first"), trace("second"), reject, rewrite)
+	remote := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 42}
+
+	tests := []struct {
+		qname     string
+		wantRcode int
+		wantName  string
+	}{
+		{qname: "alias." + testQuestion, wantRcode: dns.RcodeSuccess, wantName: testQuestion},
+		{qname: "ads." + testQuestion, wantRcode: dns.RcodeRefused},
+		{qname: "multi." + testQuestion, wantRcode: dns.RcodeFormatError},
+	}
+	for _, tt := range tests {
+		calls, clients = nil, nil
+		var q dns.Msg
+		q.SetQuestion(tt.qname, dns.TypeA)
+		w := &fakeResponseWriter{remote: remote}
+		s.ServeDNS(w, &q)
+		if len(w.msgs) != 1 {
+			t.Fatalf("%s: responses: got %d want 1", tt.qname, len(w.msgs))
+		}
+		m := w.msgs[0]
+		if m.Rcode != tt.wantRcode {
+			t.Errorf("%s: rcode: got %s want %s", tt.qname, dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.wantRcode])
+		}
+		if tt.wantName != "" {
+			if len(m.Answer) != 1 || m.Answer[0].Header().Name != tt.wantName || m.Answer[0].Header().Ttl != 42 {
+				t.Errorf("%s: answer: got %v want %s with TTL 42", tt.qname, m.Answer, tt.wantName)
+			}
+		}
+		if len(calls) != 2 || calls[0] != "first" || calls[1] != "second" {
+			t.Errorf("%s: calls: got %v want [first second]", tt.qname, calls)
+		}
+		for _, c := range clients {
+			if c != remote {
+				t.Errorf("%s: client: got %v want %v", tt.qname, c, remote)
+			}
+		}
+	}
+}
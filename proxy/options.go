@@ -0,0 +1,553 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Option configures a Server. Options are applied in order by NewServerWithOptions,
+// so later options override earlier ones.
+type Option func(*options)
+
+// options holds the user-provided configuration of a Server.
+type options struct {
+	// cache replaces the built-in cache if set, see WithCache.
+	cache        Cache
+	cacheSize    int
+	evictMetrics bool
+	lruOnly      bool
+	cacheShards  int
+	ttlStrategy  TTLStrategy
+	originalTTL  bool
+	maxStale     time.Duration
+	// minTTL and maxTTL bound the TTLs of cached records, see WithCacheTTLBounds.
+	minTTL, maxTTL time.Duration
+	// cacheFile is where the cache is persisted across restarts, see WithCacheFile.
+	cacheFile     string
+	negativeCache bool
+	// servfailTTL is how long SERVFAIL responses are cached for, see WithServfailCaching.
+	servfailTTL     time.Duration
+	upstreamServers []string
+	// poolSize is the amount of idle connections kept open to each upstream.
+	poolSize int
+	// idleTimeout is how long pooled connections can be idle before they are recycled, see WithIdleTimeout.
+	idleTimeout time.Duration
+	// maxConnLifetime is how long pooled connections are reused for, see WithMaxConnectionLifetime.
+	maxConnLifetime time.Duration
+	// dotAddrs are the addresses DNS over TLS queries are served on with dotConfig, see WithDoTServer.
+	dotAddrs  []string
+	dotConfig *tls.Config
+	// udpWorkers is how many UDP sockets are bound to every address, see WithUDPWorkers.
+	udpWorkers int
+	// upstreamTimeout bounds dialing and exchanging messages with upstreams, see WithUpstreamTimeout.
+	upstreamTimeout time.Duration
+	// forwardRetries is how many times resolving a query is retried when no upstream answered it,
+	// waiting about retryDelay in between, see WithForwardRetries.
+	forwardRetries int
+	retryDelay     time.Duration
+	// servfailWait is how long SelectFastest waits for a better response after a SERVFAIL, see WithServfailWait.
+	servfailWait time.Duration
+	// probeUpstreams discards upstreams that cannot be dialed at construction.
+	probeUpstreams bool
+	// pipelineDepth is the maximum amount of queries in flight on the single connection to each
+	// DNS over TLS upstream. A value <= 0 disables pipelining.
+	pipelineDepth int
+	// plainFallback makes unencrypted upstreams only be used when all the others fail.
+	plainFallback bool
+	// TLS configuration of upstream connections, see WithTLSVersions and WithTLSCipherSuites.
+	tlsMinVersion, tlsMaxVersion uint16
+	tlsCipherSuites              []uint16
+	// rootCAs, if set, replaces the system roots to verify upstream certificates.
+	rootCAs *x509.CertPool
+	// clientCertFile and clientKeyFile hold the certificate presented to upstreams, see WithClientCertificate.
+	clientCertFile, clientKeyFile string
+	// transports maps upstream schemes to the factories of their transports.
+	transports map[string]TransportFactory
+	// dial overrides how connections to the upstreams are established.
+	dial func(addr string, cfg *tls.Config) (net.Conn, error)
+
+	// maxAnswerSize is the packed size in bytes above which sizePolicy is applied before caching.
+	// A value <= 0 disables the check.
+	maxAnswerSize int
+	sizePolicy    AnswerSizePolicy
+	onLargeAnswer func(q dns.Question, size int)
+
+	// firstQuestionOnly makes the server answer the first question of multi-question messages
+	// instead of rejecting them.
+	firstQuestionOnly bool
+
+	// refreshTopK is the amount of most accessed entries that are proactively refreshed
+	// refreshLead before they expire. A value <= 0 disables the scheduler.
+	refreshTopK int
+	refreshLead time.Duration
+
+	// prefetchTopK is the amount of most accessed entries that are prefetched when less than prefetchFraction
+	// of their lifetime is left, if they were accessed at least prefetchMinAccesses times.
+	// A value <= 0 disables prefetching.
+	prefetchTopK        int
+	prefetchFraction    float64
+	prefetchMinAccesses uint
+
+	// noStreamCompression disables name compression of responses sent over TCP.
+	noStreamCompression bool
+
+	// maxCNAMEChain is the maximum amount of CNAME records that can be followed in an answer.
+	maxCNAMEChain int
+
+	// upstreamUDPSize, if not 0, is the EDNS0 UDP payload size advertised on every upstream query,
+	// upstreamDO also sets the DO bit on them, see WithUpstreamEDNS0.
+	upstreamUDPSize uint16
+	upstreamDO      bool
+	// paddingBlock, if > 0, is the block size upstream queries are padded to, see WithUpstreamPadding.
+	paddingBlock int
+
+	// healthInterval is how often upstreams are checked, healthFailures how many consecutive
+	// checks they must fail to be considered unhealthy. See WithHealthCheck.
+	healthInterval time.Duration
+	healthFailures int
+	// breakerFailures is how many consecutive exchanges an upstream must fail to open its circuit
+	// breaker, for breakerCooldown. See WithCircuitBreaker.
+	breakerFailures int
+	breakerCooldown time.Duration
+
+	// shutdownGrace is how long in-flight upstream exchanges are waited for on shutdown.
+	shutdownGrace time.Duration
+
+	// dnssec enables DNSSEC validation using trustAnchors, see WithDNSSECValidation.
+	dnssec       bool
+	trustAnchors []*dns.DS
+	// qnameMinimization makes the server check that the ancestors of names exist before forwarding
+	// queries for them, see WithQNAMEMinimization.
+	qnameMinimization bool
+
+	// queryLogger, if set, is told about every answered query.
+	queryLogger QueryLogger
+	// acl decides which clients can query the server.
+	acl acl
+	// dohTrustedProxies are the networks of the reverse proxies that DoH clients are known through, see
+	// WithDoHTrustedProxies.
+	dohTrustedProxies []*net.IPNet
+	// clientLimit is the maximum amount of in-flight queries per client IP, clientWait is how long
+	// to wait for a slot before refusing the query.
+	clientLimit int
+	clientWait  time.Duration
+
+	// stickySize is the maximum amount of questions to remember the last good upstream for,
+	// stickyTTL is for how long to remember it.
+	stickySize int
+	stickyTTL  time.Duration
+	// stickyClock overrides how the sticky upstreams get the current time.
+	stickyClock func() time.Time
+	// topNames is how many of the most queried names are reported over windows of topNamesWindow,
+	// see WithTopNames.
+	topNames       int
+	topNamesWindow time.Duration
+
+	// selection decides which upstreams are asked to resolve a question.
+	selection SelectionStrategy
+
+	// domainUpstreams maps lowercase fully qualified domains to their upstreams, see WithDomainUpstreams.
+	domainUpstreams map[string][]string
+
+	// identity is served to CHAOS class queries, see WithIdentity. If nil defaultIdentity is used.
+	identity *identity
+
+	// localZones maps authoritative apexes to the records served locally for them.
+	// Records under the empty apex are served without being authoritative for any zone.
+	localZones map[string][]dns.RR
+
+	// sinkholeV4 and sinkholeV6, if set, are the addresses blocked names resolve to, see WithSinkhole.
+	sinkholeV4, sinkholeV6 net.IP
+
+	// noIPv6 makes the server answer AAAA queries with NODATA instead of forwarding them.
+	noIPv6 bool
+	// rotateAddresses rotates the address records of served answers, see WithAddressRotation.
+	rotateAddresses bool
+	// sortlist and sortByClient decide the order of the address records of served answers, see
+	// WithSortlist and WithClientAddressSorting.
+	sortlist     []*net.IPNet
+	sortByClient bool
+
+	// ecsV4Prefix and ecsV6Prefix are the lengths of the client subnets sent upstream, see WithClientSubnet.
+	ecsV4Prefix, ecsV6Prefix int
+
+	// introspection enables replies to the IntrospectionOption.
+	introspection bool
+
+	// StatsD reporting, see WithStatsD.
+	statsdAddr     string
+	statsdPrefix   string
+	statsdInterval time.Duration
+
+	// Fault injection for testing, see WithChaos.
+	chaosFailureRate float64
+	chaosLatency     time.Duration
+}
+
+// WithCache makes the server store answers in c instead of its built-in cache, e.g. a RedisCache to
+// share answers across servers. The options configuring the built-in cache are then ignored, and so are
+// the features relying on its internals: WithServfailCaching, refreshes, prefetching, persistence and
+// flushing.
+func WithCache(c Cache) Option {
+	return func(o *options) { o.cache = c }
+}
+
+// WithCacheSize sets the amount of entries the cache can hold.
+// If size is 0 a default value will be used, to disable caching use a negative value.
+func WithCacheSize(size int) Option {
+	return func(o *options) { o.cacheSize = size }
+}
+
+// WithConnectionsPerUpstream sets how many idle connections are kept open to each upstream for reuse.
+// More connections allow more concurrent queries without dialing, at the cost of memory and file
+// descriptors. If n <= 0 a default of 5 will be used.
+func WithConnectionsPerUpstream(n int) Option {
+	return func(o *options) { o.poolSize = n }
+}
+
+// WithDoTServer makes Run also serve DNS over TLS (RFC 7858) queries on addrs, usually on port 853, with
+// the certificates in cfg. Queries are answered as the ones received over plain DNS, including access
+// control and rate limiting by client IP.
+func WithDoTServer(cfg *tls.Config, addrs ...string) Option {
+	return func(o *options) {
+		o.dotConfig = cfg
+		o.dotAddrs = addrs
+	}
+}
+
+// WithUDPWorkers makes Run bind n UDP sockets to every address with SO_REUSEPORT, each served by its
+// own goroutine, so that the kernel spreads the queries across them and a single socket does not limit
+// the throughput on machines with many cores. TCP is not affected.
+// If n <= 1 a single socket is bound, which is the default. SO_REUSEPORT is only supported on Linux,
+// macOS and the BSDs, elsewhere Run fails if n > 1.
+func WithUDPWorkers(n int) Option {
+	return func(o *options) { o.udpWorkers = n }
+}
+
+// WithIdleTimeout makes the server close the connections to upstreams that were idle in the pool for
+// longer than d instead of reusing them. Upstreams close idle connections after a while, often silently,
+// and reusing such a connection makes the query fail and be retried. This is disabled by default.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(o *options) { o.idleTimeout = d }
+}
+
+// WithMaxConnectionLifetime makes the server close the pooled connections to upstreams that have been in use
+// for longer than d once the exchange in progress completes, and dial new ones as needed. This bounds how
+// long server side issues and TLS sessions are carried over. By default connections are reused indefinitely.
+func WithMaxConnectionLifetime(d time.Duration) Option {
+	return func(o *options) { o.maxConnLifetime = d }
+}
+
+// WithUpstreamTimeout sets how long the server waits for an upstream to connect and to answer a query
+// before giving up on it. If d <= 0 a default of 10 seconds will be used.
+func WithUpstreamTimeout(d time.Duration) Option {
+	return func(o *options) { o.upstreamTimeout = d }
+}
+
+// WithForwardRetries sets how many more times the server asks the upstreams to resolve a query when none of
+// them provided a response, waiting a random duration between delay/2 and delay before each retry so that
+// concurrent retries do not hit the upstreams at the same time.
+// If n is 0 a default of 2 retries will be used, to never retry use a negative value. A delay <= 0
+// retries immediately, which is the default.
+func WithForwardRetries(n int, delay time.Duration) Option {
+	return func(o *options) {
+		o.forwardRetries = n
+		o.retryDelay = delay
+	}
+}
+
+// WithServfailWait sets how long SelectFastest waits for the other upstreams after receiving a SERVFAIL,
+// which is returned only if none of them provides another response by then. Responses received before
+// any SERVFAIL are returned right away, so the wait only adds latency when an upstream is failing.
+// If d is 0 a default of 100ms will be used, to return the first response whatever its rcode use a
+// negative value.
+func WithServfailWait(d time.Duration) Option {
+	return func(o *options) { o.servfailWait = d }
+}
+
+// WithEvictMetrics tells the cache to collect metrics on recently evicted items,
+// which doubles its memory footprint.
+func WithEvictMetrics(enabled bool) Option {
+	return func(o *options) { o.evictMetrics = enabled }
+}
+
+// WithLRUOnlyCache makes the cache behave as a plain LRU cache instead of the default LRU/MFA hybrid.
+// Plain LRU is easier to reason about when debugging hit rates, but frequently accessed entries
+// can be pushed out by bursts of one-off queries.
+func WithLRUOnlyCache(enabled bool) Option {
+	return func(o *options) { o.lruOnly = enabled }
+}
+
+// WithCacheShards splits the cache in n shards with their own lock, so that concurrent queries for
+// different names rarely wait for each other. Every shard holds an equal part of the cache size, and
+// caches too small to hold at least 1024 entries per shard get fewer shards.
+// By default, or if n <= 1, the cache is not sharded.
+func WithCacheShards(n int) Option {
+	return func(o *options) { o.cacheShards = n }
+}
+
+// WithTTLStrategy sets how the expiration of cached answers is computed from the TTLs of their records.
+// Defaults to TTLMin.
+func WithTTLStrategy(st TTLStrategy) Option {
+	return func(o *options) { o.ttlStrategy = st }
+}
+
+// WithCacheTTLBounds clamps the TTL of every cached record to [min, max] when computing when answers
+// expire, which also applies to the TTLs served from the cache. A min above 0 keeps answers with very
+// short TTLs cached longer than their owners intended. A max <= 0 uses the default of 24 hours.
+func WithCacheTTLBounds(min, max time.Duration) Option {
+	return func(o *options) { o.minTTL, o.maxTTL = min, max }
+}
+
+// WithMaxStale limits how long after expiration cached answers can be served while they are refreshed,
+// as described in RFC 8767. Older answers are resolved again before replying. By default expired answers are
+// served for as long as they are in the cache.
+func WithMaxStale(d time.Duration) Option {
+	return func(o *options) { o.maxStale = d }
+}
+
+// WithNegativeCaching makes the server cache NXDOMAIN and NODATA responses for the time specified by the
+// SOA record in their authority section, as described in RFC 2308. By default only responses with
+// answers are cached.
+func WithNegativeCaching(enabled bool) Option {
+	return func(o *options) { o.negativeCache = enabled }
+}
+
+// WithServfailCaching makes the server cache SERVFAIL responses for ttl, including the ones it sends
+// when no upstream provided a response, so that clients retrying during an outage fail fast instead of
+// having each retry forwarded. The TTL of other answers is not affected: SERVFAIL responses never replace
+// cached answers, even expired ones, and are never served stale themselves.
+// A ttl <= 0 disables SERVFAIL caching, which is the default.
+func WithServfailCaching(ttl time.Duration) Option {
+	return func(o *options) { o.servfailTTL = ttl }
+}
+
+// WithPipelining makes the server use a single connection to each DNS over TLS upstream and send up to
+// depth queries on it without waiting for the previous responses. This requires fewer connections than
+// the default of sending one query at a time over a pool of connections, but not all servers support it.
+// A depth <= 0 disables pipelining.
+func WithPipelining(depth int) Option {
+	return func(o *options) { o.pipelineDepth = depth }
+}
+
+// WithPlainFallback makes unencrypted udp:// and tcp:// upstreams only be asked when all encrypted ones
+// fail to provide a response. If there are only unencrypted upstreams they are always used.
+func WithPlainFallback(enabled bool) Option {
+	return func(o *options) { o.plainFallback = enabled }
+}
+
+// WithTLSVersions sets the minimum and maximum TLS versions used with upstreams, e.g. tls.VersionTLS13.
+// A zero min keeps the default of TLS 1.2, a zero max allows the latest version supported by crypto/tls.
+func WithTLSVersions(min, max uint16) Option {
+	return func(o *options) {
+		o.tlsMinVersion = min
+		o.tlsMaxVersion = max
+	}
+}
+
+// WithTLSCipherSuites restricts the cipher suites used with upstreams for TLS versions up to 1.2,
+// see tls.Config.CipherSuites. TLS 1.3 cipher suites are not configurable.
+func WithTLSCipherSuites(suites ...uint16) Option {
+	return func(o *options) { o.tlsCipherSuites = suites }
+}
+
+// WithRootCAs makes the server verify upstream certificates against the given roots instead of the
+// system ones, e.g. for upstreams using certificates issued by an internal CA.
+func WithRootCAs(roots *x509.CertPool) Option {
+	return func(o *options) { o.rootCAs = roots }
+}
+
+// WithUpstreamEDNS0 makes every query forwarded upstream carry an OPT record advertising udpSize, e.g. 1232,
+// and the DO bit if do is true, even if the client did not send one. The OPT record and the DNSSEC records
+// are removed from the responses to clients that did not ask for them. A zero udpSize disables this.
+func WithUpstreamEDNS0(udpSize uint16, do bool) Option {
+	return func(o *options) {
+		o.upstreamUDPSize = udpSize
+		o.upstreamDO = do
+	}
+}
+
+// WithShutdownGracePeriod sets how long the server waits on shutdown for the upstream exchanges in progress
+// to complete before canceling them, so that clients do not get SERVFAIL during restarts.
+// If d is 0 a default value will be used, to cancel them immediately use a negative value.
+func WithShutdownGracePeriod(d time.Duration) Option {
+	return func(o *options) { o.shutdownGrace = d }
+}
+
+// WithOriginalTTLs makes cache hits carry the TTLs records had when they were received from upstream
+// instead of the remaining time before they expire. This helps downstream caches that misbehave
+// with small TTLs, at the cost of records being cached downstream for longer than intended.
+func WithOriginalTTLs(enabled bool) Option {
+	return func(o *options) { o.originalTTL = enabled }
+}
+
+// WithUpstreams sets the DNS-over-TLS servers queries are forwarded to, in the "host:port" or
+// "servername:port@ip" form, optionally followed by one or more "#pin=<base64>" SHA-256 hashes of the
+// SubjectPublicKeyInfo the upstream certificate must match. DNS-over-HTTPS servers can be specified by URL, e.g.
+// "https://dns.google/dns-query". Plain DNS servers can be specified as "udp://ip:port" or "tcp://ip:port",
+// see WithPlainFallback. Upstreams using other transports can be specified as "scheme://..."
+// if a transport for the scheme was registered with WithUpstreamTransport.
+// If no upstream servers are specified default ones will be used.
+func WithUpstreams(upstreamServers ...string) Option {
+	return func(o *options) { o.upstreamServers = upstreamServers }
+}
+
+// AnswerSizePolicy tells the server what to do with resolved answers that are bigger
+// than the limit set with WithAnswerSizeLimit.
+type AnswerSizePolicy int
+
+const (
+	// SizeRejectCache serves oversized answers but does not cache them.
+	SizeRejectCache AnswerSizePolicy = iota
+	// SizeTruncateAdditional drops the additional section (but the OPT record) from the cached
+	// copy of oversized answers. If the answer is still too big it is not cached.
+	SizeTruncateAdditional
+	// SizeLog logs oversized answers and caches them as usual.
+	SizeLog
+)
+
+// WithAnswerSizeLimit limits the size of the answers stored in the cache to limit bytes,
+// applying policy to the ones that exceed it. This only affects caching: clients always
+// receive the full answer.
+// If observe is not nil it is called with the question and the packed size of every
+// oversized answer.
+func WithAnswerSizeLimit(limit int, policy AnswerSizePolicy, observe func(q dns.Question, size int)) Option {
+	return func(o *options) {
+		o.maxAnswerSize = limit
+		o.sizePolicy = policy
+		o.onLargeAnswer = observe
+	}
+}
+
+// WithFirstQuestionOnly makes the server answer only the first question of messages that carry more than one,
+// instead of rejecting them with FORMERR as recommended by RFC 9619.
+// This is only meant for compatibility with legacy clients.
+func WithFirstQuestionOnly(enabled bool) Option {
+	return func(o *options) { o.firstQuestionOnly = enabled }
+}
+
+// WithRefreshScheduler starts a background scheduler that refreshes the topK most accessed cache entries
+// when they are about to expire in less than lead, so that hot entries are never served stale.
+// Upstream load is bounded to topK queries per lead/2.
+func WithRefreshScheduler(topK int, lead time.Duration) Option {
+	return func(o *options) {
+		o.refreshTopK = topK
+		o.refreshLead = lead
+	}
+}
+
+// WithPrefetch starts a background prefetcher that refreshes the topK most accessed cache entries once less
+// than fraction of their TTL is left, e.g. 0.1 for 10%, so that hot entries are never served stale.
+// Only entries accessed at least minAccesses times, including when they were cached, are prefetched.
+// Unlike WithRefreshScheduler the lead time is proportional to the TTL of every entry.
+func WithPrefetch(topK int, fraction float64, minAccesses uint) Option {
+	return func(o *options) {
+		o.prefetchTopK = topK
+		o.prefetchFraction = fraction
+		o.prefetchMinAccesses = minAccesses
+	}
+}
+
+// WithStreamCompression sets whether responses sent to clients over TCP should use name compression.
+// UDP responses are always compressed to fit as much as possible in a datagram, while stream transports
+// can afford bigger messages and skipping compression saves CPU. Defaults to true.
+func WithStreamCompression(enabled bool) Option {
+	return func(o *options) { o.noStreamCompression = !enabled }
+}
+
+// WithMaxCNAMEChain sets the maximum length of the CNAME chains accepted in upstream answers.
+// Answers with longer chains are treated as upstream failures. Answers with CNAME loops are always rejected.
+// If n is 0 a default value will be used.
+func WithMaxCNAMEChain(n int) Option {
+	return func(o *options) { o.maxCNAMEChain = n }
+}
+
+// WithClientConcurrencyLimit caps the amount of queries from a single client IP that are served concurrently,
+// so that a single client cannot monopolize the upstream connections.
+// Queries above the limit wait up to wait for a slot to free up and are refused if none does.
+// A limit <= 0 disables the check.
+func WithClientConcurrencyLimit(limit int, wait time.Duration) Option {
+	return func(o *options) {
+		o.clientLimit = limit
+		o.clientWait = wait
+	}
+}
+
+// WithStickyUpstreams makes the server remember which upstream answered each question for ttl,
+// and send following queries for the same question to that upstream first.
+// Other upstreams are only queried if the sticky one fails.
+// At most size questions are remembered, a size <= 0 disables stickiness.
+func WithStickyUpstreams(size int, ttl time.Duration) Option {
+	return func(o *options) {
+		o.stickySize = size
+		o.stickyTTL = ttl
+	}
+}
+
+// WithSinkhole makes the server answer A and AAAA queries for blocked names with v4 and v6 respectively,
+// e.g. 0.0.0.0 and ::, instead of NXDOMAIN. Queries for other types, or for a type whose address is nil,
+// get NODATA. See ReloadBlocklist.
+func WithSinkhole(v4, v6 net.IP) Option {
+	return func(o *options) {
+		o.sinkholeV4 = v4.To4()
+		o.sinkholeV6 = v6.To16()
+	}
+}
+
+// WithNoIPv6 makes the server answer AAAA queries that are not for local names with NODATA
+// without forwarding them. This is useful on networks without IPv6 connectivity.
+func WithNoIPv6(enabled bool) Option {
+	return func(o *options) { o.noIPv6 = enabled }
+}
+
+// WithHashedUpstreams makes the server send each question to a single upstream chosen by hashing it,
+// instead of sending it to all upstreams and using the fastest answer. If the chosen upstream fails
+// the following ones are tried in order.
+// This spreads the load across upstreams and makes the upstream used for a question predictable.
+// It is equivalent to WithSelectionStrategy(SelectHashed).
+func WithHashedUpstreams(enabled bool) Option {
+	return func(o *options) {
+		o.selection = SelectFastest
+		if enabled {
+			o.selection = SelectHashed
+		}
+	}
+}
+
+// WithLocalZone serves the given records locally instead of forwarding queries for them.
+// If apex is not empty the server becomes authoritative for it and all names below: names without
+// records get NODATA if they have children and NXDOMAIN otherwise.
+// If apex is empty only the names of the given records are answered locally.
+// Names are matched case-insensitively. This option can be specified multiple times.
+func WithLocalZone(apex string, rrs ...dns.RR) Option {
+	return func(o *options) {
+		if o.localZones == nil {
+			o.localZones = make(map[string][]dns.RR)
+		}
+		o.localZones[apex] = append(o.localZones[apex], rrs...)
+	}
+}
+
+// WithQNAMEMinimization makes the server ask the upstreams whether the ancestors of names exist before
+// forwarding queries for them, starting from the top-level domain, with minimized queries that do not
+// carry the full name nor the EDNS0 options of the query, as described in RFC 9156. If an ancestor does
+// not exist the query is answered with NXDOMAIN without sending the full name upstream. The ancestors
+// known to exist are remembered for the TTL of their responses, up to an hour.
+// This trades the latency of a few more round trips for not revealing names that do not exist, e.g.
+// typos and names of internal domains, to the upstreams.
+func WithQNAMEMinimization() Option {
+	return func(o *options) { o.qnameMinimization = true }
+}
+
+// WithDoHTrustedProxies makes DoHHandler trust the reverse proxies whose IP is in one of the given
+// networks to report the address of their clients in the Forwarded (RFC 7239) or X-Forwarded-For header.
+// The clients of the queries relayed by them are then subject to access control and rate limiting, and
+// logged, instead of the proxies. By default no proxy is trusted and the headers are ignored, as clients
+// could set them to pass for other clients.
+func WithDoHTrustedProxies(nets ...*net.IPNet) Option {
+	return func(o *options) { o.dohTrustedProxies = append(o.dohTrustedProxies, nets...) }
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"github.com/miekg/dns"
+)
+
+// WithUpstreamPadding pads the queries forwarded upstream with the EDNS0 Padding option (RFC 7830) to a
+// multiple of blockSize bytes, so that their size reveals less about the names being resolved to whoever
+// can observe the encrypted traffic. RFC 8467 recommends a blockSize of 128.
+// Padding is removed from the responses before they are cached. A blockSize <= 0 disables padding.
+func WithUpstreamPadding(blockSize int) Option {
+	return func(o *options) { o.paddingBlock = blockSize }
+}
+
+// withPadding returns a copy of q padded as configured by WithUpstreamPadding, or q itself if padding is
+// disabled.
+func (s *Server) withPadding(q *dns.Msg) *dns.Msg {
+	block := s.opts.paddingBlock
+	if block <= 0 {
+		return q
+	}
+	pq := q.Copy()
+	opt := pq.IsEdns0()
+	if opt == nil {
+		pq.SetEdns0(ednsUDPSize, false)
+		opt = pq.IsEdns0()
+	}
+	// Padding sent by the client is replaced.
+	removeEdns0Option(pq, dns.EDNS0PADDING)
+	// The option header counts towards the padded size.
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+	if rem := pq.Len() % block; rem != 0 {
+		padding.Padding = make([]byte, block-rem)
+	}
+	return pq
+}
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestUpstreamPadding(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		lens []int
+	)
+	upstream := funcTransport(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+		buf, err := q.Pack()
+		if err != nil {
+			return nil, err
+		}
+		mu.Lock()
+		lens = append(lens, len(buf))
+		mu.Unlock()
+		m, err := (&fakeTransport{}).Exchange(ctx, q)
+		if err != nil {
+			return nil, err
+		}
+		// Servers pad their responses as well.
+		m.SetEdns0(ednsUDPSize, false)
+		m.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_PADDING{Padding: make([]byte, 42)}}
+		return m, nil
+	})
+	s := NewServerWithOptions(
+		WithUpstreams("fake://"),
+		WithUpstreamTransport("fake", func(string) (UpstreamTransport, error) { return upstream, nil }),
+		WithUpstreamPadding(128),
+	)
+	for i, name := range []string{"a.miki.", strings.Repeat("raccoon.", 20) + "miki.", "padded.miki."} {
+		q := new(dns.Msg).SetQuestion(name, dns.TypeA)
+		if i == 2 {
+			// Padding sent by clients is replaced.
+			q.SetEdns0(ednsUDPSize, false)
+			q.IsEdns0().Option = []dns.EDNS0{&dns.EDNS0_PADDING{Padding: make([]byte, 100)}}
+		}
+		w := &fakeResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 42}}
+		s.ServeDNS(w, q)
+		if len(w.msgs) != 1 {
+			t.Fatalf("%s: responses: got %d want 1", name, len(w.msgs))
+		}
+		if got := w.msgs[0].IsEdns0() != nil; got != (i == 2) {
+			t.Errorf("%s: OPT in response: got %t want %t", name, got, i == 2)
+		}
+		if got := fmt.Sprint(w.msgs[0].IsEdns0()); strings.Contains(got, "PADDING") {
+			t.Errorf("%s: padding in response: %s", name, got)
+		}
+		v, _ := s.cache.c.Get(key(q))
+		cm, err := v.(cacheValue).unpack()
+		if err != nil {
+			t.Fatalf("%s: cannot unpack cached message: %v", name, err)
+		}
+		if opt := cm.IsEdns0(); opt != nil && len(opt.Option) > 0 {
+			t.Errorf("%s: cached OPT: got %v want no options", name, opt)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for i, l := range lens {
+		if l%128 != 0 {
+			t.Errorf("query %d: got %d bytes want a multiple of 128", i, l)
+		}
+	}
+}
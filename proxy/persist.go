@@ -0,0 +1,130 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// errNoBuiltinCache is returned when persisting a cache set with WithCache, which is not supported.
+var errNoBuiltinCache = errors.New("only the built-in cache can be saved and loaded")
+
+// WithCacheFile makes Run load the cache from path when it starts and save it there when it stops,
+// so that restarts do not empty the cache. See SaveCache and LoadCache.
+// It is ignored if the cache is set with WithCache.
+func WithCacheFile(path string) Option {
+	return func(o *options) { o.cacheFile = path }
+}
+
+// persistedEntry is the serialized form of a cache entry.
+type persistedEntry struct {
+	Key    string
+	Stored time.Time
+	Exp    time.Time
+	Exps   []time.Time
+	// Msg is the answer in wire format.
+	Msg []byte
+	// ECS and DO are the EDNS0 Client Subnet option and the DO bit of the query the answer was stored for.
+	ECS *dns.EDNS0_SUBNET
+	DO  bool
+}
+
+// dump writes all entries to w, least accessed first.
+func (c *cache) dump(w io.Writer) error {
+	if c == nil {
+		return nil
+	}
+	es := c.c.MostAccessed(c.c.Len())
+	enc := gob.NewEncoder(w)
+	for i := len(es) - 1; i >= 0; i-- {
+		v := es[i].Value.(cacheValue)
+		pe := persistedEntry{Key: es[i].Key, Stored: v.stored, Exp: v.exp, Exps: v.exps, Msg: v.msg, ECS: v.ecs, DO: v.do}
+		if err := enc.Encode(&pe); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load reads entries written by dump from r and adds the ones that are not expired to the cache.
+// It returns the amount of loaded entries.
+func (c *cache) load(r io.Reader) (int, error) {
+	if c == nil {
+		return 0, nil
+	}
+	now := c.now()
+	dec := gob.NewDecoder(r)
+	n := 0
+	for {
+		var pe persistedEntry
+		if err := dec.Decode(&pe); err == io.EOF {
+			return n, nil
+		} else if err != nil {
+			return n, err
+		}
+		if !pe.Exp.After(now) {
+			continue
+		}
+		var m dns.Msg
+		if err := m.Unpack(pe.Msg); err != nil {
+			return n, fmt.Errorf("entry %q: %v", pe.Key, err)
+		}
+		cv := cacheValue{stored: pe.Stored, exp: pe.Exp, exps: pe.Exps, ecs: pe.ECS, do: pe.DO}
+		if err := cv.pack(&m); err != nil {
+			return n, fmt.Errorf("entry %q: %v", pe.Key, err)
+		}
+		c.c.Put(pe.Key, cv)
+		n++
+	}
+}
+
+// SaveCache writes the content of the cache to the file at path, replacing it.
+// Caches set with WithCache are not supported and leave the file untouched.
+func (s *Server) SaveCache(path string) error {
+	if s.cache == nil {
+		return errNoBuiltinCache
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	w := bufio.NewWriter(f)
+	if err := s.cache.dump(w); err != nil {
+		f.Close()
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadCache adds the entries saved with SaveCache in the file at path to the cache.
+// Entries that expired in the meantime are discarded. Caches set with WithCache are not supported.
+func (s *Server) LoadCache(path string) error {
+	if s.cache == nil {
+		return errNoBuiltinCache
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	n, err := s.cache.load(bufio.NewReader(f))
+	log.Infof("Loaded %d cache entries from %s", n, path)
+	return err
+}
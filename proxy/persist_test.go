@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestCachePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.gob")
+
+	now := time.Date(2019, 10, 18, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	s := NewServerWithOptions(WithTTLStrategy(TTLSplit))
+	s.cache.clock = clock
+	short, sm := testAnswer(t, "short.miki.", "short.miki. 60 IN A 42.42.42.42")
+	long, lm := testAnswer(t, "long.miki.", "long.miki. 3600 IN A 42.42.42.42", "long.miki. 600 IN A 43.43.43.43")
+	s.cache.put(short, sm)
+	s.cache.put(long, lm)
+	if err := s.SaveCache(path); err != nil {
+		t.Fatalf("Cannot save cache: %v", err)
+	}
+
+	// Restart after two minutes.
+	now = now.Add(2 * time.Minute)
+	s = NewServerWithOptions(WithTTLStrategy(TTLSplit))
+	s.cache.clock = clock
+	if err := s.LoadCache(path); err != nil {
+		t.Fatalf("Cannot load cache: %v", err)
+	}
+	if got := s.cache.c.Len(); got != 1 {
+		t.Errorf("loaded entries: got %d want 1", got)
+	}
+	if m, _ := s.cache.get(short); m != nil {
+		t.Errorf("expired entry was loaded: %v", m)
+	}
+	m, fresh := s.cache.get(long)
+	if !fresh {
+		t.Fatalf("get(%v): got miss want hit", long.Question[0])
+	}
+	want := []uint32{3600 - 120, 600 - 120}
+	if len(m.Answer) != len(want) {
+		t.Fatalf("answers: got %v want %d records", m.Answer, len(want))
+	}
+	for i, a := range m.Answer {
+		if a.Header().Ttl != want[i] {
+			t.Errorf("TTL of record %d: got %d want %d", i, a.Header().Ttl, want[i])
+		}
+	}
+	if m.Answer[0].(*dns.A).A.String() != "42.42.42.42" {
+		t.Errorf("answer: got %v", m.Answer[0])
+	}
+
+	if err := s.LoadCache(filepath.Join(dir, "missing")); !os.IsNotExist(err) {
+		t.Errorf("loading missing file: got %v want not exist error", err)
+	}
+}
+
+func TestCacheSavedOnShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.gob")
+
+	ts, cleanup := setupTestServer(t, 0, nil, WithCacheFile(path))
+	ts.exchange("cachefill", "42.42.42.42")
+	// Canceling the context of Run saves the cache.
+	cleanup()
+
+	s := NewServerWithOptions()
+	if err := s.LoadCache(path); err != nil {
+		t.Fatalf("Cannot load cache: %v", err)
+	}
+	if got := s.cache.c.Len(); got != 1 {
+		t.Errorf("loaded entries: got %d want 1", got)
+	}
+}
+
+func TestCacheFileIgnoredWithCustomCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatalf("Cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.gob")
+	const content = "saved by another server"
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("Cannot write cache file: %v", err)
+	}
+
+	c := &mapCache{answers: make(map[dns.Question]*dns.Msg)}
+	ts, cleanup := setupTestServer(t, 0, nil, WithCache(c), WithCacheFile(path))
+	ts.exchange("cachefill", "42.42.42.42")
+	cleanup()
+
+	if err := ts.s.SaveCache(path); err != errNoBuiltinCache {
+		t.Errorf("SaveCache: got %v want %v", err, errNoBuiltinCache)
+	}
+	if err := ts.s.LoadCache(path); err != errNoBuiltinCache {
+		t.Errorf("LoadCache: got %v want %v", err, errNoBuiltinCache)
+	}
+	if got, err := ioutil.ReadFile(path); err != nil || string(got) != content {
+		t.Errorf("cache file: got %q, %v want %q", got, err, content)
+	}
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// pinPrefix introduces a certificate pin in an upstream spec.
+const pinPrefix = "#pin="
+
+// errPinMismatch is returned when the certificate of an upstream does not match any of its pins.
+var errPinMismatch = errors.New("certificate does not match any pin")
+
+// parsePins splits the "#pin=<base64>" suffixes off a DNS over TLS upstream spec. Every pin is the
+// standard base64 encoding of the SHA-256 of a SubjectPublicKeyInfo, multiple pins can be specified
+// to allow key rotation.
+func parsePins(spec string) (rest string, pins [][]byte, err error) {
+	i := strings.Index(spec, "#")
+	if i < 0 {
+		return spec, nil, nil
+	}
+	rest = spec[:i]
+	for _, p := range strings.Split(spec[i:], "#")[1:] {
+		p = "#" + p
+		if !strings.HasPrefix(p, pinPrefix) {
+			return "", nil, fmt.Errorf("malformed pin %q", p)
+		}
+		pin, err := base64.StdEncoding.DecodeString(p[len(pinPrefix):])
+		if err != nil {
+			return "", nil, fmt.Errorf("malformed pin %q: %v", p, err)
+		}
+		if len(pin) != sha256.Size {
+			return "", nil, fmt.Errorf("malformed pin %q: got %d bytes want %d", p, len(pin), sha256.Size)
+		}
+		pins = append(pins, pin)
+	}
+	return rest, pins, nil
+}
+
+// verifyPins returns a tls.Config.VerifyPeerCertificate callback that accepts leaf certificates
+// whose SubjectPublicKeyInfo hash matches one of the pins.
+func verifyPins(pins [][]byte) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errPinMismatch
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		for _, pin := range pins {
+			if bytes.Equal(pin, sum[:]) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: got %s", errPinMismatch, base64.StdEncoding.EncodeToString(sum[:]))
+	}
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParsePins(t *testing.T) {
+	pin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	tests := []struct {
+		spec     string
+		wantRest string
+		wantPins int
+		wantErr  bool
+	}{
+		{spec: "dns.google:853@8.8.8.8", wantRest: "dns.google:853@8.8.8.8"},
+		{spec: "dns.google:853@8.8.8.8#pin=" + pin, wantRest: "dns.google:853@8.8.8.8", wantPins: 1},
+		{spec: "1.1.1.1:853#pin=" + pin + "#pin=" + pin, wantRest: "1.1.1.1:853", wantPins: 2},
+		{spec: "1.1.1.1:853#pin=", wantErr: true},
+		{spec: "1.1.1.1:853#pin=notbase64!", wantErr: true},
+		{spec: "1.1.1.1:853#pin=Z29waGVy", wantErr: true},
+		{spec: "1.1.1.1:853#hash=" + pin, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			rest, pins, err := parsePins(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error: got %v want error %t", err, tt.wantErr)
+			}
+			if rest != tt.wantRest || len(pins) != tt.wantPins {
+				t.Errorf("got %q with %d pins want %q with %d pins", rest, len(pins), tt.wantRest, tt.wantPins)
+			}
+		})
+	}
+}
+
+func TestPinning(t *testing.T) {
+	cert := newTestCert(t, time.Now().Add(time.Hour))
+	addr, cleanup := startTLSUpstream(t, &tls.Config{Certificates: []tls.Certificate{cert}})
+	defer cleanup()
+	sum := sha256.Sum256(cert.Leaf.RawSubjectPublicKeyInfo)
+	good := base64.StdEncoding.EncodeToString(sum[:])
+	bad := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name    string
+		pins    []string
+		wantErr bool
+	}{
+		{name: "no pins"},
+		{name: "matching", pins: []string{good}},
+		{name: "one matching", pins: []string{bad, good}},
+		{name: "mismatch", pins: []string{bad}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := addr
+			for _, p := range tt.pins {
+				spec += pinPrefix + p
+			}
+			s := NewServerWithOptions(WithUpstreams(spec))
+			s.dial = trustingDialer(cert)
+			defer s.upstreams[0].t.Close()
+			var q dns.Msg
+			q.SetQuestion(testQuestion, dns.TypeA)
+			_, err := s.exchangeMessages(context.Background(), s.upstreams[0], &q)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("exchange error: got %v want error %t", err, tt.wantErr)
+			}
+			us := s.upstreamStats()[0]
+			var wantPinErrors uint64
+			if tt.wantErr {
+				wantPinErrors = 1
+				if !errors.Is(err, errPinMismatch) {
+					t.Errorf("exchange error: got %v want %v", err, errPinMismatch)
+				}
+			}
+			if us.PinErrors != wantPinErrors || us.Errors != wantPinErrors {
+				t.Errorf("stats: got %d pin errors and %d errors want %d", us.PinErrors, us.Errors, wantPinErrors)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// pipeline is a connection to an upstream that carries multiple outstanding queries at once,
+// as allowed by RFC 7766. Responses might come in any order and are matched to their queries by ID,
+// so queries are sent with IDs that are unique on the connection.
+type pipeline struct {
+	c *dns.Conn
+	// slots limits the amount of queries in flight.
+	slots chan struct{}
+
+	// wmu serializes writes.
+	wmu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]pendingQuery
+	// done is closed when the connection breaks, err tells why.
+	done chan struct{}
+	err  error
+}
+
+// pendingQuery is a query waiting for its response on a pipeline.
+type pendingQuery struct {
+	q  dns.Question
+	ch chan *dns.Msg
+}
+
+// matches reports whether m can be the response to pq. Responses of abandoned queries might arrive
+// after their ID was reused, checking the question keeps them from being taken for the new one.
+func (pq pendingQuery) matches(m *dns.Msg) bool {
+	if len(m.Question) == 0 {
+		// Some error responses carry no question, the ID is all there is to go by.
+		return true
+	}
+	r := m.Question[0]
+	return r.Qtype == pq.q.Qtype && r.Qclass == pq.q.Qclass && strings.EqualFold(r.Name, pq.q.Name)
+}
+
+func newPipeline(c *dns.Conn, depth int) *pipeline {
+	pl := &pipeline{
+		c:       c,
+		slots:   make(chan struct{}, depth),
+		pending: make(map[uint16]pendingQuery),
+		done:    make(chan struct{}),
+	}
+	go pl.readLoop()
+	return pl
+}
+
+func (pl *pipeline) readLoop() {
+	for {
+		m, err := pl.c.ReadMsg()
+		if err != nil {
+			log.Debugf("Error while reading pipelined message: %v", err)
+			pl.fail(err)
+			return
+		}
+		pl.mu.Lock()
+		pq, ok := pl.pending[m.Id]
+		ok = ok && pq.matches(m)
+		if ok {
+			delete(pl.pending, m.Id)
+		}
+		pl.mu.Unlock()
+		if !ok {
+			// Most likely the response to an abandoned query.
+			log.Debugf("Dropping unexpected response with ID %d", m.Id)
+			continue
+		}
+		pq.ch <- m
+	}
+}
+
+// fail breaks pl, closing its connection. Pending and future exchanges fail with err.
+func (pl *pipeline) fail(err error) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if pl.err != nil {
+		return
+	}
+	pl.err = err
+	close(pl.done)
+	pl.c.Close()
+}
+
+func (pl *pipeline) broken() bool {
+	select {
+	case <-pl.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (pl *pipeline) error() error {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	return pl.err
+}
+
+// exchange sends q and waits for its response. The response has the same ID as q.
+func (pl *pipeline) exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	select {
+	case pl.slots <- struct{}{}:
+	case <-pl.done:
+		return nil, pl.error()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	defer func() { <-pl.slots }()
+
+	ch := make(chan *dns.Msg, 1)
+	pl.mu.Lock()
+	if pl.err != nil {
+		pl.mu.Unlock()
+		return nil, pl.err
+	}
+	id := dns.Id()
+	for _, ok := pl.pending[id]; ok; _, ok = pl.pending[id] {
+		id = dns.Id()
+	}
+	pl.pending[id] = pendingQuery{q: q.Question[0], ch: ch}
+	pl.mu.Unlock()
+
+	// Only the ID changes, a shallow copy is enough.
+	pq := *q
+	pq.Id = id
+	pl.wmu.Lock()
+	// The deadline of the previous writer must not apply to this one.
+	d, _ := ctx.Deadline()
+	_ = pl.c.SetWriteDeadline(d)
+	err := writeMsg(pl.c, &pq)
+	pl.wmu.Unlock()
+	if err != nil {
+		log.Debugf("Send pipelined question message failed: %v", err)
+		pl.fail(err)
+		return nil, err
+	}
+
+	select {
+	case m := <-ch:
+		m.Id = q.Id
+		return m, nil
+	case <-pl.done:
+		select {
+		case m := <-ch:
+			m.Id = q.Id
+			return m, nil
+		default:
+			return nil, pl.error()
+		}
+	case <-ctx.Done():
+		// Only this query is abandoned, the others on the connection might still be answered.
+		// Its response is dropped if it ever arrives.
+		pl.mu.Lock()
+		delete(pl.pending, id)
+		pl.mu.Unlock()
+		return nil, ctx.Err()
+	}
+}
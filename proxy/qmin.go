@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/mikispag/dns-over-tls-forwarder/proxy/internal/specialized"
+)
+
+const (
+	// maxMinimizedQueries bounds the amount of minimized queries sent for a name, as MAX_MINIMISE_COUNT
+	// in RFC 9156 2.3: the ancestors closest to the root are not asked about.
+	maxMinimizedQueries = 10
+	// minimizerSize is the amount of names known to exist that are remembered.
+	minimizerSize = 4096
+	// maxMinimizerTTL caps how long names are known to exist for.
+	maxMinimizerTTL = time.Hour
+)
+
+// minimizer remembers the names that minimized queries proved to exist, so that they are not asked
+// about again. A nil *minimizer does not minimize queries.
+type minimizer struct {
+	c *specialized.Cache
+}
+
+func newMinimizer() *minimizer {
+	c, err := specialized.NewLRUCache(minimizerSize, false)
+	if err != nil {
+		return nil
+	}
+	return &minimizer{c: c}
+}
+
+// exists reports whether name is known to exist at now.
+func (mz *minimizer) exists(name string, now time.Time) bool {
+	v, ok := mz.c.Get(name)
+	return ok && v.(time.Time).After(now)
+}
+
+func (mz *minimizer) setExists(name string, exp time.Time) {
+	mz.c.Put(name, exp)
+}
+
+// minimize asks the upstreams of the name of q whether its ancestors exist, starting from the top-level
+// domain, with queries that only carry the ancestor name and no EDNS0 options. If one of them does not
+// exist, neither does the name and the NXDOMAIN response for q is returned without sending it, as
+// described in RFC 8020. Otherwise, or if an ancestor could not be resolved, nil is returned and q
+// should be forwarded as is.
+func (s *Server) minimize(ctx context.Context, q *dns.Msg) (*dns.Msg, *upstream) {
+	name := strings.ToLower(q.Question[0].Name)
+	labels := dns.SplitDomainName(name)
+	first := len(labels) - 1
+	if first > maxMinimizedQueries {
+		first = maxMinimizedQueries
+	}
+	for i := first; i > 0; i-- {
+		ancestor := dns.Fqdn(strings.Join(labels[i:], "."))
+		now := s.now()
+		if s.qmin.exists(ancestor, now) {
+			continue
+		}
+		m, u := s.forwardTo(ctx, minimizedQuery(q, ancestor), name)
+		if m == nil {
+			return nil, nil
+		}
+		switch m.Rcode {
+		case dns.RcodeSuccess:
+			s.qmin.setExists(ancestor, now.Add(minimizedTTL(m)))
+		case dns.RcodeNameError:
+			if len(m.Answer) > 0 {
+				// The ancestor is an alias, the response is about its target.
+				return nil, nil
+			}
+			log.Debugf("Answering %q with NXDOMAIN: %q does not exist", name, ancestor)
+			r := new(dns.Msg).SetRcode(q, dns.RcodeNameError)
+			r.RecursionAvailable = m.RecursionAvailable
+			r.AuthenticatedData = m.AuthenticatedData
+			r.Ns = m.Ns
+			return r, u
+		default:
+			// RFC 9156 2.3: fall back to the full query rather than failing.
+			return nil, nil
+		}
+	}
+	return nil, nil
+}
+
+// minimizedQuery returns a query for the A records of name, as recommended by RFC 9156 2.1, with the
+// same flags and DO bit as q but none of its EDNS0 options.
+func minimizedQuery(q *dns.Msg, name string) *dns.Msg {
+	mq := new(dns.Msg).SetQuestion(name, dns.TypeA)
+	mq.RecursionDesired = q.RecursionDesired
+	mq.CheckingDisabled = q.CheckingDisabled
+	if opt := q.IsEdns0(); opt != nil {
+		mq.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	return mq
+}
+
+// minimizedTTL returns how long the name m answers about is known to exist for: the shortest TTL of
+// its records, up to maxMinimizerTTL.
+func minimizedTTL(m *dns.Msg) time.Duration {
+	ttl := maxMinimizerTTL
+	for _, rr := range append(m.Answer[:len(m.Answer):len(m.Answer)], m.Ns...) {
+		if d := time.Duration(rr.Header().Ttl) * time.Second; d < ttl {
+			ttl = d
+		}
+	}
+	return ttl
+}
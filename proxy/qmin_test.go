@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestQNAMEMinimization(t *testing.T) {
+	var sent []string
+	upstream := funcTransport(func(_ context.Context, q *dns.Msg) (*dns.Msg, error) {
+		name := q.Question[0].Name
+		sent = append(sent, name+" "+dns.TypeToString[q.Question[0].Qtype])
+		if opt := q.IsEdns0(); opt != nil && len(opt.Option) > 0 && q.Question[0].Qtype == dns.TypeA {
+			t.Errorf("minimized query for %s carries EDNS0 options %v", name, opt.Option)
+		}
+		m := new(dns.Msg).SetReply(q)
+		switch name {
+		case "miki.", "raccoon.miki.":
+			m.Ns = []dns.RR{mustRR(t, "miki. 300 IN SOA ns.miki. hostmaster.miki. 1 7200 3600 1209600 300")}
+		case "host.raccoon.miki.":
+			m.Answer = []dns.RR{mustRR(t, "host.raccoon.miki. 300 IN A 42.42.42.42")}
+		case "broken.miki.":
+			m.Rcode = dns.RcodeServerFailure
+		case "alias.miki.":
+			m.Rcode = dns.RcodeNameError
+			m.Answer = []dns.RR{mustRR(t, "alias.miki. 300 IN CNAME nx.miki.")}
+		default:
+			m.Rcode = dns.RcodeNameError
+		}
+		return m, nil
+	})
+	s := NewServerWithOptions(
+		WithCacheSize(-1),
+		WithUpstreams("fake://"),
+		WithUpstreamTransport("fake", func(string) (UpstreamTransport, error) { return upstream, nil }),
+		WithQNAMEMinimization(),
+	)
+
+	tests := []struct {
+		qname     string
+		wantRcode int
+		wantSent  []string
+	}{
+		{
+			qname:    "host.raccoon.miki.",
+			wantSent: []string{"miki. A", "raccoon.miki. A", "host.raccoon.miki. AAAA"},
+		},
+		{
+			// Ancestors known to exist are not asked about again.
+			qname:    "host.raccoon.miki.",
+			wantSent: []string{"host.raccoon.miki. AAAA"},
+		},
+		{
+			// The full name is never sent if an ancestor does not exist.
+			qname:     "secret.nx.miki.",
+			wantRcode: dns.RcodeNameError,
+			wantSent:  []string{"nx.miki. A"},
+		},
+		{
+			// The full query is sent if an ancestor cannot be resolved.
+			qname:     "host.broken.miki.",
+			wantRcode: dns.RcodeNameError,
+			wantSent:  []string{"broken.miki. A", "host.broken.miki. AAAA"},
+		},
+		{
+			// NXDOMAIN for an alias is about its target.
+			qname:     "host.alias.miki.",
+			wantRcode: dns.RcodeNameError,
+			wantSent:  []string{"alias.miki. A", "host.alias.miki. AAAA"},
+		},
+	}
+	for _, tt := range tests {
+		sent = nil
+		var q dns.Msg
+		q.SetQuestion(tt.qname, dns.TypeAAAA)
+		q.SetEdns0(1232, false)
+		addClientSubnet(&q, net.IPv4(192, 0, 2, 1))
+		w := &fakeResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 42}}
+		s.ServeDNS(w, &q)
+		if len(w.msgs) != 1 {
+			t.Fatalf("%s: responses: got %d want 1", tt.qname, len(w.msgs))
+		}
+		if got := w.msgs[0].Rcode; got != tt.wantRcode {
+			t.Errorf("%s: rcode: got %s want %s", tt.qname, dns.RcodeToString[got], dns.RcodeToString[tt.wantRcode])
+		}
+		if !reflect.DeepEqual(sent, tt.wantSent) {
+			t.Errorf("%s: queries sent: got %q want %q", tt.qname, sent, tt.wantSent)
+		}
+	}
+}
+
+// addClientSubnet adds an EDNS0 client subnet option for ip to q.
+func addClientSubnet(q *dns.Msg, ip net.IP) {
+	q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       ip,
+	})
+}
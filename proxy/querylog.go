@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// CacheStatus describes how the cache was involved in answering a query.
+type CacheStatus string
+
+const (
+	// CacheHit means the answer was served fresh from the cache.
+	CacheHit CacheStatus = "hit"
+	// CacheStale means an expired answer was served from the cache while it is refreshed in background.
+	CacheStale CacheStatus = "stale"
+	// CacheMiss means the answer was requested upstream.
+	CacheMiss CacheStatus = "miss"
+	// CacheBypass means the answer was synthesized by the server, e.g. from local zones or the blocklist.
+	CacheBypass CacheStatus = "bypass"
+)
+
+// QueryLog describes a query served by the server.
+type QueryLog struct {
+	Time   time.Time
+	Client string
+	Name   string
+	Type   string
+	Rcode  string
+	// Answers is the amount of records in the answer section of the response.
+	Answers int
+	Cache   CacheStatus
+	// Upstream is the upstream that provided the answer, if any.
+	Upstream string `json:",omitempty"`
+	Latency  time.Duration
+}
+
+// QueryLogger records the queries served by the server. LogQuery is called once the answer to a query
+// is known and before it is written to the client, so it should not block.
+type QueryLogger interface {
+	LogQuery(QueryLog)
+}
+
+// WithQueryLogger makes the server report every answered query to l.
+func WithQueryLogger(l QueryLogger) Option {
+	return func(o *options) { o.queryLogger = l }
+}
+
+// queryLogBuffer is the amount of queries a JSONQueryLogger holds while they are being written, the
+// following ones are dropped.
+const queryLogBuffer = 1024
+
+// JSONQueryLogger is a QueryLogger that writes queries to an io.Writer as JSON lines. Queries are written
+// in background, so that slow writes do not delay answers: they are dropped if too many are waiting to
+// be written. Close must be called to write the pending ones.
+type JSONQueryLogger struct {
+	// dropped counts the queries that were not written, accessed atomically.
+	dropped uint64
+	w       io.Writer
+	logs    chan QueryLog
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+	err    error
+}
+
+// NewJSONQueryLogger returns a QueryLogger that writes one JSON object per query to w.
+func NewJSONQueryLogger(w io.Writer) *JSONQueryLogger {
+	l := &JSONQueryLogger{
+		w:    w,
+		logs: make(chan QueryLog, queryLogBuffer),
+		done: make(chan struct{}),
+	}
+	go l.write()
+	return l
+}
+
+// write writes the queries until the logger is closed, flushing them whenever there is none waiting.
+func (l *JSONQueryLogger) write() {
+	defer close(l.done)
+	bw := bufio.NewWriter(l.w)
+	enc := json.NewEncoder(bw)
+	for ql := range l.logs {
+		if err := enc.Encode(ql); err != nil {
+			log.Warnf("Unable to write query log: %v", err)
+		}
+		if len(l.logs) == 0 {
+			if err := bw.Flush(); err != nil {
+				log.Warnf("Unable to write query log: %v", err)
+			}
+		}
+	}
+	l.err = bw.Flush()
+}
+
+// LogQuery implements QueryLogger. It never blocks, queries logged after Close are dropped.
+func (l *JSONQueryLogger) LogQuery(ql QueryLog) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.logs <- ql:
+	default:
+		if atomic.AddUint64(&l.dropped, 1) == 1 {
+			log.Warnf("Query log cannot keep up, dropping queries")
+		}
+	}
+}
+
+// Close writes the pending queries and closes the writer if it is an io.Closer.
+func (l *JSONQueryLogger) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.logs)
+	l.mu.Unlock()
+	<-l.done
+	if n := atomic.LoadUint64(&l.dropped); n > 0 {
+		log.Warnf("Dropped %d queries from the query log", n)
+	}
+	err := l.err
+	if c, ok := l.w.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
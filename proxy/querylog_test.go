@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+type recordingLogger struct {
+	mu   sync.Mutex
+	logs []QueryLog
+}
+
+func (r *recordingLogger) LogQuery(ql QueryLog) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.logs = append(r.logs, ql)
+}
+
+func TestQueryLogger(t *testing.T) {
+	var rl recordingLogger
+	ts, cleanup := setupTestServer(t, 0, nil, WithQueryLogger(&rl))
+	defer cleanup()
+	var c dns.Client
+	for i := 0; i < 2; i++ {
+		var m dns.Msg
+		m.SetQuestion(testQuestion, dns.TypeA)
+		if _, _, err := c.Exchange(&m, ts.laddr); err != nil {
+			t.Fatalf("cannot contact server: %v", err)
+		}
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	want := []QueryLog{
+		{Client: "127.0.0.1", Name: testQuestion, Type: "A", Rcode: "NOERROR", Answers: 1, Cache: CacheMiss, Upstream: "gopher.empijei:853"},
+		{Client: "127.0.0.1", Name: testQuestion, Type: "A", Rcode: "NOERROR", Answers: 1, Cache: CacheHit},
+	}
+	if len(rl.logs) != len(want) {
+		t.Fatalf("logs: got %+v want %d entries", rl.logs, len(want))
+	}
+	for i, got := range rl.logs {
+		if got.Time.IsZero() || got.Latency <= 0 {
+			t.Errorf("log %d: got time %v and latency %v want them set", i, got.Time, got.Latency)
+		}
+		got.Time, got.Latency = want[i].Time, want[i].Latency
+		if got != want[i] {
+			t.Errorf("log %d: got %+v want %+v", i, got, want[i])
+		}
+	}
+}
+
+func TestJSONQueryLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewJSONQueryLogger(&buf)
+	want := []QueryLog{
+		{Client: "127.0.0.1", Name: testQuestion, Type: "A", Rcode: "NOERROR", Answers: 1, Cache: CacheMiss, Upstream: "dns.google:853@8.8.8.8"},
+		{Client: "::1", Name: testQuestion, Type: "AAAA", Rcode: "SERVFAIL", Cache: CacheMiss},
+	}
+	for _, ql := range want {
+		l.LogQuery(ql)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Cannot close logger: %v", err)
+	}
+	// Queries logged after Close are dropped.
+	l.LogQuery(want[0])
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != len(want) {
+		t.Fatalf("lines: got %q want %d", buf.String(), len(want))
+	}
+	for i, line := range lines {
+		var got QueryLog
+		if err := json.Unmarshal(line, &got); err != nil {
+			t.Fatalf("line %d: cannot decode %q: %v", i, line, err)
+		}
+		if got != want[i] {
+			t.Errorf("line %d: got %+v want %+v", i, got, want[i])
+		}
+	}
+}
+
+// blockingWriter blocks writes until release is closed.
+type blockingWriter struct {
+	release chan struct{}
+	bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.Buffer.Write(p)
+}
+
+func TestJSONQueryLoggerSlowWriter(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	l := NewJSONQueryLogger(w)
+	const n = 2 * queryLogBuffer
+	for i := 0; i < n; i++ {
+		l.LogQuery(QueryLog{Name: testQuestion})
+	}
+	close(w.release)
+	if err := l.Close(); err != nil {
+		t.Fatalf("Cannot close logger: %v", err)
+	}
+	written := bytes.Count(w.Bytes(), []byte("\n"))
+	if dropped := atomic.LoadUint64(&l.dropped); written+int(dropped) != n || dropped == 0 {
+		t.Errorf("queries: got %d written and %d dropped want %d in total, some of them dropped", written, dropped, n)
+	}
+}
@@ -0,0 +1,287 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultRedisTimeout bounds every Redis command, which run while clients wait for answers.
+	defaultRedisTimeout = 100 * time.Millisecond
+	// redisRetryDelay is how long Redis is considered down after a failure: lookups miss and answers
+	// are not stored without trying to reach it, so that clients are not delayed by timeouts.
+	redisRetryDelay = time.Second
+	// redisMaxIdle is the maximum amount of idle connections kept open to Redis.
+	redisMaxIdle = 16
+)
+
+// errRedisDown is returned by the commands sent while Redis is considered down.
+var errRedisDown = errors.New("redis is unavailable")
+
+// RedisCache is a Cache storing answers in Redis, so that the servers using the same Redis share their
+// answers and a server that just started benefits from the ones resolved by the others.
+// Answers are stored packed with their expiration, which is computed as the built-in cache does by
+// default: together with their shortest lived record, or as described in RFC 2308 for negative answers.
+// Redis removes them when they expire, so expired answers are never served. Answers are not stored and
+// lookups miss while Redis cannot be reached, the server then works as if caching was disabled.
+type RedisCache struct {
+	addr, prefix string
+	timeout      time.Duration
+	idle         chan *redisConn
+	// clock is used to get the current time, if nil time.Now is used.
+	clock func() time.Time
+
+	mu sync.Mutex
+	// metrics counts the hits as HitLRU.
+	metrics CacheMetrics
+	// retryAt is when Redis can be tried again after a failure.
+	retryAt time.Time
+	down    bool
+}
+
+// NewRedisCache returns a Cache storing answers in the Redis server listening on the TCP address addr,
+// see RedisCache. The keys of all stored answers start with prefix. Use it with WithCache.
+func NewRedisCache(addr, prefix string) *RedisCache {
+	return &RedisCache{
+		addr:    addr,
+		prefix:  prefix,
+		timeout: defaultRedisTimeout,
+		idle:    make(chan *redisConn, redisMaxIdle),
+	}
+}
+
+func (c *RedisCache) now() time.Time {
+	if c.clock != nil {
+		return c.clock()
+	}
+	return time.Now()
+}
+
+// Get implements Cache.
+func (c *RedisCache) Get(q *dns.Msg) (*dns.Msg, bool) {
+	k := c.prefix + key(q)
+	m, exp, err := c.get(k)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil || m == nil {
+		if err != nil {
+			log.Debugf("[REDIS] MISS due to error for %v: %v", k, err)
+		}
+		c.metrics.Miss++
+		return nil, false
+	}
+	now := c.now()
+	if !exp.After(now) {
+		// Redis expires keys with a millisecond precision, but TTLs have a second one.
+		c.metrics.Miss++
+		return nil, false
+	}
+	log.Debugf("[REDIS] HIT %v", k)
+	c.metrics.HitLRU++
+	// Rewrite the answer ID and question to match the ones of the query, which might be spelled differently.
+	m.Id = q.Id
+	m.Question = append([]dns.Question(nil), q.Question...)
+	setTTL(m, uint32(exp.Sub(now).Seconds()))
+	return m, true
+}
+
+// get returns the answer stored for k, nil if there is none, and its expiration.
+func (c *RedisCache) get(k string) (*dns.Msg, time.Time, error) {
+	r, err := c.do("GET", k)
+	if err != nil || r == nil {
+		return nil, time.Time{}, err
+	}
+	buf, ok := r.([]byte)
+	if !ok || len(buf) < 8 {
+		return nil, time.Time{}, fmt.Errorf("unexpected value %q", r)
+	}
+	exp := time.Unix(0, int64(binary.BigEndian.Uint64(buf)))
+	m := new(dns.Msg)
+	if err := m.Unpack(buf[8:]); err != nil {
+		return nil, time.Time{}, err
+	}
+	return m, exp, nil
+}
+
+// Put implements Cache.
+func (c *RedisCache) Put(q, m *dns.Msg) {
+	k := c.prefix + key(q)
+	if m.Truncated || m.Rcode == dns.RcodeServerFailure {
+		log.Debugf("[REDIS] Did not store truncated or SERVFAIL answer %v", k)
+		return
+	}
+	now := c.now()
+	var exp time.Time
+	if len(m.Answer) == 0 {
+		var ok bool
+		if exp, ok = negativeExpiration(now, m, 0, defaultMaxTTL); !ok {
+			log.Debugf("[REDIS] Did not store empty answer %v", k)
+			return
+		}
+	} else {
+		exp = TTLMin.expiration(now, m.Answer, 0, defaultMaxTTL)
+	}
+	ttl := exp.Sub(now).Milliseconds()
+	if ttl <= 0 {
+		return
+	}
+	packed, err := m.Pack()
+	if err != nil {
+		log.Debugf("[REDIS] Did not store %v: %v", k, err)
+		return
+	}
+	buf := make([]byte, 8, 8+len(packed))
+	binary.BigEndian.PutUint64(buf, uint64(exp.UnixNano()))
+	buf = append(buf, packed...)
+	if _, err := c.do("SET", k, string(buf), "PX", strconv.FormatInt(ttl, 10)); err != nil {
+		log.Debugf("[REDIS] Did not store %v: %v", k, err)
+	}
+}
+
+// Len implements Cache, it returns the amount of keys in the Redis database, which might include keys
+// not stored by the server. It returns 0 if Redis cannot be reached.
+func (c *RedisCache) Len() int {
+	r, err := c.do("DBSIZE")
+	if err != nil {
+		return 0
+	}
+	n, _ := r.(int64)
+	return int(n)
+}
+
+// Cap implements Cache, it returns 0 as the size of the cache is bounded by the Redis configuration.
+func (c *RedisCache) Cap() int { return 0 }
+
+// Metrics implements Cache.
+func (c *RedisCache) Metrics() CacheMetrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.metrics
+}
+
+// redisConn is a connection to Redis.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// do sends a command to Redis and returns its reply: nil, an int64, a []byte or a string.
+// Failures other than error replies make Redis considered down for redisRetryDelay.
+func (c *RedisCache) do(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	if c.down && c.now().Before(c.retryAt) {
+		c.mu.Unlock()
+		return nil, errRedisDown
+	}
+	c.mu.Unlock()
+	r, err := c.roundTrip(args)
+	var rerr redisError
+	if errors.As(err, &rerr) {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case err != nil && !c.down:
+		log.Warnf("Redis at %s is unavailable, answers will not be shared: %v", c.addr, err)
+		c.down = true
+		c.retryAt = c.now().Add(redisRetryDelay)
+	case err != nil:
+		c.retryAt = c.now().Add(redisRetryDelay)
+	case c.down:
+		log.Infof("Redis at %s is available again", c.addr)
+		c.down = false
+	}
+	return r, err
+}
+
+func (c *RedisCache) roundTrip(args []string) (interface{}, error) {
+	var conn *redisConn
+	select {
+	case conn = <-c.idle:
+	default:
+		nc, err := net.DialTimeout("tcp", c.addr, c.timeout)
+		if err != nil {
+			return nil, err
+		}
+		conn = &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+	}
+	r, err := conn.roundTrip(args, c.timeout)
+	var rerr redisError
+	if err != nil && !errors.As(err, &rerr) {
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return r, err
+}
+
+func (c *redisConn) roundTrip(args []string, timeout time.Duration) (interface{}, error) {
+	if err := c.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, a := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n", len(a))...)
+		buf = append(buf, a...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return readRedisReply(c.r)
+}
+
+// redisError is an error reply from Redis.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// readRedisReply reads a reply in the Redis serialization protocol from r. Arrays are not supported,
+// as no command sent by RedisCache returns them.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("malformed reply %q", line)
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("malformed reply length %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	return nil, fmt.Errorf("unsupported reply %q", kind)
+}
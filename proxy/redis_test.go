@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeRedis is a Redis server supporting GET, SET with PX and DBSIZE. Keys do not expire.
+type fakeRedis struct {
+	l net.Listener
+
+	mu   sync.Mutex
+	keys map[string]string
+	ttls map[string]int
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	r := &fakeRedis{l: l, keys: make(map[string]string), ttls: make(map[string]int)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.serve(c)
+		}
+	}()
+	return r
+}
+
+func (r *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	for {
+		var n int
+		if _, err := fmt.Fscanf(br, "*%d\r\n", &n); err != nil {
+			return
+		}
+		args := make([]string, n)
+		for i := range args {
+			var l int
+			if _, err := fmt.Fscanf(br, "$%d\r\n", &l); err != nil {
+				return
+			}
+			buf := make([]byte, l+2)
+			if _, err := io.ReadFull(br, buf); err != nil {
+				return
+			}
+			args[i] = string(buf[:l])
+		}
+		r.mu.Lock()
+		var reply string
+		switch {
+		case args[0] == "GET" && n == 2:
+			v, ok := r.keys[args[1]]
+			reply = "$-1\r\n"
+			if ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			}
+		case args[0] == "SET" && n == 5 && args[3] == "PX":
+			r.keys[args[1]] = args[2]
+			r.ttls[args[1]], _ = strconv.Atoi(args[4])
+			reply = "+OK\r\n"
+		case args[0] == "DBSIZE":
+			reply = fmt.Sprintf(":%d\r\n", len(r.keys))
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		r.mu.Unlock()
+		if _, err := io.WriteString(c, reply); err != nil {
+			return
+		}
+	}
+}
+
+func TestRedisCache(t *testing.T) {
+	r := newFakeRedis(t)
+	defer r.l.Close()
+	c := NewRedisCache(r.l.Addr().String(), "test:")
+	now := time.Now()
+	c.clock = func() time.Time { return now }
+	q := new(dns.Msg).SetQuestion("Raccoon.Miki.", dns.TypeA)
+	if _, ok := c.Get(q); ok {
+		t.Fatalf("Get before Put: got a hit want a miss")
+	}
+	rr, err := dns.NewRR("raccoon.miki. 300 IN A 42.42.42.42")
+	if err != nil {
+		t.Fatalf("Cannot parse test response: %v", err)
+	}
+	m := new(dns.Msg).SetReply(q)
+	m.Answer = []dns.RR{rr}
+	c.Put(q, m)
+	r.mu.Lock()
+	ttl := r.ttls["test:"+key(q)]
+	r.mu.Unlock()
+	if ttl != 300000 {
+		t.Errorf("stored TTL: got %d ms want 300000 ms", ttl)
+	}
+
+	now = now.Add(100 * time.Second)
+	q2 := new(dns.Msg).SetQuestion("raccoon.miki.", dns.TypeA)
+	got, ok := c.Get(q2)
+	if !ok {
+		t.Fatalf("Get after Put: got a miss want a hit")
+	}
+	if got.Id != q2.Id || got.Question[0].Name != "raccoon.miki." {
+		t.Errorf("answer: got ID %d and question %v want %d and %v", got.Id, got.Question[0], q2.Id, q2.Question[0])
+	}
+	if len(got.Answer) != 1 || got.Answer[0].Header().Ttl != 200 {
+		t.Errorf("answer: got %v want %v with a TTL of 200", got.Answer, rr)
+	}
+	if got, want := c.Metrics(), (CacheMetrics{HitLRU: 1, Miss: 1}); got != want {
+		t.Errorf("metrics: got %+v want %+v", got, want)
+	}
+	if got := c.Len(); got != 1 {
+		t.Errorf("len: got %d want 1", got)
+	}
+
+	// Answers that should have expired are not served, whether Redis removed them or not.
+	now = now.Add(200 * time.Second)
+	if _, ok := c.Get(q2); ok {
+		t.Errorf("Get after expiration: got a hit want a miss")
+	}
+
+	// Empty answers are only stored if they have a SOA.
+	nq := new(dns.Msg).SetQuestion("nodata.miki.", dns.TypeA)
+	c.Put(nq, new(dns.Msg).SetReply(nq))
+	if _, ok := c.Get(nq); ok {
+		t.Errorf("Get empty answer without SOA: got a hit want a miss")
+	}
+}
+
+func TestRedisCacheUnavailable(t *testing.T) {
+	r := newFakeRedis(t)
+	c := NewRedisCache(r.l.Addr().String(), "test:")
+	r.l.Close()
+	now := time.Now()
+	c.clock = func() time.Time { return now }
+	q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+	rr, err := dns.NewRR(testQuestion + " 300 IN A 42.42.42.42")
+	if err != nil {
+		t.Fatalf("Cannot parse test response: %v", err)
+	}
+	m := new(dns.Msg).SetReply(q)
+	m.Answer = []dns.RR{rr}
+	c.Put(q, m)
+	if _, ok := c.Get(q); ok {
+		t.Errorf("Get: got a hit want a miss")
+	}
+	if got := c.Len(); got != 0 {
+		t.Errorf("len: got %d want 0", got)
+	}
+	c.mu.Lock()
+	down, retryAt := c.down, c.retryAt
+	c.mu.Unlock()
+	if !down || !retryAt.Equal(now.Add(redisRetryDelay)) {
+		t.Errorf("down: got %v until %v want true until %v", down, retryAt, now.Add(redisRetryDelay))
+	}
+
+	// Redis is tried again once the retry delay is over.
+	r = newFakeRedis(t)
+	defer r.l.Close()
+	c.addr = r.l.Addr().String()
+	now = now.Add(redisRetryDelay)
+	c.Put(q, m)
+	if _, ok := c.Get(q); !ok {
+		t.Errorf("Get after Redis is back: got a miss want a hit")
+	}
+}
+
+func TestRedisCacheServer(t *testing.T) {
+	r := newFakeRedis(t)
+	defer r.l.Close()
+	ts, cleanup := setupTestServer(t, 0, nil, WithCache(NewRedisCache(r.l.Addr().String(), "test:")))
+	defer cleanup()
+	ts.exchange("cachefill", "42.42.42.42")
+	ts.exchange("hit", "42.42.42.42")
+	if got, want := ts.s.Stats().CacheMetrics, (CacheMetrics{HitLRU: 1, Miss: 1}); got != want {
+		t.Errorf("cache metrics: got %+v want %+v", got, want)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// listenPacketReusePort fails, as SO_REUSEPORT is not supported on this system, see WithUDPWorkers.
+func listenPacketReusePort(addr string) (net.PacketConn, error) {
+	return nil, errors.New("multiple UDP workers are not supported on this system")
+}
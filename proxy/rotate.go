@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// WithAddressRotation makes the server rotate the order of the A and AAAA records of every answer it
+// serves, so that successive clients get different first addresses and spread their connections across
+// them. Answers are rotated by an amount derived from the ID of the query, so a given query always gets
+// the same order. Only address records move, and only within their RRset: CNAME and RRSIG records keep
+// their positions, and signatures stay valid as they cover RRsets in canonical order (RFC 4034).
+func WithAddressRotation(enabled bool) Option {
+	return func(o *options) { o.rotateAddresses = enabled }
+}
+
+// rotate returns m, the answer to q that must not be shared with the cache, with its addresses rotated
+// if address rotation is enabled.
+func (s *Server) rotate(q, m *dns.Msg) *dns.Msg {
+	if s.opts.rotateAddresses && m != nil {
+		rotateAddresses(m.Answer, int(q.Id))
+	}
+	return m
+}
+
+// rotateAddresses rotates the A and AAAA records of every RRset in rrs by n positions, in place.
+// The records of other types are left where they are.
+func rotateAddresses(rrs []dns.RR, n int) {
+	for _, idx := range addressSets(rrs) {
+		set := make([]dns.RR, len(idx))
+		for i, j := range idx {
+			set[i] = rrs[j]
+		}
+		shift := n % len(set)
+		for i, j := range idx {
+			rrs[j] = set[(i+shift)%len(set)]
+		}
+	}
+}
+
+// addressSets returns the indexes in rrs of the records of every A and AAAA RRset with more than one
+// record, in order of appearance.
+func addressSets(rrs []dns.RR) [][]int {
+	type rrset struct {
+		name   string
+		rrtype uint16
+	}
+	sets := make(map[rrset]int)
+	var idx [][]int
+	for i, rr := range rrs {
+		h := rr.Header()
+		if h.Rrtype != dns.TypeA && h.Rrtype != dns.TypeAAAA {
+			continue
+		}
+		k := rrset{strings.ToLower(h.Name), h.Rrtype}
+		j, ok := sets[k]
+		if !ok {
+			j = len(idx)
+			sets[k] = j
+			idx = append(idx, nil)
+		}
+		idx[j] = append(idx[j], i)
+	}
+	multi := idx[:0]
+	for _, set := range idx {
+		if len(set) > 1 {
+			multi = append(multi, set)
+		}
+	}
+	return multi
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRotateAddresses(t *testing.T) {
+	rrs := func(t *testing.T, ss ...string) []dns.RR {
+		t.Helper()
+		var rrs []dns.RR
+		for _, s := range ss {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatalf("Cannot parse %q: %v", s, err)
+			}
+			rrs = append(rrs, rr)
+		}
+		return rrs
+	}
+	tests := []struct {
+		name string
+		in   []string
+		n    int
+		want []string
+	}{
+		{
+			name: "no rotation",
+			in:   []string{"a.miki. 300 IN A 192.0.2.1", "a.miki. 300 IN A 192.0.2.2", "a.miki. 300 IN A 192.0.2.3"},
+			n:    3,
+			want: []string{"a.miki. 300 IN A 192.0.2.1", "a.miki. 300 IN A 192.0.2.2", "a.miki. 300 IN A 192.0.2.3"},
+		},
+		{
+			name: "rotation",
+			in:   []string{"a.miki. 300 IN A 192.0.2.1", "a.miki. 300 IN A 192.0.2.2", "a.miki. 300 IN A 192.0.2.3"},
+			n:    4,
+			want: []string{"a.miki. 300 IN A 192.0.2.2", "a.miki. 300 IN A 192.0.2.3", "a.miki. 300 IN A 192.0.2.1"},
+		},
+		{
+			name: "cname and rrsig kept in place",
+			in: []string{
+				"www.miki. 300 IN CNAME a.miki.",
+				"a.miki. 300 IN A 192.0.2.1",
+				"a.miki. 300 IN A 192.0.2.2",
+				"a.miki. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 42 miki. AAAA",
+			},
+			n: 1,
+			want: []string{
+				"www.miki. 300 IN CNAME a.miki.",
+				"a.miki. 300 IN A 192.0.2.2",
+				"a.miki. 300 IN A 192.0.2.1",
+				"a.miki. 300 IN RRSIG A 13 2 300 20300101000000 20200101000000 42 miki. AAAA",
+			},
+		},
+		{
+			name: "rrsets rotated independently",
+			in: []string{
+				"a.miki. 300 IN A 192.0.2.1",
+				"a.miki. 300 IN AAAA 2001:db8::1",
+				"a.miki. 300 IN A 192.0.2.2",
+				"a.miki. 300 IN AAAA 2001:db8::2",
+				"a.miki. 300 IN AAAA 2001:db8::3",
+			},
+			n: 2,
+			want: []string{
+				"a.miki. 300 IN A 192.0.2.1",
+				"a.miki. 300 IN AAAA 2001:db8::3",
+				"a.miki. 300 IN A 192.0.2.2",
+				"a.miki. 300 IN AAAA 2001:db8::1",
+				"a.miki. 300 IN AAAA 2001:db8::2",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rrs(t, tt.in...)
+			rotateAddresses(got, tt.n)
+			want := rrs(t, tt.want...)
+			for i := range want {
+				if got[i].String() != want[i].String() {
+					t.Errorf("record %d: got %q want %q", i, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestAddressRotation(t *testing.T) {
+	s := NewServerWithOptions(
+		WithUpstreams("fake://rotate"),
+		WithUpstreamTransport("fake", func(string) (UpstreamTransport, error) {
+			return funcTransport(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+				m := new(dns.Msg).SetReply(q)
+				for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+					rr, err := dns.NewRR(testQuestion + " 300 IN A " + ip)
+					if err != nil {
+						return nil, err
+					}
+					m.Answer = append(m.Answer, rr)
+				}
+				return m, nil
+			}), nil
+		}),
+		WithAddressRotation(true),
+	)
+	tests := []struct {
+		id        uint16
+		wantFirst string
+		wantCache CacheStatus
+	}{
+		{id: 3, wantFirst: "192.0.2.1", wantCache: CacheMiss},
+		{id: 4, wantFirst: "192.0.2.2", wantCache: CacheHit},
+		{id: 5, wantFirst: "192.0.2.3", wantCache: CacheHit},
+		{id: 3, wantFirst: "192.0.2.1", wantCache: CacheHit},
+	}
+	for _, tt := range tests {
+		q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+		q.Id = tt.id
+		m, cs, _ := s.getAnswer(context.Background(), q)
+		if cs != tt.wantCache {
+			t.Errorf("id %d: cache status: got %v want %v", tt.id, cs, tt.wantCache)
+		}
+		if m == nil || len(m.Answer) != 3 {
+			t.Fatalf("id %d: answer: got %v want 3 records", tt.id, m)
+		}
+		if got := m.Answer[0].String(); !strings.HasSuffix(got, tt.wantFirst) {
+			t.Errorf("id %d: first record: got %q want address %s", tt.id, got, tt.wantFirst)
+		}
+	}
+}
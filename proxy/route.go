@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// WithDomainUpstreams makes the server forward the questions for domain and its subdomains only to
+// upstreams, which are in the same form as the ones of WithUpstreams, instead of the default ones.
+// This is useful for split DNS, e.g. to resolve the names of a corporate network with its internal
+// resolver. If several domains match a name the longest one is used. Questions for a domain whose
+// upstreams are all invalid are answered with SERVFAIL rather than leaked to the default upstreams.
+// Domain upstreams are not replaced by SetUpstreams. This option can be specified multiple times.
+func WithDomainUpstreams(domain string, upstreams ...string) Option {
+	return func(o *options) {
+		if o.domainUpstreams == nil {
+			o.domainUpstreams = make(map[string][]string)
+		}
+		d := strings.ToLower(dns.Fqdn(domain))
+		o.domainUpstreams[d] = append(o.domainUpstreams[d], upstreams...)
+	}
+}
+
+// route is the set of upstreams that resolve the names of a domain.
+type route struct {
+	ups   []*upstream
+	tiers [][]*upstream
+}
+
+// routes maps lowercase fully qualified domains to their routes. It is immutable once built, a nil
+// routes matches nothing.
+type routes map[string]*route
+
+// newRoutes creates the upstreams for the given domains and returns the ones that could not be created.
+// Upstreams listed for several domains are shared.
+func (s *Server) newRoutes(domainUpstreams map[string][]string) (routes, []*UpstreamError) {
+	if len(domainUpstreams) == 0 {
+		return nil, nil
+	}
+	var failed []*UpstreamError
+	rs := make(routes, len(domainUpstreams))
+	created := make(map[string]*upstream)
+	for d, specs := range domainUpstreams {
+		r := &route{}
+		for _, spec := range specs {
+			u, ok := created[spec]
+			if !ok {
+				var err error
+				if u, err = s.newUpstream(spec); err != nil {
+					f := &UpstreamError{spec, err}
+					log.Warnf("Discarding %v for %s", f, d)
+					failed = append(failed, f)
+					continue
+				}
+				created[spec] = u
+			}
+			r.ups = append(r.ups, u)
+		}
+		if len(r.ups) == 0 {
+			log.Warnf("No valid upstreams for %s, its names will not be resolved", d)
+		}
+		r.tiers = tiers(r.ups)
+		rs[d] = r
+	}
+	return rs, failed
+}
+
+// match returns the route of the longest domain that name, which must be fully qualified, belongs to,
+// or nil if there is none.
+func (rs routes) match(name string) *route {
+	if len(rs) == 0 {
+		return nil
+	}
+	name = strings.ToLower(name)
+	for {
+		if r, ok := rs[name]; ok {
+			return r
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			// The root domain is the last candidate.
+			return rs["."]
+		}
+		name = name[i+1:]
+	}
+}
+
+// upstreams returns the upstreams of all routes, sorted by domain and without duplicates.
+func (rs routes) upstreams() []*upstream {
+	domains := make([]string, 0, len(rs))
+	for d := range rs {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+	var ups []*upstream
+	seen := make(map[*upstream]bool)
+	for _, d := range domains {
+		for _, u := range rs[d].ups {
+			if !seen[u] {
+				seen[u] = true
+				ups = append(ups, u)
+			}
+		}
+	}
+	return ups
+}
+
+// upstreamsFor returns the upstreams and tiers that should resolve name, see WithDomainUpstreams.
+func (s *Server) upstreamsFor(name string) ([]*upstream, [][]*upstream) {
+	if r := s.routes.match(name); r != nil {
+		return r.ups, r.tiers
+	}
+	return s.upstreamSet()
+}
+
+// allUpstreams returns the default upstreams followed by the domain ones.
+func (s *Server) allUpstreams() []*upstream {
+	ups, _ := s.upstreamSet()
+	if len(s.routes) == 0 {
+		return ups
+	}
+	return append(append([]*upstream(nil), ups...), s.routes.upstreams()...)
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDomainUpstreams(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		asked []string
+	)
+	s := NewServerWithOptions(
+		WithCacheSize(-1),
+		WithUpstreams("fake://public"),
+		WithDomainUpstreams("corp.internal", "fake://corp"),
+		WithDomainUpstreams("Lab.Corp.Internal.", "fake://lab"),
+		WithDomainUpstreams("broken.internal", "fake://bad"),
+		WithUpstreamTransport("fake", func(spec string) (UpstreamTransport, error) {
+			if spec == "fake://bad" {
+				return nil, errors.New("bad upstream")
+			}
+			return funcTransport(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+				mu.Lock()
+				asked = append(asked, spec)
+				mu.Unlock()
+				return new(dns.Msg).SetReply(q), nil
+			}), nil
+		}),
+	)
+	tests := []struct {
+		qname string
+		want  string
+	}{
+		{qname: "example.com.", want: "fake://public"},
+		{qname: "corp.internal.", want: "fake://corp"},
+		{qname: "wiki.CORP.internal.", want: "fake://corp"},
+		{qname: "lab.corp.internal.", want: "fake://lab"},
+		{qname: "gpu.lab.corp.internal.", want: "fake://lab"},
+		{qname: "notcorp.internal.", want: "fake://public"},
+		{qname: "host.broken.internal."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.qname, func(t *testing.T) {
+			mu.Lock()
+			asked = nil
+			mu.Unlock()
+			m, _ := s.forwardMessageAndGetResponse(context.Background(), new(dns.Msg).SetQuestion(tt.qname, dns.TypeA))
+			if got := m != nil; got != (tt.want != "") {
+				t.Errorf("response: got %v want response %v", m, tt.want != "")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if tt.want == "" {
+				if len(asked) != 0 {
+					t.Errorf("asked: got %v want none", asked)
+				}
+				return
+			}
+			if len(asked) != 1 || asked[0] != tt.want {
+				t.Errorf("asked: got %v want [%s]", asked, tt.want)
+			}
+		})
+	}
+	if got := len(s.Stats().Upstreams); got != 3 {
+		t.Errorf("upstream stats: got %d upstreams want 3", got)
+	}
+}
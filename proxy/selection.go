@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// SelectionStrategy decides which upstreams are asked to resolve a question.
+type SelectionStrategy int
+
+const (
+	// SelectFastest sends every question to all upstreams and uses the first response.
+	SelectFastest SelectionStrategy = iota
+	// SelectRoundRobin sends every question to a single upstream, rotating across them.
+	SelectRoundRobin
+	// SelectWeighted sends every question to a single upstream picked at random, with a probability
+	// inversely proportional to the time it took to answer last.
+	SelectWeighted
+	// SelectHashed sends every question to a single upstream chosen by hashing the question.
+	SelectHashed
+)
+
+// WithSelectionStrategy sets how upstreams are selected, the default is SelectFastest.
+// With all strategies but SelectFastest only one upstream is asked at first and the others are
+// asked one at a time only if it fails. This saves upstream capacity at the cost of latency.
+func WithSelectionStrategy(st SelectionStrategy) Option {
+	return func(o *options) { o.selection = st }
+}
+
+// order returns the order in which ups should be asked to resolve the question with key k.
+func (s *Server) order(ups []*upstream, k string) []*upstream {
+	n := len(ups)
+	if n <= 1 {
+		return ups
+	}
+	var start int
+	switch s.opts.selection {
+	case SelectRoundRobin:
+		start = int(atomic.AddUint64(&s.next, 1) % uint64(n))
+	case SelectHashed:
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(k))
+		start = int(h.Sum32() % uint32(n))
+	case SelectWeighted:
+		return weighted(ups)
+	}
+	ordered := make([]*upstream, 0, n)
+	ordered = append(ordered, ups[start:]...)
+	return append(ordered, ups[:start]...)
+}
+
+// weighted returns ups with the first one picked at random with a probability inversely proportional to
+// its round trip time, followed by the others from the fastest to the slowest.
+// Upstreams that have not answered yet are considered as fast as the fastest one.
+func weighted(ups []*upstream) []*upstream {
+	rtts := make([]float64, len(ups))
+	fastest := 0.0
+	for i, u := range ups {
+		rtts[i] = float64(atomic.LoadInt64(&u.rtt))
+		if rtts[i] > 0 && (fastest == 0 || rtts[i] < fastest) {
+			fastest = rtts[i]
+		}
+	}
+	var tot float64
+	weights := make([]float64, len(ups))
+	for i, rtt := range rtts {
+		if rtt == 0 {
+			rtt = fastest
+		}
+		weights[i] = 1
+		if rtt > 0 {
+			weights[i] = 1 / rtt
+		}
+		tot += weights[i]
+	}
+	idx := make([]int, len(ups))
+	for i := range idx {
+		idx[i] = i
+	}
+	// Pick the first one at random, then sort the others by weight.
+	for i, r := 0, rand.Float64()*tot; i < len(weights); i++ {
+		if r -= weights[i]; r < 0 || i == len(weights)-1 {
+			idx[0], idx[i] = idx[i], idx[0]
+			break
+		}
+	}
+	rest := idx[1:]
+	sort.SliceStable(rest, func(i, j int) bool { return weights[rest[i]] > weights[rest[j]] })
+	ordered := make([]*upstream, len(ups))
+	for i, j := range idx {
+		ordered[i] = ups[j]
+	}
+	return ordered
+}
+
+// forwardInOrder asks ups to resolve q one at a time, in order, and returns the first response and the
+// upstream that provided it.
+func (s *Server) forwardInOrder(ctx context.Context, ups []*upstream, k string, q *dns.Msg) (*dns.Msg, *upstream) {
+	for _, u := range ups {
+		if ctx.Err() != nil {
+			return nil, nil
+		}
+		r, err := s.exchange(ctx, u, q)
+		if err == nil {
+			s.sticky.put(k, u)
+			return r, u
+		}
+		log.Debugf("Upstream %s failed to resolve %q: %v", u.addr, q.Question[0].Name, err)
+		if s.opts.selection == SelectWeighted {
+			// Make failing upstreams unlikely to be picked until they answer again.
+			atomic.StoreInt64(&u.rtt, int64(s.opts.upstreamTimeout))
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRoundRobinSelection(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		queries [3]int
+		broken  [3]bool
+	)
+	upstream := func(i int) fakeServer {
+		return func(w dns.ResponseWriter, q *dns.Msg) {
+			mu.Lock()
+			queries[i]++
+			b := broken[i]
+			mu.Unlock()
+			if b {
+				_ = w.Close()
+				return
+			}
+			m := new(dns.Msg).SetReply(q)
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 2311 IN MX 10 %d.%d.%d.%d", q.Question[0].Name, i, i, i, i))
+			m.Answer = []dns.RR{rr}
+			_ = w.WriteMsg(m)
+		}
+	}
+	ts, cleanup := setupTestServerWithUpstreams(t, -1, []fakeServer{upstream(0), upstream(1), upstream(2)},
+		WithSelectionStrategy(SelectRoundRobin))
+	defer cleanup()
+	check := func(logmsg string, want [3]int) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if queries != want {
+			t.Errorf("%s: upstream queries: got %v want %v", logmsg, queries, want)
+		}
+	}
+
+	for i := 0; i < 6; i++ {
+		ts.exchange("rotate", "")
+	}
+	check("rotate", [3]int{2, 2, 2})
+
+	// Failing upstreams are skipped.
+	mu.Lock()
+	broken[1] = true
+	mu.Unlock()
+	for i := 0; i < 3; i++ {
+		ts.exchange("failover", "")
+	}
+	check("failover", [3]int{3, 3, 4})
+}
+
+func TestWeightedSelection(t *testing.T) {
+	ups := []*upstream{
+		{addr: "slow", rtt: int64(100 * time.Millisecond)},
+		{addr: "fast", rtt: int64(time.Millisecond)},
+		{addr: "medium", rtt: int64(10 * time.Millisecond)},
+	}
+	picked := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		o := weighted(ups)
+		if len(o) != len(ups) {
+			t.Fatalf("order: got %d upstreams want %d", len(o), len(ups))
+		}
+		picked[o[0].addr]++
+		// The others are ordered from the fastest.
+		for j := 2; j < len(o); j++ {
+			if o[j-1].rtt > o[j].rtt {
+				t.Fatalf("order: %s before %s", o[j-1].addr, o[j].addr)
+			}
+		}
+	}
+	// The fast upstream should be picked about 90% of the times, the slow one about 1%.
+	if picked["fast"] < 800 || picked["slow"] > 50 {
+		t.Errorf("picked: got %v want mostly fast", picked)
+	}
+
+	// Upstreams that never answered are considered fast to give them a chance.
+	ups = append(ups, &upstream{addr: "new"})
+	picked = map[string]int{}
+	for i := 0; i < 1000; i++ {
+		picked[weighted(ups)[0].addr]++
+	}
+	if picked["new"] < 300 {
+		t.Errorf("picked: got %v want new about as much as fast", picked)
+	}
+}
+
+func TestWeightedSelectionFailure(t *testing.T) {
+	ts, cleanup := setupTestServerWithUpstreams(t, -1, []fakeServer{
+		func(w dns.ResponseWriter, q *dns.Msg) { _ = w.Close() },
+		func(w dns.ResponseWriter, q *dns.Msg) {
+			m := new(dns.Msg).SetReply(q)
+			rr, _ := dns.NewRR("raccoon.miki. 2311 IN MX 10 1.1.1.1")
+			m.Answer = []dns.RR{rr}
+			_ = w.WriteMsg(m)
+		},
+	}, WithSelectionStrategy(SelectWeighted))
+	defer cleanup()
+	for i := 0; i < 5; i++ {
+		ts.exchange("weighted", "1.1.1.1")
+	}
+	// The failing upstream is either unused or penalized.
+	if rtt := atomic.LoadInt64(&ts.s.upstreams[0].rtt); rtt != 0 && rtt != int64(connectionTimeout) {
+		t.Errorf("failing upstream RTT: got %v want 0 or %v", time.Duration(rtt), connectionTimeout)
+	}
+}
@@ -2,17 +2,21 @@ package proxy
 
 import (
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
-	"github.com/mikispag/dns-over-tls-forwarder/proxy/internal/specialized"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sync/errgroup"
 )
@@ -22,77 +26,291 @@ const (
 	connectionTimeout      = 10 * time.Second
 	connectionsPerUpstream = 5
 	refreshQueueSize       = 2048
+	// prefetchInterval is how often the prefetcher looks for entries close to expiration.
+	prefetchInterval = time.Second
+	// defaultForwardRetries is how many times queries no upstream answered are retried.
+	defaultForwardRetries = 2
+	// defaultServfailWait is how long a SERVFAIL is held back while waiting for other upstreams to answer.
+	defaultServfailWait = 100 * time.Millisecond
+	// defaultShutdownGrace is how long in-flight upstream exchanges are waited for on shutdown.
+	defaultShutdownGrace = 5 * time.Second
+	// ednsUDPSize is the UDP payload size advertised to EDNS0 clients.
+	ednsUDPSize = dns.DefaultMsgSize
 )
 
+var defaultUpstreamServers = []string{"one.one.one.one:853@1.1.1.1", "dns.google:853@8.8.8.8"}
+
 // Minimum amount of milliseconds that have to pass between two
 // requests of the current time issued to the system.
 var resolutionMilliseconds = 500
 
 // Server is a caching DNS proxy that upgrades DNS to DNS over TLS.
 type Server struct {
-	cache *cache
-	pools []*pool
-	rq    chan *dns.Msg
-	dial  func(addr string, cfg *tls.Config) (net.Conn, error)
+	// The 64-bit fields accessed atomically come first: only the first word of an allocated struct is
+	// guaranteed to be 64-bit aligned on 32-bit platforms, where unaligned atomic operations panic.
+
+	// next is the position of the next upstream to use for round robin selection.
+	next uint64
+	// inflight counts the upstream exchanges in progress.
+	inflight int64
+	// scheduledRefreshes counts the refreshes enqueued by the refresh scheduler and the prefetcher.
+	scheduledRefreshes uint64
+	// clientLimited counts the queries refused because of the per-client concurrency limit.
+	clientLimited uint64
+	// blockedQueries counts the queries for names in the blocklist.
+	blockedQueries uint64
+
+	// answers stores the answers, it is cache unless WithCache is used, in which case cache is nil.
+	answers Cache
+	cache   *cache
+
+	// upMu guards upstreams and tiers, which are replaced as a whole by SetUpstreams.
+	// reloadMu serializes the calls to SetUpstreams.
+	upMu      sync.RWMutex
+	reloadMu  sync.Mutex
+	upstreams []*upstream
+	// tiers groups upstreams by priority, see tiers.
+	tiers [][]*upstream
+	// routes holds the upstreams of the domains set with WithDomainUpstreams, it is never modified.
+	routes routes
+	// rq holds the queries to refresh in background. pendingMu guards pending, the keys of the queries
+	// in rq or being refreshed.
+	rq        chan *dns.Msg
+	pendingMu sync.Mutex
+	pending   map[string]struct{}
+	dial      func(addr string, cfg *tls.Config) (net.Conn, error)
+	opts      options
+
+	limiter *clientLimiter
+	sticky  *stickyUpstreams
+	local   *localZone
+	failed  []*UpstreamError
+	// validator verifies DNSSEC signatures, it is nil if validation is disabled.
+	validator *validator
+	// qmin remembers the names known to exist, it is nil if QNAME minimization is disabled.
+	qmin *minimizer
+	// top counts the queries for the most queried names, it is nil if they are not counted.
+	top *topNames
+	// traffic counts the queries by type and the responses by rcode. It is allocated separately so that
+	// its counters are 64-bit aligned for atomic operations.
+	traffic *traffic
+	// clientCert is presented to upstreams that request it, see WithClientCertificate.
+	clientCert *tls.Certificate
+	// middlewares wrap getAnswer, see Use.
+	middlewares []MiddlewareFunc
+
+	// blocklist holds the current *blocklist, it is replaced as a whole on reload.
+	blocklist atomic.Value
 
 	mu          sync.RWMutex
 	currentTime time.Time
 	startTime   time.Time
+	// ctx is the context of the running server, upstream exchanges are canceled when it is done.
+	ctx context.Context
+	// draining is set to 1 on shutdown to refuse new upstream exchanges, it is accessed atomically.
+	draining int32
 }
 
 // NewServer constructs a new server but does not start it, use Run to start it afterwards.
+// It is kept for compatibility, NewServerWithOptions allows to configure all features.
 // Calling New(0) is valid and comes with working defaults:
 // * If cacheSize is 0 a default value will be used. to disable caches use a negative value.
 // * If no upstream servers are specified default ones will be used.
 func NewServer(cacheSize int, evictMetrics bool, upstreamServers ...string) *Server {
+	return NewServerWithOptions(WithCacheSize(cacheSize), WithEvictMetrics(evictMetrics), WithUpstreams(upstreamServers...))
+}
+
+// NewServerWithOptions constructs a new server configured with the given options but does not start it,
+// use Run to start it afterwards.
+// Calling NewServerWithOptions() is valid and comes with working defaults.
+// Upstreams that are malformed or, if WithUpstreamProbe is used, unreachable are discarded, see
+// FailedUpstreams. It exits the process if the server cannot be constructed, use NewServerE to handle
+// the error instead.
+func NewServerWithOptions(opts ...Option) *Server {
+	s, err := newServer(opts...)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return s
+}
+
+// NewServerE is like NewServerWithOptions but returns an error if the server cannot be constructed.
+// Unlike NewServerWithOptions it fails if any upstream is malformed or, if WithUpstreamProbe is used,
+// unreachable, returning an UpstreamErrors that lists all of them.
+func NewServerE(opts ...Option) (*Server, error) {
+	s, err := newServer(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if failed := s.FailedUpstreams(); len(failed) > 0 {
+		for _, u := range s.allUpstreams() {
+			u.t.Close()
+		}
+		return nil, UpstreamErrors(failed)
+	}
+	return s, nil
+}
+
+func newServer(opts ...Option) (*Server, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	cacheSize := o.cacheSize
 	switch {
 	case cacheSize == 0:
 		cacheSize = defaultCacheSize
 	case cacheSize < 0:
 		cacheSize = 0
 	}
-	cache, err := newCache(cacheSize, evictMetrics)
-	if err != nil {
-		log.Fatal("Unable to initialize the cache")
+	if o.poolSize <= 0 {
+		o.poolSize = connectionsPerUpstream
+	}
+	if o.upstreamTimeout <= 0 {
+		o.upstreamTimeout = connectionTimeout
+	}
+	if o.forwardRetries == 0 {
+		o.forwardRetries = defaultForwardRetries
+	}
+	if o.servfailWait == 0 {
+		o.servfailWait = defaultServfailWait
+	}
+	if o.shutdownGrace == 0 {
+		o.shutdownGrace = defaultShutdownGrace
+	}
+	var (
+		cache   *cache
+		answers = o.cache
+		err     error
+	)
+	if answers == nil {
+		cache, err = newCache(cacheSize, o.cacheShards, o.evictMetrics, o.lruOnly)
+		if err != nil {
+			return nil, fmt.Errorf("unable to initialize the cache: %w", err)
+		}
+		cache.ttl = o.ttlStrategy
+		cache.originalTTL = o.originalTTL
+		cache.negative = o.negativeCache
+		cache.servfailTTL = o.servfailTTL
+		cache.maxStale = o.maxStale
+		cache.minTTL = o.minTTL
+		if o.maxTTL > 0 {
+			cache.maxTTL = o.maxTTL
+		}
+		answers = cache
 	}
 	s := &Server{
-		cache: cache,
-		rq:    make(chan *dns.Msg, refreshQueueSize),
+		cache:   cache,
+		answers: answers,
+		rq:      make(chan *dns.Msg, refreshQueueSize),
+		pending: make(map[string]struct{}),
 		dial: func(addr string, cfg *tls.Config) (net.Conn, error) {
-			return tls.Dial("tcp", addr, cfg)
+			return tls.DialWithDialer(&net.Dialer{Timeout: o.upstreamTimeout}, "tcp", addr, cfg)
 		},
+		opts:        o,
+		limiter:     newClientLimiter(o.clientLimit, o.clientWait),
+		sticky:      newStickyUpstreams(o.stickySize, o.stickyTTL, o.stickyClock),
+		top:         newTopNames(o.topNames, o.topNamesWindow),
+		traffic:     new(traffic),
+		currentTime: time.Now(),
+		ctx:         context.Background(),
 	}
-	if len(upstreamServers) == 0 {
-		s.pools = []*pool{
-			newPool(connectionsPerUpstream, s.connector("one.one.one.one:853@1.1.1.1")),
-			newPool(connectionsPerUpstream, s.connector("dns.google:853@8.8.8.8")),
-		}
-	} else {
-		for _, addr := range upstreamServers {
-			s.pools = append(s.pools, newPool(connectionsPerUpstream, s.connector(addr)))
+	if o.dial != nil {
+		s.dial = o.dial
+	}
+	if s.clientCert, err = loadClientCert(o.clientCertFile, o.clientKeyFile); err != nil {
+		return nil, err
+	}
+	if len(o.localZones) > 0 {
+		s.local = newLocalZone()
+		for apex, rrs := range o.localZones {
+			if apex != "" {
+				s.local.addZone(apex)
+			}
+			for _, rr := range rrs {
+				s.local.add(rr)
+			}
 		}
 	}
-	return s
+	if o.dnssec {
+		s.validator = newValidator(o.trustAnchors, s.dnssecLookup, s.now)
+	}
+	if o.qnameMinimization {
+		s.qmin = newMinimizer()
+	}
+	if s.opts.chaosEnabled() {
+		log.Warnf("Chaos enabled: upstream exchanges fail with rate %v and are delayed by %v. Do not use in production.",
+			s.opts.chaosFailureRate, s.opts.chaosLatency)
+	}
+	if s.opts.identity == nil {
+		s.opts.identity = defaultIdentity()
+	}
+	if s.opts.maxCNAMEChain == 0 {
+		s.opts.maxCNAMEChain = defaultMaxCNAMEChain
+	}
+	if len(o.upstreamServers) == 0 {
+		o.upstreamServers = defaultUpstreamServers
+	}
+	s.upstreams, s.failed = s.newUpstreams(o.upstreamServers)
+	s.tiers = tiers(s.upstreams)
+	var failed []*UpstreamError
+	s.routes, failed = s.newRoutes(o.domainUpstreams)
+	s.failed = append(s.failed, failed...)
+	return s, nil
+}
+
+// tlsConfig returns the configuration of TLS sessions with upstreams.
+func (s *Server) tlsConfig(servername string) *tls.Config {
+	cfg := &tls.Config{
+		// Force TLS 1.2 as minimum version.
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   s.opts.tlsMaxVersion,
+		CipherSuites: s.opts.tlsCipherSuites,
+		RootCAs:      s.opts.rootCAs,
+		ServerName:   servername,
+	}
+	if s.opts.tlsMinVersion != 0 {
+		cfg.MinVersion = s.opts.tlsMinVersion
+	}
+	if s.clientCert != nil {
+		cfg.Certificates = []tls.Certificate{*s.clientCert}
+	}
+	return cfg
 }
 
-func (s *Server) connector(upstreamServer string) func() (*dns.Conn, error) {
+// connector returns a connector to the DNS over TLS upstream at addr. If pins are given the certificate
+// of the upstream must match one of them, see parsePins. If sni is not empty it is sent in the handshake
+// instead of servername, which the certificate is still verified against, see sniPrefix. If cert is not nil
+// it is presented to the upstream instead of the one set with WithClientCertificate.
+func (s *Server) connector(addr, servername, sni string, pins [][]byte, cert *tls.Certificate) connector {
+	// Sessions are shared by the connections to the upstream so that new ones resume them instead of going
+	// through a full handshake. Pins need not be checked again on resumption: sessions in the cache were
+	// established with a pinned certificate.
+	sessions := tls.NewLRUClientSessionCache(1)
 	return func() (*dns.Conn, error) {
-		tlsConf := &tls.Config{
-			// Force TLS 1.2 as minimum version.
-			MinVersion: tls.VersionTLS12,
-		}
-		dialableAddress := upstreamServer
-		serverComponents := strings.Split(upstreamServer, "@")
-		if len(serverComponents) == 2 {
-			servername, port, err := net.SplitHostPort(serverComponents[0])
-			if err != nil {
-				log.Warnf("Failed to parse DNS-over-TLS upstream address: %v", err)
-				return nil, err
+		cfg := s.tlsConfig(servername)
+		cfg.ClientSessionCache = sessions
+		if cert != nil {
+			cfg.Certificates = []tls.Certificate{*cert}
+		}
+		switch {
+		case sni != "":
+			name := servername
+			if name == "" {
+				name, _, _ = net.SplitHostPort(addr)
 			}
-			tlsConf.ServerName = servername
-			dialableAddress = serverComponents[1] + ":" + port
+			cfg.ServerName = sni
+			// crypto/tls would verify the certificate against sni.
+			cfg.InsecureSkipVerify = true
+			cfg.VerifyPeerCertificate = verifyChain(name, s.opts.rootCAs, pins)
+		case len(pins) > 0:
+			cfg.VerifyPeerCertificate = verifyPins(pins)
+		}
+		conn, err := s.dial(addr, cfg)
+		if errors.Is(err, errPinMismatch) {
+			log.Errorf("Certificate pinning failed for DNS-over-TLS upstream %s: %v", addr, err)
+			return nil, err
 		}
-		conn, err := s.dial(dialableAddress, tlsConf)
 		if err != nil {
 			log.Warnf("Failed to connect to DNS-over-TLS upstream: %v", err)
 			return nil, err
@@ -101,71 +319,421 @@ func (s *Server) connector(upstreamServer string) func() (*dns.Conn, error) {
 	}
 }
 
-// Run runs the server. The server will gracefully shutdown when context is canceled.
+// Run runs the server. The server will gracefully shutdown when context is canceled: it stops accepting
+// queries and waits for the upstream exchanges in progress to complete, up to the grace period set with
+// WithShutdownGracePeriod, before closing the connections to the upstreams.
 func (s *Server) Run(ctx context.Context, addr string) error {
+	return s.RunMulti(ctx, []string{addr})
+}
+
+// RunMulti is like Run but listens on all addrs, over both TCP and UDP, and on the addresses set with
+// WithDoTServer. All addresses are bound before serving any query: if one of them cannot be bound the
+// error is returned right away.
+func (s *Server) RunMulti(ctx context.Context, addrs []string) error {
+	if len(addrs) == 0 {
+		return errors.New("no addresses to listen on")
+	}
 	mux := dns.NewServeMux()
 	mux.Handle(".", s)
 
-	servers := []*dns.Server{
-		&dns.Server{Addr: addr, Net: "tcp", Handler: mux},
-		&dns.Server{Addr: addr, Net: "udp", Handler: mux},
+	servers, err := listen(addrs, s.opts.udpWorkers, s.opts.dotAddrs, s.opts.dotConfig, mux)
+	if err != nil {
+		return err
+	}
+
+	cacheFile := s.opts.cacheFile
+	if cacheFile != "" && s.cache == nil {
+		log.Warnf("Ignoring cache file %s: only the built-in cache can be persisted", cacheFile)
+		cacheFile = ""
+	}
+	if cacheFile != "" {
+		if err := s.LoadCache(cacheFile); err != nil && !os.IsNotExist(err) {
+			log.Warnf("Unable to load the cache: %v", err)
+		}
 	}
 
 	g, ctx := errgroup.WithContext(ctx)
+	// Upstream exchanges outlive ctx until they are drained.
+	exchanges, cancelExchanges := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.ctx = exchanges
+	s.mu.Unlock()
 
-	go func() {
+	g.Go(func() error {
 		<-ctx.Done()
+		grace := time.AfterFunc(s.opts.shutdownGrace, cancelExchanges)
+		defer grace.Stop()
+		// Shutdown waits for the queries being answered.
 		for _, s := range servers {
 			_ = s.Shutdown()
 		}
-		for _, p := range s.pools {
-			p.shutdown()
+		s.drain(exchanges)
+		cancelExchanges()
+		for _, u := range s.allUpstreams() {
+			u.t.Close()
 		}
-	}()
+		if cacheFile != "" {
+			if err := s.SaveCache(cacheFile); err != nil {
+				log.Warnf("Unable to save the cache: %v", err)
+			}
+		}
+		return nil
+	})
 
 	go s.refresher(ctx)
 	go s.timer(ctx)
+	if s.opts.refreshTopK > 0 && s.opts.refreshLead > 0 {
+		go s.refreshScheduler(ctx)
+	}
+	if s.opts.prefetchTopK > 0 && s.opts.prefetchFraction > 0 {
+		go s.prefetcher(ctx)
+	}
+	if s.opts.statsdAddr != "" {
+		go s.statsdReporter(ctx)
+	}
+	if s.opts.healthInterval > 0 {
+		go s.healthChecker(ctx)
+	}
 
 	for _, s := range servers {
 		s := s
-		g.Go(func() error { return s.ListenAndServe() })
+		g.Go(func() error { return s.ActivateAndServe() })
 	}
 
+	s.mu.Lock()
 	s.startTime = time.Now()
-	log.Infof("DNS over TLS forwarder listening on %v", addr)
+	s.mu.Unlock()
+	log.Infof("DNS over TLS forwarder listening on %v", strings.Join(addrs, ", "))
+	if len(s.opts.dotAddrs) > 0 {
+		log.Infof("Serving DNS over TLS on %v", strings.Join(s.opts.dotAddrs, ", "))
+	}
 	return g.Wait()
 }
 
+// errShuttingDown is returned for upstream exchanges started while the server is shutting down.
+var errShuttingDown = errors.New("server is shutting down")
+
+// drain makes new upstream exchanges fail and waits for the ones in progress, e.g. refreshes, to complete
+// or for ctx to be done.
+func (s *Server) drain(ctx context.Context) {
+	atomic.StoreInt32(&s.draining, 1)
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for atomic.LoadInt64(&s.inflight) > 0 {
+		select {
+		case <-ctx.Done():
+			log.Warnf("Canceled %d upstream exchanges still in progress", atomic.LoadInt64(&s.inflight))
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// listen binds addrs over TCP and over udpWorkers UDP sockets sharing the port, and tlsAddrs over TLS
+// with cfg, and returns the servers that answer queries on them with h. If any address cannot be bound
+// the ones already bound are closed.
+func listen(addrs []string, udpWorkers int, tlsAddrs []string, cfg *tls.Config, h dns.Handler) (servers []*dns.Server, err error) {
+	defer func() {
+		if err == nil {
+			return
+		}
+		for _, s := range servers {
+			if s.Listener != nil {
+				s.Listener.Close()
+			}
+			if s.PacketConn != nil {
+				s.PacketConn.Close()
+			}
+		}
+		servers = nil
+	}()
+	for _, addr := range addrs {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return servers, err
+		}
+		servers = append(servers, &dns.Server{Addr: addr, Net: "tcp", Listener: l, Handler: h, MsgAcceptFunc: acceptMsg})
+		if udpWorkers <= 1 {
+			pc, err := net.ListenPacket("udp", addr)
+			if err != nil {
+				return servers, err
+			}
+			servers = append(servers, &dns.Server{Addr: addr, Net: "udp", PacketConn: pc, Handler: h, MsgAcceptFunc: acceptMsg})
+			continue
+		}
+		bind := addr
+		for i := 0; i < udpWorkers; i++ {
+			pc, err := listenPacketReusePort(bind)
+			if err != nil {
+				return servers, err
+			}
+			// Bind the other sockets to the same port, which matters if addr lets the system pick it.
+			bind = pc.LocalAddr().String()
+			servers = append(servers, &dns.Server{Addr: addr, Net: "udp", PacketConn: pc, Handler: h, MsgAcceptFunc: acceptMsg})
+		}
+	}
+	for _, addr := range tlsAddrs {
+		l, err := tls.Listen("tcp", addr, cfg)
+		if err != nil {
+			return servers, err
+		}
+		servers = append(servers, &dns.Server{Addr: addr, Net: "tcp-tls", Listener: l, TLSConfig: cfg, Handler: h, MsgAcceptFunc: acceptMsg})
+	}
+	return servers, nil
+}
+
+// acceptMsg behaves like dns.DefaultMsgAcceptFunc but lets messages with multiple questions
+// through so that ServeDNS can apply the configured policy.
+func acceptMsg(dh dns.Header) dns.MsgAcceptAction {
+	if dh.Qdcount > 1 {
+		dh.Qdcount = 1
+	}
+	return dns.DefaultMsgAcceptFunc(dh)
+}
+
 // ServeDNS implements miekg/dns.Handler for Server.
+// Only standard queries are answered, other opcodes get NOTIMP. Messages must carry exactly one question:
+// the ones without questions, or with more than one unless WithFirstQuestionOnly is set, get FORMERR
+// without being forwarded.
 func (s *Server) ServeDNS(w dns.ResponseWriter, q *dns.Msg) {
 	inboundIP, _, _ := net.SplitHostPort(w.RemoteAddr().String())
+	if !s.opts.acl.permits(net.ParseIP(inboundIP)) {
+		log.Debugf("Refusing query from %s: client not allowed", inboundIP)
+		s.replyRcode(w, q, dns.RcodeRefused)
+		return
+	}
+	if q.Opcode != dns.OpcodeQuery {
+		// UPDATE, NOTIFY and the like are meant for authoritative servers, not for the upstreams.
+		log.Debugf("Rejecting message with opcode %s from %s", dns.OpcodeToString[q.Opcode], inboundIP)
+		s.replyRcode(w, q, dns.RcodeNotImplemented)
+		return
+	}
+	if len(q.Question) == 0 {
+		log.Debugf("Rejecting message without questions from %s", inboundIP)
+		s.replyRcode(w, q, dns.RcodeFormatError)
+		return
+	}
+	if len(q.Question) > 1 {
+		if !s.opts.firstQuestionOnly {
+			// RFC 9619: messages with more than one question are malformed.
+			log.Debugf("Rejecting message with %d questions from %s", len(q.Question), inboundIP)
+			s.replyRcode(w, q, dns.RcodeFormatError)
+			return
+		}
+		q.Question = q.Question[:1]
+	}
+	s.traffic.countQuery(q.Question[0].Qtype)
+	if !s.limiter.acquire(inboundIP) {
+		log.Debugf("Refusing query from %s: too many queries in flight", inboundIP)
+		atomic.AddUint64(&s.clientLimited, 1)
+		s.replyRcode(w, q, dns.RcodeRefused)
+		return
+	}
+	defer s.limiter.release(inboundIP)
 	log.Debugf("Question from %s: %q", inboundIP, q.Question[0])
-	m := s.getAnswer(q)
+	fq := q
+	if s.opts.ecsV4Prefix > 0 || s.opts.ecsV6Prefix > 0 {
+		fq = s.withClientSubnet(q, net.ParseIP(inboundIP))
+	}
+	start := time.Now()
+	m, cs, u := s.answer(s.context(), w.RemoteAddr(), fq)
+	if s.opts.queryLogger != nil {
+		s.logQuery(inboundIP, q, m, cs, u, time.Since(start))
+	}
 	if m == nil {
-		dns.HandleFailed(w, q)
+		s.replyRcode(w, q, dns.RcodeServerFailure)
 		return
 	}
+	matchEdns0(q, m)
+	if clientSubnet(q) == nil {
+		removeClientSubnet(m)
+	}
+	if s.validator != nil || s.opts.upstreamDO {
+		stripDNSSEC(q, m)
+	}
+	if s.wantsIntrospection(q) {
+		s.addIntrospection(q, m)
+	}
+	m.Compress = s.compress(w)
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		if size := udpSize(q); m.Len() > size {
+			// Tell the client to retry over TCP.
+			m.Truncate(size)
+		}
+	}
+	s.traffic.countResponse(m.Rcode)
+	if err := w.WriteMsg(m); err != nil {
+		log.Warnf("Write message failed, message: %v, error: %v", m, err)
+	}
+}
+
+// logQuery reports the query q from client to the query logger. A nil m means that no answer could be found.
+func (s *Server) logQuery(client string, q, m *dns.Msg, cs CacheStatus, u *upstream, latency time.Duration) {
+	ql := QueryLog{
+		Time:    time.Now(),
+		Client:  client,
+		Name:    q.Question[0].Name,
+		Type:    dns.TypeToString[q.Question[0].Qtype],
+		Rcode:   dns.RcodeToString[dns.RcodeServerFailure],
+		Cache:   cs,
+		Latency: latency,
+	}
+	if m != nil {
+		ql.Rcode = dns.RcodeToString[m.Rcode]
+		ql.Answers = len(m.Answer)
+	}
+	if u != nil {
+		ql.Upstream = u.addr
+	}
+	s.opts.queryLogger.LogQuery(ql)
+}
+
+// writeRcode replies to q with an empty response with the given rcode.
+// The question and the EDNS0 OPT record of q are echoed in the response.
+func writeRcode(w dns.ResponseWriter, q *dns.Msg, rcode int) {
+	m := new(dns.Msg)
+	m.SetRcode(q, rcode)
+	matchEdns0(q, m)
 	if err := w.WriteMsg(m); err != nil {
 		log.Warnf("Write message failed, message: %v, error: %v", m, err)
 	}
 }
 
-type debugStats struct {
-	CacheMetrics       specialized.CacheMetrics
+// matchEdns0 makes m carry an OPT record if and only if q does, as required by RFC 6891.
+// The DO bit of the response is copied from q as required by RFC 3225.
+func matchEdns0(q, m *dns.Msg) {
+	qopt, mopt := q.IsEdns0(), m.IsEdns0()
+	switch {
+	case qopt == nil && mopt == nil:
+	case qopt == nil:
+		removeEdns0(m)
+	case mopt == nil:
+		m.SetEdns0(ednsUDPSize, qopt.Do())
+	default:
+		mopt.SetUDPSize(ednsUDPSize)
+		mopt.SetDo(qopt.Do())
+	}
+}
+
+// removeEdns0 removes the OPT record from m.
+func removeEdns0(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
+
+// removeEdns0Option removes the EDNS0 options with the given code from m.
+func removeEdns0Option(m *dns.Msg, code uint16) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != code {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// withUpstreamEdns0 returns a copy of q with the OPT record configured by WithUpstreamEDNS0,
+// or q itself if none is configured.
+func (s *Server) withUpstreamEdns0(q *dns.Msg) *dns.Msg {
+	if s.opts.upstreamUDPSize == 0 {
+		return q
+	}
+	uq := q.Copy()
+	opt := uq.IsEdns0()
+	if opt == nil {
+		uq.SetEdns0(s.opts.upstreamUDPSize, s.opts.upstreamDO)
+		return uq
+	}
+	opt.SetUDPSize(s.opts.upstreamUDPSize)
+	if s.opts.upstreamDO {
+		opt.SetDo()
+	}
+	return uq
+}
+
+// udpSize returns the largest UDP response the client that sent q can receive.
+func udpSize(q *dns.Msg) int {
+	if opt := q.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
+
+// compress tells whether responses written to w should use name compression.
+func (s *Server) compress(w dns.ResponseWriter) bool {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		return true
+	}
+	return !s.opts.noStreamCompression
+}
+
+// Stats is a snapshot of the server stats, see Server.Stats.
+type Stats struct {
+	// CacheMetrics counts the cache hits and misses, and the evictions if WithEvictMetrics is used.
+	CacheMetrics       CacheMetrics
 	CacheLen, CacheCap int
-	Uptime             string
+	// StaleServed and StaleExpired count the expired answers served from the cache and the ones that
+	// were too old to be served.
+	StaleServed, StaleExpired uint64
+	// Uptime is how long the server has been running, formatted as by time.Duration.String, and
+	// UptimeSeconds the same in seconds, for monitoring systems.
+	Uptime        string
+	UptimeSeconds float64
+	// ScheduledRefreshes counts the refreshes enqueued by the refresh scheduler and the prefetcher.
+	ScheduledRefreshes uint64
+	// ClientLimited counts the queries refused because of the per-client concurrency limit.
+	ClientLimited uint64
+	// Blocked counts the queries for names in the blocklist.
+	Blocked uint64
+	// TCRetries counts the truncated upstream responses that were retried over a new stream connection.
+	TCRetries       uint64
+	RefreshQueueLen int
+	Upstreams       []UpstreamStats
+	// TopNames lists the most queried names, most queried first, if enabled with WithTopNames.
+	TopNames []NameCount `json:",omitempty"`
+	// QueryTypes counts the queries by type and Rcodes the responses by rcode, e.g. "AAAA" and "NXDOMAIN".
+	QueryTypes, Rcodes map[string]uint64
+}
+
+// UpstreamStats describes an upstream and the exchanges with it.
+type UpstreamStats struct {
+	Address string
+	// TLS is the last TLS session established with a DNS over TLS upstream.
+	TLS *TLSInfo `json:",omitempty"`
+	// RTT is the duration of the last successful exchange.
+	RTT time.Duration
+	// Latency is the moving average of the duration of exchanges.
+	Latency           time.Duration
+	Successes, Errors uint64
+	// PinErrors counts the errors caused by certificates not matching the upstream pins.
+	PinErrors uint64 `json:",omitempty"`
+	// TCRetries counts the truncated responses that were retried over a new stream connection.
+	TCRetries uint64 `json:",omitempty"`
+	// Pool describes the connections to upstreams using the built-in DNS over TLS, TCP or UDP transports.
+	Pool *PoolStats `json:",omitempty"`
+	// Healthy is false if the upstream is failing its health checks, HealthCheckFailures counts
+	// the consecutive failed checks.
+	Healthy             bool
+	HealthCheckFailures uint32 `json:",omitempty"`
+	// Breaker is the state of the circuit breaker of the upstream: "closed", "open" or "half-open".
+	// It is empty if circuit breakers are disabled, see WithCircuitBreaker.
+	Breaker string `json:",omitempty"`
 }
 
-// DebugHandler returns an http.Handler that serves debug stats.
+// DebugHandler returns an http.Handler that serves the stats returned by Stats as JSON.
 func (s *Server) DebugHandler() http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		buf, err := json.MarshalIndent(debugStats{
-			s.cache.c.Metrics(),
-			s.cache.c.Len(),
-			s.cache.c.Cap(),
-			time.Since(s.startTime).String(),
-		}, "", " ")
+		buf, err := json.MarshalIndent(s.Stats(), "", " ")
 		if err != nil {
 			http.Error(w, "Unable to retrieve debug info", http.StatusInternalServerError)
 			return
@@ -174,40 +742,266 @@ func (s *Server) DebugHandler() http.Handler {
 	})
 }
 
-func (s *Server) getAnswer(q *dns.Msg) *dns.Msg {
-	m, ok := s.cache.get(q)
+// RegisterDebugHandlers mounts on mux the DebugHandler at /debug/server/. Stats can reveal internals,
+// mux should only be served on trusted interfaces.
+func (s *Server) RegisterDebugHandlers(mux *http.ServeMux) {
+	mux.Handle("/debug/server/", s.DebugHandler())
+}
+
+// errCacheNotFlushable is returned when flushing a cache set with WithCache, which is not supported.
+var errCacheNotFlushable = errors.New("caches set with WithCache cannot be flushed")
+
+// FlushCache removes all answers from the cache, so that the following queries are resolved again by the
+// upstreams, and returns how many were removed. It is safe for concurrent use with the server.
+// Caches set with WithCache are not supported and are left untouched.
+func (s *Server) FlushCache() (int, error) {
+	if s.cache == nil {
+		return 0, errCacheNotFlushable
+	}
+	n := s.cache.flush()
+	log.Infof("Flushed %d cached answers", n)
+	return n, nil
+}
+
+// FlushName removes the cached answers for name, for all query types, so that the following queries for it
+// are resolved again by the upstreams, and returns how many were removed. Subdomains of name are kept.
+// It is safe for concurrent use with the server. Caches set with WithCache are not supported and are left
+// untouched.
+func (s *Server) FlushName(name string) (int, error) {
+	if s.cache == nil {
+		return 0, errCacheNotFlushable
+	}
+	n := s.cache.delete(name)
+	log.Infof("Flushed %d cached answers for %q", n, name)
+	return n, nil
+}
+
+// FlushCacheHandler returns an http.Handler that flushes the cache on POST requests carrying token in
+// an "Authorization: Bearer" header, and replies with the amount of removed answers as JSON.
+// If the request has a name parameter only the answers for that name are flushed, see FlushName.
+// All requests are rejected if token is empty, and replied to with 501 if the cache cannot be flushed.
+func (s *Server) FlushCacheHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "Bearer "
+		auth := r.Header.Get("Authorization")
+		if token == "" || !strings.HasPrefix(auth, prefix) ||
+			subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), []byte(token)) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var (
+			n   int
+			err error
+		)
+		if name := r.FormValue("name"); name != "" {
+			n, err = s.FlushName(name)
+		} else {
+			n, err = s.FlushCache()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotImplemented)
+			return
+		}
+		buf, err := json.Marshal(struct{ Flushed int }{n})
+		if err != nil {
+			http.Error(w, "Unable to encode the response", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(buf)
+	})
+}
+
+// Stats returns a snapshot of the server stats. It is safe for concurrent use with the server, e.g. to
+// export them to a monitoring system.
+func (s *Server) Stats() Stats {
+	uptime := s.uptime()
+	st := Stats{
+		CacheMetrics:       s.answers.Metrics(),
+		CacheLen:           s.answers.Len(),
+		CacheCap:           s.answers.Cap(),
+		Uptime:             uptime.String(),
+		UptimeSeconds:      uptime.Seconds(),
+		ScheduledRefreshes: atomic.LoadUint64(&s.scheduledRefreshes),
+		ClientLimited:      atomic.LoadUint64(&s.clientLimited),
+		Blocked:            atomic.LoadUint64(&s.blockedQueries),
+		RefreshQueueLen:    len(s.rq),
+		Upstreams:          s.upstreamStats(),
+		TopNames:           s.top.get(s.now()),
+		QueryTypes:         s.traffic.qtypeStats(),
+		Rcodes:             s.traffic.rcodeStats(),
+	}
+	if s.cache != nil {
+		st.StaleServed = atomic.LoadUint64(&s.cache.staleServed)
+		st.StaleExpired = atomic.LoadUint64(&s.cache.staleExpired)
+	}
+	for _, u := range st.Upstreams {
+		st.TCRetries += u.TCRetries
+	}
+	return st
+}
+
+func (s *Server) upstreamStats() []UpstreamStats {
+	ups := s.allUpstreams()
+	us := make([]UpstreamStats, len(ups))
+	for i, u := range ups {
+		us[i] = UpstreamStats{
+			Address:   u.addr,
+			RTT:       time.Duration(atomic.LoadInt64(&u.rtt)),
+			Latency:   time.Duration(atomic.LoadInt64(&u.latency)),
+			Successes: atomic.LoadUint64(&u.successes),
+			Errors:    atomic.LoadUint64(&u.errors),
+			PinErrors: atomic.LoadUint64(&u.pinErrors),
+
+			Healthy:             u.healthy(),
+			HealthCheckFailures: atomic.LoadUint32(&u.checkFailures),
+			Breaker:             u.breaker.status(s.now()),
+		}
+		if p, ok := u.t.(*pool); ok {
+			us[i].TLS = p.tlsInfo()
+			us[i].TCRetries = atomic.LoadUint64(&p.tcRetries)
+			us[i].Pool = p.stats()
+		}
+	}
+	return us
+}
+
+// getAnswer returns the answer to q, how the cache was involved and the upstream that provided it, if any.
+// Upstream exchanges are canceled when ctx is done.
+// ServeDNS only passes queries with exactly one question, but middlewares might rewrite them: other
+// queries get FORMERR rather than an answer to their first question only.
+func (s *Server) getAnswer(ctx context.Context, q *dns.Msg) (*dns.Msg, CacheStatus, *upstream) {
+	if len(q.Question) != 1 {
+		return new(dns.Msg).SetRcode(q, dns.RcodeFormatError), CacheBypass, nil
+	}
+	s.top.add(q.Question[0].Name, s.now())
+	if q.Question[0].Qclass == dns.ClassCHAOS {
+		return s.opts.identity.chaosAnswer(q), CacheBypass, nil
+	}
+	if m, ok := s.local.answer(q); ok {
+		return m, CacheBypass, nil
+	}
+	if s.blocked(q) {
+		atomic.AddUint64(&s.blockedQueries, 1)
+		return s.blockedAnswer(q), CacheBypass, nil
+	}
+	if s.opts.noIPv6 && q.Question[0].Qtype == dns.TypeAAAA {
+		return noData(q), CacheBypass, nil
+	}
+	m, ok := s.answers.Get(q)
 	// Cache HIT.
 	if ok {
-		return m
+		return s.rotate(q, m), CacheHit, nil
 	}
 	// If there is a cache HIT with an expired TTL, speculatively return the cache entry anyway with a short TTL, and refresh it.
 	if !ok && m != nil {
 		s.refresh(q)
-		return m
+		return s.rotate(q, m), CacheStale, nil
 	}
 	// If there is a cache MISS, forward the message upstream and return the answer.
-	// miek/dns does not pass a context so we fallback to Background.
-	return s.forwardMessageAndCacheResponse(q)
+	m, u := s.forwardMessageAndCacheResponse(ctx, q)
+	if (m == nil || m.Rcode == dns.RcodeServerFailure) && ctx.Err() == nil {
+		sm := m
+		if sm == nil {
+			sm = new(dns.Msg).SetRcode(q, dns.RcodeServerFailure)
+		}
+		s.cache.putServfail(q, sm)
+	}
+	return s.rotate(q, m), CacheMiss, u
 }
 
-func (s *Server) refresh(q *dns.Msg) {
+// refresh enqueues q to be refreshed in background and reports whether it was enqueued. It is not if
+// there is no room or if a refresh of the same question is already pending.
+func (s *Server) refresh(q *dns.Msg) bool {
+	k := key(q)
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	if _, ok := s.pending[k]; ok {
+		return false
+	}
 	select {
 	case s.rq <- q:
+		s.pending[k] = struct{}{}
+		return true
 	default:
+		return false
 	}
 }
 
+// refreshed marks the refresh of q as no longer pending.
+func (s *Server) refreshed(q *dns.Msg) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	delete(s.pending, key(q))
+}
+
 func (s *Server) refresher(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case q := <-s.rq:
-			s.forwardMessageAndCacheResponse(q)
+			s.forwardMessageAndCacheResponse(s.context(), q)
+			s.refreshed(q)
+		}
+	}
+}
+
+func (s *Server) refreshScheduler(ctx context.Context) {
+	t := time.NewTicker(s.opts.refreshLead / 2)
+	for {
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case now := <-t.C:
+			s.scheduleRefreshes(now)
+		}
+	}
+}
+
+// scheduleRefreshes enqueues a refresh for the most accessed entries that expire within the refresh lead time
+// from now.
+func (s *Server) scheduleRefreshes(now time.Time) {
+	for _, q := range s.cache.expiring(s.opts.refreshTopK, now.Add(s.opts.refreshLead)) {
+		log.Debugf("[SCHEDULER] Refreshing %v", q.Question[0])
+		s.scheduleRefresh(q)
+	}
+}
+
+// scheduleRefresh enqueues a refresh of q that was not triggered by a client query.
+func (s *Server) scheduleRefresh(q *dns.Msg) {
+	if s.refresh(q) {
+		atomic.AddUint64(&s.scheduledRefreshes, 1)
+	}
+}
+
+func (s *Server) prefetcher(ctx context.Context) {
+	t := time.NewTicker(prefetchInterval)
+	for {
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case now := <-t.C:
+			s.prefetch(now)
 		}
 	}
 }
 
+// prefetch enqueues a refresh for the hot entries that are close to expiration at now, see WithPrefetch.
+func (s *Server) prefetch(now time.Time) {
+	o := s.opts
+	for _, q := range s.cache.prefetchable(o.prefetchTopK, o.prefetchMinAccesses, o.prefetchFraction, now) {
+		log.Debugf("[PREFETCH] Refreshing %v", q.Question[0])
+		s.scheduleRefresh(q)
+	}
+}
+
 func (s *Server) timer(ctx context.Context) {
 	t := time.NewTicker(time.Duration(resolutionMilliseconds) * time.Millisecond)
 	for {
@@ -223,6 +1017,20 @@ func (s *Server) timer(ctx context.Context) {
 	}
 }
 
+func (s *Server) uptime() time.Duration {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return time.Since(s.startTime)
+}
+
+// context returns the context of the running server, or a background one if it is not running.
+// miekg/dns does not pass a context to handlers, so this is what queries are answered with.
+func (s *Server) context() context.Context {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.ctx
+}
+
 func (s *Server) now() time.Time {
 	s.mu.RLock()
 	t := s.currentTime
@@ -230,65 +1038,250 @@ func (s *Server) now() time.Time {
 	return t
 }
 
-func (s *Server) forwardMessageAndCacheResponse(q *dns.Msg) (m *dns.Msg) {
-	m = s.forwardMessageAndGetResponse(q)
-	// Let's try a couple of times if we can't resolve it at the first try.
-	for c := 0; m == nil && c < 2; c++ {
-		m = s.forwardMessageAndGetResponse(q)
+// forwardMessageAndCacheResponse resolves q upstream and caches the result.
+// A nil result means that no upstream could provide a response. Responses without answers
+// (e.g. NODATA or NXDOMAIN) are valid results: they are returned as they are and never retried.
+func (s *Server) forwardMessageAndCacheResponse(ctx context.Context, q *dns.Msg) (m *dns.Msg, u *upstream) {
+	uq := q
+	if s.validator != nil {
+		uq = withDNSSECOK(q)
+	}
+	m, u = s.forwardMessageAndGetResponse(ctx, uq)
+	// Let's try a few more times if we can't resolve it at the first try.
+	for c := 0; m == nil && c < s.opts.forwardRetries && s.waitRetry(ctx); c++ {
+		m, u = s.forwardMessageAndGetResponse(ctx, uq)
 	}
 	if m == nil {
-		return nil
+		return nil, nil
+	}
+	if s.validator != nil {
+		secure, err := s.validator.validate(q, m)
+		if err != nil {
+			log.Debugf("Discarding response for %q: %v", q.Question[0].Name, err)
+			return nil, nil
+		}
+		m.AuthenticatedData = secure
+	}
+	if cm, ok := s.checkAnswerSize(q, m); ok {
+		s.answers.Put(q, cm)
+	}
+	return m, u
+}
+
+// waitRetry waits for the jittered delay set with WithForwardRetries before retrying a query.
+// It returns false if ctx was done before the delay elapsed.
+func (s *Server) waitRetry(ctx context.Context) bool {
+	d := s.opts.retryDelay
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	t := time.NewTimer(d/2 + time.Duration(rand.Int63n(int64(d/2)+1)))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// checkAnswerSize applies the configured size policy to m and returns the message that should be cached,
+// if any.
+func (s *Server) checkAnswerSize(q, m *dns.Msg) (cm *dns.Msg, ok bool) {
+	limit := s.opts.maxAnswerSize
+	if limit <= 0 {
+		return m, true
+	}
+	size := m.Len()
+	if size <= limit {
+		return m, true
+	}
+	if s.opts.onLargeAnswer != nil {
+		s.opts.onLargeAnswer(q.Question[0], size)
+	}
+	switch s.opts.sizePolicy {
+	case SizeLog:
+		log.Infof("Answer for %q is %d bytes, above the %d bytes limit", q.Question[0].Name, size, limit)
+		return m, true
+	case SizeTruncateAdditional:
+		cm = m.Copy()
+		cm.Extra = nil
+		if opt := m.IsEdns0(); opt != nil {
+			cm.Extra = []dns.RR{opt}
+		}
+		if cm.Len() <= limit {
+			return cm, true
+		}
+	}
+	log.Debugf("Not caching answer for %q: %d bytes, above the %d bytes limit", q.Question[0].Name, size, limit)
+	return nil, false
+}
+
+// forwardMessageAndGetResponse returns the first response received from the upstreams,
+// or nil if all of them failed to provide one, together with the upstream that provided it.
+// Only the upstreams of the domain of q are asked, see WithDomainUpstreams. Fallback upstreams are only
+// asked if all the others failed, unhealthy upstreams and upstreams with an open circuit breaker are skipped.
+// If stickiness is enabled and an upstream recently answered q, it is asked first and alone.
+// If QNAME minimization is enabled, q is only sent if the ancestors of its name exist, see
+// WithQNAMEMinimization.
+func (s *Server) forwardMessageAndGetResponse(ctx context.Context, q *dns.Msg) (m *dns.Msg, u *upstream) {
+	if s.qmin != nil {
+		if m, u := s.minimize(ctx, q); m != nil {
+			return m, u
+		}
+	}
+	return s.forwardTo(ctx, q, q.Question[0].Name)
+}
+
+// forwardTo is like forwardMessageAndGetResponse without QNAME minimization, and asks the upstreams of
+// the domain of name instead of the one of q.
+func (s *Server) forwardTo(ctx context.Context, q *dns.Msg, name string) (m *dns.Msg, u *upstream) {
+	k := key(q)
+	if u := s.sticky.get(k); u != nil && u.healthy() && !u.breaker.skip(s.now()) {
+		if r, err := s.exchange(ctx, u, q); err == nil {
+			s.sticky.put(k, u)
+			return r, u
+		}
 	}
-	s.cache.put(q, m)
-	return m
+	for _, tier := range s.closedTiers(s.healthyTiers(s.upstreamsFor(name))) {
+		if s.opts.selection == SelectFastest {
+			m, u = s.forwardRace(ctx, tier, k, q)
+		} else {
+			m, u = s.forwardInOrder(ctx, s.order(tier, k), k, q)
+		}
+		if m != nil || ctx.Err() != nil {
+			return m, u
+		}
+	}
+	return nil, nil
 }
 
-func (s *Server) forwardMessageAndGetResponse(q *dns.Msg) (m *dns.Msg) {
-	resps := make(chan *dns.Msg, len(s.pools))
-	for _, p := range s.pools {
-		go func(p *pool) {
-			r, err := s.exchangeMessages(p, q)
+// forwardRace sends q to all ups and returns the first response and the upstream that provided it.
+// SERVFAIL responses are only returned if no other response arrives in time, see WithServfailWait.
+func (s *Server) forwardRace(ctx context.Context, ups []*upstream, k string, q *dns.Msg) (*dns.Msg, *upstream) {
+	type resp struct {
+		u *upstream
+		m *dns.Msg
+	}
+	if len(ups) == 1 {
+		// Nothing to race against, spare the goroutine.
+		r, err := s.exchange(ctx, ups[0], q)
+		if err != nil || r == nil {
+			return nil, nil
+		}
+		if r.Rcode != dns.RcodeServerFailure {
+			s.sticky.put(k, ups[0])
+		}
+		return r, ups[0]
+	}
+	resps := make(chan resp, len(ups))
+	for _, u := range ups {
+		go func(u *upstream) {
+			r, err := s.exchange(ctx, u, q)
 			if err != nil || r == nil {
-				resps <- nil
+				resps <- resp{}
+				return
 			}
-			resps <- r
-		}(p)
+			resps <- resp{u, r}
+		}(u)
 	}
-	for c := 0; c < len(s.pools); c++ {
-		if r := <-resps; r != nil {
-			return r
+	// A SERVFAIL is only returned if no other upstream provides a response within servfailWait.
+	var (
+		servfail resp
+		wait     <-chan time.Time
+	)
+	for c := 0; c < len(ups); c++ {
+		var r resp
+		select {
+		case r = <-resps:
+		case <-wait:
+			return servfail.m, servfail.u
+		}
+		if r.m == nil {
+			continue
 		}
+		if r.m.Rcode == dns.RcodeServerFailure && s.opts.servfailWait > 0 {
+			if servfail.m == nil {
+				servfail = r
+				t := time.NewTimer(s.opts.servfailWait)
+				defer t.Stop()
+				wait = t.C
+			}
+			continue
+		}
+		s.sticky.put(k, r.u)
+		return r.m, r.u
 	}
-	return nil
+	return servfail.m, servfail.u
 }
 
-var errNilResponse = errors.New("nil response from upstream")
+// verifyResponse checks that resp is the response of u to uq, the query sent for q, and undoes the
+// changes made to the query name, see checkResponse, caseSuffix and cookieSuffix.
+func verifyResponse(u *upstream, q, uq, resp *dns.Msg) error {
+	if err := checkResponse(q, resp); err != nil {
+		return err
+	}
+	if u.randomCase {
+		if err := restoreCase(uq, resp, q.Question[0].Name); err != nil {
+			return err
+		}
+	}
+	if u.cookies != nil {
+		return u.cookies.check(resp)
+	}
+	return nil
+}
 
-func (s *Server) exchangeMessages(p *pool, q *dns.Msg) (resp *dns.Msg, err error) {
-	c, err := p.get()
-	if err != nil {
-		return nil, err
+// exchangeMessages sends q to u. It either returns a valid response, which might have no answers,
+// or an error. The exchange is canceled when ctx is done or after the upstream timeout.
+func (s *Server) exchangeMessages(ctx context.Context, u *upstream, q *dns.Msg) (resp *dns.Msg, err error) {
+	atomic.AddInt64(&s.inflight, 1)
+	defer atomic.AddInt64(&s.inflight, -1)
+	atomic.AddInt64(&u.inflight, 1)
+	defer atomic.AddInt64(&u.inflight, -1)
+	if atomic.LoadInt32(&s.draining) != 0 {
+		return nil, errShuttingDown
 	}
-	_ = c.SetDeadline(s.now().Add(connectionTimeout))
+	if atomic.LoadInt32(&u.removed) != 0 {
+		return nil, errUpstreamRemoved
+	}
+	parent := ctx
+	ctx, cancel := context.WithDeadline(ctx, s.now().Add(s.opts.upstreamTimeout))
+	defer cancel()
+	start := time.Now()
+	probe := u.breaker.begin(s.now())
 	defer func() {
-		if err != nil {
-			c.Close()
-			return
-		}
-		p.put(c)
+		u.record(time.Since(start), err)
+		u.breaker.done(s.now(), probe, parent.Err() != nil, err)
 	}()
-	if err := c.WriteMsg(q); err != nil {
-		log.Debugf("Send question message failed: %v", err)
-		return nil, err
+	uq := s.withPadding(s.withUpstreamEdns0(q))
+	if u.randomCase {
+		uq = withRandomCase(uq)
 	}
-	resp, err = c.ReadMsg()
+	if u.cookies != nil {
+		uq = u.cookies.withCookie(uq)
+	}
+	resp, err = u.t.Exchange(ctx, uq)
 	if err != nil {
-		log.Debugf("Error while reading message: %v", err)
 		return nil, err
 	}
 	if resp == nil {
-		log.Debug("Response message returned nil. Please check your query or DNS configuration")
 		return nil, errNilResponse
 	}
-	return resp, err
+	if err := verifyResponse(u, q, uq, resp); err != nil {
+		log.Debugf("Invalid response for %q from %s: %v", q.Question[0].Name, u.addr, err)
+		return nil, err
+	}
+	if q.IsEdns0() == nil {
+		// Keep the OPT record added by withUpstreamEdns0, withPadding or withCookie out of the cache.
+		removeEdns0(resp)
+	}
+	removeEdns0Option(resp, dns.EDNS0PADDING)
+	removeEdns0Option(resp, dns.EDNS0COOKIE)
+	atomic.StoreInt64(&u.rtt, int64(time.Since(start)))
+	if err := checkCNAMEChain(q.Question[0].Name, resp.Answer, s.opts.maxCNAMEChain); err != nil {
+		log.Debugf("Invalid response for %q: %v", q.Question[0].Name, err)
+		return nil, err
+	}
+	return resp, nil
 }
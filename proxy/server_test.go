@@ -3,15 +3,20 @@ package proxy
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -30,6 +35,19 @@ type fakeAddr string
 func (f fakeAddr) Network() string { return string(f) }
 func (f fakeAddr) String() string  { return string(f) }
 
+type fakeResponseWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msgs   []*dns.Msg
+}
+
+func (f *fakeResponseWriter) RemoteAddr() net.Addr { return f.remote }
+func (f *fakeResponseWriter) LocalAddr() net.Addr  { return f.remote }
+func (f *fakeResponseWriter) WriteMsg(m *dns.Msg) error {
+	f.msgs = append(f.msgs, m)
+	return nil
+}
+
 type fakeListener struct {
 	a string
 	c chan net.Conn
@@ -57,23 +75,14 @@ func (f fakeListener) connect() net.Conn {
 	f.c <- r
 	return l
 }
-func (f fakeListener) dialer() func(addr string, c *tls.Config) (net.Conn, error) {
-	return func(addr string, _ *tls.Config) (net.Conn, error) {
-		// TODO assert the tls config is correct.
-		if addr == f.a {
-			return f.connect(), nil
-		}
-		return nil, fmt.Errorf("connect to %q, want %q", addr, f.a)
-	}
-}
 
 type testServer struct {
 	tb       testing.TB
 	laddr    string
 	question string
 
-	s      *Server
-	remote *dns.Server
+	s       *Server
+	remotes []*dns.Server
 }
 
 func (ts *testServer) exchange(logmsg string, wantIP string) {
@@ -93,42 +102,64 @@ func (ts *testServer) exchange(logmsg string, wantIP string) {
 	}
 }
 
-func setupTestServer(tb testing.TB, cacheSize int, responder func(q string) string) (ts *testServer, cleanup func()) {
-	const raddr = "gopher.empijei:853"
+const testQuestion = "raccoon.miki."
+
+func setupTestServer(tb testing.TB, cacheSize int, responder func(q string) string, opts ...Option) (ts *testServer, cleanup func()) {
+	return setupTestServerWithHandler(tb, cacheSize, func(w dns.ResponseWriter, q *dns.Msg) {
+		if got := q.String(); !strings.Contains(got, testQuestion) {
+			tb.Errorf("Got unexpected question: %q want it to contain %q", got, testQuestion)
+		}
+		var respb string
+		if responder != nil {
+			respb = responder(q.String())
+		} else {
+			respb = "raccoon.miki. 2311 IN A 42.42.42.42"
+		}
+		resp, err := dns.NewRR(respb)
+		if err != nil {
+			tb.Fatalf("Cannot parse test response: %v", err)
+		}
+		m := &dns.Msg{}
+		m = m.SetReply(q)
+		m.Answer = []dns.RR{resp}
+		_ = w.WriteMsg(m)
+	}, opts...)
+}
+
+func setupTestServerWithHandler(tb testing.TB, cacheSize int, handler fakeServer, opts ...Option) (ts *testServer, cleanup func()) {
+	return setupTestServerWithUpstreams(tb, cacheSize, []fakeServer{handler}, opts...)
+}
+
+// setupTestServerWithUpstreams starts a Server forwarding to a fake upstream for every given handler.
+// The upstreams are configured in the same order as the handlers.
+func setupTestServerWithUpstreams(tb testing.TB, cacheSize int, handlers []fakeServer, opts ...Option) (ts *testServer, cleanup func()) {
 	ts = &testServer{
 		tb:       tb,
-		question: "raccoon.miki.",
+		question: testQuestion,
 		laddr:    "127.0.0.1:5678",
 	}
 
-	// Setup fake remote
-	flst := newFakeListener(raddr)
-	{
-		ts.remote = &dns.Server{
+	// Setup fake remotes
+	var (
+		raddrs []string
+		flsts  = map[string]fakeListener{}
+	)
+	for i, h := range handlers {
+		raddr := "gopher.empijei:853"
+		if i > 0 {
+			raddr = fmt.Sprintf("gopher%d.empijei:853", i)
+		}
+		raddrs = append(raddrs, raddr)
+		flst := newFakeListener(raddr)
+		flsts[raddr] = flst
+		remote := &dns.Server{
 			Addr:     raddr,
 			Listener: flst,
-			Handler: fakeServer(func(w dns.ResponseWriter, q *dns.Msg) {
-				if got := q.String(); !strings.Contains(got, ts.question) {
-					tb.Errorf("Got unexpected question: %q want it to contain %q", got, ts.question)
-				}
-				var respb string
-				if responder != nil {
-					respb = responder(q.String())
-				} else {
-					respb = "raccoon.miki. 2311 IN A 42.42.42.42"
-				}
-				resp, err := dns.NewRR(respb)
-				if err != nil {
-					tb.Fatalf("Cannot parse test response: %v", err)
-				}
-				m := &dns.Msg{}
-				m = m.SetReply(q)
-				m.Answer = []dns.RR{resp}
-				_ = w.WriteMsg(m)
-			}),
+			Handler:  h,
 		}
+		ts.remotes = append(ts.remotes, remote)
 		go func() {
-			if err := ts.remote.ActivateAndServe(); err != nil {
+			if err := remote.ActivateAndServe(); err != nil {
 				tb.Errorf("Cannot ActivateAndServe: %v", err)
 			}
 		}()
@@ -136,10 +167,20 @@ func setupTestServer(tb testing.TB, cacheSize int, responder func(q string) stri
 
 	// Setup Server
 	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
 	{
-		ts.s = NewServer(cacheSize, false, raddr)
-		ts.s.dial = flst.dialer()
+		dial := func(o *options) {
+			o.dial = func(addr string, _ *tls.Config) (net.Conn, error) {
+				// TODO assert the tls config is correct.
+				if flst, ok := flsts[addr]; ok {
+					return flst.connect(), nil
+				}
+				return nil, fmt.Errorf("connect to %q, want one of %q", addr, raddrs)
+			}
+		}
+		ts.s = NewServerWithOptions(append([]Option{WithCacheSize(cacheSize), WithUpstreams(raddrs...), dial}, opts...)...)
 		go func() {
+			defer close(done)
 			if err := ts.s.Run(ctx, ts.laddr); err != nil {
 				tb.Errorf("Cannot run Server: %v", err)
 			}
@@ -153,8 +194,12 @@ func setupTestServer(tb testing.TB, cacheSize int, responder func(q string) stri
 	}
 
 	return ts, func() {
-		flst.Close()
+		for _, flst := range flsts {
+			flst.Close()
+		}
 		cancel()
+		// Wait for the listeners to be released so that the next test can reuse the address.
+		<-done
 	}
 }
 
@@ -189,6 +234,25 @@ func BenchmarkServerNoCache(b *testing.B) {
 	}
 }
 
+func TestNewServerE(t *testing.T) {
+	if _, err := NewServerE(WithCacheSize(1)); err == nil {
+		t.Errorf("cache size 1: got nil error")
+	}
+	s, err := NewServerE(WithCacheSize(-1), WithUpstreams("udp://127.0.0.1:53"))
+	if err != nil || s == nil {
+		t.Errorf("valid options: got %v, %v want a server", s, err)
+	}
+	_, err = NewServerE(
+		WithCacheSize(-1),
+		WithUpstreams("udp://127.0.0.1:53", "gopher", "unknown://gopher:53"),
+		WithDomainUpstreams("corp.internal", "tcp://127.0.0.1"),
+	)
+	var ues UpstreamErrors
+	if !errors.As(err, &ues) || len(ues) != 3 {
+		t.Errorf("invalid upstreams: got %v want 3 upstream errors", err)
+	}
+}
+
 func TestCache(t *testing.T) {
 	var mu sync.Mutex
 	resp := "raccoon.miki. 2311 IN A 42.42.42.42"
@@ -207,11 +271,78 @@ func TestCache(t *testing.T) {
 	ts.exchange("hit", "43.43.43.43")
 }
 
+// mapCache is a Cache storing answers forever, keyed by question.
+type mapCache struct {
+	mu      sync.Mutex
+	answers map[dns.Question]*dns.Msg
+	metrics CacheMetrics
+}
+
+func (c *mapCache) Get(q *dns.Msg) (*dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.answers[q.Question[0]]
+	if !ok {
+		c.metrics.Miss++
+		return nil, false
+	}
+	c.metrics.HitLRU++
+	m = m.Copy()
+	m.Id = q.Id
+	return m, true
+}
+
+func (c *mapCache) Put(q, m *dns.Msg) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.answers[q.Question[0]] = m.Copy()
+}
+
+func (c *mapCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.answers)
+}
+
+func (c *mapCache) Cap() int { return 42 }
+
+func (c *mapCache) Metrics() CacheMetrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.metrics
+}
+
+func TestCustomCache(t *testing.T) {
+	var mu sync.Mutex
+	resp := "raccoon.miki. 2311 IN A 42.42.42.42"
+	c := &mapCache{answers: make(map[dns.Question]*dns.Msg)}
+	ts, cleanup := setupTestServer(t, 0, func(string) string {
+		mu.Lock()
+		defer mu.Unlock()
+		return resp
+	}, WithCache(c))
+	defer cleanup()
+	ts.exchange("cachefill", "42.42.42.42")
+	mu.Lock()
+	resp = "raccoon.miki. 2311 IN A 43.43.43.43"
+	mu.Unlock()
+	ts.exchange("hit", "42.42.42.42")
+	if ts.s.cache != nil {
+		t.Errorf("built-in cache: got %v want none", ts.s.cache)
+	}
+	st := ts.s.Stats()
+	want := CacheMetrics{HitLRU: 1, Miss: 1}
+	if st.CacheMetrics != want || st.CacheLen != 1 || st.CacheCap != 42 {
+		t.Errorf("stats: got %+v, len %d, cap %d want %+v, len 1, cap 42", st.CacheMetrics, st.CacheLen, st.CacheCap, want)
+	}
+}
+
 func TestDebugHandler(t *testing.T) {
 	type testData struct {
 		CacheMetrics       specialized.CacheMetrics
 		CacheLen, CacheCap int
 		Uptime             string
+		UptimeSeconds      float64
 	}
 
 	tests := []struct {
@@ -260,9 +391,1569 @@ func TestDebugHandler(t *testing.T) {
 				t.Fatalf("Can't unmarshal HTTP response: %v", err)
 			}
 			// Intentionally ignoring Uptime for tests
-			if got.Uptime = ""; got != tt.want {
+			if got.Uptime, got.UptimeSeconds = "", 0; got != tt.want {
 				t.Errorf("newServer(%v,%v).DebugHandler(): %d requests, got\n%+v\nwant\n%+v", tt.size, tt.evictMetrics, tt.reqs, got, tt.want)
 			}
 		})
 	}
 }
+
+func TestRegisterDebugHandlers(t *testing.T) {
+	s := NewServerWithOptions(WithCacheSize(-1))
+	mux := http.NewServeMux()
+	s.RegisterDebugHandlers(mux)
+	tests := []struct {
+		path            string
+		wantCode        int
+		wantContentType string
+	}{
+		{path: "/debug/server/", wantCode: http.StatusOK, wantContentType: "application/json"},
+		// Profiling handlers are left to the program.
+		{path: "/debug/pprof/", wantCode: http.StatusNotFound, wantContentType: "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.wantCode {
+				t.Fatalf("HTTP status: got %d want %d", w.Code, tt.wantCode)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("content type: got %q want %q", got, tt.wantContentType)
+			}
+		})
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	ts, cleanup := setupTestServer(t, -1, nil)
+	defer cleanup()
+	for i := 0; i < 3; i++ {
+		ts.exchange(strconv.Itoa(i), "42.42.42.42")
+	}
+	w := httptest.NewRecorder()
+	ts.s.DebugHandler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var got struct{ Upstreams []UpstreamStats }
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Can't unmarshal HTTP response: %v", err)
+	}
+	if len(got.Upstreams) != 1 || got.Upstreams[0].Pool == nil {
+		t.Fatalf("upstreams: got %+v want one with pool stats", got.Upstreams)
+	}
+	want := PoolStats{Idle: 1, Dials: 1, Reuses: 2}
+	if p := *got.Upstreams[0].Pool; p != want {
+		t.Errorf("pool stats: got %+v want %+v", p, want)
+	}
+}
+
+func TestFlushCacheHandler(t *testing.T) {
+	const token = "s3cr3t"
+	tests := []struct {
+		name       string
+		token      string
+		method     string
+		target     string
+		auth       string
+		wantStatus int
+		wantLen    int
+	}{
+		{name: "flush", token: token, method: "POST", target: "/", auth: "Bearer " + token, wantStatus: 200},
+		{name: "flush name", token: token, method: "POST", target: "/?name=" + strings.ToUpper(testQuestion), auth: "Bearer " + token, wantStatus: 200},
+		{name: "flush other name", token: token, method: "POST", target: "/?name=sub." + testQuestion, auth: "Bearer " + token, wantStatus: 200, wantLen: 1},
+		{name: "wrong token", token: token, method: "POST", auth: "Bearer nope", wantStatus: 401, wantLen: 1},
+		{name: "no auth", token: token, method: "POST", wantStatus: 401, wantLen: 1},
+		{name: "empty token", method: "POST", auth: "Bearer ", wantStatus: 401, wantLen: 1},
+		{name: "get", token: token, method: "GET", auth: "Bearer " + token, wantStatus: 405, wantLen: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, cleanup := setupTestServer(t, 100, nil)
+			defer cleanup()
+			ts.exchange("fill", "42.42.42.42")
+			w := httptest.NewRecorder()
+			target := tt.target
+			if target == "" {
+				target = "/"
+			}
+			r := httptest.NewRequest(tt.method, target, nil)
+			if tt.auth != "" {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			ts.s.FlushCacheHandler(tt.token).ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("HTTP status: got %d want %d", w.Code, tt.wantStatus)
+			}
+			if got := ts.s.cache.c.Len(); got != tt.wantLen {
+				t.Errorf("cache len: got %d want %d", got, tt.wantLen)
+			}
+			if tt.wantStatus != 200 {
+				return
+			}
+			var got struct{ Flushed int }
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("Can't unmarshal HTTP response: %v", err)
+			}
+			if want := 1 - tt.wantLen; got.Flushed != want {
+				t.Errorf("flushed: got %d want %d", got.Flushed, want)
+			}
+		})
+	}
+}
+
+func TestFlushCustomCache(t *testing.T) {
+	const token = "s3cr3t"
+	c := &mapCache{answers: make(map[dns.Question]*dns.Msg)}
+	ts, cleanup := setupTestServer(t, 0, nil, WithCache(c))
+	defer cleanup()
+	ts.exchange("fill", "42.42.42.42")
+	if _, err := ts.s.FlushCache(); err != errCacheNotFlushable {
+		t.Errorf("FlushCache: got %v want %v", err, errCacheNotFlushable)
+	}
+	if _, err := ts.s.FlushName(testQuestion); err != errCacheNotFlushable {
+		t.Errorf("FlushName: got %v want %v", err, errCacheNotFlushable)
+	}
+	for _, target := range []string{"/", "/?name=" + testQuestion} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", target, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		ts.s.FlushCacheHandler(token).ServeHTTP(w, r)
+		if w.Code != http.StatusNotImplemented {
+			t.Errorf("%s: HTTP status: got %d want %d", target, w.Code, http.StatusNotImplemented)
+		}
+	}
+	if got := c.Len(); got != 1 {
+		t.Errorf("cache len: got %d want 1", got)
+	}
+}
+
+func TestStats(t *testing.T) {
+	ts, cleanup := setupTestServer(t, 100, nil)
+	defer cleanup()
+	ts.exchange("network", "42.42.42.42")
+	ts.exchange("cache", "42.42.42.42")
+	st := ts.s.Stats()
+	if st.CacheLen != 1 || st.CacheMetrics.Hit() != 1 || st.CacheMetrics.Miss != 1 {
+		t.Errorf("cache: got len %d, %d hits and %d misses want 1, 1 and 1", st.CacheLen, st.CacheMetrics.Hit(), st.CacheMetrics.Miss)
+	}
+	if st.Uptime == "" || st.UptimeSeconds <= 0 {
+		t.Errorf("uptime: got %q and %v seconds want > 0", st.Uptime, st.UptimeSeconds)
+	}
+	if len(st.Upstreams) != 1 || st.Upstreams[0].Successes != 1 {
+		t.Errorf("upstreams: got %+v want one with 1 success", st.Upstreams)
+	}
+}
+
+func TestTrafficStats(t *testing.T) {
+	ts, cleanup := setupTestServer(t, 100, nil, WithNoIPv6(true))
+	defer cleanup()
+	w := &fakeResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 42}}
+	for _, q := range []*dns.Msg{
+		new(dns.Msg).SetQuestion(testQuestion, dns.TypeMX),
+		new(dns.Msg).SetQuestion(testQuestion, dns.TypeMX),
+		new(dns.Msg).SetQuestion(testQuestion, dns.TypeAAAA),
+		new(dns.Msg).SetQuestion(testQuestion, 4242),
+		new(dns.Msg).SetNotify("miki."),
+		{},
+	} {
+		ts.s.ServeDNS(w, q)
+	}
+	st := ts.s.Stats()
+	wantTypes := map[string]uint64{"MX": 2, "AAAA": 1, otherKey: 1}
+	if !reflect.DeepEqual(st.QueryTypes, wantTypes) {
+		t.Errorf("query types: got %v want %v", st.QueryTypes, wantTypes)
+	}
+	// The upstream answers every question with a record, the AAAA query gets NODATA.
+	wantRcodes := map[string]uint64{"NOERROR": 4, "NOTIMP": 1, "FORMERR": 1}
+	if !reflect.DeepEqual(st.Rcodes, wantRcodes) {
+		t.Errorf("rcodes: got %v want %v", st.Rcodes, wantRcodes)
+	}
+}
+
+func TestForwardRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         []Option
+		wantAttempts int32
+		wantMinTime  time.Duration
+	}{
+		{name: "default", wantAttempts: 3},
+		{name: "no retries", opts: []Option{WithForwardRetries(-1, 0)}, wantAttempts: 1},
+		{name: "more retries", opts: []Option{WithForwardRetries(4, 0)}, wantAttempts: 5},
+		{name: "delay", opts: []Option{WithForwardRetries(2, 40*time.Millisecond)}, wantAttempts: 3, wantMinTime: 40 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			failing := funcTransport(func(context.Context, *dns.Msg) (*dns.Msg, error) {
+				atomic.AddInt32(&attempts, 1)
+				return nil, errors.New("flaky")
+			})
+			s := NewServerWithOptions(append([]Option{
+				WithCacheSize(-1),
+				WithUpstreams("fake://flaky"),
+				WithUpstreamTransport("fake", func(string) (UpstreamTransport, error) { return failing, nil }),
+			}, tt.opts...)...)
+			start := time.Now()
+			if m, _ := s.forwardMessageAndCacheResponse(context.Background(), new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)); m != nil {
+				t.Errorf("response: got %v want nil", m)
+			}
+			if got := atomic.LoadInt32(&attempts); got != tt.wantAttempts {
+				t.Errorf("attempts: got %d want %d", got, tt.wantAttempts)
+			}
+			if elapsed := time.Since(start); elapsed < tt.wantMinTime {
+				t.Errorf("elapsed: got %v want at least %v", elapsed, tt.wantMinTime)
+			}
+		})
+	}
+}
+
+func TestTruncatedRetry(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		count int
+	)
+	ts, cleanup := setupTestServerWithHandler(t, 0, func(w dns.ResponseWriter, q *dns.Msg) {
+		mu.Lock()
+		count++
+		first := count == 1
+		mu.Unlock()
+		m := &dns.Msg{}
+		m = m.SetReply(q)
+		if first {
+			// Pretend the answer did not fit.
+			m.Truncated = true
+			_ = w.WriteMsg(m)
+			return
+		}
+		resp, err := dns.NewRR("raccoon.miki. 2311 IN MX 10 42.42.42.42")
+		if err != nil {
+			t.Fatalf("Cannot parse test response: %v", err)
+		}
+		m.Answer = []dns.RR{resp}
+		_ = w.WriteMsg(m)
+	})
+	defer cleanup()
+	ts.exchange("retry", "42.42.42.42")
+	ts.exchange("cache", "42.42.42.42")
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := count, 2; got != want {
+		t.Errorf("upstream queries: got %d want %d", got, want)
+	}
+	if got := ts.s.Stats().TCRetries; got != 1 {
+		t.Errorf("TC retries: got %d want 1", got)
+	}
+}
+
+func TestAnswerSizeLimit(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      AnswerSizePolicy
+		wantQueries int
+		wantExtra   int
+	}{
+		{name: "reject", policy: SizeRejectCache, wantQueries: 2},
+		{name: "truncate additional", policy: SizeTruncateAdditional, wantQueries: 1, wantExtra: 0},
+		{name: "log", policy: SizeLog, wantQueries: 1, wantExtra: 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				queries  int
+				observed []int
+			)
+			observe := func(q dns.Question, size int) {
+				mu.Lock()
+				defer mu.Unlock()
+				if q.Name != testQuestion {
+					t.Errorf("observed question: got %q want %q", q.Name, testQuestion)
+				}
+				observed = append(observed, size)
+			}
+			ts, cleanup := setupTestServerWithHandler(t, 0, func(w dns.ResponseWriter, q *dns.Msg) {
+				mu.Lock()
+				queries++
+				mu.Unlock()
+				m := &dns.Msg{}
+				m = m.SetReply(q)
+				resp, _ := dns.NewRR("raccoon.miki. 2311 IN MX 10 42.42.42.42")
+				m.Answer = []dns.RR{resp}
+				for i := 0; i < 10; i++ {
+					extra, _ := dns.NewRR(fmt.Sprintf("glue%d.miki. 2311 IN A 10.0.0.%d", i, i))
+					m.Extra = append(m.Extra, extra)
+				}
+				_ = w.WriteMsg(m)
+			}, WithAnswerSizeLimit(150, tt.policy, observe))
+			defer cleanup()
+			ts.exchange("first", "42.42.42.42")
+			ts.exchange("second", "42.42.42.42")
+
+			mu.Lock()
+			defer mu.Unlock()
+			if queries != tt.wantQueries {
+				t.Errorf("upstream queries: got %d want %d", queries, tt.wantQueries)
+			}
+			if len(observed) == 0 || observed[0] <= 150 {
+				t.Errorf("observed sizes: got %v want at least one above 150", observed)
+			}
+			if tt.wantQueries != 1 {
+				return
+			}
+			var q dns.Msg
+			q.SetQuestion(testQuestion, dns.TypeMX)
+			m, ok := ts.s.cache.get(&q)
+			if !ok {
+				t.Fatalf("answer was not cached")
+			}
+			if got := len(m.Extra); got != tt.wantExtra {
+				t.Errorf("cached additional records: got %d want %d", got, tt.wantExtra)
+			}
+		})
+	}
+}
+
+func TestMultipleQuestions(t *testing.T) {
+	tests := []struct {
+		name         string
+		opts         []Option
+		wantRcode    int
+		wantAns      int
+		wantUpstream int32
+	}{
+		{name: "default", wantRcode: dns.RcodeFormatError},
+		{name: "first question only", opts: []Option{WithFirstQuestionOnly(true)}, wantRcode: dns.RcodeSuccess, wantAns: 1, wantUpstream: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstream int32
+			ts, cleanup := setupTestServer(t, 0, func(string) string {
+				atomic.AddInt32(&upstream, 1)
+				return "raccoon.miki. 2311 IN A 42.42.42.42"
+			}, tt.opts...)
+			defer cleanup()
+			newMsg := func() *dns.Msg {
+				m := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+				m.Question = append(m.Question, dns.Question{Name: "other.miki.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+				return m
+			}
+			check := func(via string, r *dns.Msg) {
+				t.Helper()
+				if r.Rcode != tt.wantRcode {
+					t.Errorf("%s: rcode: got %s want %s", via, dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.wantRcode])
+				}
+				if len(r.Answer) != tt.wantAns {
+					t.Errorf("%s: answers: got %d want %d", via, len(r.Answer), tt.wantAns)
+				}
+				// Responses only echo the first question, whatever the outcome.
+				if len(r.Question) != 1 || r.Question[0].Name != testQuestion {
+					t.Errorf("%s: question: got %v want %s only", via, r.Question, testQuestion)
+				}
+			}
+
+			// Over the network and through ServeDNS directly, as the DoH handler and library users do.
+			var c dns.Client
+			r, _, err := c.Exchange(newMsg(), ts.laddr)
+			if err != nil {
+				t.Fatalf("cannot contact server: %v", err)
+			}
+			check("network", r)
+			w := &fakeResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 42}}
+			ts.s.ServeDNS(w, newMsg())
+			if len(w.msgs) != 1 {
+				t.Fatalf("ServeDNS: got %d responses want 1", len(w.msgs))
+			}
+			check("ServeDNS", w.msgs[0])
+			// The second answer, if any, comes from the cache.
+			if got := atomic.LoadInt32(&upstream); got != tt.wantUpstream {
+				t.Errorf("upstream queries: got %d want %d", got, tt.wantUpstream)
+			}
+		})
+	}
+}
+
+func TestNonQueryOpcodes(t *testing.T) {
+	var upstream int32
+	ts, cleanup := setupTestServer(t, 0, func(string) string {
+		atomic.AddInt32(&upstream, 1)
+		return "42.42.42.42"
+	})
+	defer cleanup()
+	var c dns.Client
+	for _, tt := range []struct {
+		name string
+		msg  *dns.Msg
+	}{
+		{"update", new(dns.Msg).SetUpdate("miki.")},
+		{"notify", new(dns.Msg).SetNotify("miki.")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _, err := c.Exchange(tt.msg, ts.laddr)
+			if err != nil {
+				t.Fatalf("cannot contact server: %v", err)
+			}
+			if r.Rcode != dns.RcodeNotImplemented {
+				t.Errorf("rcode: got %s want NOTIMP", dns.RcodeToString[r.Rcode])
+			}
+		})
+	}
+	if got := atomic.LoadInt32(&upstream); got != 0 {
+		t.Errorf("upstream queries: got %d want 0", got)
+	}
+}
+
+func TestNoQuestions(t *testing.T) {
+	ts, cleanup := setupTestServer(t, 0, nil)
+	defer cleanup()
+
+	// Over the network and through ServeDNS directly, as the DoH handler and library users do.
+	var (
+		c dns.Client
+		q dns.Msg
+	)
+	q.Id = dns.Id()
+	q.RecursionDesired = true
+	r, _, err := c.Exchange(&q, ts.laddr)
+	if err != nil {
+		t.Fatalf("cannot contact server: %v", err)
+	}
+	if r.Rcode != dns.RcodeFormatError {
+		t.Errorf("network: got %s want FORMERR", dns.RcodeToString[r.Rcode])
+	}
+	w := &fakeResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 42}}
+	ts.s.ServeDNS(w, &q)
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeFormatError {
+		t.Errorf("ServeDNS: got %v want a FORMERR response", w.msgs)
+	}
+}
+
+func TestRefreshScheduler(t *testing.T) {
+	s := NewServerWithOptions(WithRefreshScheduler(1, 30*time.Second))
+	put := func(name string, gets int) {
+		var q dns.Msg
+		q.SetQuestion(name, dns.TypeA)
+		rr, err := dns.NewRR(name + " 100 IN A 42.42.42.42")
+		if err != nil {
+			t.Fatalf("Cannot parse test response: %v", err)
+		}
+		m := new(dns.Msg).SetReply(&q)
+		m.Answer = []dns.RR{rr}
+		s.cache.put(&q, m)
+		for i := 0; i < gets; i++ {
+			s.cache.get(&q)
+		}
+	}
+	put("hot.miki.", 5)
+	put("cold.miki.", 1)
+
+	now := time.Now()
+	s.scheduleRefreshes(now)
+	if got := len(s.rq); got != 0 {
+		t.Fatalf("refreshes scheduled long before expiration: got %d want 0", got)
+	}
+	s.scheduleRefreshes(now.Add(80 * time.Second))
+	if got := len(s.rq); got != 1 {
+		t.Fatalf("refreshes scheduled before expiration: got %d want 1", got)
+	}
+	if got := (<-s.rq).Question[0].Name; got != "hot.miki." {
+		t.Errorf("refreshed question: got %q want %q", got, "hot.miki.")
+	}
+	if got := atomic.LoadUint64(&s.scheduledRefreshes); got != 1 {
+		t.Errorf("scheduled refreshes metric: got %d want 1", got)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	s := NewServerWithOptions(WithPrefetch(10, 0.1, 3))
+	now := time.Now()
+	s.cache.clock = func() time.Time { return now }
+	put := func(name string, ttl, gets int) {
+		var q dns.Msg
+		q.SetQuestion(name, dns.TypeA)
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN A 42.42.42.42", name, ttl))
+		if err != nil {
+			t.Fatalf("Cannot parse test response: %v", err)
+		}
+		m := new(dns.Msg).SetReply(&q)
+		m.Answer = []dns.RR{rr}
+		s.cache.put(&q, m)
+		for i := 0; i < gets; i++ {
+			s.cache.get(&q)
+		}
+	}
+	put("hot.miki.", 100, 5)
+	put("hot-long.miki.", 1000, 5)
+	put("cold.miki.", 100, 1)
+
+	tests := []struct {
+		after time.Duration
+		want  []string
+	}{
+		{after: 80 * time.Second},
+		{after: 95 * time.Second, want: []string{"hot.miki."}},
+		{after: 101 * time.Second},
+		{after: 950 * time.Second, want: []string{"hot-long.miki."}},
+	}
+	for _, tt := range tests {
+		s.prefetch(now.Add(tt.after))
+		var got []string
+		for len(s.rq) > 0 {
+			got = append(got, (<-s.rq).Question[0].Name)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("prefetched after %v: got %v want %v", tt.after, got, tt.want)
+		}
+	}
+	if got := atomic.LoadUint64(&s.scheduledRefreshes); got != 2 {
+		t.Errorf("scheduled refreshes metric: got %d want 2", got)
+	}
+}
+
+func TestPrefetchQuery(t *testing.T) {
+	s := NewServerWithOptions(WithPrefetch(10, 0.1, 1))
+	now := time.Now()
+	s.cache.clock = func() time.Time { return now }
+	var q dns.Msg
+	q.SetQuestion("hot.miki.", dns.TypeA)
+	q.SetEdns0(1232, true)
+	addClientSubnet(&q, net.IPv4(192, 0, 2, 0))
+	m := new(dns.Msg).SetReply(&q)
+	m.Answer = []dns.RR{mustRR(t, "hot.miki. 100 IN A 42.42.42.42")}
+	s.cache.put(&q, m)
+	s.cache.get(&q)
+
+	// The entry is not enqueued again while its refresh is pending.
+	s.prefetch(now.Add(95 * time.Second))
+	s.prefetch(now.Add(96 * time.Second))
+	if got := len(s.rq); got != 1 {
+		t.Fatalf("enqueued refreshes: got %d want 1", got)
+	}
+	r := <-s.rq
+	if got, want := key(r), key(&q); got != want {
+		t.Errorf("refresh key: got %q want %q", got, want)
+	}
+	if opt := r.IsEdns0(); opt == nil || !opt.Do() {
+		t.Errorf("refresh: got %v want the DO bit set", r)
+	}
+	s.refreshed(r)
+	s.prefetch(now.Add(97 * time.Second))
+	if got := len(s.rq); got != 1 {
+		t.Errorf("enqueued refreshes after the refresh completed: got %d want 1", got)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	var (
+		udp = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}
+		tcp = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}
+	)
+	tests := []struct {
+		name   string
+		opts   []Option
+		remote net.Addr
+		want   bool
+	}{
+		{name: "udp", remote: udp, want: true},
+		{name: "tcp", remote: tcp, want: true},
+		{name: "udp no stream compression", opts: []Option{WithStreamCompression(false)}, remote: udp, want: true},
+		{name: "tcp no stream compression", opts: []Option{WithStreamCompression(false)}, remote: tcp, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServerWithOptions(tt.opts...)
+			var q dns.Msg
+			q.SetQuestion(testQuestion, dns.TypeA)
+			rr, _ := dns.NewRR("raccoon.miki. 2311 IN A 42.42.42.42")
+			m := new(dns.Msg).SetReply(&q)
+			m.Answer = []dns.RR{rr}
+			s.cache.put(&q, m)
+
+			w := &fakeResponseWriter{remote: tt.remote}
+			s.ServeDNS(w, &q)
+			if len(w.msgs) != 1 {
+				t.Fatalf("responses: got %d want 1", len(w.msgs))
+			}
+			if got := w.msgs[0].Compress; got != tt.want {
+				t.Errorf("compress: got %v want %v", got, tt.want)
+			}
+			// The cached copy must not be affected by egress decisions.
+			v, _ := s.cache.c.Get(key(&q))
+			if cm, err := v.(cacheValue).unpack(); err != nil || cm.Compress {
+				t.Errorf("cached message: got compression set or %v", err)
+			}
+		})
+	}
+}
+
+func TestClientTruncation(t *testing.T) {
+	var (
+		udp = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}
+		tcp = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 4242}
+	)
+	tests := []struct {
+		name          string
+		remote        net.Addr
+		udpSize       uint16
+		wantTruncated bool
+	}{
+		{name: "udp", remote: udp, wantTruncated: true},
+		{name: "udp EDNS0 small", remote: udp, udpSize: 1232, wantTruncated: true},
+		{name: "udp EDNS0 below minimum", remote: udp, udpSize: 256, wantTruncated: true},
+		{name: "udp EDNS0 large", remote: udp, udpSize: 4096},
+		{name: "tcp", remote: tcp},
+	}
+	// The answer takes about 2KB.
+	var q dns.Msg
+	q.SetQuestion(testQuestion, dns.TypeTXT)
+	m := new(dns.Msg).SetReply(&q)
+	for i := 0; i < 8; i++ {
+		rr, _ := dns.NewRR(fmt.Sprintf("raccoon.miki. 2311 IN TXT %q", strings.Repeat(strconv.Itoa(i), 250)))
+		m.Answer = append(m.Answer, rr)
+	}
+	s := NewServerWithOptions()
+	s.cache.put(&q, m)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cq := q.Copy()
+			if tt.udpSize > 0 {
+				cq.SetEdns0(tt.udpSize, false)
+			}
+			w := &fakeResponseWriter{remote: tt.remote}
+			s.ServeDNS(w, cq)
+			if len(w.msgs) != 1 {
+				t.Fatalf("responses: got %d want 1", len(w.msgs))
+			}
+			r := w.msgs[0]
+			if r.Truncated != tt.wantTruncated {
+				t.Errorf("TC: got %t want %t", r.Truncated, tt.wantTruncated)
+			}
+			if size := udpSize(cq); tt.wantTruncated && r.Len() > size {
+				t.Errorf("size: got %d want at most %d", r.Len(), size)
+			}
+			if !tt.wantTruncated && len(r.Answer) != len(m.Answer) {
+				t.Errorf("answers: got %d want %d", len(r.Answer), len(m.Answer))
+			}
+		})
+	}
+	// The cached copy must not be affected by egress decisions.
+	v, _ := s.cache.c.Get(key(&q))
+	if cm, err := v.(cacheValue).unpack(); err != nil || len(cm.Answer) != len(m.Answer) {
+		t.Errorf("cached message was truncated or cannot be unpacked: %v", err)
+	}
+}
+
+func TestCNAMELoopRejected(t *testing.T) {
+	ts, cleanup := setupTestServer(t, 0, func(string) string {
+		return "raccoon.miki. 2311 IN CNAME raccoon.miki."
+	})
+	defer cleanup()
+	var (
+		c dns.Client
+		m dns.Msg
+	)
+	m.SetQuestion(testQuestion, dns.TypeA)
+	r, _, err := c.Exchange(&m, ts.laddr)
+	if err != nil {
+		t.Fatalf("cannot contact server: %v", err)
+	}
+	if r.Rcode != dns.RcodeServerFailure {
+		t.Errorf("rcode: got %s want SERVFAIL", dns.RcodeToString[r.Rcode])
+	}
+	if ts.s.cache.c.Len() != 0 {
+		t.Errorf("looping answer was cached")
+	}
+}
+
+func TestServFail(t *testing.T) {
+	ts, cleanup := setupTestServer(t, 0, func(string) string {
+		return "raccoon.miki. 2311 IN MX 10 42.42.42.42"
+	}, WithChaos(1, 0))
+	defer cleanup()
+	for _, edns := range []bool{false, true} {
+		t.Run(fmt.Sprintf("edns=%t", edns), func(t *testing.T) {
+			var (
+				c dns.Client
+				m dns.Msg
+			)
+			m.SetQuestion(testQuestion, dns.TypeMX)
+			if edns {
+				m.SetEdns0(1232, true)
+			}
+			r, _, err := c.Exchange(&m, ts.laddr)
+			if err != nil {
+				t.Fatalf("cannot contact server: %v", err)
+			}
+			if r.Rcode != dns.RcodeServerFailure {
+				t.Errorf("rcode: got %s want SERVFAIL", dns.RcodeToString[r.Rcode])
+			}
+			if len(r.Question) != 1 || r.Question[0] != m.Question[0] {
+				t.Errorf("question: got %v want %v", r.Question, m.Question)
+			}
+			opt := r.IsEdns0()
+			if got := opt != nil; got != edns {
+				t.Fatalf("OPT record: got %t want %t", got, edns)
+			}
+			if edns && (opt.UDPSize() != ednsUDPSize || !opt.Do()) {
+				t.Errorf("OPT record: got UDP size %d DO %t want %d true", opt.UDPSize(), opt.Do(), ednsUDPSize)
+			}
+		})
+	}
+}
+
+func TestServfailCaching(t *testing.T) {
+	const ttl = 5 * time.Second
+	tests := []struct {
+		name string
+		ttl  time.Duration
+		// reply is the rcode of the upstream, -1 for no response at all.
+		reply int
+		// stale puts an expired answer in the cache first.
+		stale       bool
+		wantQueries []int32
+		wantStatus  []CacheStatus
+	}{
+		{
+			name:        "disabled",
+			reply:       dns.RcodeServerFailure,
+			wantQueries: []int32{1, 2, 3},
+			wantStatus:  []CacheStatus{CacheMiss, CacheMiss, CacheMiss},
+		},
+		{
+			name:        "servfail",
+			ttl:         ttl,
+			reply:       dns.RcodeServerFailure,
+			wantQueries: []int32{1, 1, 2},
+			wantStatus:  []CacheStatus{CacheMiss, CacheHit, CacheMiss},
+		},
+		{
+			name:        "no response",
+			ttl:         ttl,
+			reply:       -1,
+			wantQueries: []int32{1, 1, 2},
+			wantStatus:  []CacheStatus{CacheMiss, CacheHit, CacheMiss},
+		},
+		{
+			name:        "stale answer kept",
+			ttl:         ttl,
+			reply:       dns.RcodeServerFailure,
+			stale:       true,
+			wantQueries: []int32{0, 0, 0},
+			wantStatus:  []CacheStatus{CacheStale, CacheStale, CacheStale},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queries int32
+			s := NewServerWithOptions(
+				WithUpstreams("fake://servfail"),
+				WithUpstreamTransport("fake", func(string) (UpstreamTransport, error) {
+					return funcTransport(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+						atomic.AddInt32(&queries, 1)
+						if tt.reply < 0 {
+							return nil, errors.New("down")
+						}
+						return new(dns.Msg).SetRcode(q, tt.reply), nil
+					}), nil
+				}),
+				WithForwardRetries(-1, 0),
+				WithServfailCaching(tt.ttl),
+			)
+			now := time.Now()
+			s.cache.clock = func() time.Time { return now }
+			q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+			if tt.stale {
+				rr, err := dns.NewRR(testQuestion + " 1 IN A 42.42.42.42")
+				if err != nil {
+					t.Fatalf("Cannot parse test response: %v", err)
+				}
+				m := new(dns.Msg).SetReply(q)
+				m.Answer = []dns.RR{rr}
+				s.cache.put(q, m)
+				now = now.Add(time.Minute)
+			}
+			for i, advance := range []time.Duration{0, ttl / 2, ttl} {
+				now = now.Add(advance)
+				m, status, _ := s.getAnswer(context.Background(), q)
+				if status != tt.wantStatus[i] {
+					t.Errorf("query %d: cache status: got %v want %v", i, status, tt.wantStatus[i])
+				}
+				if !tt.stale && m != nil && m.Rcode != dns.RcodeServerFailure {
+					t.Errorf("query %d: rcode: got %s want SERVFAIL", i, dns.RcodeToString[m.Rcode])
+				}
+				if got := atomic.LoadInt32(&queries); got != tt.wantQueries[i] {
+					t.Errorf("query %d: upstream queries: got %d want %d", i, got, tt.wantQueries[i])
+				}
+			}
+		})
+	}
+}
+
+func TestChaos(t *testing.T) {
+	t.Run("failures", func(t *testing.T) {
+		var (
+			mu      sync.Mutex
+			queries int
+		)
+		ts, cleanup := setupTestServer(t, 0, func(string) string {
+			mu.Lock()
+			defer mu.Unlock()
+			queries++
+			return "raccoon.miki. 2311 IN MX 10 42.42.42.42"
+		}, WithChaos(1, 0))
+		defer cleanup()
+		var (
+			c dns.Client
+			m dns.Msg
+		)
+		m.SetQuestion(testQuestion, dns.TypeMX)
+		r, _, err := c.Exchange(&m, ts.laddr)
+		if err != nil {
+			t.Fatalf("cannot contact server: %v", err)
+		}
+		if r.Rcode != dns.RcodeServerFailure {
+			t.Errorf("rcode: got %s want SERVFAIL", dns.RcodeToString[r.Rcode])
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if queries != 0 {
+			t.Errorf("upstream queries: got %d want 0", queries)
+		}
+	})
+	t.Run("latency", func(t *testing.T) {
+		const latency = 100 * time.Millisecond
+		ts, cleanup := setupTestServer(t, 0, func(string) string {
+			return "raccoon.miki. 2311 IN MX 10 42.42.42.42"
+		}, WithChaos(0, latency))
+		defer cleanup()
+		start := time.Now()
+		ts.exchange("latency", "42.42.42.42")
+		if got := time.Since(start); got < latency {
+			t.Errorf("exchange took %v, want at least %v", got, latency)
+		}
+	})
+	t.Run("cancel", func(t *testing.T) {
+		s := NewServerWithOptions(WithCacheSize(-1), WithChaos(0, time.Hour))
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		var q dns.Msg
+		q.SetQuestion(testQuestion, dns.TypeA)
+		if _, err := s.exchange(ctx, nil, &q); err != context.Canceled {
+			t.Errorf("exchange error: got %v want %v", err, context.Canceled)
+		}
+	})
+}
+
+func TestEmptyVersusNilResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     func(w dns.ResponseWriter, q *dns.Msg)
+		wantRcode   int
+		wantQueries int
+	}{
+		{
+			name: "empty",
+			handler: func(w dns.ResponseWriter, q *dns.Msg) {
+				_ = w.WriteMsg(new(dns.Msg).SetReply(q))
+			},
+			wantRcode:   dns.RcodeSuccess,
+			wantQueries: 1,
+		},
+		{
+			name: "nxdomain",
+			handler: func(w dns.ResponseWriter, q *dns.Msg) {
+				_ = w.WriteMsg(new(dns.Msg).SetRcode(q, dns.RcodeNameError))
+			},
+			wantRcode:   dns.RcodeNameError,
+			wantQueries: 1,
+		},
+		{
+			name: "no response",
+			handler: func(w dns.ResponseWriter, q *dns.Msg) {
+				_ = w.Close()
+			},
+			wantRcode: dns.RcodeServerFailure,
+			// The first attempt plus two retries.
+			wantQueries: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu      sync.Mutex
+				queries int
+			)
+			ts, cleanup := setupTestServerWithHandler(t, 0, func(w dns.ResponseWriter, q *dns.Msg) {
+				mu.Lock()
+				queries++
+				mu.Unlock()
+				tt.handler(w, q)
+			})
+			defer cleanup()
+			var (
+				c dns.Client
+				m dns.Msg
+			)
+			m.SetQuestion(testQuestion, dns.TypeA)
+			r, _, err := c.Exchange(&m, ts.laddr)
+			if err != nil {
+				t.Fatalf("cannot contact server: %v", err)
+			}
+			if r.Rcode != tt.wantRcode {
+				t.Errorf("rcode: got %s want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			if len(r.Answer) != 0 {
+				t.Errorf("answers: got %d want 0", len(r.Answer))
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if queries != tt.wantQueries {
+				t.Errorf("upstream queries: got %d want %d", queries, tt.wantQueries)
+			}
+		})
+	}
+}
+
+func TestClientConcurrencyLimit(t *testing.T) {
+	const (
+		limit   = 2
+		queries = 10
+	)
+	var (
+		started = make(chan struct{}, queries)
+		release = make(chan struct{})
+	)
+	ts, cleanup := setupTestServerWithHandler(t, -1, func(w dns.ResponseWriter, q *dns.Msg) {
+		started <- struct{}{}
+		<-release
+		m := new(dns.Msg).SetReply(q)
+		rr, _ := dns.NewRR("raccoon.miki. 2311 IN A 42.42.42.42")
+		m.Answer = []dns.RR{rr}
+		_ = w.WriteMsg(m)
+	}, WithClientConcurrencyLimit(limit, 0))
+	defer cleanup()
+
+	rcodes := make(chan int, queries)
+	for i := 0; i < queries; i++ {
+		go func() {
+			var (
+				c dns.Client
+				m dns.Msg
+			)
+			m.SetQuestion(testQuestion, dns.TypeA)
+			r, _, err := c.Exchange(&m, ts.laddr)
+			if err != nil {
+				t.Errorf("cannot contact server: %v", err)
+				rcodes <- -1
+				return
+			}
+			rcodes <- r.Rcode
+		}()
+	}
+	for i := 0; i < limit; i++ {
+		<-started
+	}
+	for i := 0; i < queries-limit; i++ {
+		if got := <-rcodes; got != dns.RcodeRefused {
+			t.Errorf("rcode of query above the limit: got %s want REFUSED", dns.RcodeToString[got])
+		}
+	}
+	close(release)
+	for i := 0; i < limit; i++ {
+		if got := <-rcodes; got != dns.RcodeSuccess {
+			t.Errorf("rcode of query within the limit: got %s want NOERROR", dns.RcodeToString[got])
+		}
+	}
+	if got := atomic.LoadUint64(&ts.s.clientLimited); got != queries-limit {
+		t.Errorf("limited queries metric: got %d want %d", got, queries-limit)
+	}
+	ts.s.limiter.mu.Lock()
+	defer ts.s.limiter.mu.Unlock()
+	if got := len(ts.s.limiter.clients); got != 0 {
+		t.Errorf("tracked clients after queries: got %d want 0", got)
+	}
+}
+
+func TestStickyUpstreams(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	var (
+		mu      sync.Mutex
+		queries [2]int
+		delays  = [2]time.Duration{0, delay}
+	)
+	upstream := func(i int) fakeServer {
+		return func(w dns.ResponseWriter, q *dns.Msg) {
+			mu.Lock()
+			queries[i]++
+			d := delays[i]
+			mu.Unlock()
+			time.Sleep(d)
+			m := new(dns.Msg).SetReply(q)
+			rr, _ := dns.NewRR(fmt.Sprintf("raccoon.miki. 2311 IN MX 10 %d.%d.%d.%d", i, i, i, i))
+			m.Answer = []dns.RR{rr}
+			_ = w.WriteMsg(m)
+		}
+	}
+	const ttl = time.Minute
+	var clockMu sync.Mutex
+	now := time.Now()
+	clock := func(o *options) {
+		o.stickyClock = func() time.Time {
+			clockMu.Lock()
+			defer clockMu.Unlock()
+			return now
+		}
+	}
+	ts, cleanup := setupTestServerWithUpstreams(t, -1, []fakeServer{upstream(0), upstream(1)}, WithStickyUpstreams(10, ttl), clock)
+	defer cleanup()
+	check := func(logmsg string, want [2]int) {
+		t.Helper()
+		// Let slow upstreams finish answering.
+		time.Sleep(2 * delay)
+		mu.Lock()
+		defer mu.Unlock()
+		if queries != want {
+			t.Errorf("%s: upstream queries: got %v want %v", logmsg, queries, want)
+		}
+	}
+
+	ts.exchange("race", "0.0.0.0")
+	check("race", [2]int{1, 1})
+
+	// Now the other upstream is faster, but the first one sticks.
+	mu.Lock()
+	delays = [2]time.Duration{delay, 0}
+	mu.Unlock()
+	ts.exchange("sticky", "0.0.0.0")
+	check("sticky", [2]int{2, 1})
+
+	// Once stickiness expires, the fastest wins again.
+	clockMu.Lock()
+	now = now.Add(ttl + time.Second)
+	clockMu.Unlock()
+	ts.exchange("expired", "1.1.1.1")
+	check("expired", [2]int{3, 2})
+	ts.exchange("sticky again", "1.1.1.1")
+	check("sticky again", [2]int{3, 3})
+}
+
+func TestHashedUpstreams(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		queries [3]int
+		broken  [3]bool
+	)
+	upstream := func(i int) fakeServer {
+		return func(w dns.ResponseWriter, q *dns.Msg) {
+			mu.Lock()
+			queries[i]++
+			b := broken[i]
+			mu.Unlock()
+			if b {
+				_ = w.Close()
+				return
+			}
+			m := new(dns.Msg).SetReply(q)
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 2311 IN MX 10 %d.%d.%d.%d", q.Question[0].Name, i, i, i, i))
+			m.Answer = []dns.RR{rr}
+			_ = w.WriteMsg(m)
+		}
+	}
+	ts, cleanup := setupTestServerWithUpstreams(t, -1, []fakeServer{upstream(0), upstream(1), upstream(2)}, WithHashedUpstreams(true))
+	defer cleanup()
+	snapshot := func() [3]int {
+		mu.Lock()
+		defer mu.Unlock()
+		return queries
+	}
+
+	ts.exchange("first", "")
+	var chosen int
+	for i, n := range snapshot() {
+		if n == 1 {
+			chosen = i
+		}
+	}
+	want := [3]int{}
+	want[chosen] = 5
+	for i := 0; i < 4; i++ {
+		ts.exchange("same", fmt.Sprintf("%d.%d.%d.%d", chosen, chosen, chosen, chosen))
+	}
+	if got := snapshot(); got != want {
+		t.Errorf("upstream queries: got %v want %v", got, want)
+	}
+
+	// Different questions are spread across upstreams.
+	for i := 0; i < 30; i++ {
+		ts.question = fmt.Sprintf("%d.%s", i, testQuestion)
+		ts.exchange("spread", "")
+	}
+	for i, n := range snapshot() {
+		if n == want[i] {
+			t.Errorf("upstream %d got no queries for 30 different questions", i)
+		}
+	}
+
+	// The following upstream is used when the chosen one fails.
+	ts.question = testQuestion
+	mu.Lock()
+	broken[chosen] = true
+	queries = [3]int{}
+	mu.Unlock()
+	next := (chosen + 1) % 3
+	for i := 0; i < 3; i++ {
+		ts.exchange("failover", fmt.Sprintf("%d.%d.%d.%d", next, next, next, next))
+	}
+	if got := snapshot(); got[next] != 3 || got[3-chosen-next] != 0 {
+		t.Errorf("upstream queries after failure of %d: got %v want 3 for %d", chosen, got, next)
+	}
+}
+
+func TestEdns0Egress(t *testing.T) {
+	// The upstream always answers with an OPT record, even to queries without one.
+	ts, cleanup := setupTestServerWithHandler(t, 0, func(w dns.ResponseWriter, q *dns.Msg) {
+		m := new(dns.Msg).SetReply(q)
+		rr, _ := dns.NewRR("raccoon.miki. 2311 IN MX 10 42.42.42.42")
+		m.Answer = []dns.RR{rr}
+		m.SetEdns0(1232, false)
+		_ = w.WriteMsg(m)
+	})
+	defer cleanup()
+	var c dns.Client
+	for _, tt := range []struct {
+		name string
+		edns bool
+		do   bool
+	}{
+		{"no EDNS0 network", false, false},
+		{"no EDNS0 cache", false, false},
+		{"EDNS0", true, false},
+		{"EDNS0 DO", true, true},
+		{"no EDNS0 again", false, false},
+	} {
+		m := new(dns.Msg).SetQuestion(testQuestion, dns.TypeMX)
+		if tt.edns {
+			m.SetEdns0(1232, tt.do)
+		}
+		r, _, err := c.Exchange(m, ts.laddr)
+		if err != nil {
+			t.Fatalf("%s: cannot contact server: %v", tt.name, err)
+		}
+		opt := r.IsEdns0()
+		if got := opt != nil; got != tt.edns {
+			t.Errorf("%s: got OPT %t want %t", tt.name, got, tt.edns)
+			continue
+		}
+		if opt == nil {
+			continue
+		}
+		if opt.Do() != tt.do {
+			t.Errorf("%s: DO: got %t want %t", tt.name, opt.Do(), tt.do)
+		}
+		if got := opt.UDPSize(); got != ednsUDPSize {
+			t.Errorf("%s: UDP size: got %d want %d", tt.name, got, ednsUDPSize)
+		}
+	}
+}
+
+func TestUpstreamEdns0(t *testing.T) {
+	// The upstream answers with signatures to queries with the DO bit.
+	var (
+		mu       sync.Mutex
+		upstream []*dns.Msg
+	)
+	ts, cleanup := setupTestServerWithHandler(t, 0, func(w dns.ResponseWriter, q *dns.Msg) {
+		mu.Lock()
+		upstream = append(upstream, q)
+		mu.Unlock()
+		m := new(dns.Msg).SetReply(q)
+		rr, _ := dns.NewRR("raccoon.miki. 2311 IN MX 10 42.42.42.42")
+		m.Answer = []dns.RR{rr}
+		if opt := q.IsEdns0(); opt != nil {
+			m.SetEdns0(opt.UDPSize(), opt.Do())
+			if opt.Do() {
+				sig, _ := dns.NewRR("raccoon.miki. 2311 IN RRSIG MX 13 2 2311 20300101000000 20200101000000 42 miki. AAAA")
+				m.Answer = append(m.Answer, sig)
+				m.AuthenticatedData = true
+			}
+		}
+		_ = w.WriteMsg(m)
+	}, WithUpstreamEDNS0(1232, true))
+	defer cleanup()
+	var c dns.Client
+	for _, tt := range []struct {
+		name     string
+		edns, do bool
+	}{
+		{"no EDNS0 network", false, false},
+		{"no EDNS0 cache", false, false},
+		{"EDNS0", true, false},
+		{"EDNS0 DO", true, true},
+	} {
+		m := new(dns.Msg).SetQuestion(testQuestion, dns.TypeMX)
+		if tt.edns {
+			m.SetEdns0(4096, tt.do)
+		}
+		r, _, err := c.Exchange(m, ts.laddr)
+		if err != nil {
+			t.Fatalf("%s: cannot contact server: %v", tt.name, err)
+		}
+		if got := r.IsEdns0() != nil; got != tt.edns {
+			t.Errorf("%s: got OPT %t want %t", tt.name, got, tt.edns)
+		}
+		if got := len(r.Answer); got != 1 && !tt.do || got != 2 && tt.do {
+			t.Errorf("%s: answers: got %v", tt.name, r.Answer)
+		}
+		if r.AuthenticatedData != tt.do {
+			t.Errorf("%s: AD: got %t want %t", tt.name, r.AuthenticatedData, tt.do)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(upstream) != 1 {
+		t.Fatalf("upstream queries: got %d want 1", len(upstream))
+	}
+	if opt := upstream[0].IsEdns0(); opt == nil || opt.UDPSize() != 1232 || !opt.Do() {
+		t.Errorf("upstream OPT: got %v want UDP size 1232 and DO", opt)
+	}
+}
+
+func TestLocalZoneServed(t *testing.T) {
+	rr, _ := dns.NewRR("nas.home.lan. 300 IN A 192.168.1.10")
+	ts, cleanup := setupTestServer(t, 0, nil, WithLocalZone("home.lan.", rr))
+	defer cleanup()
+	var c dns.Client
+	for _, tt := range []struct {
+		qname     string
+		wantRcode int
+		wantAns   int
+	}{
+		{"NAS.home.lan.", dns.RcodeSuccess, 1},
+		{"home.lan.", dns.RcodeSuccess, 0},
+		{"tv.home.lan.", dns.RcodeNameError, 0},
+		{testQuestion, dns.RcodeSuccess, 1},
+	} {
+		var m dns.Msg
+		m.SetQuestion(tt.qname, dns.TypeA)
+		r, _, err := c.Exchange(&m, ts.laddr)
+		if err != nil {
+			t.Fatalf("%s: cannot contact server: %v", tt.qname, err)
+		}
+		if r.Rcode != tt.wantRcode || len(r.Answer) != tt.wantAns {
+			t.Errorf("%s: got %s with %d answers want %s with %d", tt.qname,
+				dns.RcodeToString[r.Rcode], len(r.Answer), dns.RcodeToString[tt.wantRcode], tt.wantAns)
+		}
+	}
+}
+
+func TestNoIPv6(t *testing.T) {
+	rr, _ := dns.NewRR("nas.home.lan. 300 IN AAAA 2001:db8::10")
+	var upstream int32
+	ts, cleanup := setupTestServer(t, -1, func(string) string {
+		atomic.AddInt32(&upstream, 1)
+		return "raccoon.miki. 2311 IN A 42.42.42.42"
+	}, WithNoIPv6(true), WithLocalZone("", rr))
+	defer cleanup()
+	var c dns.Client
+	for _, tt := range []struct {
+		qname        string
+		qtype        uint16
+		wantAns      int
+		wantNs       int
+		wantUpstream int32
+	}{
+		{testQuestion, dns.TypeAAAA, 0, 1, 0},
+		{"nas.home.lan.", dns.TypeAAAA, 1, 0, 0},
+		{testQuestion, dns.TypeA, 1, 0, 1},
+	} {
+		var m dns.Msg
+		m.SetQuestion(tt.qname, tt.qtype)
+		r, _, err := c.Exchange(&m, ts.laddr)
+		if err != nil {
+			t.Fatalf("%s: cannot contact server: %v", tt.qname, err)
+		}
+		if r.Rcode != dns.RcodeSuccess || len(r.Answer) != tt.wantAns || len(r.Ns) != tt.wantNs {
+			t.Errorf("%s %s: got %s with %d answers and %d authority records want NOERROR with %d and %d",
+				tt.qname, dns.TypeToString[tt.qtype], dns.RcodeToString[r.Rcode], len(r.Answer), len(r.Ns), tt.wantAns, tt.wantNs)
+		}
+		if len(r.Ns) > 0 && r.Ns[0].Header().Rrtype != dns.TypeSOA {
+			t.Errorf("%s %s: got authority %v want SOA", tt.qname, dns.TypeToString[tt.qtype], r.Ns[0])
+		}
+		if got := atomic.LoadInt32(&upstream); got != tt.wantUpstream {
+			t.Errorf("%s %s: upstream queries: got %d want %d", tt.qname, dns.TypeToString[tt.qtype], got, tt.wantUpstream)
+		}
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enabled %v", enabled), func(t *testing.T) {
+			ts, cleanup := setupTestServer(t, 100, nil, WithIntrospection(enabled))
+			defer cleanup()
+			var (
+				c dns.Client
+				m dns.Msg
+			)
+			m.SetQuestion(testQuestion, dns.TypeA)
+			m.SetEdns0(1232, false)
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: IntrospectionOption})
+			r, _, err := c.Exchange(&m, ts.laddr)
+			if err != nil {
+				t.Fatalf("cannot contact server: %v", err)
+			}
+			if len(r.Answer) != 1 {
+				t.Errorf("answers: got %d want 1", len(r.Answer))
+			}
+			var local *dns.EDNS0_LOCAL
+			if ropt := r.IsEdns0(); ropt != nil {
+				for _, o := range ropt.Option {
+					if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == IntrospectionOption {
+						local = l
+					}
+				}
+			}
+			if !enabled {
+				if local != nil {
+					t.Errorf("introspection disabled: got option %v", local)
+				}
+				return
+			}
+			if local == nil {
+				t.Fatalf("introspection option not found in %v", r)
+			}
+			var info IntrospectionInfo
+			if err := json.Unmarshal(local.Data, &info); err != nil {
+				t.Fatalf("Cannot unmarshal introspection info: %v", err)
+			}
+			if info.CacheLen != 1 || info.CacheCap != 100 || info.ConfigHash != ts.s.configHash() || info.Version == "" {
+				t.Errorf("introspection info: got %+v", info)
+			}
+		})
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	newServer := func(opts ...Option) *Server {
+		return NewServerWithOptions(append([]Option{
+			WithCacheSize(-1),
+			WithUpstreams("fake://one"),
+			WithUpstreamTransport("fake", func(spec string) (UpstreamTransport, error) {
+				return &fakeTransport{upstream: spec}, nil
+			}),
+		}, opts...)...)
+	}
+	base := newServer().configHash()
+	if got := newServer().configHash(); got != base {
+		t.Errorf("same configuration: got %s want %s", got, base)
+	}
+
+	tests := []struct {
+		name  string
+		opts  []Option
+		setup func(*Server) error
+	}{
+		{name: "dnssec", opts: []Option{WithDNSSECValidation()}},
+		{name: "domain upstreams", opts: []Option{WithDomainUpstreams("corp.miki.", "fake://corp")}},
+		{name: "acl", opts: []Option{WithAllowedClients(mustParseCIDRs(t, "127.0.0.0/8")...)}},
+		{name: "local zone", opts: []Option{WithLocalZone("", mustRR(t, "raccoon.miki. 300 IN A 42.42.42.42"))}},
+		{name: "sinkhole", opts: []Option{WithSinkhole(net.IPv4zero, net.IPv6zero)}},
+		{name: "servfail caching", opts: []Option{WithServfailCaching(time.Second)}},
+		{name: "set upstreams", setup: func(s *Server) error { return s.SetUpstreams([]string{"fake://two"}) }},
+		{name: "blocklist", setup: func(s *Server) error { return s.ReloadBlocklist(strings.NewReader("ads.miki.")) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(tt.opts...)
+			if tt.setup != nil {
+				if err := tt.setup(s); err != nil {
+					t.Fatalf("Cannot set up server: %v", err)
+				}
+			}
+			if got := s.configHash(); got == base {
+				t.Errorf("config hash: got %s, the same as the default configuration", got)
+			}
+		})
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		grace     time.Duration
+		wantRcode int
+	}{
+		{"drained", time.Second, dns.RcodeSuccess},
+		{"canceled", -1, dns.RcodeServerFailure},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{})
+			slow := funcTransport(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+				close(started)
+				select {
+				case <-ctx.Done():
+					return nil, ctx.Err()
+				case <-time.After(200 * time.Millisecond):
+				}
+				return (&fakeTransport{}).Exchange(ctx, q)
+			})
+			s := NewServerWithOptions(
+				WithCacheSize(-1),
+				WithUpstreams("fake://slow"),
+				WithUpstreamTransport("fake", func(string) (UpstreamTransport, error) { return slow, nil }),
+				WithShutdownGracePeriod(tt.grace),
+			)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error)
+			go func() { done <- s.Run(ctx, "127.0.0.1:5678") }()
+			time.Sleep(50 * time.Millisecond)
+
+			resps := make(chan *dns.Msg)
+			go func() {
+				var c dns.Client
+				r, _, err := c.Exchange(new(dns.Msg).SetQuestion(testQuestion, dns.TypeA), "127.0.0.1:5678")
+				if err != nil {
+					t.Errorf("Cannot contact server: %v", err)
+				}
+				resps <- r
+			}()
+			<-started
+			cancel()
+			if r := <-resps; r != nil && r.Rcode != tt.wantRcode {
+				t.Errorf("rcode: got %s want %s", dns.RcodeToString[r.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			if err := <-done; err != nil {
+				t.Errorf("Run: %v", err)
+			}
+			if _, err := s.exchangeMessages(context.Background(), s.upstreams[0], new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)); err != errShuttingDown {
+				t.Errorf("exchange after shutdown: got %v want %v", err, errShuttingDown)
+			}
+		})
+	}
+}
+
+func TestRunMulti(t *testing.T) {
+	s := NewServerWithOptions(
+		WithCacheSize(-1),
+		WithUpstreams("fake://one"),
+		WithUpstreamTransport("fake", func(spec string) (UpstreamTransport, error) {
+			return &fakeTransport{upstream: spec}, nil
+		}),
+	)
+	addrs := []string{"127.0.0.1:5679", "127.0.0.1:5680"}
+
+	// An address that is already in use makes RunMulti fail without holding the other ones.
+	busy, err := net.Listen("tcp", addrs[1])
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	if err := s.RunMulti(context.Background(), addrs); err == nil {
+		t.Errorf("RunMulti with a busy address: got nil error")
+	}
+	busy.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.RunMulti(ctx, addrs) }()
+	time.Sleep(50 * time.Millisecond)
+	for _, addr := range addrs {
+		for _, network := range []string{"udp", "tcp"} {
+			c := dns.Client{Net: network}
+			r, _, err := c.Exchange(new(dns.Msg).SetQuestion(testQuestion, dns.TypeA), addr)
+			if err != nil {
+				t.Errorf("%s %s: cannot contact server: %v", network, addr, err)
+				continue
+			}
+			if len(r.Answer) != 1 {
+				t.Errorf("%s %s: got %v want one answer", network, addr, r)
+			}
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("RunMulti: %v", err)
+	}
+}
+
+func TestUDPWorkers(t *testing.T) {
+	servers, err := listen([]string{"127.0.0.1:0"}, 4, nil, nil, dns.HandlerFunc(func(dns.ResponseWriter, *dns.Msg) {}))
+	if err != nil {
+		t.Skipf("Multiple UDP workers not available: %v", err)
+	}
+	var udp []string
+	for _, srv := range servers {
+		if srv.PacketConn != nil {
+			udp = append(udp, srv.PacketConn.LocalAddr().String())
+			srv.PacketConn.Close()
+		} else {
+			srv.Listener.Close()
+		}
+	}
+	if len(udp) != 4 {
+		t.Fatalf("UDP sockets: got %d want 4", len(udp))
+	}
+	for _, addr := range udp[1:] {
+		if addr != udp[0] {
+			t.Errorf("UDP socket address: got %s want %s, the one of the first socket", addr, udp[0])
+		}
+	}
+
+	s := NewServerWithOptions(
+		WithCacheSize(-1),
+		WithUpstreams("fake://one"),
+		WithUpstreamTransport("fake", func(spec string) (UpstreamTransport, error) {
+			return &fakeTransport{upstream: spec}, nil
+		}),
+		WithUDPWorkers(4),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.RunMulti(ctx, []string{"127.0.0.1:5683"}) }()
+	time.Sleep(50 * time.Millisecond)
+	// Every client uses a new socket, so that the queries are spread across the workers.
+	for i := 0; i < 8; i++ {
+		var c dns.Client
+		r, _, err := c.Exchange(new(dns.Msg).SetQuestion(testQuestion, dns.TypeA), "127.0.0.1:5683")
+		if err != nil {
+			t.Errorf("query %d: cannot contact server: %v", i, err)
+			continue
+		}
+		if len(r.Answer) != 1 {
+			t.Errorf("query %d: got %v want one answer", i, r)
+		}
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("RunMulti: %v", err)
+	}
+}
+
+func TestDoTServer(t *testing.T) {
+	cert := newTestCert(t, time.Now().Add(time.Hour))
+	s := NewServerWithOptions(
+		WithCacheSize(-1),
+		WithUpstreams("fake://one"),
+		WithUpstreamTransport("fake", func(spec string) (UpstreamTransport, error) {
+			return &fakeTransport{upstream: spec}, nil
+		}),
+		WithDoTServer(&tls.Config{Certificates: []tls.Certificate{cert}}, "127.0.0.1:5681"),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.RunMulti(ctx, []string{"127.0.0.1:5682"}) }()
+	time.Sleep(50 * time.Millisecond)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	c := dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{RootCAs: roots, ServerName: "gopher.empijei"}}
+	r, _, err := c.Exchange(new(dns.Msg).SetQuestion(testQuestion, dns.TypeA), "127.0.0.1:5681")
+	if err != nil {
+		t.Errorf("Cannot contact server over TLS: %v", err)
+	} else if len(r.Answer) != 1 {
+		t.Errorf("got %v want one answer", r)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("RunMulti: %v", err)
+	}
+}
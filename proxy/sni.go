@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"errors"
+)
+
+// sniPrefix introduces, in a DNS over TLS upstream spec, the server name sent in the TLS handshake when it
+// must differ from the one the certificate is verified against, e.g. for upstreams behind a load balancer
+// routing on SNI: with "dns.corp:853@10.0.0.53#sni=lb.corp" the upstream is sent "lb.corp" and must present
+// a certificate for "dns.corp".
+const sniPrefix = "#sni="
+
+// verifyChain returns a tls.Config.VerifyPeerCertificate callback that verifies the certificate chain
+// against name and roots, or the system roots if nil. It replaces the verification done by crypto/tls,
+// which uses the server name sent in the handshake, when that is overridden with sniPrefix.
+// If pins are given the leaf certificate must also match one of them.
+func verifyChain(name string, roots *x509.CertPool, pins [][]byte) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			c, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+			certs[i] = c
+		}
+		intermediates := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			intermediates.AddCert(c)
+		}
+		if _, err := certs[0].Verify(x509.VerifyOptions{DNSName: name, Roots: roots, Intermediates: intermediates}); err != nil {
+			return err
+		}
+		if len(pins) > 0 {
+			return verifyPins(pins)(rawCerts, nil)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSNIOverride(t *testing.T) {
+	cert := newTestCert(t, time.Now().Add(time.Hour))
+	var (
+		mu     sync.Mutex
+		gotSNI string
+	)
+	addr, cleanup := startTLSUpstream(t, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			mu.Lock()
+			gotSNI = hello.ServerName
+			mu.Unlock()
+			return nil, nil
+		},
+	})
+	defer cleanup()
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatalf("Cannot split address: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+	bad := pinPrefix + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name    string
+		spec    string
+		wantSNI string
+		wantErr bool
+	}{
+		{name: "no override", spec: "gopher.empijei:" + port + "@127.0.0.1", wantSNI: "gopher.empijei"},
+		{name: "override", spec: "gopher.empijei:" + port + "@127.0.0.1#sni=lb.empijei", wantSNI: "lb.empijei"},
+		{name: "override without server name", spec: addr + "#sni=lb.empijei", wantSNI: "lb.empijei"},
+		{name: "certificate name mismatch", spec: "other.empijei:" + port + "@127.0.0.1#sni=gopher.empijei", wantSNI: "gopher.empijei", wantErr: true},
+		{name: "pin mismatch", spec: "gopher.empijei:" + port + "@127.0.0.1#sni=lb.empijei" + bad, wantSNI: "lb.empijei", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewServerE(WithUpstreams(tt.spec), WithRootCAs(roots))
+			if err != nil {
+				t.Fatalf("NewServerE: %v", err)
+			}
+			defer s.upstreams[0].t.Close()
+			q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+			if _, err := s.exchangeMessages(context.Background(), s.upstreams[0], q); (err != nil) != tt.wantErr {
+				t.Errorf("exchange: got %v want error %t", err, tt.wantErr)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if gotSNI != tt.wantSNI {
+				t.Errorf("SNI: got %q want %q", gotSNI, tt.wantSNI)
+			}
+		})
+	}
+}
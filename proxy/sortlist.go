@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// WithSortlist makes the server sort the A and AAAA records of every answer it serves by the first of the
+// given networks they belong to, like the sortlist of resolv.conf: addresses in earlier networks come
+// first, followed by the addresses in none of them. Records only move within their RRset, and keep their
+// relative order otherwise, e.g. the one set by WithAddressRotation.
+func WithSortlist(nets ...*net.IPNet) Option {
+	return func(o *options) { o.sortlist = append(o.sortlist, nets...) }
+}
+
+// WithClientAddressSorting makes the server sort the A and AAAA records of every answer it serves by the
+// length of the prefix they share with the client, longest first, as in rule 9 of RFC 3484. This makes
+// clients of multi-homed servers try the addresses on their own network first. The address of the
+// EDNS0 Client Subnet option of the query is used instead of the one of the client, if present.
+// Addresses are sorted by WithSortlist first, the shared prefix only orders those it ranks equally.
+func WithClientAddressSorting(enabled bool) Option {
+	return func(o *options) { o.sortByClient = enabled }
+}
+
+// sortAddresses sorts the address records of m, the answer to q sent by client that must not be shared
+// with the cache, as configured by WithSortlist and WithClientAddressSorting.
+func (s *Server) sortAddresses(client net.Addr, q, m *dns.Msg) {
+	if m == nil || (len(s.opts.sortlist) == 0 && !s.opts.sortByClient) {
+		return
+	}
+	var cip net.IP
+	if s.opts.sortByClient {
+		if ecs := clientSubnet(q); ecs != nil {
+			cip = ecs.Address
+		} else if client != nil {
+			host, _, _ := net.SplitHostPort(client.String())
+			cip = net.ParseIP(host)
+		}
+	}
+	sortlist := s.opts.sortlist
+	rank := func(rr dns.RR) (int, int) {
+		ip := addressOf(rr)
+		i := 0
+		for ; i < len(sortlist); i++ {
+			if sortlist[i].Contains(ip) {
+				break
+			}
+		}
+		return i, -commonPrefixLen(ip, cip)
+	}
+	for _, idx := range addressSets(m.Answer) {
+		set := make([]dns.RR, len(idx))
+		for i, j := range idx {
+			set[i] = m.Answer[j]
+		}
+		sort.SliceStable(set, func(a, b int) bool {
+			ra, pa := rank(set[a])
+			rb, pb := rank(set[b])
+			if ra != rb {
+				return ra < rb
+			}
+			return pa < pb
+		})
+		for i, j := range idx {
+			m.Answer[j] = set[i]
+		}
+	}
+}
+
+// addressOf returns the address of rr, which must be an A or AAAA record.
+func addressOf(rr dns.RR) net.IP {
+	switch a := rr.(type) {
+	case *dns.A:
+		return a.A
+	case *dns.AAAA:
+		return a.AAAA
+	}
+	return nil
+}
+
+// commonPrefixLen returns the number of leading bits a and b have in common, 0 if they are not of the
+// same family.
+func commonPrefixLen(a, b net.IP) int {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil || b4 != nil {
+		a, b = a4, b4
+	}
+	if a == nil || b == nil || len(a) != len(b) {
+		return 0
+	}
+	n := 0
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return n
+}
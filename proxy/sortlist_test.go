@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSortAddresses(t *testing.T) {
+	cidr := func(s string) *net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatalf("Cannot parse %q: %v", s, err)
+		}
+		return n
+	}
+	answer := []string{
+		"www.miki. 300 IN CNAME a.miki.",
+		"a.miki. 300 IN A 192.0.2.1",
+		"a.miki. 300 IN A 198.51.100.1",
+		"a.miki. 300 IN A 203.0.113.1",
+		"a.miki. 300 IN AAAA 2001:db8:1::1",
+		"a.miki. 300 IN AAAA 2001:db8:2::1",
+	}
+	tests := []struct {
+		name   string
+		opts   []Option
+		client string
+		ecs    string
+		want   []string
+	}{
+		{
+			name: "disabled",
+			want: []string{"192.0.2.1", "198.51.100.1", "203.0.113.1", "2001:db8:1::1", "2001:db8:2::1"},
+		},
+		{
+			name: "sortlist",
+			opts: []Option{WithSortlist(cidr("203.0.113.0/24"), cidr("198.51.100.0/24"), cidr("2001:db8:2::/48"))},
+			want: []string{"203.0.113.1", "198.51.100.1", "192.0.2.1", "2001:db8:2::1", "2001:db8:1::1"},
+		},
+		{
+			name:   "client",
+			opts:   []Option{WithClientAddressSorting(true)},
+			client: "198.51.100.42",
+			want:   []string{"198.51.100.1", "192.0.2.1", "203.0.113.1", "2001:db8:1::1", "2001:db8:2::1"},
+		},
+		{
+			name:   "ipv6 client",
+			opts:   []Option{WithClientAddressSorting(true)},
+			client: "2001:db8:2::42",
+			want:   []string{"192.0.2.1", "198.51.100.1", "203.0.113.1", "2001:db8:2::1", "2001:db8:1::1"},
+		},
+		{
+			name:   "client subnet",
+			opts:   []Option{WithClientAddressSorting(true)},
+			client: "198.51.100.42",
+			ecs:    "203.0.113.0",
+			want:   []string{"203.0.113.1", "192.0.2.1", "198.51.100.1", "2001:db8:1::1", "2001:db8:2::1"},
+		},
+		{
+			name:   "sortlist before client",
+			opts:   []Option{WithSortlist(cidr("192.0.2.0/24")), WithClientAddressSorting(true)},
+			client: "203.0.113.42",
+			want:   []string{"192.0.2.1", "203.0.113.1", "198.51.100.1", "2001:db8:1::1", "2001:db8:2::1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServerWithOptions(append([]Option{
+				WithCacheSize(-1),
+				WithUpstreams("fake://sort"),
+				WithUpstreamTransport("fake", func(string) (UpstreamTransport, error) {
+					return funcTransport(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+						m := new(dns.Msg).SetReply(q)
+						for _, a := range answer {
+							rr, err := dns.NewRR(a)
+							if err != nil {
+								return nil, err
+							}
+							m.Answer = append(m.Answer, rr)
+						}
+						return m, nil
+					}), nil
+				}),
+			}, tt.opts...)...)
+			q := new(dns.Msg).SetQuestion("www.miki.", dns.TypeA)
+			if tt.ecs != "" {
+				q.SetEdns0(dns.DefaultMsgSize, false)
+				q.IsEdns0().Option = append(q.IsEdns0().Option, &dns.EDNS0_SUBNET{
+					Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(tt.ecs).To4(),
+				})
+			}
+			var client net.Addr
+			if tt.client != "" {
+				client = &net.UDPAddr{IP: net.ParseIP(tt.client), Port: 42}
+			}
+			m, _, _ := s.answer(context.Background(), client, q)
+			if m == nil || len(m.Answer) != len(tt.want)+1 {
+				t.Fatalf("answer: got %v want %d records", m, len(tt.want)+1)
+			}
+			if _, ok := m.Answer[0].(*dns.CNAME); !ok {
+				t.Errorf("first record: got %v want the CNAME", m.Answer[0])
+			}
+			for i, want := range tt.want {
+				if got := addressOf(m.Answer[i+1]); !got.Equal(net.ParseIP(want)) {
+					t.Errorf("address %d: got %v want %s", i, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultStatsDInterval = 10 * time.Second
+
+// WithStatsD makes the server push its core metrics to the StatsD server listening on the UDP address addr
+// every interval: cache hits and misses, refresh queue depth and upstream round trip times among others.
+// All metric names start with prefix followed by a dot.
+// If interval is 0 the default of 10s is used.
+func WithStatsD(addr, prefix string, interval time.Duration) Option {
+	return func(o *options) {
+		o.statsdAddr = addr
+		o.statsdPrefix = prefix
+		o.statsdInterval = interval
+	}
+}
+
+func (s *Server) statsdReporter(ctx context.Context) {
+	conn, err := net.Dial("udp", s.opts.statsdAddr)
+	if err != nil {
+		log.Errorf("Unable to connect to StatsD: %v", err)
+		return
+	}
+	defer conn.Close()
+	interval := s.opts.statsdInterval
+	if interval <= 0 {
+		interval = defaultStatsDInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var prev Stats
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			cur := s.Stats()
+			if err := s.writeStatsD(conn, cur, prev); err != nil {
+				log.Debugf("Unable to send metrics to StatsD: %v", err)
+			}
+			prev = cur
+		}
+	}
+}
+
+// writeStatsD writes the metrics in cur to w in StatsD format. Counters are reported as the increase from prev.
+func (s *Server) writeStatsD(w io.Writer, cur, prev Stats) error {
+	var buf bytes.Buffer
+	counter := func(name string, cur, prev uint64) {
+		fmt.Fprintf(&buf, "%s.%s:%d|c\n", s.opts.statsdPrefix, name, cur-prev)
+	}
+	gauge := func(name string, v int) {
+		fmt.Fprintf(&buf, "%s.%s:%d|g\n", s.opts.statsdPrefix, name, v)
+	}
+	counter("cache.hit", uint64(cur.CacheMetrics.Hit()), uint64(prev.CacheMetrics.Hit()))
+	counter("cache.miss", uint64(cur.CacheMetrics.Miss), uint64(prev.CacheMetrics.Miss))
+	counter("cache.stale", cur.StaleServed, prev.StaleServed)
+	counter("cache.stale_expired", cur.StaleExpired, prev.StaleExpired)
+	gauge("cache.len", cur.CacheLen)
+	gauge("cache.cap", cur.CacheCap)
+	gauge("refresh.queue", cur.RefreshQueueLen)
+	counter("refresh.scheduled", cur.ScheduledRefreshes, prev.ScheduledRefreshes)
+	counter("client.limited", cur.ClientLimited, prev.ClientLimited)
+	counter("blocked", cur.Blocked, prev.Blocked)
+	counter("upstream.tc_retries", cur.TCRetries, prev.TCRetries)
+	for _, u := range cur.Upstreams {
+		// Dots would add hierarchy levels to the metric name.
+		fmt.Fprintf(&buf, "%s.upstream.%s.rtt:%d|ms\n", s.opts.statsdPrefix, strings.NewReplacer(".", "_", ":", "_").Replace(u.Address), u.RTT.Milliseconds())
+	}
+	_, err := w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return err
+}
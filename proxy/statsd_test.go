@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestStatsD(t *testing.T) {
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	defer sink.Close()
+
+	s := NewServerWithOptions(WithCacheSize(100), WithStatsD(sink.LocalAddr().String(), "dot", 10*time.Millisecond))
+	q, m := testAnswer(t, testQuestion, "raccoon.miki. 2311 IN A 42.42.42.42")
+	s.cache.put(q, m)
+	s.cache.get(q)
+	s.cache.get(q)
+	s.cache.get(new(dns.Msg).SetQuestion("missing.miki.", dns.TypeA))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.statsdReporter(ctx)
+
+	read := func() []string {
+		t.Helper()
+		buf := make([]byte, 1500)
+		_ = sink.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := sink.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Cannot read from sink: %v", err)
+		}
+		return strings.Split(string(buf[:n]), "\n")
+	}
+	want := []string{
+		"dot.cache.hit:2|c",
+		"dot.cache.miss:1|c",
+		"dot.cache.stale:0|c",
+		"dot.cache.stale_expired:0|c",
+		"dot.cache.len:1|g",
+		"dot.cache.cap:100|g",
+		"dot.refresh.queue:0|g",
+		"dot.refresh.scheduled:0|c",
+		"dot.client.limited:0|c",
+		"dot.blocked:0|c",
+		"dot.upstream.tc_retries:0|c",
+		"dot.upstream.one_one_one_one_853@1_1_1_1.rtt:0|ms",
+		"dot.upstream.dns_google_853@8_8_8_8.rtt:0|ms",
+	}
+	check := func(got, want []string) {
+		t.Helper()
+		if strings.Join(got, "\n") != strings.Join(want, "\n") {
+			t.Errorf("lines: got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+		}
+	}
+	check(read(), want)
+	// Counters are reported as deltas.
+	want[0], want[1] = "dot.cache.hit:0|c", "dot.cache.miss:0|c"
+	check(read(), want)
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/mikispag/dns-over-tls-forwarder/proxy/internal/specialized"
+)
+
+// stickyUpstreams remembers which upstream last answered a question, so that following queries
+// for the same question can be sent there first. This reduces the variance of answers across
+// upstreams, for example when they balance load differently.
+// A nil *stickyUpstreams never sticks.
+type stickyUpstreams struct {
+	ttl time.Duration
+	c   *specialized.Cache
+	// clock is used to get the current time, if nil time.Now is used. Entries live for less than the
+	// resolution of the coarse server clock, so they use their own.
+	clock func() time.Time
+}
+
+type stickyEntry struct {
+	u   *upstream
+	exp time.Time
+}
+
+func newStickyUpstreams(size int, ttl time.Duration, clock func() time.Time) *stickyUpstreams {
+	if size <= 0 || ttl <= 0 {
+		return nil
+	}
+	if size < 2 {
+		size = 2
+	}
+	c, err := specialized.NewLRUCache(size, false)
+	if err != nil {
+		return nil
+	}
+	return &stickyUpstreams{ttl: ttl, c: c, clock: clock}
+}
+
+func (st *stickyUpstreams) now() time.Time {
+	if st.clock != nil {
+		return st.clock()
+	}
+	return time.Now()
+}
+
+// get returns the upstream that last answered k, if it did so less than st.ttl ago.
+func (st *stickyUpstreams) get(k string) *upstream {
+	if st == nil {
+		return nil
+	}
+	v, ok := st.c.Get(k)
+	if !ok {
+		return nil
+	}
+	e := v.(stickyEntry)
+	if e.exp.Before(st.now()) {
+		return nil
+	}
+	return e.u
+}
+
+func (st *stickyUpstreams) put(k string, u *upstream) {
+	if st == nil {
+		return
+	}
+	st.c.Put(k, stickyEntry{u: u, exp: st.now().Add(st.ttl)})
+}
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultTopNamesWindow is the window of WithTopNames when none is given.
+const defaultTopNamesWindow = 5 * time.Minute
+
+// WithTopNames makes the server count the queries for every name and report the n most queried ones in
+// Stats, to find out what drives the query volume. Counts cover the last one to two windows: they are
+// kept for the current window and the previous one. Memory use does not depend on the amount of names
+// queried, at the cost of counts that might be slightly overestimated.
+// A n <= 0 disables counting, which is the default. A window <= 0 uses a default of 5 minutes.
+func WithTopNames(n int, window time.Duration) Option {
+	return func(o *options) {
+		o.topNames = n
+		o.topNamesWindow = window
+	}
+}
+
+// NameCount is the amount of queries received for a name.
+type NameCount struct {
+	Name  string
+	Count uint64
+}
+
+// Dimensions of countMin, which overestimates counts by at most 0.15% of the queries of a window with
+// a probability of 98%.
+const (
+	sketchDepth = 4
+	sketchWidth = 2048
+)
+
+// countMin is a count-min sketch: an approximate counter using a fixed amount of memory, which never
+// underestimates counts.
+type countMin [sketchDepth][sketchWidth]uint32
+
+// indexes returns the counter of name in every row of the sketch.
+func (c *countMin) indexes(name string) [sketchDepth]int {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)
+	var idx [sketchDepth]int
+	for i := range idx {
+		idx[i] = int((h1 + uint32(i)*h2) % sketchWidth)
+	}
+	return idx
+}
+
+// add counts a query for name and returns the estimated count of name.
+func (c *countMin) add(name string) uint64 {
+	min := ^uint32(0)
+	for i, j := range c.indexes(name) {
+		c[i][j]++
+		if c[i][j] < min {
+			min = c[i][j]
+		}
+	}
+	return uint64(min)
+}
+
+// estimate returns the estimated count of name. A nil sketch counts nothing.
+func (c *countMin) estimate(name string) uint64 {
+	if c == nil {
+		return 0
+	}
+	min := ^uint32(0)
+	for i, j := range c.indexes(name) {
+		if c[i][j] < min {
+			min = c[i][j]
+		}
+	}
+	return uint64(min)
+}
+
+// nameHeap is a min-heap of the most queried names of a window, by count.
+type nameHeap struct {
+	counts []NameCount
+	idx    map[string]int
+}
+
+func (h *nameHeap) Len() int           { return len(h.counts) }
+func (h *nameHeap) Less(i, j int) bool { return h.counts[i].Count < h.counts[j].Count }
+func (h *nameHeap) Swap(i, j int) {
+	h.counts[i], h.counts[j] = h.counts[j], h.counts[i]
+	h.idx[h.counts[i].Name] = i
+	h.idx[h.counts[j].Name] = j
+}
+func (h *nameHeap) Push(x interface{}) {
+	nc := x.(NameCount)
+	h.idx[nc.Name] = len(h.counts)
+	h.counts = append(h.counts, nc)
+}
+func (h *nameHeap) Pop() interface{} {
+	nc := h.counts[len(h.counts)-1]
+	h.counts = h.counts[:len(h.counts)-1]
+	delete(h.idx, nc.Name)
+	return nc
+}
+
+func (h *nameHeap) names() []string {
+	names := make([]string, len(h.counts))
+	for i, nc := range h.counts {
+		names[i] = nc.Name
+	}
+	return names
+}
+
+// topNames tracks the most queried names, see WithTopNames. A nil *topNames counts nothing.
+type topNames struct {
+	n      int
+	window time.Duration
+
+	mu sync.Mutex
+	// start is when the current window started.
+	start     time.Time
+	cur, prev *countMin
+	// top holds the most queried names of the current window, prevTop the ones of the previous window.
+	top     nameHeap
+	prevTop []string
+}
+
+func newTopNames(n int, window time.Duration) *topNames {
+	if n <= 0 {
+		return nil
+	}
+	if window <= 0 {
+		window = defaultTopNamesWindow
+	}
+	return &topNames{n: n, window: window, cur: new(countMin), top: nameHeap{idx: make(map[string]int)}}
+}
+
+// rotate starts a new window if the current one is over at now. The caller must hold t.mu.
+func (t *topNames) rotate(now time.Time) {
+	if now.Sub(t.start) < t.window {
+		return
+	}
+	t.prev, t.prevTop = nil, nil
+	if now.Sub(t.start) < 2*t.window {
+		t.prev = t.cur
+		t.prevTop = t.top.names()
+	}
+	t.start = now
+	t.cur = new(countMin)
+	t.top = nameHeap{idx: make(map[string]int)}
+}
+
+// add counts a query for name received at now.
+func (t *topNames) add(name string, now time.Time) {
+	if t == nil {
+		return
+	}
+	name = strings.ToLower(name)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate(now)
+	c := t.cur.add(name)
+	switch i, ok := t.top.idx[name]; {
+	case ok:
+		t.top.counts[i].Count = c
+		heap.Fix(&t.top, i)
+	case t.top.Len() < t.n:
+		heap.Push(&t.top, NameCount{Name: name, Count: c})
+	case c > t.top.counts[0].Count:
+		delete(t.top.idx, t.top.counts[0].Name)
+		t.top.counts[0] = NameCount{Name: name, Count: c}
+		t.top.idx[name] = 0
+		heap.Fix(&t.top, 0)
+	}
+}
+
+// get returns the most queried names at now, most queried first, with their counts over the current
+// and the previous window.
+func (t *topNames) get(now time.Time) []NameCount {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate(now)
+	seen := make(map[string]bool)
+	var top []NameCount
+	for _, name := range append(t.top.names(), t.prevTop...) {
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		top = append(top, NameCount{Name: name, Count: t.cur.estimate(name) + t.prev.estimate(name)})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Count != top[j].Count {
+			return top[i].Count > top[j].Count
+		}
+		return top[i].Name < top[j].Name
+	})
+	if len(top) > t.n {
+		top = top[:t.n]
+	}
+	return top
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestTopNames(t *testing.T) {
+	const window = time.Minute
+	top := newTopNames(2, window)
+	now := time.Date(2019, 10, 18, 0, 0, 0, 0, time.UTC)
+	add := func(name string, n int) {
+		for i := 0; i < n; i++ {
+			top.add(name, now)
+		}
+	}
+	// The steps run in order and share the counts.
+	tests := []struct {
+		name    string
+		advance time.Duration
+		queries map[string]int
+		want    []NameCount
+	}{
+		{
+			name:    "first window",
+			queries: map[string]int{"a.miki.": 3, "B.miki.": 5, "c.miki.": 1},
+			want:    []NameCount{{"b.miki.", 5}, {"a.miki.", 3}},
+		},
+		{
+			name:    "new name overtakes",
+			queries: map[string]int{"c.miki.": 4},
+			want:    []NameCount{{"b.miki.", 5}, {"c.miki.", 5}},
+		},
+		{
+			name:    "previous window counted",
+			advance: window,
+			queries: map[string]int{"a.miki.": 1},
+			want:    []NameCount{{"b.miki.", 5}, {"c.miki.", 5}},
+		},
+		{
+			name:    "previous window forgotten",
+			advance: window,
+			queries: map[string]int{"d.miki.": 1},
+			want:    []NameCount{{"a.miki.", 1}, {"d.miki.", 1}},
+		},
+		{
+			name:    "idle for two windows",
+			advance: 2 * window,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.advance)
+			for name, n := range tt.queries {
+				add(name, n)
+			}
+			if got := top.get(now); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("top names: got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTopNamesStats(t *testing.T) {
+	ts, cleanup := setupTestServer(t, 0, nil, WithTopNames(1, 0))
+	defer cleanup()
+	for i := 0; i < 3; i++ {
+		ts.exchange(fmt.Sprintf("query %d", i), "42.42.42.42")
+	}
+	// Queries answered without upstreams are counted too.
+	q := new(dns.Msg).SetQuestion("version.bind.", dns.TypeTXT)
+	q.Question[0].Qclass = dns.ClassCHAOS
+	ts.s.getAnswer(context.Background(), q)
+	want := []NameCount{{testQuestion, 3}}
+	if got := ts.s.Stats().TopNames; !reflect.DeepEqual(got, want) {
+		t.Errorf("top names: got %v want %v", got, want)
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// traffic counts the queries by type and the responses by rcode, all accessed atomically.
+// Types and rcodes beyond the arrays, which are unlikely to be seen, are counted together.
+type traffic struct {
+	qtypes      [512]uint64
+	otherQtypes uint64
+	rcodes      [32]uint64
+	otherRcodes uint64
+}
+
+// otherKey is the key of the types and rcodes counted together in Stats.
+const otherKey = "OTHER"
+
+func (t *traffic) countQuery(qtype uint16) {
+	if int(qtype) < len(t.qtypes) {
+		atomic.AddUint64(&t.qtypes[qtype], 1)
+		return
+	}
+	atomic.AddUint64(&t.otherQtypes, 1)
+}
+
+func (t *traffic) countResponse(rcode int) {
+	if rcode >= 0 && rcode < len(t.rcodes) {
+		atomic.AddUint64(&t.rcodes[rcode], 1)
+		return
+	}
+	atomic.AddUint64(&t.otherRcodes, 1)
+}
+
+// qtypeStats returns the amount of queries by type, omitting the types never queried.
+func (t *traffic) qtypeStats() map[string]uint64 {
+	st := make(map[string]uint64)
+	for i := range t.qtypes {
+		if n := atomic.LoadUint64(&t.qtypes[i]); n > 0 {
+			st[dns.Type(i).String()] = n
+		}
+	}
+	if n := atomic.LoadUint64(&t.otherQtypes); n > 0 {
+		st[otherKey] = n
+	}
+	return st
+}
+
+// rcodeStats returns the amount of responses by rcode, omitting the rcodes never sent.
+func (t *traffic) rcodeStats() map[string]uint64 {
+	st := make(map[string]uint64)
+	for i := range t.rcodes {
+		if n := atomic.LoadUint64(&t.rcodes[i]); n > 0 {
+			name, ok := dns.RcodeToString[i]
+			if !ok {
+				name = fmt.Sprintf("RCODE%d", i)
+			}
+			st[name] = n
+		}
+	}
+	if n := atomic.LoadUint64(&t.otherRcodes); n > 0 {
+		st[otherKey] = n
+	}
+	return st
+}
+
+// replyRcode replies to q with an empty response with the given rcode, see writeRcode, and counts it.
+func (s *Server) replyRcode(w dns.ResponseWriter, q *dns.Msg, rcode int) {
+	s.traffic.countResponse(rcode)
+	writeRcode(w, q, rcode)
+}
@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/miekg/dns"
+)
+
+// UpstreamTransport exchanges messages with an upstream resolver.
+// Implementations must be safe for concurrent use.
+type UpstreamTransport interface {
+	// Exchange sends q to the upstream and returns its response.
+	// Implementations should give up when ctx is done.
+	Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error)
+	// Close releases the resources held by the transport. Exchange is not called after Close.
+	Close()
+}
+
+// TransportFactory creates the transport for upstream, which is passed as it was configured.
+type TransportFactory func(upstream string) (UpstreamTransport, error)
+
+// tlsScheme is the scheme of the built-in DNS over TLS transport, which is also used
+// for upstreams without a scheme.
+const tlsScheme = "tls"
+
+// WithUpstreamTransport uses the transport created by f for the upstreams in the "scheme://..." form.
+// Upstreams without a scheme or with the "tls" scheme use the built-in DNS over TLS transport,
+// which cannot be overridden. Upstreams with the "https" scheme use the built-in DNS over HTTPS
+// transport unless a different one is registered. This option can be specified multiple times.
+func WithUpstreamTransport(scheme string, f TransportFactory) Option {
+	return func(o *options) {
+		if o.transports == nil {
+			o.transports = make(map[string]TransportFactory)
+		}
+		o.transports[scheme] = f
+	}
+}
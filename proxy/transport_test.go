@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type fakeTransport struct {
+	upstream  string
+	exchanges int32
+}
+
+func (f *fakeTransport) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+	if _, ok := ctx.Deadline(); !ok {
+		return nil, errors.New("no deadline")
+	}
+	atomic.AddInt32(&f.exchanges, 1)
+	rr, err := dns.NewRR(q.Question[0].Name + " 300 IN A 42.42.42.42")
+	if err != nil {
+		return nil, err
+	}
+	m := new(dns.Msg).SetReply(q)
+	m.Answer = []dns.RR{rr}
+	return m, nil
+}
+
+func (f *fakeTransport) Close() {}
+
+// funcTransport is an UpstreamTransport that calls itself to exchange messages.
+type funcTransport func(ctx context.Context, q *dns.Msg) (*dns.Msg, error)
+
+func (f funcTransport) Exchange(ctx context.Context, q *dns.Msg) (*dns.Msg, error) { return f(ctx, q) }
+
+func (f funcTransport) Close() {}
+
+func TestForwardRaceFailingUpstream(t *testing.T) {
+	failing := funcTransport(func(context.Context, *dns.Msg) (*dns.Msg, error) {
+		return nil, errors.New("failing upstream")
+	})
+	good := &fakeTransport{upstream: "fake://good"}
+	slow := funcTransport(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+		// Let the failing upstreams reply first.
+		time.Sleep(50 * time.Millisecond)
+		return good.Exchange(ctx, q)
+	})
+	s := NewServerWithOptions(WithCacheSize(-1))
+	ups := []*upstream{{addr: "fake://failing1", t: failing}, {addr: "fake://failing2", t: failing}, {addr: "fake://good", t: slow}}
+
+	before := runtime.NumGoroutine()
+	q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+	m, u := s.forwardRace(context.Background(), ups, key(q), q)
+	if m == nil || len(m.Answer) != 1 {
+		t.Fatalf("answer: got %v want the one of the good upstream", m)
+	}
+	if u != ups[2] {
+		t.Errorf("upstream: got %v want %v", u, ups[2])
+	}
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before; {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines: got %d want at most %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestForwardRaceServfail(t *testing.T) {
+	// reply returns a transport answering with rcode after delay.
+	reply := func(rcode int, delay time.Duration) funcTransport {
+		return func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+			time.Sleep(delay)
+			return new(dns.Msg).SetRcode(q, rcode), nil
+		}
+	}
+	failing := funcTransport(func(context.Context, *dns.Msg) (*dns.Msg, error) {
+		return nil, errors.New("failing upstream")
+	})
+	tests := []struct {
+		name      string
+		wait      time.Duration
+		ts        []UpstreamTransport
+		wantRcode int
+		wantU     int
+	}{
+		{
+			name:      "noerror after servfail",
+			ts:        []UpstreamTransport{reply(dns.RcodeServerFailure, 0), reply(dns.RcodeSuccess, 20*time.Millisecond)},
+			wantRcode: dns.RcodeSuccess,
+			wantU:     1,
+		},
+		{
+			name:      "nxdomain after servfail",
+			ts:        []UpstreamTransport{reply(dns.RcodeServerFailure, 0), reply(dns.RcodeNameError, 20*time.Millisecond)},
+			wantRcode: dns.RcodeNameError,
+			wantU:     1,
+		},
+		{
+			name:      "all servfail",
+			ts:        []UpstreamTransport{reply(dns.RcodeServerFailure, 0), reply(dns.RcodeServerFailure, 20*time.Millisecond)},
+			wantRcode: dns.RcodeServerFailure,
+		},
+		{
+			name:      "servfail and failure",
+			ts:        []UpstreamTransport{reply(dns.RcodeServerFailure, 0), failing},
+			wantRcode: dns.RcodeServerFailure,
+		},
+		{
+			name:      "too slow",
+			wait:      10 * time.Millisecond,
+			ts:        []UpstreamTransport{reply(dns.RcodeServerFailure, 0), reply(dns.RcodeSuccess, time.Second)},
+			wantRcode: dns.RcodeServerFailure,
+		},
+		{
+			name:      "single upstream",
+			ts:        []UpstreamTransport{reply(dns.RcodeSuccess, 0)},
+			wantRcode: dns.RcodeSuccess,
+		},
+		{
+			name:      "single upstream servfail",
+			ts:        []UpstreamTransport{reply(dns.RcodeServerFailure, 0)},
+			wantRcode: dns.RcodeServerFailure,
+		},
+		{
+			name:      "disabled",
+			wait:      -1,
+			ts:        []UpstreamTransport{reply(dns.RcodeServerFailure, 0), reply(dns.RcodeSuccess, 50*time.Millisecond)},
+			wantRcode: dns.RcodeServerFailure,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServerWithOptions(WithCacheSize(-1), WithServfailWait(tt.wait))
+			var ups []*upstream
+			for i, tr := range tt.ts {
+				ups = append(ups, &upstream{addr: fmt.Sprintf("fake://%d", i), t: tr})
+			}
+			q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+			m, u := s.forwardRace(context.Background(), ups, key(q), q)
+			if m == nil {
+				t.Fatal("got no response")
+			}
+			if m.Rcode != tt.wantRcode {
+				t.Errorf("rcode: got %s want %s", dns.RcodeToString[m.Rcode], dns.RcodeToString[tt.wantRcode])
+			}
+			if u != ups[tt.wantU] {
+				t.Errorf("upstream: got %s want %s", u.addr, ups[tt.wantU].addr)
+			}
+		})
+	}
+}
+
+func BenchmarkForwardRace(b *testing.B) {
+	for _, n := range []int{1, 2} {
+		b.Run(fmt.Sprintf("%d upstreams", n), func(b *testing.B) {
+			s := NewServerWithOptions(WithCacheSize(-1))
+			var ups []*upstream
+			for i := 0; i < n; i++ {
+				ups = append(ups, &upstream{addr: fmt.Sprintf("fake://%d", i), t: funcTransport(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+					return new(dns.Msg).SetReply(q), nil
+				})})
+			}
+			q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+			k := key(q)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if m, _ := s.forwardRace(context.Background(), ups, k, q); m == nil {
+					b.Fatal("got no response")
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamTransport(t *testing.T) {
+	var created []*fakeTransport
+	factory := func(upstream string) (UpstreamTransport, error) {
+		if upstream == "fake://broken" {
+			return nil, errors.New("broken")
+		}
+		f := &fakeTransport{upstream: upstream}
+		created = append(created, f)
+		return f, nil
+	}
+	s := NewServerWithOptions(
+		WithCacheSize(-1),
+		WithUpstreams("fake://one", "fake://broken", "unknown://two", "tls://dns.google:853"),
+		WithUpstreamTransport("fake", factory),
+	)
+
+	if len(created) != 1 || created[0].upstream != "fake://one" {
+		t.Fatalf("created transports: got %+v want one for %q", created, "fake://one")
+	}
+	failed := s.FailedUpstreams()
+	if len(failed) != 2 || failed[0].Upstream != "fake://broken" || failed[1].Upstream != "unknown://two" {
+		t.Errorf("failed upstreams: got %v want the broken and unknown ones", failed)
+	}
+	if len(s.upstreams) != 2 {
+		t.Fatalf("upstreams: got %d want 2", len(s.upstreams))
+	}
+	if _, ok := s.upstreams[1].t.(*pool); !ok {
+		t.Errorf("tls upstream: got %T want built-in transport", s.upstreams[1].t)
+	}
+
+	q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+	r, err := s.exchange(context.Background(), s.upstreams[0], q)
+	if err != nil {
+		t.Fatalf("Cannot exchange messages: %v", err)
+	}
+	if len(r.Answer) != 1 {
+		t.Errorf("answer: got %v want one record", r.Answer)
+	}
+	if got := atomic.LoadInt32(&created[0].exchanges); got != 1 {
+		t.Errorf("exchanges: got %d want 1", got)
+	}
+
+	s.upstreams = s.upstreams[:1]
+	w := &fakeResponseWriter{remote: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 42}}
+	s.ServeDNS(w, q)
+	if len(w.msgs) != 1 || len(w.msgs[0].Answer) != 1 {
+		t.Errorf("ServeDNS: got %v want one answer", w.msgs)
+	}
+}
+
+func TestForwardCanceled(t *testing.T) {
+	var exchanges int32
+	blocking := funcTransport(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(&exchanges, 1)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	s := NewServerWithOptions(
+		WithCacheSize(-1),
+		WithUpstreams("fake://1", "fake://2"),
+		WithUpstreamTransport("fake", func(string) (UpstreamTransport, error) { return blocking, nil }),
+		WithSelectionStrategy(SelectRoundRobin),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+	if m, _ := s.forwardMessageAndCacheResponse(ctx, q); m != nil {
+		t.Errorf("answer: got %v want nil", m)
+	}
+	if elapsed := time.Since(start); elapsed > connectionTimeout/2 {
+		t.Errorf("elapsed: got %v want the exchange to be canceled", elapsed)
+	}
+	if got := atomic.LoadInt32(&exchanges); got != 1 {
+		t.Errorf("exchanges: got %d want 1", got)
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	blocking := funcTransport(func(ctx context.Context, q *dns.Msg) (*dns.Msg, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	s := NewServerWithOptions(
+		WithCacheSize(-1),
+		WithUpstreams("fake://1"),
+		WithUpstreamTransport("fake", func(string) (UpstreamTransport, error) { return blocking, nil }),
+		WithUpstreamTimeout(50*time.Millisecond),
+	)
+	start := time.Now()
+	q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+	if _, err := s.exchangeMessages(context.Background(), s.upstreams[0], q); err == nil {
+		t.Errorf("exchange: got nil error want a timeout")
+	}
+	if elapsed := time.Since(start); elapsed > connectionTimeout/2 {
+		t.Errorf("elapsed: got %v want the exchange to time out after 50ms", elapsed)
+	}
+}
@@ -0,0 +1,386 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+	log "github.com/sirupsen/logrus"
+)
+
+// UpstreamError reports an upstream that was discarded at construction.
+type UpstreamError struct {
+	Upstream string
+	Err      error
+}
+
+func (e *UpstreamError) Error() string { return fmt.Sprintf("upstream %q: %v", e.Upstream, e.Err) }
+
+// Unwrap returns the underlying error.
+func (e *UpstreamError) Unwrap() error { return e.Err }
+
+// UpstreamErrors reports all the upstreams that were discarded at construction, see NewServerE.
+type UpstreamErrors []*UpstreamError
+
+func (es UpstreamErrors) Error() string {
+	msgs := make([]string, len(es))
+	for i, e := range es {
+		msgs[i] = e.Error()
+	}
+	return fmt.Sprintf("%d invalid upstreams: %s", len(es), strings.Join(msgs, "; "))
+}
+
+// WithUpstreamProbe makes the server dial every DNS over TLS upstream at construction and discard the
+// unreachable ones. The successful connections are kept for later use.
+func WithUpstreamProbe(enabled bool) Option {
+	return func(o *options) { o.probeUpstreams = enabled }
+}
+
+// parseUpstream parses an upstream in the "host:port" or "servername:port@ip" form and returns the
+// address to dial and the name to verify the certificate for. An empty servername means that the host
+// of the dialed address should be used. IPv6 literals must be bracketed before the port, as in
+// "[2001:db8::1]:853", and can optionally be bracketed after the @.
+func parseUpstream(upstream string) (addr, servername string, err error) {
+	components := strings.Split(upstream, "@")
+	switch len(components) {
+	case 1:
+		host, _, err := net.SplitHostPort(upstream)
+		if err != nil {
+			return "", "", err
+		}
+		if host == "" {
+			return "", "", errors.New("missing host")
+		}
+		return upstream, "", nil
+	case 2:
+		servername, port, err := net.SplitHostPort(components[0])
+		if err != nil {
+			return "", "", err
+		}
+		if servername == "" {
+			return "", "", errors.New("missing server name")
+		}
+		ip := components[1]
+		if strings.HasPrefix(ip, "[") && strings.HasSuffix(ip, "]") {
+			// IPv6 literals may be bracketed as they are in "host:port" addresses.
+			ip = ip[1 : len(ip)-1]
+		}
+		if ip == "" {
+			return "", "", errors.New("missing address after @")
+		}
+		return net.JoinHostPort(ip, port), servername, nil
+	}
+	return "", "", errors.New("too many @")
+}
+
+// upstream is a resolver queries are forwarded to.
+type upstream struct {
+	addr string
+	t    UpstreamTransport
+	// fallback upstreams are only used when all the others fail.
+	fallback bool
+	// randomCase is set if the case of query names is randomized, see caseSuffix.
+	randomCase bool
+	// cookies holds the EDNS0 cookies exchanged with the upstream, it is nil if cookies are disabled.
+	// See cookieSuffix.
+	cookies *cookieJar
+
+	// rtt is the duration in nanoseconds of the last successful exchange, accessed atomically.
+	rtt int64
+	// latency is the exponentially weighted moving average of the duration in nanoseconds of exchanges,
+	// accessed atomically.
+	latency int64
+	// successes and errors count the exchanges, accessed atomically.
+	successes, errors uint64
+	// pinErrors counts the errors caused by certificate pin mismatches, accessed atomically.
+	pinErrors uint64
+
+	// unhealthy is 1 if the upstream is failing its health checks and checkFailures counts the consecutive
+	// failed checks, both accessed atomically. See WithHealthCheck.
+	unhealthy     int32
+	checkFailures uint32
+	// nextCheck is when the upstream should be checked next, after waiting backoff since the last failure.
+	nextCheck time.Time
+	backoff   time.Duration
+	// breaker is the circuit breaker of the upstream, nil if disabled. See WithCircuitBreaker.
+	breaker *breaker
+
+	// inflight counts the exchanges in progress and removed is set to 1 when the upstream is removed by
+	// SetUpstreams, both accessed atomically.
+	inflight int64
+	removed  int32
+}
+
+// latencyWeight is the weight of the last sample in the latency moving average.
+const latencyWeight = 0.2
+
+// record updates the stats of u with the outcome of an exchange that took d.
+func (u *upstream) record(d time.Duration, err error) {
+	if err != nil {
+		atomic.AddUint64(&u.errors, 1)
+		if errors.Is(err, errPinMismatch) {
+			atomic.AddUint64(&u.pinErrors, 1)
+		}
+	} else {
+		atomic.AddUint64(&u.successes, 1)
+	}
+	for {
+		old := atomic.LoadInt64(&u.latency)
+		avg := int64(d)
+		if old != 0 {
+			avg = int64(latencyWeight*float64(d) + (1-latencyWeight)*float64(old))
+		}
+		if atomic.CompareAndSwapInt64(&u.latency, old, avg) {
+			return
+		}
+	}
+}
+
+// newUpstreams creates the transports for all valid upstreams. If probing is enabled DNS over TLS
+// upstreams that cannot be dialed are discarded as well.
+func (s *Server) newUpstreams(specs []string) (ups []*upstream, failed []*UpstreamError) {
+	for _, spec := range specs {
+		u, err := s.newUpstream(spec)
+		if err != nil {
+			failed = append(failed, &UpstreamError{spec, err})
+			continue
+		}
+		ups = append(ups, u)
+	}
+	for _, f := range failed {
+		log.Warnf("Discarding %v", f)
+	}
+	return ups, failed
+}
+
+// cutSpecOption removes the opt suffix, which enables a feature for an upstream, from spec and reports
+// whether it was present. See caseSuffix and cookieSuffix.
+func cutSpecOption(spec, opt string) (rest string, ok bool) {
+	if !strings.Contains(spec, opt) {
+		return spec, false
+	}
+	return strings.Replace(spec, opt, "", -1), true
+}
+
+// cutSpecValue removes the prefix suffix, which sets a value for an upstream, from spec and returns its
+// value, which extends to the next suffix. See clientCertPrefix and sniPrefix.
+func cutSpecValue(spec, prefix string) (rest, value string, ok bool) {
+	i := strings.Index(spec, prefix)
+	if i < 0 {
+		return spec, "", false
+	}
+	value = spec[i+len(prefix):]
+	end := len(value)
+	if j := strings.Index(value, "#"); j >= 0 {
+		end = j
+	}
+	return spec[:i] + value[end:], value[:end], true
+}
+
+func (s *Server) newUpstream(spec string) (*upstream, error) {
+	rest, randomCase := cutSpecOption(spec, caseSuffix)
+	rest, cookies := cutSpecOption(rest, cookieSuffix)
+	t, err := s.newTransport(rest)
+	if err != nil {
+		return nil, err
+	}
+	u := &upstream{addr: spec, t: t, randomCase: randomCase}
+	u.breaker = newBreaker(spec, s.opts.breakerFailures, s.opts.breakerCooldown)
+	if cookies {
+		u.cookies = newCookieJar()
+	}
+	if s.opts.plainFallback {
+		u.fallback = strings.HasPrefix(spec, "udp://") || strings.HasPrefix(spec, "tcp://")
+	}
+	return u, nil
+}
+
+// errUpstreamRemoved is returned for exchanges with upstreams removed by SetUpstreams.
+var errUpstreamRemoved = errors.New("upstream was removed")
+
+// SetUpstreams replaces the upstreams queries are forwarded to, specified as in WithUpstreams, while the
+// server is running. The cache is kept, and so are the connections and stats of the upstreams that are
+// still in use. Removed upstreams are closed once the exchanges in progress with them complete.
+// If any of the upstreams is malformed or, if WithUpstreamProbe is used, unreachable, the current
+// upstreams are kept and the error is returned.
+func (s *Server) SetUpstreams(specs []string) error {
+	if len(specs) == 0 {
+		return errors.New("no upstreams")
+	}
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	old, _ := s.upstreamSet()
+	current := make(map[string]*upstream, len(old))
+	for _, u := range old {
+		current[u.addr] = u
+	}
+	var ups, created []*upstream
+	for _, spec := range specs {
+		if u, ok := current[spec]; ok {
+			ups = append(ups, u)
+			continue
+		}
+		u, err := s.newUpstream(spec)
+		if err != nil {
+			for _, u := range created {
+				u.t.Close()
+			}
+			return &UpstreamError{spec, err}
+		}
+		current[spec] = u
+		ups = append(ups, u)
+		created = append(created, u)
+	}
+
+	s.upMu.Lock()
+	s.upstreams, s.tiers, s.failed = ups, tiers(ups), nil
+	s.upMu.Unlock()
+
+	kept := make(map[*upstream]bool, len(ups))
+	for _, u := range ups {
+		kept[u] = true
+	}
+	for _, u := range old {
+		if !kept[u] {
+			u.remove(s.opts.upstreamTimeout)
+		}
+	}
+	log.Infof("Forwarding to %d upstreams: %d added, %d kept", len(ups), len(created), len(ups)-len(created))
+	return nil
+}
+
+// remove makes new exchanges with u fail and closes it once the ones in progress complete, or after
+// timeout.
+func (u *upstream) remove(timeout time.Duration) {
+	atomic.StoreInt32(&u.removed, 1)
+	go func() {
+		t := time.NewTicker(10 * time.Millisecond)
+		defer t.Stop()
+		for deadline := time.Now().Add(timeout); atomic.LoadInt64(&u.inflight) > 0 && time.Now().Before(deadline); {
+			<-t.C
+		}
+		u.t.Close()
+		log.Infof("Removed upstream %s", u.addr)
+	}()
+}
+
+// upstreamSet returns the current upstreams and their tiers.
+func (s *Server) upstreamSet() ([]*upstream, [][]*upstream) {
+	s.upMu.RLock()
+	defer s.upMu.RUnlock()
+	return s.upstreams, s.tiers
+}
+
+func (s *Server) newTransport(spec string) (UpstreamTransport, error) {
+	scheme, rest := tlsScheme, spec
+	if i := strings.Index(spec, "://"); i >= 0 {
+		scheme, rest = spec[:i], spec[i+len("://"):]
+	}
+	if f, ok := s.opts.transports[scheme]; ok && scheme != tlsScheme {
+		return f(spec)
+	}
+	switch scheme {
+	case tlsScheme:
+	case dohScheme:
+		return s.newDoH(spec)
+	case "udp", "tcp":
+		p, err := newPlainPool(spec, scheme, rest, s.opts.poolSize, s.opts.upstreamTimeout)
+		if err != nil {
+			return nil, err
+		}
+		p.idleTimeout, p.maxLifetime = s.opts.idleTimeout, s.opts.maxConnLifetime
+		return p, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", scheme)
+	}
+	rest, cert, err := cutClientCert(rest)
+	if err != nil {
+		return nil, err
+	}
+	rest, sni, _ := cutSpecValue(rest, sniPrefix)
+	rest, pins, err := parsePins(rest)
+	if err != nil {
+		return nil, err
+	}
+	addr, servername, err := parseUpstream(rest)
+	if err != nil {
+		return nil, err
+	}
+	p := newPool(spec, s.opts.poolSize, s.connector(addr, servername, sni, pins, cert))
+	p.depth = s.opts.pipelineDepth
+	p.idleTimeout, p.maxLifetime = s.opts.idleTimeout, s.opts.maxConnLifetime
+	if s.opts.probeUpstreams {
+		c, err := p.dial()
+		if err != nil {
+			return nil, err
+		}
+		if p.depth > 0 {
+			p.pl = newPipeline(c, p.depth)
+		} else {
+			p.put(c)
+		}
+	}
+	return p, nil
+}
+
+// newPlainPool returns a pool of up to size unencrypted connections to addr over the given network,
+// dialed with the given timeout. Truncated responses received over UDP are retried over TCP.
+func newPlainPool(spec, network, addr string, size int, timeout time.Duration) (*pool, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		return nil, errors.New("missing host")
+	}
+	p := newPool(spec, size, plainConnector(network, addr, timeout))
+	if network == "udp" {
+		p.retry = plainConnector("tcp", addr, timeout)
+	}
+	return p, nil
+}
+
+func plainConnector(network, addr string, timeout time.Duration) connector {
+	return func() (*dns.Conn, error) {
+		conn, err := net.DialTimeout(network, addr, timeout)
+		if err != nil {
+			log.Warnf("Failed to connect to plain DNS upstream: %v", err)
+			return nil, err
+		}
+		return &dns.Conn{Conn: conn, UDPSize: dns.DefaultMsgSize}, nil
+	}
+}
+
+// tiers groups ups by priority, from the highest to the lowest.
+func tiers(ups []*upstream) [][]*upstream {
+	var primary, fallback []*upstream
+	for _, u := range ups {
+		if u.fallback {
+			fallback = append(fallback, u)
+		} else {
+			primary = append(primary, u)
+		}
+	}
+	var ts [][]*upstream
+	for _, t := range [][]*upstream{primary, fallback} {
+		if len(t) > 0 {
+			ts = append(ts, t)
+		}
+	}
+	return ts
+}
+
+// FailedUpstreams returns the upstreams, including the ones of WithDomainUpstreams, that were discarded at
+// construction because they were malformed or, if WithUpstreamProbe is used, unreachable. It is empty
+// after a successful SetUpstreams.
+// If all upstreams failed the server will reply SERVFAIL to all queries that cannot be answered from cache,
+// callers might want to check this before calling Run.
+func (s *Server) FailedUpstreams() []*UpstreamError {
+	s.upMu.RLock()
+	defer s.upMu.RUnlock()
+	return s.failed
+}
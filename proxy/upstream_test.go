@@ -0,0 +1,348 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestParseUpstream(t *testing.T) {
+	tests := []struct {
+		upstream       string
+		wantAddr       string
+		wantServername string
+		wantErr        bool
+	}{
+		{upstream: "dns.google:853", wantAddr: "dns.google:853"},
+		{upstream: "one.one.one.one:853@1.1.1.1", wantAddr: "1.1.1.1:853", wantServername: "one.one.one.one"},
+		{upstream: "dns.google:853@2001:4860:4860::8888", wantAddr: "[2001:4860:4860::8888]:853", wantServername: "dns.google"},
+		{upstream: "dns.google:853@[2001:4860:4860::8888]", wantAddr: "[2001:4860:4860::8888]:853", wantServername: "dns.google"},
+		{upstream: "8.8.8.8:853", wantAddr: "8.8.8.8:853"},
+		{upstream: "[2001:4860:4860::8888]:853", wantAddr: "[2001:4860:4860::8888]:853"},
+		{upstream: "[2001:4860:4860::8888]:853@[2001:4860:4860::8844]", wantAddr: "[2001:4860:4860::8844]:853", wantServername: "2001:4860:4860::8888"},
+		{upstream: "2001:4860:4860::8888:853", wantErr: true},
+		{upstream: "dns.google:853@[]", wantErr: true},
+		{upstream: "dns.google", wantErr: true},
+		{upstream: ":853", wantErr: true},
+		{upstream: "dns.google@8.8.8.8", wantErr: true},
+		{upstream: ":853@8.8.8.8", wantErr: true},
+		{upstream: "dns.google:853@", wantErr: true},
+		{upstream: "dns.google:853@8.8.8.8@8.8.4.4", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.upstream, func(t *testing.T) {
+			addr, servername, err := parseUpstream(tt.upstream)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err: got %v want error %t", err, tt.wantErr)
+			}
+			if addr != tt.wantAddr || servername != tt.wantServername {
+				t.Errorf("got %q, %q want %q, %q", addr, servername, tt.wantAddr, tt.wantServername)
+			}
+		})
+	}
+}
+
+func TestPartialUpstreams(t *testing.T) {
+	ts, cleanup := setupTestServer(t, -1, nil,
+		WithUpstreams("gopher", "gopher.empijei:853", "gopher.empijei:853@", "down.empijei:853"),
+		WithUpstreamProbe(true))
+	defer cleanup()
+
+	want := []string{"gopher", "gopher.empijei:853@", "down.empijei:853"}
+	got := ts.s.FailedUpstreams()
+	if len(got) != len(want) {
+		t.Fatalf("failed upstreams: got %v want %q", got, want)
+	}
+	for i, f := range got {
+		if f.Upstream != want[i] || f.Err == nil {
+			t.Errorf("failed upstream %d: got %v want %q with an error", i, f, want[i])
+		}
+	}
+	if got := len(ts.s.upstreams); got != 1 {
+		t.Fatalf("upstreams: got %d want 1", got)
+	}
+	for _, v := range []string{"probed", "pooled"} {
+		ts.exchange(v, "42.42.42.42")
+	}
+}
+
+// startPlainUpstream starts a plain DNS server answering on UDP and TCP on the same local port.
+// Answers over UDP are truncated if truncate is set.
+func startPlainUpstream(t *testing.T, ip string, truncate bool) (addr string, queries func() (udp, tcp int), cleanup func()) {
+	t.Helper()
+	var (
+		mu     sync.Mutex
+		counts = map[string]int{}
+	)
+	handler := fakeServer(func(w dns.ResponseWriter, q *dns.Msg) {
+		network := w.RemoteAddr().Network()
+		mu.Lock()
+		counts[network]++
+		mu.Unlock()
+		m := new(dns.Msg).SetReply(q)
+		if network == "udp" && truncate {
+			m.Truncated = true
+		} else {
+			rr, _ := dns.NewRR(fmt.Sprintf("%s 2311 IN MX 10 %s", q.Question[0].Name, ip))
+			m.Answer = []dns.RR{rr}
+		}
+		_ = w.WriteMsg(m)
+	})
+	var (
+		pc  net.PacketConn
+		l   net.Listener
+		err error
+	)
+	// The TCP port might be taken, try a few times.
+	for i := 0; i < 10; i++ {
+		if pc, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+			t.Fatalf("Cannot listen: %v", err)
+		}
+		if l, err = net.Listen("tcp", pc.LocalAddr().String()); err == nil {
+			break
+		}
+		pc.Close()
+	}
+	if err != nil {
+		t.Fatalf("Cannot listen: %v", err)
+	}
+	srvs := []*dns.Server{{PacketConn: pc, Handler: handler}, {Listener: l, Handler: handler}}
+	for _, srv := range srvs {
+		go func(srv *dns.Server) { _ = srv.ActivateAndServe() }(srv)
+	}
+	return pc.LocalAddr().String(), func() (int, int) {
+			mu.Lock()
+			defer mu.Unlock()
+			return counts["udp"], counts["tcp"]
+		}, func() {
+			for _, srv := range srvs {
+				_ = srv.Shutdown()
+			}
+		}
+}
+
+func TestPlainUpstreams(t *testing.T) {
+	addr, queries, cleanup := startPlainUpstream(t, "9.9.9.9", false)
+	defer cleanup()
+	// Let the servers start.
+	time.Sleep(50 * time.Millisecond)
+	for _, network := range []string{"udp", "tcp"} {
+		s := NewServerWithOptions(WithUpstreams(network + "://" + addr))
+		q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeMX)
+		m, err := s.exchange(context.Background(), s.upstreams[0], q)
+		if err != nil {
+			t.Fatalf("%s: cannot exchange messages: %v", network, err)
+		}
+		if len(m.Answer) != 1 {
+			t.Errorf("%s: got answer %v want one record", network, m.Answer)
+		}
+		s.upstreams[0].t.Close()
+	}
+	if udp, tcp := queries(); udp != 1 || tcp != 1 {
+		t.Errorf("queries: got %d over UDP and %d over TCP want 1 and 1", udp, tcp)
+	}
+
+	s := NewServerWithOptions(WithUpstreams("udp://:53", "tcp://127.0.0.1"))
+	if got := len(s.FailedUpstreams()); got != 2 {
+		t.Errorf("invalid plain upstreams: got %d failures want 2", got)
+	}
+}
+
+func TestPlainUpstreamTruncated(t *testing.T) {
+	addr, queries, cleanup := startPlainUpstream(t, "9.9.9.9", true)
+	defer cleanup()
+	time.Sleep(50 * time.Millisecond)
+	s := NewServerWithOptions(WithUpstreams("udp://" + addr))
+	defer s.upstreams[0].t.Close()
+	q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeMX)
+	m, err := s.exchange(context.Background(), s.upstreams[0], q)
+	if err != nil {
+		t.Fatalf("Cannot exchange messages: %v", err)
+	}
+	if m.Truncated || len(m.Answer) != 1 {
+		t.Errorf("got truncated %t with answer %v want full response", m.Truncated, m.Answer)
+	}
+	if udp, tcp := queries(); udp != 1 || tcp != 1 {
+		t.Errorf("queries: got %d over UDP and %d over TCP want 1 and 1", udp, tcp)
+	}
+	if got := s.Stats().TCRetries; got != 1 {
+		t.Errorf("TC retries: got %d want 1", got)
+	}
+}
+
+func TestPlainFallback(t *testing.T) {
+	addr, queries, cleanupPlain := startPlainUpstream(t, "9.9.9.9", false)
+	defer cleanupPlain()
+	var broken int32
+	ts, cleanup := setupTestServerWithHandler(t, -1, func(w dns.ResponseWriter, q *dns.Msg) {
+		if atomic.LoadInt32(&broken) == 1 {
+			_ = w.Close()
+			return
+		}
+		m := new(dns.Msg).SetReply(q)
+		rr, _ := dns.NewRR("raccoon.miki. 2311 IN MX 10 42.42.42.42")
+		m.Answer = []dns.RR{rr}
+		_ = w.WriteMsg(m)
+	}, WithUpstreams("gopher.empijei:853", "udp://"+addr), WithPlainFallback(true))
+	defer cleanup()
+
+	ts.exchange("encrypted", "42.42.42.42")
+	if udp, _ := queries(); udp != 0 {
+		t.Errorf("fallback queries while the encrypted upstream works: got %d want 0", udp)
+	}
+	atomic.StoreInt32(&broken, 1)
+	ts.exchange("fallback", "9.9.9.9")
+	if udp, _ := queries(); udp != 1 {
+		t.Errorf("fallback queries when the encrypted upstream fails: got %d want 1", udp)
+	}
+}
+
+func TestUpstreamStats(t *testing.T) {
+	ts, cleanup := setupTestServerWithUpstreams(t, -1, []fakeServer{
+		func(w dns.ResponseWriter, q *dns.Msg) {
+			m := new(dns.Msg).SetReply(q)
+			rr, _ := dns.NewRR("raccoon.miki. 2311 IN MX 10 42.42.42.42")
+			m.Answer = []dns.RR{rr}
+			_ = w.WriteMsg(m)
+		},
+		func(w dns.ResponseWriter, q *dns.Msg) { _ = w.Close() },
+	})
+	defer cleanup()
+	for i := 0; i < 3; i++ {
+		for _, u := range ts.s.upstreams {
+			_, _ = ts.s.exchange(context.Background(), u, new(dns.Msg).SetQuestion(testQuestion, dns.TypeMX))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	ts.s.DebugHandler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var got struct{ Upstreams []UpstreamStats }
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Can't unmarshal HTTP response: %v", err)
+	}
+	if len(got.Upstreams) != 2 {
+		t.Fatalf("upstreams: got %d want 2", len(got.Upstreams))
+	}
+	for i, want := range []struct {
+		addr              string
+		successes, errors uint64
+	}{
+		{"gopher.empijei:853", 3, 0},
+		{"gopher1.empijei:853", 0, 3},
+	} {
+		u := got.Upstreams[i]
+		if u.Address != want.addr || u.Successes != want.successes || u.Errors != want.errors {
+			t.Errorf("upstream %d: got %s with %d successes and %d errors want %s with %d and %d",
+				i, u.Address, u.Successes, u.Errors, want.addr, want.successes, want.errors)
+		}
+		if u.Latency <= 0 {
+			t.Errorf("upstream %d: latency: got %v want > 0", i, u.Latency)
+		}
+	}
+}
+
+func TestUpstreamLatency(t *testing.T) {
+	var u upstream
+	u.record(100*time.Millisecond, nil)
+	if got, want := time.Duration(u.latency), 100*time.Millisecond; got != want {
+		t.Errorf("first sample: got %v want %v", got, want)
+	}
+	u.record(200*time.Millisecond, errors.New("failed"))
+	if got, want := time.Duration(u.latency), 120*time.Millisecond; got != want {
+		t.Errorf("second sample: got %v want %v", got, want)
+	}
+	if u.successes != 1 || u.errors != 1 {
+		t.Errorf("counts: got %d successes and %d errors want 1 and 1", u.successes, u.errors)
+	}
+}
+
+// closeTransport is a fakeTransport that records whether it was closed.
+type closeTransport struct {
+	fakeTransport
+	closed int32
+}
+
+func (c *closeTransport) Close() { atomic.StoreInt32(&c.closed, 1) }
+
+func TestSetUpstreams(t *testing.T) {
+	var (
+		mu         sync.Mutex
+		transports = map[string]*closeTransport{}
+	)
+	s := NewServerWithOptions(
+		WithCacheSize(-1),
+		WithUpstreams("fake://one", "fake://two"),
+		WithUpstreamTransport("fake", func(spec string) (UpstreamTransport, error) {
+			if spec == "fake://bad" {
+				return nil, errors.New("bad upstream")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			ct := &closeTransport{fakeTransport: fakeTransport{upstream: spec}}
+			transports[spec] = ct
+			return ct, nil
+		}),
+	)
+	one, two := s.upstreams[0], s.upstreams[1]
+	addrs := func() []string {
+		ups, _ := s.upstreamSet()
+		var as []string
+		for _, u := range ups {
+			as = append(as, u.addr)
+		}
+		return as
+	}
+
+	// An exchange with the removed upstream is in progress.
+	atomic.AddInt64(&two.inflight, 1)
+	if err := s.SetUpstreams([]string{"fake://one", "fake://three"}); err != nil {
+		t.Fatalf("SetUpstreams: %v", err)
+	}
+	if got, want := fmt.Sprint(addrs()), "[fake://one fake://three]"; got != want {
+		t.Errorf("upstreams: got %s want %s", got, want)
+	}
+	if s.upstreams[0] != one {
+		t.Errorf("kept upstream was recreated")
+	}
+	if _, err := s.exchangeMessages(context.Background(), two, new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)); err != errUpstreamRemoved {
+		t.Errorf("exchange with removed upstream: got %v want %v", err, errUpstreamRemoved)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if atomic.LoadInt32(&transports["fake://two"].closed) != 0 {
+		t.Errorf("removed upstream closed with an exchange in progress")
+	}
+	atomic.AddInt64(&two.inflight, -1)
+	for deadline := time.Now().Add(time.Second); atomic.LoadInt32(&transports["fake://two"].closed) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("removed upstream was not closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&transports["fake://one"].closed) != 0 {
+		t.Errorf("kept upstream was closed")
+	}
+
+	// Invalid upstreams leave the current ones in place.
+	if err := s.SetUpstreams([]string{"fake://four", "fake://bad"}); err == nil {
+		t.Errorf("SetUpstreams with a bad upstream: got no error")
+	}
+	if got, want := fmt.Sprint(addrs()), "[fake://one fake://three]"; got != want {
+		t.Errorf("upstreams: got %s want %s", got, want)
+	}
+	if atomic.LoadInt32(&transports["fake://four"].closed) == 0 {
+		t.Errorf("upstream created by a failed SetUpstreams was not closed")
+	}
+	q := new(dns.Msg).SetQuestion(testQuestion, dns.TypeA)
+	if m, _ := s.forwardMessageAndGetResponse(context.Background(), q); m == nil {
+		t.Errorf("answer: got nil after SetUpstreams")
+	}
+}
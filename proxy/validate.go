@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// defaultMaxCNAMEChain is way more than what is seen in the wild, but still small enough
+// to protect clients from silly answers.
+const defaultMaxCNAMEChain = 16
+
+var (
+	errCNAMELoop        = errors.New("CNAME loop in upstream answer")
+	errCNAMETooLong     = errors.New("CNAME chain too long in upstream answer")
+	errIDMismatch       = errors.New("upstream response ID does not match the query")
+	errQuestionMismatch = errors.New("upstream response question does not match the query")
+)
+
+// checkResponse fails if resp is not the response to q, as it might be a late response to a previous
+// query on the same connection or an attempt to poison the cache. Names are compared case-insensitively.
+func checkResponse(q, resp *dns.Msg) error {
+	if resp.Id != q.Id {
+		return errIDMismatch
+	}
+	if len(resp.Question) != len(q.Question) {
+		return errQuestionMismatch
+	}
+	for i, rq := range resp.Question {
+		qq := q.Question[i]
+		if rq.Qtype != qq.Qtype || rq.Qclass != qq.Qclass || !strings.EqualFold(rq.Name, qq.Name) {
+			return errQuestionMismatch
+		}
+	}
+	return nil
+}
+
+// checkCNAMEChain follows the CNAME records in answer starting from name and fails if it finds a loop
+// or if more than max records need to be followed.
+func checkCNAMEChain(name string, answer []dns.RR, max int) error {
+	targets := make(map[string]string)
+	for _, rr := range answer {
+		if c, ok := rr.(*dns.CNAME); ok {
+			targets[strings.ToLower(c.Hdr.Name)] = strings.ToLower(c.Target)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+	seen := map[string]bool{}
+	cur := strings.ToLower(name)
+	for n := 0; ; n++ {
+		next, ok := targets[cur]
+		if !ok {
+			return nil
+		}
+		if n >= max {
+			return errCNAMETooLong
+		}
+		seen[cur] = true
+		if seen[next] {
+			return errCNAMELoop
+		}
+		cur = next
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCheckCNAMEChain(t *testing.T) {
+	tests := []struct {
+		name   string
+		answer []string
+		max    int
+		want   error
+	}{
+		{
+			name:   "no cname",
+			answer: []string{"a.miki. 60 IN A 42.42.42.42"},
+			max:    1,
+		},
+		{
+			name: "chain",
+			answer: []string{
+				"a.miki. 60 IN CNAME b.miki.",
+				"b.miki. 60 IN CNAME c.miki.",
+				"c.miki. 60 IN A 42.42.42.42",
+			},
+			max: 2,
+		},
+		{
+			name: "mixed case",
+			answer: []string{
+				"A.miki. 60 IN CNAME b.MIKI.",
+				"b.miki. 60 IN A 42.42.42.42",
+			},
+			max: 1,
+		},
+		{
+			name: "too long",
+			answer: []string{
+				"a.miki. 60 IN CNAME b.miki.",
+				"b.miki. 60 IN CNAME c.miki.",
+				"c.miki. 60 IN A 42.42.42.42",
+			},
+			max:  1,
+			want: errCNAMETooLong,
+		},
+		{
+			name: "loop",
+			answer: []string{
+				"a.miki. 60 IN CNAME b.miki.",
+				"b.miki. 60 IN CNAME c.miki.",
+				"c.miki. 60 IN CNAME a.miki.",
+			},
+			max:  16,
+			want: errCNAMELoop,
+		},
+		{
+			name:   "self loop",
+			answer: []string{"a.miki. 60 IN CNAME a.miki."},
+			max:    16,
+			want:   errCNAMELoop,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rrs []dns.RR
+			for _, a := range tt.answer {
+				rr, err := dns.NewRR(a)
+				if err != nil {
+					t.Fatalf("Cannot parse %q: %v", a, err)
+				}
+				rrs = append(rrs, rr)
+			}
+			if got := checkCNAMEChain("a.miki.", rrs, tt.max); got != tt.want {
+				t.Errorf("checkCNAMEChain: got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	q := new(dns.Msg).SetQuestion("a.miki.", dns.TypeA)
+	tests := []struct {
+		name   string
+		modify func(m *dns.Msg)
+		want   error
+	}{
+		{name: "match", modify: func(*dns.Msg) {}},
+		{name: "mixed case", modify: func(m *dns.Msg) { m.Question[0].Name = "A.Miki." }},
+		{name: "id", modify: func(m *dns.Msg) { m.Id++ }, want: errIDMismatch},
+		{name: "name", modify: func(m *dns.Msg) { m.Question[0].Name = "b.miki." }, want: errQuestionMismatch},
+		{name: "type", modify: func(m *dns.Msg) { m.Question[0].Qtype = dns.TypeAAAA }, want: errQuestionMismatch},
+		{name: "class", modify: func(m *dns.Msg) { m.Question[0].Qclass = dns.ClassCHAOS }, want: errQuestionMismatch},
+		{name: "no question", modify: func(m *dns.Msg) { m.Question = nil }, want: errQuestionMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := new(dns.Msg).SetReply(q)
+			tt.modify(resp)
+			if got := checkResponse(q, resp); got != tt.want {
+				t.Errorf("got %v want %v", got, tt.want)
+			}
+		})
+	}
+}